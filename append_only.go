@@ -0,0 +1,1458 @@
+package restis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAppendOnlyCorrupt  = errors.New("restis: append-only log is corrupt")
+	ErrRewriteInProgress  = errors.New("ERR Background append only file rewriting already in progress")
+	ErrAppendOnlyDisabled = errors.New("ERR append-only log is not enabled")
+)
+
+// errTruncatedCommand means the log ends part way through a command, as it
+// does when the process dies mid-write.
+var errTruncatedCommand = errors.New("truncated command")
+
+// rewriteItemsPerCommand caps how many members a rewritten command carries,
+// so huge collections don't become a single huge command.
+const rewriteItemsPerCommand = 64
+
+type FsyncPolicy int
+
+const (
+	FsyncEverySecond FsyncPolicy = iota // lose at most about a second of writes
+	FsyncAlways                         // sync after every write
+	FsyncNever                          // leave it to the operating system
+)
+
+type AppendOnlyOptions struct {
+	Path  string
+	Fsync FsyncPolicy
+	// Once the log is at least RewriteMinSize bytes and has grown by
+	// RewritePercentage since the last rewrite, it's rewritten in the
+	// background. Zero RewritePercentage disables automatic rewrites.
+	RewritePercentage int64
+	RewriteMinSize    int64
+	Clock             Clock // defaults to the system clock
+}
+
+// rewriteStore is implemented by stores with a log that can be compacted,
+// and backs BGREWRITEAOF and the /append-only-log routes.
+type rewriteStore interface {
+	BackgroundRewrite() error
+}
+
+// An AppendOnlyStore is a MemoryStore that logs every write as a Redis
+// command, and rebuilds itself by replaying the log when it's opened. Writes
+// are serialised so that the log holds them in the order they were applied.
+// Relative expiries are logged as absolute times, so a replay doesn't extend
+// them.
+type AppendOnlyStore struct {
+	store   *MemoryStore
+	options AppendOnlyOptions
+
+	mu            sync.Mutex
+	file          *os.File
+	size          int64
+	baseSize      int64
+	rewriting     bool
+	rewriteBuffer []byte
+	rewriteDone   *sync.Cond
+	closeOnce     sync.Once
+	closed        chan struct{}
+
+	// pending collects the log entries of a transaction, on the store it
+	// runs against, so that they're logged together once it ends.
+	pending *[]byte
+}
+
+var _ Store = (*AppendOnlyStore)(nil)
+
+// OpenAppendOnlyStore replays the log at options.Path, if there is one, and
+// appends to it from then on. A command or transaction cut short at the end
+// of the log is dropped and the log truncated before it; anything else that
+// can't be parsed fails with ErrAppendOnlyCorrupt.
+func OpenAppendOnlyStore(options AppendOnlyOptions) (*AppendOnlyStore, error) {
+	clock := options.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	store := NewMemoryStoreWithClock(clock)
+	size, err := replayAppendOnlyLog(store, options.Path)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	file, err := os.OpenFile(options.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	a := &AppendOnlyStore{
+		store:    store,
+		options:  options,
+		file:     file,
+		size:     size,
+		baseSize: size,
+		closed:   make(chan struct{}),
+	}
+	a.rewriteDone = sync.NewCond(&a.mu)
+	if options.Fsync == FsyncEverySecond {
+		go a.runFsync()
+	}
+	return a, nil
+}
+
+func replayAppendOnlyLog(store *MemoryStore, path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	c := &respConn{store: store, writer: &respWriter{Writer: bufio.NewWriter(ioutil.Discard), protocol: 2}}
+	offset := 0
+	// A transaction the log ends part way through is dropped along with
+	// its MULTI, since its commands are only queued until EXEC.
+	multi := -1
+	for offset < len(data) {
+		args, n, err := parseLoggedCommand(data[offset:])
+		if err == errTruncatedCommand {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: offset %d: %w", path, offset, err)
+		}
+		switch strings.ToLower(args[0]) {
+		case "multi":
+			multi = offset
+		case "exec":
+			multi = -1
+		}
+		c.execute(args)
+		offset += n
+	}
+	if multi >= 0 {
+		offset = multi
+	}
+	if offset < len(data) {
+		return int64(offset), os.Truncate(path, int64(offset))
+	}
+	return int64(offset), nil
+}
+
+// parseLoggedCommand parses the multi-bulk command at the start of data and
+// returns it with its length in bytes.
+func parseLoggedCommand(data []byte) ([]string, int, error) {
+	pos := 0
+	line := func() (string, error) {
+		end := bytes.Index(data[pos:], []byte("\r\n"))
+		if end < 0 {
+			if len(data)-pos > maxInlineLength {
+				return "", ErrAppendOnlyCorrupt
+			}
+			return "", errTruncatedCommand
+		}
+		l := string(data[pos : pos+end])
+		pos += end + 2
+		return l, nil
+	}
+	header, err := line()
+	if err != nil {
+		return nil, 0, err
+	}
+	count, ok := parseLoggedLength(header, '*')
+	if !ok || count < 1 || count > maxMultiBulkCount {
+		return nil, 0, ErrAppendOnlyCorrupt
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		header, err := line()
+		if err != nil {
+			return nil, 0, err
+		}
+		length, ok := parseLoggedLength(header, '$')
+		if !ok || length < 0 || length > maxBulkLength {
+			return nil, 0, ErrAppendOnlyCorrupt
+		}
+		if pos+length+2 > len(data) {
+			return nil, 0, errTruncatedCommand
+		}
+		if data[pos+length] != '\r' || data[pos+length+1] != '\n' {
+			return nil, 0, ErrAppendOnlyCorrupt
+		}
+		args = append(args, string(data[pos:pos+length]))
+		pos += length + 2
+	}
+	return args, pos, nil
+}
+
+// parseLoggedLength parses a header line like "*3" or "$5".
+func parseLoggedLength(line string, prefix byte) (int, bool) {
+	if len(line) < 2 || line[0] != prefix {
+		return 0, false
+	}
+	n, err := strconv.Atoi(line[1:])
+	return n, err == nil
+}
+
+func appendCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// write applies a change and logs the command it returns, if any. A failure
+// to log is returned even though the change has been applied in memory.
+func (a *AppendOnlyStore) write(apply func() ([]string, error)) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	args, err := apply()
+	if err != nil || args == nil {
+		return err
+	}
+	return a.appendEntry(appendCommand(nil, args...))
+}
+
+// appendEntry appends entry to the log, or to the pending transaction if a
+// is running one. It's called with a.mu held.
+func (a *AppendOnlyStore) appendEntry(entry []byte) error {
+	if a.pending != nil {
+		*a.pending = append(*a.pending, entry...)
+		return nil
+	}
+	if _, err := a.file.Write(entry); err != nil {
+		return err
+	}
+	a.size += int64(len(entry))
+	if a.rewriting {
+		a.rewriteBuffer = append(a.rewriteBuffer, entry...)
+	}
+	if a.options.Fsync == FsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if a.rewriteDue() {
+		go a.finishRewrite(a.startRewrite())
+	}
+	return nil
+}
+
+func (a *AppendOnlyStore) rewriteDue() bool {
+	return !a.rewriting && a.options.RewritePercentage > 0 && a.size >= a.options.RewriteMinSize &&
+		a.size >= a.baseSize+a.baseSize*a.options.RewritePercentage/100
+}
+
+func (a *AppendOnlyStore) runFsync() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.closed:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			file := a.file
+			a.mu.Unlock()
+			// A rewrite may close the file first, which only means there's
+			// nothing left to sync on it.
+			file.Sync()
+		}
+	}
+}
+
+// Rewrite replaces the log with the shortest one that rebuilds the current
+// state, and waits for it to be written.
+func (a *AppendOnlyStore) Rewrite() error {
+	a.mu.Lock()
+	if a.rewriting {
+		a.mu.Unlock()
+		return ErrRewriteInProgress
+	}
+	base := a.startRewrite()
+	a.mu.Unlock()
+	return a.finishRewrite(base)
+}
+
+// BackgroundRewrite rewrites the log like Rewrite without waiting for it.
+// Writes carry on being logged to the old file, and are copied to the new
+// one before it replaces the old.
+func (a *AppendOnlyStore) BackgroundRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rewriting {
+		return ErrRewriteInProgress
+	}
+	go a.finishRewrite(a.startRewrite())
+	return nil
+}
+
+// startRewrite is called with a.mu held, so no write can slip between the
+// state it captures and the start of the rewrite buffer.
+func (a *AppendOnlyStore) startRewrite() []byte {
+	a.rewriting = true
+	a.rewriteBuffer = nil
+	return a.store.appendOnlyCommands()
+}
+
+func (a *AppendOnlyStore) finishRewrite(base []byte) (err error) {
+	dir := filepath.Dir(a.options.Path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(a.options.Path)+".rewrite-*")
+	if err == nil {
+		if _, err = tmp.Write(base); err == nil {
+			err = tmp.Sync()
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	defer func() {
+		if err != nil && tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		a.rewriting = false
+		a.rewriteBuffer = nil
+		a.rewriteDone.Broadcast()
+	}()
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(a.rewriteBuffer); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), a.options.Path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	// The temporary file is the log now, and it's already positioned at
+	// its end.
+	a.file.Close()
+	a.file = tmp
+	a.size = int64(len(base) + len(a.rewriteBuffer))
+	a.baseSize = a.size
+	return nil
+}
+
+// waitForRewrite blocks until no rewrite is in progress.
+func (a *AppendOnlyStore) waitForRewrite() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.rewriting {
+		a.rewriteDone.Wait()
+	}
+}
+
+// Close waits for any rewrite, then syncs and closes the log.
+func (a *AppendOnlyStore) Close() error {
+	a.closeOnce.Do(func() { close(a.closed) })
+	a.waitForRewrite()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.store.Close()
+	return err
+}
+
+// Broker returns the pub/sub broker of the underlying store. Messages are
+// not logged.
+func (a *AppendOnlyStore) Broker() *Broker {
+	return a.store.Broker()
+}
+
+// Scripts returns the underlying store's script cache, running scripts
+// against a so that what they write is logged.
+func (a *AppendOnlyStore) Scripts() *Scripts {
+	return a.store.Scripts().on(a)
+}
+
+// KeyspaceEvents, SetKeyspaceEvents and WatchKeyspace report changes to
+// keys as the underlying store does. The setting is not logged.
+func (a *AppendOnlyStore) KeyspaceEvents() KeyspaceEvents {
+	return a.store.KeyspaceEvents()
+}
+
+func (a *AppendOnlyStore) SetKeyspaceEvents(events KeyspaceEvents) {
+	a.store.SetKeyspaceEvents(events)
+}
+
+func (a *AppendOnlyStore) WatchKeyspace(events KeyspaceEvents) *KeyspaceWatcher {
+	return a.store.WatchKeyspace(events)
+}
+
+func (a *AppendOnlyStore) Transaction(fn func(tx Store) error) error {
+	return a.WatchedTransaction(nil, fn)
+}
+
+func (a *AppendOnlyStore) Watch(keys ...string) (map[string]uint64, error) {
+	return a.store.Watch(keys...)
+}
+
+// WatchedTransaction logs the transaction's writes between MULTI and EXEC,
+// so that replaying a log cut short part way through drops all of them.
+func (a *AppendOnlyStore) WatchedTransaction(watched map[string]uint64, fn func(tx Store) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var pending []byte
+	err := a.store.WatchedTransaction(watched, func(tx Store) error {
+		return fn(&AppendOnlyStore{store: tx.(*MemoryStore), options: a.options, pending: &pending})
+	})
+	if len(pending) == 0 {
+		return err
+	}
+	// A transaction run inside another is already part of its MULTI.
+	if a.pending == nil {
+		pending = append(appendCommand(nil, "MULTI"), pending...)
+		pending = appendCommand(pending, "EXEC")
+	}
+	if logErr := a.appendEntry(pending); err == nil {
+		err = logErr
+	}
+	return err
+}
+
+// appendOnlyCommands returns the commands that rebuild the store, taken
+// with all shards locked so they describe a single point in time.
+func (s *MemoryStore) appendOnlyCommands() []byte {
+	for _, sh := range s.shards {
+		sh.Lock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.Unlock()
+		}
+	}()
+	now := s.now()
+	var buf []byte
+	for _, sh := range s.shards {
+		buf = sh.appendCommands(buf, now)
+	}
+	return buf
+}
+
+func (sh *shard) appendCommands(buf []byte, now int64) []byte {
+	// batched writes items in commands of up to rewriteItemsPerCommand
+	// items, each of which is one or more arguments.
+	batched := func(name, key string, items [][]string) {
+		for len(items) > 0 {
+			n := len(items)
+			if n > rewriteItemsPerCommand {
+				n = rewriteItemsPerCommand
+			}
+			args := []string{name, key}
+			for _, item := range items[:n] {
+				args = append(args, item...)
+			}
+			buf = appendCommand(buf, args...)
+			items = items[n:]
+		}
+	}
+	// Keys whose expiry has passed but that haven't been removed yet are
+	// left out, as they'd otherwise come back without their expiry.
+	for key, value := range sh.strings {
+		if !sh.expired(key, now) {
+			buf = appendCommand(buf, "SET", key, value)
+		}
+	}
+	for key, set := range sh.sets {
+		if sh.expired(key, now) {
+			continue
+		}
+		items := make([][]string, 0, len(set))
+		for member := range set {
+			items = append(items, []string{member})
+		}
+		batched("SADD", key, items)
+	}
+	for key, hash := range sh.hashes {
+		if sh.expired(key, now) {
+			continue
+		}
+		items := make([][]string, 0, len(hash))
+		for field, value := range hash {
+			items = append(items, []string{field, value})
+		}
+		batched("HSET", key, items)
+	}
+	for key, e := range sh.fieldExpires {
+		if sh.expired(key, now) {
+			continue
+		}
+		// Fields whose expiry has passed are expired again as they're
+		// replayed.
+		fields := map[int64][]string{}
+		for field, at := range e.at {
+			fields[at] = append(fields[at], field)
+		}
+		for at, fields := range fields {
+			for len(fields) > 0 {
+				n := len(fields)
+				if n > rewriteItemsPerCommand {
+					n = rewriteItemsPerCommand
+				}
+				buf = appendCommand(buf, fieldsCommand([]string{"HPEXPIREAT", key, itoa(at)}, fields[:n])...)
+				fields = fields[n:]
+			}
+		}
+	}
+	for key, list := range sh.lists {
+		if sh.expired(key, now) {
+			continue
+		}
+		items := make([][]string, list.length())
+		for i, item := range list.items() {
+			items[i] = []string{item}
+		}
+		batched("RPUSH", key, items)
+	}
+	for key, z := range sh.sortedSets {
+		if sh.expired(key, now) {
+			continue
+		}
+		items := make([][]string, 0, z.length())
+		for member, score := range z.scores {
+			items = append(items, []string{formatScore(score), member})
+		}
+		batched("ZADD", key, items)
+	}
+	for key, at := range sh.expires {
+		if !sh.expired(key, now) {
+			buf = appendCommand(buf, "PEXPIREAT", key, strconv.FormatInt(at, 10))
+		}
+	}
+	return buf
+}
+
+// when returns args if condition holds, for changes that only need logging
+// when they took effect.
+func when(condition bool, args ...string) []string {
+	if !condition {
+		return nil
+	}
+	return args
+}
+
+// fieldsCommand appends fields to args the way the hash field expiry
+// commands take them, after FIELDS and their number.
+func fieldsCommand(args []string, fields []string) []string {
+	args = append(args, "FIELDS", itoa(int64(len(fields))))
+	return append(args, fields...)
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func (a *AppendOnlyStore) Delete(keys ...string) (int64, error) {
+	var deleted int64
+	err := a.write(func() (_ []string, err error) {
+		deleted, err = a.store.Delete(keys...)
+		return when(deleted > 0, append([]string{"DEL"}, keys...)...), err
+	})
+	return deleted, err
+}
+
+func (a *AppendOnlyStore) Exists(keys ...string) (int64, error) {
+	return a.store.Exists(keys...)
+}
+
+func (a *AppendOnlyStore) Rename(key, newKey string) error {
+	return a.write(func() ([]string, error) {
+		return []string{"RENAME", key, newKey}, a.store.Rename(key, newKey)
+	})
+}
+
+func (a *AppendOnlyStore) RenameIfNotExists(key, newKey string) (bool, error) {
+	var renamed bool
+	err := a.write(func() (_ []string, err error) {
+		renamed, err = a.store.RenameIfNotExists(key, newKey)
+		return when(renamed, "RENAME", key, newKey), err
+	})
+	return renamed, err
+}
+
+func (a *AppendOnlyStore) Copy(source, destination string, replace bool) (bool, error) {
+	var copied bool
+	err := a.write(func() (_ []string, err error) {
+		copied, err = a.store.Copy(source, destination, replace)
+		return when(copied, "COPY", source, destination, "REPLACE"), err
+	})
+	return copied, err
+}
+
+func (a *AppendOnlyStore) Type(key string) (string, error) {
+	return a.store.Type(key)
+}
+
+func (a *AppendOnlyStore) RandomKey() (string, error) {
+	return a.store.RandomKey()
+}
+
+func (a *AppendOnlyStore) Keys(pattern string) ([]string, error) {
+	return a.store.Keys(pattern)
+}
+
+func (a *AppendOnlyStore) Scan(cursor uint64, options ScanOptions) (uint64, []string, error) {
+	return a.store.Scan(cursor, options)
+}
+
+func (a *AppendOnlyStore) Expire(key string, seconds int64) (bool, error) {
+	at, err := expiryAt(seconds, 1000, a.store.now())
+	if err != nil {
+		return false, err
+	}
+	return a.PExpireAt(key, at)
+}
+
+func (a *AppendOnlyStore) PExpire(key string, milliseconds int64) (bool, error) {
+	at, err := expiryAt(milliseconds, 1, a.store.now())
+	if err != nil {
+		return false, err
+	}
+	return a.PExpireAt(key, at)
+}
+
+func (a *AppendOnlyStore) ExpireAt(key string, timestamp int64) (bool, error) {
+	at, err := expiryAt(timestamp, 1000, 0)
+	if err != nil {
+		return false, err
+	}
+	return a.PExpireAt(key, at)
+}
+
+func (a *AppendOnlyStore) PExpireAt(key string, timestamp int64) (bool, error) {
+	var updated bool
+	err := a.write(func() (_ []string, err error) {
+		updated, err = a.store.PExpireAt(key, timestamp)
+		return when(updated, "PEXPIREAT", key, itoa(timestamp)), err
+	})
+	return updated, err
+}
+
+func (a *AppendOnlyStore) TTL(key string) (int64, error) {
+	return a.store.TTL(key)
+}
+
+func (a *AppendOnlyStore) PTTL(key string) (int64, error) {
+	return a.store.PTTL(key)
+}
+
+func (a *AppendOnlyStore) Persist(key string) (bool, error) {
+	var persisted bool
+	err := a.write(func() (_ []string, err error) {
+		persisted, err = a.store.Persist(key)
+		return when(persisted, "PERSIST", key), err
+	})
+	return persisted, err
+}
+
+func (a *AppendOnlyStore) Append(key, value string) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.Append(key, value)
+		return []string{"APPEND", key, value}, err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) Get(key string) (string, error) {
+	return a.store.Get(key)
+}
+
+func (a *AppendOnlyStore) GetRange(key string, start, stop int64) (string, error) {
+	return a.store.GetRange(key, start, stop)
+}
+
+func (a *AppendOnlyStore) GetSet(key, value string) (string, error) {
+	var previous string
+	err := a.write(func() (_ []string, err error) {
+		previous, err = a.store.GetSet(key, value)
+		return []string{"SET", key, value}, err
+	})
+	return previous, err
+}
+
+func (a *AppendOnlyStore) Set(key string, value string) error {
+	return a.write(func() ([]string, error) {
+		return []string{"SET", key, value}, a.store.Set(key, value)
+	})
+}
+
+// SetWithOptions resolves a relative expiry before applying it, so the
+// logged PXAT is exactly what was applied.
+func (a *AppendOnlyStore) SetWithOptions(key string, value string, options SetOptions) (bool, error) {
+	expiresAt, err := options.expiresAt(a.store.now())
+	if err != nil {
+		return false, err
+	}
+	resolved := options
+	resolved.ExpireSeconds, resolved.ExpireMilliseconds, resolved.ExpireAt = 0, 0, 0
+	resolved.ExpireAtMilliseconds = expiresAt
+	var set bool
+	err = a.write(func() (_ []string, err error) {
+		set, err = a.store.SetWithOptions(key, value, resolved)
+		args := []string{"SET", key, value}
+		if expiresAt != 0 {
+			args = append(args, "PXAT", itoa(expiresAt))
+		}
+		if options.KeepTTL {
+			args = append(args, "KEEPTTL")
+		}
+		return when(set, args...), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) SetIfExists(key string, value string) (bool, error) {
+	var set bool
+	err := a.write(func() (_ []string, err error) {
+		set, err = a.store.SetIfExists(key, value)
+		return when(set, "SET", key, value), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) SetIfNotExists(key string, value string) (bool, error) {
+	var set bool
+	err := a.write(func() (_ []string, err error) {
+		set, err = a.store.SetIfNotExists(key, value)
+		return when(set, "SET", key, value), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) MultiGet(keys []string) (map[string]string, error) {
+	return a.store.MultiGet(keys)
+}
+
+func multiSetArgs(data map[string]string) []string {
+	args := []string{"MSET"}
+	for key, value := range data {
+		args = append(args, key, value)
+	}
+	return args
+}
+
+func (a *AppendOnlyStore) MultiSet(data map[string]string) error {
+	return a.write(func() ([]string, error) {
+		return when(len(data) > 0, multiSetArgs(data)...), a.store.MultiSet(data)
+	})
+}
+
+func (a *AppendOnlyStore) MultiSetIfNotExists(data map[string]string) (bool, error) {
+	var set bool
+	err := a.write(func() (_ []string, err error) {
+		set, err = a.store.MultiSetIfNotExists(data)
+		return when(set && len(data) > 0, multiSetArgs(data)...), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) Increment(key string) (int64, error) {
+	return a.IncrementBy(key, 1)
+}
+
+func (a *AppendOnlyStore) Decrement(key string) (int64, error) {
+	return a.DecrementBy(key, 1)
+}
+
+func (a *AppendOnlyStore) IncrementBy(key string, delta int64) (int64, error) {
+	var n int64
+	err := a.write(func() (_ []string, err error) {
+		n, err = a.store.IncrementBy(key, delta)
+		return []string{"SET", key, itoa(n), "KEEPTTL"}, err
+	})
+	return n, err
+}
+
+func (a *AppendOnlyStore) IncrementByFloat(key string, delta float64) (string, error) {
+	var value string
+	err := a.write(func() (_ []string, err error) {
+		value, err = a.store.IncrementByFloat(key, delta)
+		return []string{"SET", key, value, "KEEPTTL"}, err
+	})
+	return value, err
+}
+
+func (a *AppendOnlyStore) DecrementBy(key string, delta int64) (int64, error) {
+	var n int64
+	err := a.write(func() (_ []string, err error) {
+		n, err = a.store.DecrementBy(key, delta)
+		return []string{"SET", key, itoa(n), "KEEPTTL"}, err
+	})
+	return n, err
+}
+
+func (a *AppendOnlyStore) SetRange(key string, offset int64, value string) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.SetRange(key, offset, value)
+		return []string{"SETRANGE", key, itoa(offset), value}, err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) Length(key string) (int64, error) {
+	return a.store.Length(key)
+}
+
+func (a *AppendOnlyStore) SetAdd(key string, values ...string) error {
+	return a.write(func() ([]string, error) {
+		return when(len(values) > 0, append([]string{"SADD", key}, values...)...), a.store.SetAdd(key, values...)
+	})
+}
+
+func (a *AppendOnlyStore) SetRemove(key string, values ...string) error {
+	return a.write(func() ([]string, error) {
+		return when(len(values) > 0, append([]string{"SREM", key}, values...)...), a.store.SetRemove(key, values...)
+	})
+}
+
+func (a *AppendOnlyStore) SetIsMember(key string, value string) (bool, error) {
+	return a.store.SetIsMember(key, value)
+}
+
+func (a *AppendOnlyStore) SetMembers(key string) ([]string, error) {
+	return a.store.SetMembers(key)
+}
+
+func (a *AppendOnlyStore) SetCardinality(key string) (int64, error) {
+	return a.store.SetCardinality(key)
+}
+
+func (a *AppendOnlyStore) SetScan(key string, cursor uint64, options ScanOptions) (uint64, []string, error) {
+	return a.store.SetScan(key, cursor, options)
+}
+
+func (a *AppendOnlyStore) SetMultiIsMember(key string, values ...string) ([]bool, error) {
+	return a.store.SetMultiIsMember(key, values...)
+}
+
+func (a *AppendOnlyStore) SetMove(source, destination, value string) (bool, error) {
+	var moved bool
+	err := a.write(func() (_ []string, err error) {
+		moved, err = a.store.SetMove(source, destination, value)
+		return when(moved, "SMOVE", source, destination, value), err
+	})
+	return moved, err
+}
+
+// SetPop is logged as the removal of the members it happened to pick, so
+// that replaying the log removes the same ones.
+func (a *AppendOnlyStore) SetPop(key string, count int64) ([]string, error) {
+	var popped []string
+	err := a.write(func() (_ []string, err error) {
+		popped, err = a.store.SetPop(key, count)
+		return when(len(popped) > 0, append([]string{"SREM", key}, popped...)...), err
+	})
+	return popped, err
+}
+
+func (a *AppendOnlyStore) SetRandomMember(key string, count int64) ([]string, error) {
+	return a.store.SetRandomMember(key, count)
+}
+
+func (a *AppendOnlyStore) SetIntersect(keys ...string) ([]string, error) {
+	return a.store.SetIntersect(keys...)
+}
+
+func (a *AppendOnlyStore) SetUnion(keys ...string) ([]string, error) {
+	return a.store.SetUnion(keys...)
+}
+
+func (a *AppendOnlyStore) SetDifference(keys ...string) ([]string, error) {
+	return a.store.SetDifference(keys...)
+}
+
+func (a *AppendOnlyStore) SetIntersectStore(destination string, keys ...string) (int64, error) {
+	return a.setStore("SINTERSTORE", a.store.SetIntersectStore, destination, keys)
+}
+
+func (a *AppendOnlyStore) SetUnionStore(destination string, keys ...string) (int64, error) {
+	return a.setStore("SUNIONSTORE", a.store.SetUnionStore, destination, keys)
+}
+
+func (a *AppendOnlyStore) SetDifferenceStore(destination string, keys ...string) (int64, error) {
+	return a.setStore("SDIFFSTORE", a.store.SetDifferenceStore, destination, keys)
+}
+
+func (a *AppendOnlyStore) setStore(command string, store func(string, ...string) (int64, error), destination string, keys []string) (int64, error) {
+	var cardinality int64
+	err := a.write(func() (_ []string, err error) {
+		cardinality, err = store(destination, keys...)
+		return append([]string{command, destination}, keys...), err
+	})
+	return cardinality, err
+}
+
+func (a *AppendOnlyStore) SetIntersectCardinality(limit int64, keys ...string) (int64, error) {
+	return a.store.SetIntersectCardinality(limit, keys...)
+}
+
+func (a *AppendOnlyStore) HashGet(key, field string) (string, error) {
+	return a.store.HashGet(key, field)
+}
+
+func (a *AppendOnlyStore) HashSet(key, field, value string) error {
+	return a.write(func() ([]string, error) {
+		return []string{"HSET", key, field, value}, a.store.HashSet(key, field, value)
+	})
+}
+
+func (a *AppendOnlyStore) HashLength(key string) (int64, error) {
+	return a.store.HashLength(key)
+}
+
+func (a *AppendOnlyStore) HashMultiGet(key string, fields ...string) ([]string, error) {
+	return a.store.HashMultiGet(key, fields...)
+}
+
+func (a *AppendOnlyStore) HashMultiSet(key string, data map[string]string) error {
+	return a.write(func() ([]string, error) {
+		args := []string{"HSET", key}
+		for field, value := range data {
+			args = append(args, field, value)
+		}
+		return when(len(data) > 0, args...), a.store.HashMultiSet(key, data)
+	})
+}
+
+func (a *AppendOnlyStore) HashExists(key, field string) (bool, error) {
+	return a.store.HashExists(key, field)
+}
+
+func (a *AppendOnlyStore) HashKeys(key string) ([]string, error) {
+	return a.store.HashKeys(key)
+}
+
+func (a *AppendOnlyStore) HashValues(key string) ([]string, error) {
+	return a.store.HashValues(key)
+}
+
+func (a *AppendOnlyStore) HashScan(key string, cursor uint64, options ScanOptions) (uint64, map[string]string, error) {
+	return a.store.HashScan(key, cursor, options)
+}
+
+func (a *AppendOnlyStore) HashDelete(key string, fields ...string) (int64, error) {
+	var deleted int64
+	err := a.write(func() (_ []string, err error) {
+		deleted, err = a.store.HashDelete(key, fields...)
+		return when(deleted > 0, append([]string{"HDEL", key}, fields...)...), err
+	})
+	return deleted, err
+}
+
+func (a *AppendOnlyStore) HashGetAll(key string) (map[string]string, error) {
+	return a.store.HashGetAll(key)
+}
+
+func (a *AppendOnlyStore) HashStringLength(key, field string) (int64, error) {
+	return a.store.HashStringLength(key, field)
+}
+
+// The increments log the value they stored, so that replaying a float
+// increment can't come out differently, and keep the field's expiry as the
+// increments do.
+func (a *AppendOnlyStore) HashIncrementBy(key, field string, delta int64) (int64, error) {
+	var n int64
+	err := a.write(func() (_ []string, err error) {
+		n, err = a.store.HashIncrementBy(key, field, delta)
+		return []string{"HSETEX", key, "KEEPTTL", "FIELDS", "1", field, itoa(n)}, err
+	})
+	return n, err
+}
+
+func (a *AppendOnlyStore) HashIncrementByFloat(key, field string, delta float64) (string, error) {
+	var value string
+	err := a.write(func() (_ []string, err error) {
+		value, err = a.store.HashIncrementByFloat(key, field, delta)
+		return []string{"HSETEX", key, "KEEPTTL", "FIELDS", "1", field, value}, err
+	})
+	return value, err
+}
+
+func (a *AppendOnlyStore) HashRandomField(key string, count int64) ([]string, error) {
+	return a.store.HashRandomField(key, count)
+}
+
+func (a *AppendOnlyStore) HashRandomFieldWithValues(key string, count int64) ([]HashField, error) {
+	return a.store.HashRandomFieldWithValues(key, count)
+}
+
+func (a *AppendOnlyStore) HashExpire(key string, seconds int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	at, err := fieldExpiryAt(seconds, 1000, a.store.now())
+	if err != nil {
+		return nil, err
+	}
+	return a.HashPExpireAt(key, at, options, fields...)
+}
+
+func (a *AppendOnlyStore) HashPExpire(key string, milliseconds int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	at, err := fieldExpiryAt(milliseconds, 1, a.store.now())
+	if err != nil {
+		return nil, err
+	}
+	return a.HashPExpireAt(key, at, options, fields...)
+}
+
+func (a *AppendOnlyStore) HashExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	at, err := fieldExpiryAt(timestamp, 1000, 0)
+	if err != nil {
+		return nil, err
+	}
+	return a.HashPExpireAt(key, at, options, fields...)
+}
+
+// HashPExpireAt logs only the fields whose expiry was set or that were
+// deleted, without the condition that picked them.
+func (a *AppendOnlyStore) HashPExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	var results []int64
+	err := a.write(func() (_ []string, err error) {
+		results, err = a.store.HashPExpireAt(key, timestamp, options, fields...)
+		changed := []string{}
+		for i, result := range results {
+			if result > 0 {
+				changed = append(changed, fields[i])
+			}
+		}
+		return when(len(changed) > 0, fieldsCommand([]string{"HPEXPIREAT", key, itoa(timestamp)}, changed)...), err
+	})
+	return results, err
+}
+
+func (a *AppendOnlyStore) HashTTL(key string, fields ...string) ([]int64, error) {
+	return a.store.HashTTL(key, fields...)
+}
+
+func (a *AppendOnlyStore) HashPTTL(key string, fields ...string) ([]int64, error) {
+	return a.store.HashPTTL(key, fields...)
+}
+
+func (a *AppendOnlyStore) HashPersist(key string, fields ...string) ([]int64, error) {
+	var results []int64
+	err := a.write(func() (_ []string, err error) {
+		results, err = a.store.HashPersist(key, fields...)
+		persisted := []string{}
+		for i, result := range results {
+			if result == 1 {
+				persisted = append(persisted, fields[i])
+			}
+		}
+		return when(len(persisted) > 0, fieldsCommand([]string{"HPERSIST", key}, persisted)...), err
+	})
+	return results, err
+}
+
+// HashGetWithOptions resolves a relative expiry before applying it, and logs
+// the expiry it gave the fields it found, if any.
+func (a *AppendOnlyStore) HashGetWithOptions(key string, options HashFieldOptions, fields ...string) (map[string]string, error) {
+	expiresAt, err := options.expiresAt(a.store.now())
+	if err != nil {
+		return nil, err
+	}
+	resolved := options
+	resolved.ExpireSeconds, resolved.ExpireMilliseconds, resolved.ExpireAt = 0, 0, 0
+	resolved.ExpireAtMilliseconds = expiresAt
+	var values map[string]string
+	err = a.write(func() (_ []string, err error) {
+		values, err = a.store.HashGetWithOptions(key, resolved, fields...)
+		found := []string{}
+		for _, field := range fields {
+			if _, ok := values[field]; ok {
+				found = append(found, field)
+			}
+		}
+		if len(found) == 0 {
+			return nil, err
+		}
+		switch {
+		case options.Persist:
+			return fieldsCommand([]string{"HPERSIST", key}, found), err
+		case expiresAt != 0:
+			return fieldsCommand([]string{"HPEXPIREAT", key, itoa(expiresAt)}, found), err
+		}
+		return nil, err
+	})
+	return values, err
+}
+
+// HashSetWithOptions resolves a relative expiry before applying it, so the
+// logged PXAT is exactly what was applied.
+func (a *AppendOnlyStore) HashSetWithOptions(key string, data map[string]string, options HashFieldOptions) (bool, error) {
+	expiresAt, err := options.expiresAt(a.store.now())
+	if err != nil {
+		return false, err
+	}
+	resolved := options
+	resolved.ExpireSeconds, resolved.ExpireMilliseconds, resolved.ExpireAt = 0, 0, 0
+	resolved.ExpireAtMilliseconds = expiresAt
+	var set bool
+	err = a.write(func() (_ []string, err error) {
+		set, err = a.store.HashSetWithOptions(key, data, resolved)
+		args := []string{"HSETEX", key}
+		if expiresAt != 0 {
+			args = append(args, "PXAT", itoa(expiresAt))
+		}
+		if options.KeepTTL {
+			args = append(args, "KEEPTTL")
+		}
+		args = append(args, "FIELDS", itoa(int64(len(data))))
+		for field, value := range data {
+			args = append(args, field, value)
+		}
+		return when(set && len(data) > 0, args...), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) HashSetIfExists(key, field string, value string) (bool, error) {
+	var set bool
+	err := a.write(func() (_ []string, err error) {
+		set, err = a.store.HashSetIfExists(key, field, value)
+		return when(set, "HSET", key, field, value), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) HashSetIfNotExists(key, field string, value string) (bool, error) {
+	var set bool
+	err := a.write(func() (_ []string, err error) {
+		set, err = a.store.HashSetIfNotExists(key, field, value)
+		return when(set, "HSET", key, field, value), err
+	})
+	return set, err
+}
+
+func (a *AppendOnlyStore) ListLeftPush(key string, values ...string) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.ListLeftPush(key, values...)
+		return when(len(values) > 0, append([]string{"LPUSH", key}, values...)...), err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) ListRightPush(key string, values ...string) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.ListRightPush(key, values...)
+		return when(len(values) > 0, append([]string{"RPUSH", key}, values...)...), err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) ListLeftPop(key string) (string, error) {
+	var value string
+	err := a.write(func() (_ []string, err error) {
+		value, err = a.store.ListLeftPop(key)
+		return []string{"LPOP", key}, err
+	})
+	return value, err
+}
+
+func (a *AppendOnlyStore) ListRightPop(key string) (string, error) {
+	var value string
+	err := a.write(func() (_ []string, err error) {
+		value, err = a.store.ListRightPop(key)
+		return []string{"RPOP", key}, err
+	})
+	return value, err
+}
+
+func (a *AppendOnlyStore) ListLength(key string) (int64, error) {
+	return a.store.ListLength(key)
+}
+
+func (a *AppendOnlyStore) ListRange(key string, start, stop int64) ([]string, error) {
+	return a.store.ListRange(key, start, stop)
+}
+
+func (a *AppendOnlyStore) ListSet(key string, index int64, value string) error {
+	return a.write(func() ([]string, error) {
+		return []string{"LSET", key, itoa(index), value}, a.store.ListSet(key, index, value)
+	})
+}
+
+func (a *AppendOnlyStore) ListIndex(key string, index int64) (string, error) {
+	return a.store.ListIndex(key, index)
+}
+
+func (a *AppendOnlyStore) ListTrim(key string, start, stop int64) error {
+	return a.write(func() ([]string, error) {
+		return []string{"LTRIM", key, itoa(start), itoa(stop)}, a.store.ListTrim(key, start, stop)
+	})
+}
+
+func (a *AppendOnlyStore) ListInsertBefore(key, pivot, value string) (int64, error) {
+	return a.listInsert(key, pivot, value, "BEFORE", a.store.ListInsertBefore)
+}
+
+func (a *AppendOnlyStore) ListInsertAfter(key, pivot, value string) (int64, error) {
+	return a.listInsert(key, pivot, value, "AFTER", a.store.ListInsertAfter)
+}
+
+func (a *AppendOnlyStore) listInsert(key, pivot, value, where string, insert func(key, pivot, value string) (int64, error)) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = insert(key, pivot, value)
+		return when(length > 0, "LINSERT", key, where, pivot, value), err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) ListRemove(key string, count int64, value string) (int64, error) {
+	var removed int64
+	err := a.write(func() (_ []string, err error) {
+		removed, err = a.store.ListRemove(key, count, value)
+		return when(removed > 0, "LREM", key, itoa(count), value), err
+	})
+	return removed, err
+}
+
+func (a *AppendOnlyStore) ListPosition(key, value string, options ListPositionOptions) ([]int64, error) {
+	return a.store.ListPosition(key, value, options)
+}
+
+func (a *AppendOnlyStore) ListLeftPushIfExists(key string, values ...string) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.ListLeftPushIfExists(key, values...)
+		return when(length > 0 && len(values) > 0, append([]string{"LPUSH", key}, values...)...), err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) ListRightPushIfExists(key string, values ...string) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.ListRightPushIfExists(key, values...)
+		return when(length > 0 && len(values) > 0, append([]string{"RPUSH", key}, values...)...), err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) ListLeftPopCount(key string, count int64) ([]string, error) {
+	var values []string
+	err := a.write(func() (_ []string, err error) {
+		values, err = a.store.ListLeftPopCount(key, count)
+		return when(len(values) > 0, "LPOP", key, itoa(int64(len(values)))), err
+	})
+	return values, err
+}
+
+func (a *AppendOnlyStore) ListRightPopCount(key string, count int64) ([]string, error) {
+	var values []string
+	err := a.write(func() (_ []string, err error) {
+		values, err = a.store.ListRightPopCount(key, count)
+		return when(len(values) > 0, "RPOP", key, itoa(int64(len(values)))), err
+	})
+	return values, err
+}
+
+// ListMultiPop logs a counted pop from the key it popped from.
+func (a *AppendOnlyStore) ListMultiPop(side ListSide, count int64, keys ...string) (string, []string, error) {
+	var key string
+	var values []string
+	err := a.write(func() (_ []string, err error) {
+		key, values, err = a.store.ListMultiPop(side, count, keys...)
+		return when(len(values) > 0, strings.ToUpper(side.event("pop")), key, itoa(int64(len(values)))), err
+	})
+	return key, values, err
+}
+
+func (a *AppendOnlyStore) ListMove(source, destination string, from, to ListSide) (string, error) {
+	var value string
+	err := a.write(func() (_ []string, err error) {
+		value, err = a.store.ListMove(source, destination, from, to)
+		return []string{"LMOVE", source, destination, from.String(), to.String()}, err
+	})
+	return value, err
+}
+
+// The blocking operations wait without holding the log, and log what they
+// took as the equivalent non-blocking command.
+func (a *AppendOnlyStore) ListBlockingLeftPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	return a.listBlockingPop(ctx, timeout, keys, ListLeft)
+}
+
+func (a *AppendOnlyStore) ListBlockingRightPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	return a.listBlockingPop(ctx, timeout, keys, ListRight)
+}
+
+func (a *AppendOnlyStore) listBlockingPop(ctx context.Context, timeout time.Duration, keys []string, side ListSide) (key, value string, err error) {
+	err = a.store.awaitLists(ctx, timeout, keys, func() (popped bool, err error) {
+		err = a.write(func() (_ []string, err error) {
+			var values []string
+			key, values, popped, err = a.store.listPopFirst(keys, side, 1)
+			if popped {
+				value = values[0]
+			}
+			return when(popped, strings.ToUpper(side.event("pop")), key), err
+		})
+		return popped, err
+	})
+	return key, value, err
+}
+
+func (a *AppendOnlyStore) ListBlockingMove(ctx context.Context, timeout time.Duration, source, destination string, from, to ListSide) (value string, err error) {
+	err = a.store.awaitLists(ctx, timeout, []string{source}, func() (bool, error) {
+		value, err = a.ListMove(source, destination, from, to)
+		if err == ErrNoSuchKey {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	return value, err
+}
+
+// SortedSetAdd logs the scores members ended up with rather than the
+// options, which replaying against the same state would apply the same way.
+func (a *AppendOnlyStore) SortedSetAdd(key string, options SortedSetAddOptions, members ...ScoredMember) (int64, error) {
+	var count int64
+	err := a.write(func() (_ []string, err error) {
+		count, err = a.store.SortedSetAdd(key, options, members...)
+		if err != nil || len(members) == 0 {
+			return nil, err
+		}
+		return a.sortedSetScores(key, members)
+	})
+	return count, err
+}
+
+// sortedSetScores returns a ZADD of the current scores of those members that
+// are in the set, which conditional adds may have left some out of.
+func (a *AppendOnlyStore) sortedSetScores(key string, members []ScoredMember) ([]string, error) {
+	args := []string{"ZADD", key}
+	for _, m := range members {
+		score, found, err := a.store.SortedSetScore(key, m.Member)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			args = append(args, formatScore(score), m.Member)
+		}
+	}
+	return when(len(args) > 2, args...), nil
+}
+
+func (a *AppendOnlyStore) SortedSetAddIncrement(key string, options SortedSetAddOptions, member string, delta float64) (float64, bool, error) {
+	var score float64
+	var applied bool
+	err := a.write(func() (_ []string, err error) {
+		score, applied, err = a.store.SortedSetAddIncrement(key, options, member, delta)
+		return when(applied, "ZADD", key, formatScore(score), member), err
+	})
+	return score, applied, err
+}
+
+func (a *AppendOnlyStore) SortedSetRemove(key string, members ...string) (int64, error) {
+	var removed int64
+	err := a.write(func() (_ []string, err error) {
+		removed, err = a.store.SortedSetRemove(key, members...)
+		return when(removed > 0, append([]string{"ZREM", key}, members...)...), err
+	})
+	return removed, err
+}
+
+func (a *AppendOnlyStore) SortedSetScore(key, member string) (float64, bool, error) {
+	return a.store.SortedSetScore(key, member)
+}
+
+func (a *AppendOnlyStore) SortedSetIncrementBy(key, member string, delta float64) (float64, error) {
+	score, _, err := a.SortedSetAddIncrement(key, SortedSetAddOptions{}, member, delta)
+	return score, err
+}
+
+func (a *AppendOnlyStore) SortedSetCardinality(key string) (int64, error) {
+	return a.store.SortedSetCardinality(key)
+}
+
+func (a *AppendOnlyStore) SortedSetCount(key, min, max string) (int64, error) {
+	return a.store.SortedSetCount(key, min, max)
+}
+
+func (a *AppendOnlyStore) SortedSetRank(key, member string) (int64, bool, error) {
+	return a.store.SortedSetRank(key, member)
+}
+
+func (a *AppendOnlyStore) SortedSetReverseRank(key, member string) (int64, bool, error) {
+	return a.store.SortedSetReverseRank(key, member)
+}
+
+func (a *AppendOnlyStore) SortedSetRange(key string, query SortedSetRange) ([]ScoredMember, error) {
+	return a.store.SortedSetRange(key, query)
+}
+
+func (a *AppendOnlyStore) SortedSetRangeStore(destination, key string, query SortedSetRange) (int64, error) {
+	var length int64
+	err := a.write(func() (_ []string, err error) {
+		length, err = a.store.SortedSetRangeStore(destination, key, query)
+		args := []string{"ZRANGESTORE", destination, key, query.Start, query.Stop}
+		if query.ByScore {
+			args = append(args, "BYSCORE")
+		}
+		if query.ByLex {
+			args = append(args, "BYLEX")
+		}
+		if query.Reverse {
+			args = append(args, "REV")
+		}
+		if query.Limit != nil {
+			args = append(args, "LIMIT", itoa(query.Limit.Offset), itoa(query.Limit.Count))
+		}
+		return args, err
+	})
+	return length, err
+}
+
+func (a *AppendOnlyStore) SortedSetPopMin(key string, count int64) ([]ScoredMember, error) {
+	var popped []ScoredMember
+	err := a.write(func() (_ []string, err error) {
+		popped, err = a.store.SortedSetPopMin(key, count)
+		return when(len(popped) > 0, "ZPOPMIN", key, itoa(int64(len(popped)))), err
+	})
+	return popped, err
+}
+
+func (a *AppendOnlyStore) SortedSetPopMax(key string, count int64) ([]ScoredMember, error) {
+	var popped []ScoredMember
+	err := a.write(func() (_ []string, err error) {
+		popped, err = a.store.SortedSetPopMax(key, count)
+		return when(len(popped) > 0, "ZPOPMAX", key, itoa(int64(len(popped)))), err
+	})
+	return popped, err
+}
@@ -0,0 +1,285 @@
+package restis
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openAppendOnly(t *testing.T, options AppendOnlyOptions) *AppendOnlyStore {
+	store, err := OpenAppendOnlyStore(options)
+	return opened(t, store, err)
+}
+
+// dumpStore describes every key that's live at now, for comparing stores.
+func dumpStore(s *MemoryStore, now int64) map[string]interface{} {
+	dump := map[string]interface{}{}
+	for _, sh := range s.shards {
+		sh.Lock()
+		live := func(key string) bool {
+			at, ok := sh.expires[key]
+			if ok {
+				dump["expiry "+key] = at
+			}
+			return !ok || at > now
+		}
+		for key, value := range sh.strings {
+			if live(key) {
+				dump["string "+key] = value
+			}
+		}
+		for key, set := range sh.sets {
+			if live(key) {
+				members := []string{}
+				for member := range set {
+					members = append(members, member)
+				}
+				sort.Strings(members)
+				dump["set "+key] = members
+			}
+		}
+		for key, hash := range sh.hashes {
+			if live(key) {
+				dump["hash "+key] = hash
+			}
+		}
+		for key, list := range sh.lists {
+			if live(key) {
+				dump["list "+key] = list.items()
+			}
+		}
+		for key, z := range sh.sortedSets {
+			if live(key) {
+				dump["zset "+key] = z.scores
+			}
+		}
+		sh.Unlock()
+	}
+	for key := range dump {
+		if strings.HasPrefix(key, "expiry ") && !hasLiveKey(dump, strings.TrimPrefix(key, "expiry ")) {
+			delete(dump, key)
+		}
+	}
+	return dump
+}
+
+func hasLiveKey(dump map[string]interface{}, key string) bool {
+	for _, kind := range []string{"string ", "set ", "hash ", "list ", "zset "} {
+		if _, ok := dump[kind+key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAppendOnlyStore(t *testing.T) {
+	var stores []*AppendOnlyStore
+	storeGen := func() Store {
+		store := openAppendOnly(t, AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof"), Fsync: FsyncNever})
+		stores = append(stores, store)
+		return store
+	}
+	RunAllTestsOnStore(t, storeGen)
+	RunAllRedisDocChecksOnStore(t, storeGen)
+
+	// Every store the suites used has to come back exactly as it was left.
+	for _, store := range stores {
+		assert.NoError(t, store.Close())
+		replayed := openAppendOnly(t, store.options)
+		now := time.Now().UnixNano()/int64(time.Millisecond) + 5000
+		assert.Equal(t, dumpStore(store.store, now), dumpStore(replayed.store, now), store.options.Path)
+	}
+}
+
+func TestAppendOnlyReplay(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof"), Fsync: FsyncAlways, Clock: clock}
+	store := openAppendOnly(t, options)
+	assert.NoError(t, store.Set("s", "v"))
+	ok(store.Append("s", "alue"))
+	ok(store.IncrementBy("n", 41))
+	ok(store.Increment("n"))
+	ok(store.SetWithOptions("volatile", "v", SetOptions{ExpireSeconds: 100}))
+	ok(store.SetWithOptions("short", "v", SetOptions{ExpireSeconds: 1}))
+	ok(store.Expire("n", 50))
+	ok(store.ListRightPush("list", "a", "b", "c"))
+	ok(store.ListLeftPop("list"))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"a", 1}, ScoredMember{"b", 2}))
+	ok(store.SortedSetIncrementBy("zset", "a", 0.5))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{IfExists: true}, ScoredMember{"b", 3}, ScoredMember{"c", 3}))
+	assert.Equal(t, ErrWrongType, store.SetAdd("s", "member"))
+	assert.NoError(t, store.SetAdd("set", "a", "b", "c", "d"))
+	popped := ok(store.SetPop("set", 2)).([]string)
+	ok(store.SetMove("set", "moved", "z"))
+	ok(store.SetUnionStore("union", "set", "moved"))
+	assert.NoError(t, store.Close())
+
+	clock.Advance(10 * time.Second)
+	store = openAppendOnly(t, options)
+	assert.Equal(t, "value", ok(store.Get("s")))
+	assert.Equal(t, "42", ok(store.Get("n")))
+	assert.Equal(t, 40, ok(store.TTL("n")))
+	assert.Equal(t, 90, ok(store.TTL("volatile")))
+	assert.Equal(t, 0, ok(store.Exists("short")))
+	assert.Equal(t, []string{"b", "c"}, ok(store.ListRange("list", 0, -1)))
+	assert.Equal(t, []ScoredMember{{"a", 1.5}, {"b", 3}}, ok(store.SortedSetRange("zset", everything())))
+	assert.Equal(t, typeString, ok(store.Type("s")))
+	assert.Equal(t, []bool{false, false}, ok(store.SetMultiIsMember("set", popped...)))
+	assert.Equal(t, 2, ok(store.SetCardinality("set")))
+	assert.Equal(t, 2, ok(store.SetCardinality("union")))
+	assert.Equal(t, 0, ok(store.Exists("moved")))
+}
+
+func TestAppendOnlyTruncatedTail(t *testing.T) {
+	options := AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof")}
+	store := openAppendOnly(t, options)
+	assert.NoError(t, store.Set("k1", "v"))
+	assert.NoError(t, store.Close())
+	info, err := os.Stat(options.Path)
+	assert.NoError(t, err)
+
+	file, err := os.OpenFile(options.Path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString("*3\r\n$3\r\nSET\r\n$2\r\nk2\r\n$5\r\nva")
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	store = openAppendOnly(t, options)
+	truncated, err := os.Stat(options.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+	assert.Equal(t, 1, noError(t)(store.Exists("k1", "k2")))
+	assert.NoError(t, store.Set("k3", "v"))
+	assert.NoError(t, store.Close())
+	assert.Equal(t, 2, noError(t)(openAppendOnly(t, options).Exists("k1", "k2", "k3")))
+}
+
+func TestAppendOnlyCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "restis.aof")
+	valid := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	for name, data := range map[string]string{
+		"not a command":  "+OK\r\n" + valid,
+		"bad length":     "*3\r\n$x\r\n" + valid,
+		"long bulk":      "*1\r\n$1\r\nab\r\n" + valid,
+		"empty command":  "*0\r\n" + valid,
+		"garbage header": "*3junk\r\n" + valid,
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+		_, err := OpenAppendOnlyStore(AppendOnlyOptions{Path: path})
+		assert.True(t, errors.Is(err, ErrAppendOnlyCorrupt), name)
+	}
+}
+
+func TestAppendOnlyRewrite(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof"), Clock: clock}
+	store := openAppendOnly(t, options)
+	for i := 0; i < 100; i++ {
+		ok(store.Increment("counter"))
+		ok(store.ListRightPush("list", "item"))
+	}
+	assert.NoError(t, store.ListTrim("list", 0, 1))
+	ok(store.Expire("counter", 100))
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, store.SetAdd("set", string(rune('a'+i%26))+strings.Repeat("x", i)))
+	}
+	assert.NoError(t, store.Set("gone", "v"))
+	ok(store.Delete("gone"))
+	before, err := os.Stat(options.Path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.BackgroundRewrite())
+	assert.NoError(t, store.Set("during", "v"))
+	store.waitForRewrite()
+	assert.NoError(t, store.Set("after", "v"))
+	after, err := os.Stat(options.Path)
+	assert.NoError(t, err)
+	assert.True(t, after.Size() < before.Size())
+
+	store.mu.Lock()
+	store.rewriting = true
+	store.mu.Unlock()
+	assert.Equal(t, ErrRewriteInProgress, store.Rewrite())
+	assert.Equal(t, ErrRewriteInProgress, store.BackgroundRewrite())
+	store.mu.Lock()
+	store.rewriting = false
+	store.mu.Unlock()
+
+	assert.NoError(t, store.Close())
+	replayed := openAppendOnly(t, options)
+	now := clock.Now().UnixNano() / int64(time.Millisecond)
+	assert.Equal(t, dumpStore(store.store, now), dumpStore(replayed.store, now))
+	assert.Equal(t, 100, ok(replayed.TTL("counter")))
+	assert.Equal(t, 2, ok(replayed.Exists("during", "after")))
+}
+
+func TestAppendOnlyRewriteSkipsExpiredKeys(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof"), Clock: clock}
+	store := openAppendOnly(t, options)
+	ok(store.SetWithOptions("short", "v", SetOptions{ExpireSeconds: 1}))
+	assert.NoError(t, store.HashSet("hash", "f", "v"))
+	ok(store.Expire("hash", 1))
+	ok(store.SetWithOptions("long", "v", SetOptions{ExpireSeconds: 100}))
+	clock.Advance(2 * time.Second)
+	assert.NoError(t, store.Rewrite())
+	assert.NoError(t, store.Close())
+
+	replayed := openAppendOnly(t, options)
+	assert.Equal(t, -2, ok(replayed.PTTL("short")))
+	assert.Equal(t, -2, ok(replayed.PTTL("hash")))
+	assert.Equal(t, 98000, ok(replayed.PTTL("long")))
+}
+
+func TestAppendOnlyAutomaticRewrite(t *testing.T) {
+	options := AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof"), RewritePercentage: 100, RewriteMinSize: 1024}
+	store := openAppendOnly(t, options)
+	value := strings.Repeat("v", 20)
+	writes := 1024/len(appendCommand(nil, "SET", "k", value)) + 5
+	for i := 0; i < writes; i++ {
+		assert.NoError(t, store.Set("k", value))
+	}
+	store.waitForRewrite()
+	info, err := os.Stat(options.Path)
+	assert.NoError(t, err)
+	assert.True(t, info.Size() < 1024)
+	assert.NoError(t, store.Close())
+	assert.Equal(t, value, noError(t)(openAppendOnly(t, options).Get("k")))
+}
+
+func TestHandlerAppendOnlyLog(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("POST", "/append-only-log/rewrite", "", 501, `{"error":"ERR append-only log is not enabled"}`)
+
+	store := openAppendOnly(t, AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof")})
+	c = httpChecker{t, NewHandler(store)}
+	c.check("POST", "/append-only-log/rewrite", "", 202, "")
+	store.waitForRewrite()
+	c.check("GET", "/append-only-log/rewrite", "", 405, `{"error":"method not allowed"}`)
+	c.check("POST", "/append-only-log", "", 404, `{"error":"not found"}`)
+}
+
+func TestRESPAppendOnlyLog(t *testing.T) {
+	server, connect := startRESPServer(t)
+	c := connect()
+	c.check("-ERR append-only log is not enabled\n", "BGREWRITEAOF")
+	server.Close()
+
+	store := openAppendOnly(t, AppendOnlyOptions{Path: filepath.Join(t.TempDir(), "restis.aof")})
+	server, connect = startRESPServerWithStore(t, store)
+	defer server.Close()
+	c = connect()
+	c.check("+OK\n", "SET", "k", "v")
+	c.check("+Background append only file rewriting started\n", "BGREWRITEAOF")
+	store.waitForRewrite()
+}
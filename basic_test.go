@@ -1,177 +1,940 @@
 package restis
 
 import (
+	"context"
+	"io"
+	"math"
 	"sort"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 type storeGenerator func() Store
 
-func CheckStringOperations(t *testing.T, store StringStore) {
-	store.Set("k1", "v1")
-	assert.Equal(t, "v1", store.Get("k1"))
-
-	store.Set("k2", "v2")
-	assert.Equal(t, "v1", store.Get("k1"))
-	assert.Equal(t, "v2", store.Get("k2"))
-
-	store.Set("k1", "v1.1")
-	assert.Equal(t, "v1.1", store.Get("k1"))
-
-	assert.Equal(t, map[string]string{"k1": "v1.1", "k2": "v2"}, store.MultiGet([]string{"k1", "k2"}))
-	store.MultiSet(map[string]string{"k1": "v1.2", "k2": "v2.1"})
-	assert.Equal(t, map[string]string{"k1": "v1.2", "k2": "v2.1"}, store.MultiGet([]string{"k1", "k2"}))
-
-	assert.Equal(t, 1, store.Increment("n1"))
-	assert.Equal(t, "1", store.Get("n1"))
-	assert.Equal(t, 2, store.Increment("n1"))
-	assert.Equal(t, 3, store.Increment("n1"))
-	assert.Equal(t, 2, store.Decrement("n1"))
-	assert.Equal(t, 1, store.Decrement("n1"))
-	assert.Equal(t, "1", store.Get("n1"))
-	assert.Equal(t, 5, store.IncrementBy("n1", 4))
-	assert.Equal(t, 3, store.DecrementBy("n1", 2))
-
-	assert.True(t, store.Exists("n1"))
-	assert.False(t, store.Exists("non existent key"))
+func noError(t *testing.T) func(interface{}, error) interface{} {
+	return func(value interface{}, err error) interface{} {
+		assert.NoError(t, err)
+		return value
+	}
+}
 
-	assert.Equal(t, "", store.Get("non existent key"))
+func failure(_ interface{}, err error) error {
+	return err
+}
 
-	assert.False(t, store.SetIfExists("ek1", "ev1"))
-	assert.Equal(t, "", store.Get("ek1"))
-	store.Set("ek1", "some old value")
-	assert.True(t, store.SetIfExists("ek1", "ev2"))
-	assert.Equal(t, "ev2", store.Get("ek1"))
+// opened fails the test if store couldn't be opened, and otherwise closes it
+// once the test is done.
+func opened[S io.Closer](t *testing.T, store S, err error) S {
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
 
-	assert.True(t, store.SetIfNotExists("nk1", "vx1"))
-	assert.Equal(t, "vx1", store.Get("nk1"))
-	assert.False(t, store.SetIfNotExists("nk1", "vx2"))
-	assert.Equal(t, "vx1", store.Get("nk1"))
+func CheckStringOperations(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("k1", "v1"))
+	assert.Equal(t, "v1", ok(store.Get("k1")))
+
+	assert.NoError(t, store.Set("k2", "v2"))
+	assert.Equal(t, "v1", ok(store.Get("k1")))
+	assert.Equal(t, "v2", ok(store.Get("k2")))
+
+	assert.NoError(t, store.Set("k1", "v1.1"))
+	assert.Equal(t, "v1.1", ok(store.Get("k1")))
+
+	assert.Equal(t, map[string]string{"k1": "v1.1", "k2": "v2"}, ok(store.MultiGet([]string{"k1", "k2"})))
+	assert.NoError(t, store.MultiSet(map[string]string{"k1": "v1.2", "k2": "v2.1"}))
+	assert.Equal(t, map[string]string{"k1": "v1.2", "k2": "v2.1"}, ok(store.MultiGet([]string{"k1", "k2"})))
+
+	assert.Equal(t, 1, ok(store.Increment("n1")))
+	assert.Equal(t, "1", ok(store.Get("n1")))
+	assert.Equal(t, 2, ok(store.Increment("n1")))
+	assert.Equal(t, 3, ok(store.Increment("n1")))
+	assert.Equal(t, 2, ok(store.Decrement("n1")))
+	assert.Equal(t, 1, ok(store.Decrement("n1")))
+	assert.Equal(t, "1", ok(store.Get("n1")))
+	assert.Equal(t, 5, ok(store.IncrementBy("n1", 4)))
+	assert.Equal(t, 3, ok(store.DecrementBy("n1", 2)))
+
+	assert.Equal(t, 1, ok(store.Exists("n1")))
+	assert.Equal(t, 0, ok(store.Exists("non existent key")))
+
+	assert.Equal(t, "", ok(store.Get("non existent key")))
+
+	assert.Equal(t, false, ok(store.SetIfExists("ek1", "ev1")))
+	assert.Equal(t, "", ok(store.Get("ek1")))
+	assert.NoError(t, store.Set("ek1", "some old value"))
+	assert.Equal(t, true, ok(store.SetIfExists("ek1", "ev2")))
+	assert.Equal(t, "ev2", ok(store.Get("ek1")))
+
+	assert.Equal(t, true, ok(store.SetIfNotExists("nk1", "vx1")))
+	assert.Equal(t, "vx1", ok(store.Get("nk1")))
+	assert.Equal(t, false, ok(store.SetIfNotExists("nk1", "vx2")))
+	assert.Equal(t, "vx1", ok(store.Get("nk1")))
+
+	assert.Equal(t, ErrNotInteger, failure(store.Increment("nk1")))
+	assert.Equal(t, ErrNotInteger, failure(store.IncrementBy("nk1", 2)))
+	assert.NoError(t, store.Set("n2", "007"))
+	assert.Equal(t, ErrNotInteger, failure(store.Decrement("n2")))
+	assert.NoError(t, store.Set("n2", "9223372036854775806"))
+	assert.Equal(t, 9223372036854775807, ok(store.Increment("n2")))
+	assert.Equal(t, ErrOverflow, failure(store.Increment("n2")))
+	assert.Equal(t, ErrOverflow, failure(store.DecrementBy("n3", -9223372036854775808)))
+	assert.Equal(t, "9223372036854775807", ok(store.Get("n2")))
+
+	assert.Equal(t, "0.1", ok(store.IncrementByFloat("f1", 0.1)))
+	assert.Equal(t, "0.3", ok(store.IncrementByFloat("f1", 0.2)))
+	assert.Equal(t, "-2.7", ok(store.IncrementByFloat("f1", -3)))
+	assert.Equal(t, "0", ok(store.IncrementByFloat("f1", 2.7)))
+	assert.Equal(t, "100000000000000000000", ok(store.IncrementByFloat("f1", 1e20)))
+	assert.Equal(t, ErrNotInteger, failure(store.Increment("f1")))
+	assert.NoError(t, store.Set("f2", "1.5"))
+	assert.Equal(t, ErrNotInteger, failure(store.Increment("f2")))
+	assert.Equal(t, "1.5", ok(store.Get("f2")))
+	assert.Equal(t, "2", ok(store.IncrementByFloat("f2", 0.5)))
+	assert.Equal(t, 3, ok(store.Increment("f2")))
+	assert.Equal(t, ErrNotFloat, failure(store.IncrementByFloat("nk1", 1)))
+	assert.Equal(t, "vx1", ok(store.Get("nk1")))
+	assert.Equal(t, ErrNaNOrInfinity, failure(store.IncrementByFloat("f2", math.NaN())))
+	assert.Equal(t, ErrNaNOrInfinity, failure(store.IncrementByFloat("f2", math.Inf(-1))))
+	assert.Equal(t, "3", ok(store.Get("f2")))
+	assert.Equal(t, true, ok(store.SetWithOptions("f3", "1", SetOptions{ExpireSeconds: 100})))
+	assert.Equal(t, "1.25", ok(store.IncrementByFloat("f3", 0.25)))
+	assert.Equal(t, 100, ok(store.TTL("f3")))
+	assert.NoError(t, store.SetAdd("fs", "m"))
+	assert.Equal(t, ErrWrongType, failure(store.IncrementByFloat("fs", 1)))
+
+	assert.Equal(t, ErrOutOfRange, failure(store.SetRange("nk1", -1, "x")))
+	assert.Equal(t, "", ok(store.GetRange("nk1", 2, 1)))
 }
 
 func CheckSetOperations(t *testing.T, store SetStore) {
-	assert.False(t, store.SetIsMember("sk1", "v1"))
-	assert.Equal(t, 0, store.SetCardinality("sk1"))
+	ok := noError(t)
+	assert.Equal(t, false, ok(store.SetIsMember("sk1", "v1")))
+	assert.Equal(t, 0, ok(store.SetCardinality("sk1")))
 
-	store.SetAdd("sk1", "v1")
-	assert.True(t, store.SetIsMember("sk1", "v1"))
-	assert.False(t, store.SetIsMember("sk1", "v2"))
-	assert.Equal(t, 1, store.SetCardinality("sk1"))
+	assert.NoError(t, store.SetAdd("sk1", "v1"))
+	assert.Equal(t, true, ok(store.SetIsMember("sk1", "v1")))
+	assert.Equal(t, false, ok(store.SetIsMember("sk1", "v2")))
+	assert.Equal(t, 1, ok(store.SetCardinality("sk1")))
 
-	store.SetAdd("sk1", "v2", "v1")
-	assert.True(t, store.SetIsMember("sk1", "v2"))
-	assert.Equal(t, 2, store.SetCardinality("sk1"))
+	assert.NoError(t, store.SetAdd("sk1", "v2", "v1"))
+	assert.Equal(t, true, ok(store.SetIsMember("sk1", "v2")))
+	assert.Equal(t, 2, ok(store.SetCardinality("sk1")))
 
-	members := store.SetMembers("sk1")
+	members := ok(store.SetMembers("sk1")).([]string)
 	sort.Sort(sort.StringSlice(members))
 
 	expected := []string{"v1", "v2"}
 	sort.Sort(sort.StringSlice(expected))
 	assert.Equal(t, members, expected)
 
-	store.SetRemove("sk1", "v1")
-	assert.False(t, store.SetIsMember("sk1", "v1"))
-	assert.Equal(t, 1, store.SetCardinality("sk1"))
+	assert.NoError(t, store.SetRemove("sk1", "v1"))
+	assert.Equal(t, false, ok(store.SetIsMember("sk1", "v1")))
+	assert.Equal(t, 1, ok(store.SetCardinality("sk1")))
+}
+
+func CheckSetAlgebra(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.SetAdd("sa", "a", "b", "c", "d"))
+	assert.NoError(t, store.SetAdd("sb", "c", "d", "e"))
+	assert.NoError(t, store.SetAdd("sc", "d", "f"))
+	assert.NoError(t, store.Set("str", "v"))
+
+	assert.ElementsMatch(t, []string{"d"}, ok(store.SetIntersect("sa", "sb", "sc")))
+	assert.ElementsMatch(t, []string{}, ok(store.SetIntersect("sa", "missing")))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e", "f"}, ok(store.SetUnion("sa", "sb", "sc", "missing")))
+	assert.ElementsMatch(t, []string{"a", "b"}, ok(store.SetDifference("sa", "sb", "sc")))
+	assert.ElementsMatch(t, []string{}, ok(store.SetDifference("missing", "sa")))
+	assert.Equal(t, ErrWrongType, failure(store.SetUnion("sa", "str")))
+
+	assert.Equal(t, 2, ok(store.SetIntersectStore("dest", "sa", "sb")))
+	assert.ElementsMatch(t, []string{"c", "d"}, ok(store.SetMembers("dest")))
+	assert.Equal(t, 6, ok(store.SetUnionStore("dest", "dest", "sa", "sb", "sc")))
+	assert.Equal(t, 6, ok(store.SetCardinality("dest")))
+	assert.Equal(t, 0, ok(store.SetDifferenceStore("dest", "sa", "dest")))
+	assert.Equal(t, typeNone, ok(store.Type("dest")))
+	assert.Equal(t, 2, ok(store.SetUnionStore("str", "sc", "sc")))
+	assert.Equal(t, 0, ok(store.SetIntersectStore("str", "sa", "missing")))
+	assert.Equal(t, typeNone, ok(store.Type("str")))
+	assert.NoError(t, store.Set("str", "v"))
+	assert.Equal(t, ErrWrongType, failure(store.SetIntersectStore("dest", "sa", "str")))
+
+	assert.Equal(t, 2, ok(store.SetIntersectCardinality(0, "sa", "sb")))
+	assert.Equal(t, 1, ok(store.SetIntersectCardinality(1, "sa", "sb")))
+	assert.Equal(t, 2, ok(store.SetIntersectCardinality(5, "sa", "sb")))
+	assert.Equal(t, 0, ok(store.SetIntersectCardinality(0, "sa", "missing")))
+	assert.Equal(t, ErrNegativeLimit, failure(store.SetIntersectCardinality(-1, "sa")))
+
+	assert.Equal(t, []bool{true, false, true}, ok(store.SetMultiIsMember("sa", "a", "z", "d")))
+	assert.Equal(t, []bool{false}, ok(store.SetMultiIsMember("missing", "a")))
+	assert.Equal(t, ErrWrongType, failure(store.SetMultiIsMember("str", "a")))
+
+	assert.Equal(t, true, ok(store.SetMove("sa", "sm", "a")))
+	assert.Equal(t, false, ok(store.SetMove("sa", "sm", "a")))
+	assert.Equal(t, true, ok(store.SetMove("sb", "sc", "d")))
+	assert.ElementsMatch(t, []string{"b", "c", "d"}, ok(store.SetMembers("sa")))
+	assert.ElementsMatch(t, []string{"a"}, ok(store.SetMembers("sm")))
+	assert.ElementsMatch(t, []string{"d", "f"}, ok(store.SetMembers("sc")))
+	assert.Equal(t, true, ok(store.SetMove("sm", "sa", "a")))
+	assert.Equal(t, typeNone, ok(store.Type("sm")))
+	assert.Equal(t, ErrWrongType, failure(store.SetMove("sa", "str", "a")))
+	assert.Equal(t, ErrWrongType, failure(store.SetMove("str", "sa", "a")))
+
+	all := []string{"a", "b", "c", "d"}
+	random := ok(store.SetRandomMember("sa", 2)).([]string)
+	assert.Len(t, random, 2)
+	assert.NotEqual(t, random[0], random[1])
+	assert.Subset(t, all, random)
+	assert.ElementsMatch(t, all, ok(store.SetRandomMember("sa", 10)))
+	random = ok(store.SetRandomMember("sa", -10)).([]string)
+	assert.Len(t, random, 10)
+	assert.Subset(t, all, random)
+	assert.Equal(t, []string{}, ok(store.SetRandomMember("sa", 0)))
+	assert.Equal(t, []string{}, ok(store.SetRandomMember("missing", -3)))
+	assert.Equal(t, ErrCountOutOfRange, failure(store.SetRandomMember("sa", math.MinInt64)))
+	assert.Equal(t, ErrCountOutOfRange, failure(store.SetRandomMember("sa", -maxRandomCount-1)))
+	assert.Equal(t, 4, ok(store.SetCardinality("sa")))
+
+	popped := ok(store.SetPop("sa", 3)).([]string)
+	assert.Len(t, popped, 3)
+	assert.Subset(t, all, popped)
+	assert.Equal(t, 1, ok(store.SetCardinality("sa")))
+	assert.Len(t, ok(store.SetPop("sa", 5)), 1)
+	assert.Equal(t, typeNone, ok(store.Type("sa")))
+	assert.Equal(t, []string{}, ok(store.SetPop("sa", 1)))
+	assert.Equal(t, ErrOutOfRange, failure(store.SetPop("sb", -1)))
+	assert.Equal(t, ErrWrongType, failure(store.SetPop("str", 1)))
 }
 
 func CheckHashOperations(t *testing.T, store HashStore) {
-	store.HashSet("hk1", "f1", "v1")
-	assert.Equal(t, "v1", store.HashGet("hk1", "f1"))
-	assert.Equal(t, "", store.HashGet("hk1", "f2"))
-	assert.False(t, store.HashExists("hk1", "f0"))
-	assert.True(t, store.HashExists("hk1", "f1"))
-	assert.False(t, store.HashExists("hk2", "f1"))
-
-	store.HashSet("hm1", "k1", "v1")
-	store.HashSet("hm1", "k2", "v2")
-	assert.Equal(t, []string{"v1", "v2", ""}, store.HashMultiGet("hm1", "k1", "k2", "unknownkey"))
-	assert.Equal(t, []string{"v1", "v2", ""}, store.HashMultiGet("hm1", []string{"k1", "k2", "unknownkey"}...))
-	store.HashMultiSet("hm2", map[string]string{"k1": "v1", "k2": "v2"})
-	assert.Equal(t, "v1", store.HashGet("hm2", "k1"))
-	assert.Equal(t, "v2", store.HashGet("hm2", "k2"))
-	assert.Equal(t, 2, store.HashLength("hm2"))
-
-	assert.Equal(t, 0, store.HashLength("nonexistenthash"))
-	keys := store.HashKeys("hm2")
+	ok := noError(t)
+	assert.NoError(t, store.HashSet("hk1", "f1", "v1"))
+	assert.Equal(t, "v1", ok(store.HashGet("hk1", "f1")))
+	assert.Equal(t, "", ok(store.HashGet("hk1", "f2")))
+	assert.Equal(t, false, ok(store.HashExists("hk1", "f0")))
+	assert.Equal(t, true, ok(store.HashExists("hk1", "f1")))
+	assert.Equal(t, false, ok(store.HashExists("hk2", "f1")))
+
+	assert.NoError(t, store.HashSet("hm1", "k1", "v1"))
+	assert.NoError(t, store.HashSet("hm1", "k2", "v2"))
+	assert.Equal(t, []string{"v1", "v2", ""}, ok(store.HashMultiGet("hm1", "k1", "k2", "unknownkey")))
+	assert.Equal(t, []string{"v1", "v2", ""}, ok(store.HashMultiGet("hm1", []string{"k1", "k2", "unknownkey"}...)))
+	assert.NoError(t, store.HashMultiSet("hm2", map[string]string{"k1": "v1", "k2": "v2"}))
+	assert.Equal(t, "v1", ok(store.HashGet("hm2", "k1")))
+	assert.Equal(t, "v2", ok(store.HashGet("hm2", "k2")))
+	assert.Equal(t, 2, ok(store.HashLength("hm2")))
+
+	assert.Equal(t, 0, ok(store.HashLength("nonexistenthash")))
+	keys := ok(store.HashKeys("hm2")).([]string)
 	sort.Strings(keys)
 	assert.Equal(t, []string{"k1", "k2"}, keys)
-	values := store.HashValues("hm2")
+	values := ok(store.HashValues("hm2")).([]string)
 	sort.Strings(values)
 	assert.Equal(t, []string{"v1", "v2"}, values)
-	assert.Equal(t, 2, store.HashLength("hm2"))
+	assert.Equal(t, 2, ok(store.HashLength("hm2")))
+
+	assert.Equal(t, false, ok(store.HashSetIfExists("hm2", "k3", "v3")))
+	assert.NoError(t, store.HashSet("hm2", "k3", "v3"))
+	assert.Equal(t, true, ok(store.HashSetIfExists("hm2", "k3", "v3.1")))
+	assert.Equal(t, "v3.1", ok(store.HashGet("hm2", "k3")))
+
+	assert.Equal(t, true, ok(store.HashSetIfNotExists("hm2", "k4", "v4")))
+	assert.Equal(t, "v4", ok(store.HashGet("hm2", "k4")))
+	assert.Equal(t, false, ok(store.HashSetIfNotExists("hm2", "k4", "v4.1")))
+	assert.Equal(t, "v4", ok(store.HashGet("hm2", "k4")))
+	assert.Equal(t, 4, ok(store.HashLength("hm2")))
 
-	assert.False(t, store.HashSetIfExists("hm2", "k3", "v3"))
-	store.HashSet("hm2", "k3", "v3")
-	assert.True(t, store.HashSetIfExists("hm2", "k3", "v3.1"))
-	assert.Equal(t, "v3.1", store.HashGet("hm2", "k3"))
+}
 
-	assert.True(t, store.HashSetIfNotExists("hm2", "k4", "v4"))
-	assert.Equal(t, "v4", store.HashGet("hm2", "k4"))
-	assert.False(t, store.HashSetIfNotExists("hm2", "k4", "v4.1"))
-	assert.Equal(t, "v4", store.HashGet("hm2", "k4"))
-	assert.Equal(t, 4, store.HashLength("hm2"))
+func CheckHashEditing(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("he1", map[string]string{"f1": "v1", "f2": "v22", "f3": "v333"}))
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v22", "f3": "v333"}, ok(store.HashGetAll("he1")))
+	assert.Equal(t, map[string]string{}, ok(store.HashGetAll("nonexistenthash")))
+	assert.Equal(t, 3, ok(store.HashStringLength("he1", "f2")))
+	assert.Equal(t, 0, ok(store.HashStringLength("he1", "f9")))
+	assert.Equal(t, 0, ok(store.HashStringLength("nonexistenthash", "f1")))
+
+	assert.Equal(t, 2, ok(store.HashDelete("he1", "f1", "f2", "f9")))
+	assert.Equal(t, 0, ok(store.HashDelete("he1", "f1")))
+	assert.Equal(t, 1, ok(store.HashDelete("he1", "f3")))
+	assert.Equal(t, 0, ok(store.Exists("he1")))
+
+	assert.Equal(t, 5, ok(store.HashIncrementBy("he2", "n", 5)))
+	assert.Equal(t, -5, ok(store.HashIncrementBy("he2", "n", -10)))
+	assert.Equal(t, "-4.5", ok(store.HashIncrementByFloat("he2", "n", 0.5)))
+	assert.Equal(t, ErrHashNotInteger, failure(store.HashIncrementBy("he2", "n", 1)))
+	assert.Equal(t, "5.6", ok(store.HashIncrementByFloat("he2", "f", 5.6)))
+	assert.Equal(t, "5200", ok(store.HashIncrementByFloat("he2", "g", 5.2e3)))
+	assert.NoError(t, store.HashSet("he2", "s", "abc"))
+	assert.Equal(t, ErrHashNotFloat, failure(store.HashIncrementByFloat("he2", "s", 1)))
+	assert.Equal(t, ErrNaNOrInfinity, failure(store.HashIncrementByFloat("he2", "f", math.Inf(1))))
+	assert.NoError(t, store.HashSet("he2", "max", "9223372036854775807"))
+	assert.Equal(t, ErrOverflow, failure(store.HashIncrementBy("he2", "max", 1)))
+	assert.Equal(t, "9223372036854775807", ok(store.HashGet("he2", "max")))
+
+	assert.NoError(t, store.HashMultiSet("he3", map[string]string{"a": "1", "b": "2", "c": "3"}))
+	fields := ok(store.HashRandomField("he3", 5)).([]string)
+	sort.Strings(fields)
+	assert.Equal(t, []string{"a", "b", "c"}, fields)
+	assert.Len(t, ok(store.HashRandomField("he3", -5)), 5)
+	assert.Len(t, ok(store.HashRandomField("he3", 2)), 2)
+	assert.Equal(t, []string{}, ok(store.HashRandomField("nonexistenthash", 1)))
+	for _, field := range ok(store.HashRandomFieldWithValues("he3", -10)).([]HashField) {
+		assert.Equal(t, ok(store.HashGet("he3", field.Field)), field.Value)
+	}
+	assert.Equal(t, ErrCountOutOfRange, failure(store.HashRandomField("he3", math.MinInt64)))
+	assert.Equal(t, ErrCountOutOfRange, failure(store.HashRandomFieldWithValues("he3", -maxRandomCount-1)))
+
+	assert.NoError(t, store.Set("hs", "v"))
+	assert.Equal(t, ErrWrongType, failure(store.HashDelete("hs", "f")))
+	assert.Equal(t, ErrWrongType, failure(store.HashGetAll("hs")))
+	assert.Equal(t, ErrWrongType, failure(store.HashIncrementBy("hs", "f", 1)))
+	assert.Equal(t, ErrWrongType, failure(store.HashRandomField("hs", 1)))
+}
 
+func CheckHashFieldExpiry(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("hx1", map[string]string{"f1": "v1", "f2": "v2", "f3": "v3"}))
+	assert.Equal(t, []int64{-1, -1, -2}, ok(store.HashTTL("hx1", "f1", "f2", "f9")))
+	assert.Equal(t, []int64{-2}, ok(store.HashTTL("nonexistenthash", "f1")))
+	assert.Equal(t, []int64{1, -2}, ok(store.HashExpire("hx1", 100, HashExpireOptions{}, "f1", "f9")))
+	assert.Equal(t, []int64{100, -1}, ok(store.HashTTL("hx1", "f1", "f2")))
+	assert.InDelta(t, 100000, ok(store.HashPTTL("hx1", "f1")).([]int64)[0], 1000)
+	assert.Equal(t, -1, ok(store.TTL("hx1")))
+
+	assert.Equal(t, []int64{0, 1}, ok(store.HashPExpire("hx1", 50000, HashExpireOptions{IfNotExists: true}, "f1", "f2")))
+	assert.Equal(t, []int64{0}, ok(store.HashExpire("hx1", 200, HashExpireOptions{LessThan: true}, "f1")))
+	assert.Equal(t, []int64{1}, ok(store.HashExpire("hx1", 200, HashExpireOptions{GreaterThan: true}, "f1")))
+	assert.Equal(t, []int64{0}, ok(store.HashExpire("hx1", 200, HashExpireOptions{IfExists: true}, "f3")))
+	assert.Equal(t, []int64{0}, ok(store.HashExpire("hx1", 200, HashExpireOptions{GreaterThan: true}, "f3")))
+	assert.Equal(t, []int64{200, 50, -1}, ok(store.HashTTL("hx1", "f1", "f2", "f3")))
+	assert.Equal(t, []int64{1, -1, -2}, ok(store.HashPersist("hx1", "f1", "f3", "f9")))
+	assert.Equal(t, []int64{-1}, ok(store.HashTTL("hx1", "f1")))
+	assert.Equal(t, ErrSyntax, failure(store.HashExpire("hx1", 1, HashExpireOptions{IfExists: true, GreaterThan: true}, "f1")))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.HashExpire("hx1", -1, HashExpireOptions{}, "f1")))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.HashPExpireAt("hx1", maxFieldExpireAt+1, HashExpireOptions{}, "f1")))
+
+	assert.NoError(t, store.HashSet("hx1", "f2", "v22"))
+	assert.Equal(t, []int64{-1}, ok(store.HashTTL("hx1", "f2")))
+	assert.NoError(t, store.HashSet("hx1", "n", "0"))
+	assert.Equal(t, []int64{1}, ok(store.HashExpire("hx1", 100, HashExpireOptions{}, "n")))
+	ok(store.HashIncrementBy("hx1", "n", 1))
+	assert.Equal(t, []int64{100}, ok(store.HashTTL("hx1", "n")))
+	assert.Equal(t, []int64{2}, ok(store.HashExpireAt("hx1", 1, HashExpireOptions{}, "f1")))
+	assert.Equal(t, map[string]string{"f2": "v22", "f3": "v3", "n": "1"}, ok(store.HashGetAll("hx1")))
+	assert.Equal(t, []int64{2, 2, 2}, ok(store.HashPExpireAt("hx1", 1, HashExpireOptions{}, "f2", "f3", "n")))
+	assert.Equal(t, 0, ok(store.Exists("hx1")))
+
+	assert.NoError(t, store.HashMultiSet("hx2", map[string]string{"f1": "v1", "f2": "v2"}))
+	assert.Equal(t, []int64{1}, ok(store.HashPExpire("hx2", 20, HashExpireOptions{}, "f1")))
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, map[string]string{"f2": "v2"}, ok(store.HashGetAll("hx2")))
+	assert.Equal(t, []int64{-2}, ok(store.HashTTL("hx2", "f1")))
+	assert.Equal(t, []int64{1}, ok(store.HashPExpire("hx2", 20, HashExpireOptions{}, "f2")))
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, 0, ok(store.Exists("hx2")))
+
+	assert.NoError(t, store.HashMultiSet("hx3", map[string]string{"f1": "v1", "f2": "v2"}))
+	assert.Equal(t, map[string]string{"f1": "v1"}, ok(store.HashGetWithOptions("hx3", HashFieldOptions{ExpireSeconds: 100}, "f1", "f9")))
+	assert.Equal(t, []int64{100, -1, -2}, ok(store.HashTTL("hx3", "f1", "f2", "f9")))
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, ok(store.HashGetWithOptions("hx3", HashFieldOptions{Persist: true}, "f1", "f2")))
+	assert.Equal(t, []int64{-1, -1}, ok(store.HashTTL("hx3", "f1", "f2")))
+	assert.Equal(t, map[string]string{"f2": "v2"}, ok(store.HashGetWithOptions("hx3", HashFieldOptions{ExpireAt: 1}, "f2")))
+	assert.Equal(t, map[string]string{"f1": "v1"}, ok(store.HashGetAll("hx3")))
+	assert.Equal(t, ErrSyntax, failure(store.HashGetWithOptions("hx3", HashFieldOptions{KeepTTL: true}, "f1")))
+
+	assert.Equal(t, true, ok(store.HashSetWithOptions("hx3", map[string]string{"f1": "v11", "f2": "v2"}, HashFieldOptions{ExpireMilliseconds: 50000})))
+	assert.Equal(t, []int64{50, 50}, ok(store.HashTTL("hx3", "f1", "f2")))
+	assert.Equal(t, true, ok(store.HashSetWithOptions("hx3", map[string]string{"f1": "v111"}, HashFieldOptions{KeepTTL: true})))
+	assert.Equal(t, []int64{50}, ok(store.HashTTL("hx3", "f1")))
+	assert.Equal(t, true, ok(store.HashSetWithOptions("hx3", map[string]string{"f1": "v1"}, HashFieldOptions{})))
+	assert.Equal(t, []int64{-1, 50}, ok(store.HashTTL("hx3", "f1", "f2")))
+	assert.Equal(t, false, ok(store.HashSetWithOptions("hx3", map[string]string{"f1": "x", "f3": "x"}, HashFieldOptions{IfExists: true})))
+	assert.Equal(t, false, ok(store.HashSetWithOptions("hx3", map[string]string{"f1": "x", "f3": "x"}, HashFieldOptions{IfNotExists: true})))
+	assert.Equal(t, true, ok(store.HashSetWithOptions("hx3", map[string]string{"f3": "v3"}, HashFieldOptions{IfNotExists: true, ExpireAtMilliseconds: 1})))
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, ok(store.HashGetAll("hx3")))
+	assert.Equal(t, ErrSyntax, failure(store.HashSetWithOptions("hx3", map[string]string{"f1": "v1"}, HashFieldOptions{Persist: true})))
+	assert.Equal(t, ErrSyntax, failure(store.HashSetWithOptions("hx3", map[string]string{"f1": "v1"}, HashFieldOptions{ExpireSeconds: 1, KeepTTL: true})))
+
+	assert.NoError(t, store.Rename("hx3", "hx4"))
+	assert.Equal(t, []int64{-1, 50}, ok(store.HashTTL("hx4", "f1", "f2")))
+	assert.Equal(t, true, ok(store.Copy("hx4", "hx5", false)))
+	assert.Equal(t, []int64{50}, ok(store.HashTTL("hx5", "f2")))
+	assert.Equal(t, 1, ok(store.HashDelete("hx5", "f2")))
+	assert.NoError(t, store.HashSet("hx5", "f2", "v2"))
+	assert.Equal(t, []int64{-1}, ok(store.HashTTL("hx5", "f2")))
+
+	assert.NoError(t, store.Set("hxs", "v"))
+	assert.Equal(t, ErrWrongType, failure(store.HashExpire("hxs", 1, HashExpireOptions{}, "f")))
+	assert.Equal(t, ErrWrongType, failure(store.HashTTL("hxs", "f")))
+	assert.Equal(t, ErrWrongType, failure(store.HashPersist("hxs", "f")))
 }
 
 func CheckListOperations(t *testing.T, store ListStore) {
-	assert.Equal(t, 1, store.ListRightPush("lk1", "lv1"))
-	assert.Equal(t, 1, store.ListLength("lk1"))
-	assert.Equal(t, 3, store.ListRightPush("lk1", "lv2", "lv3"))
-	assert.Equal(t, 3, store.ListLength("lk1"))
-
-	assert.Equal(t, []string{"lv1"}, store.ListRange("lk1", 0, 0))
-	assert.Equal(t, []string{"lv1", "lv2"}, store.ListRange("lk1", 0, 1))
-	assert.Equal(t, []string{"lv2", "lv3"}, store.ListRange("lk1", 1, 10))
-
-	assert.Equal(t, []string{"lv1", "lv2", "lv3"}, store.ListRange("lk1", -3, 2))
-	assert.Equal(t, []string{"lv1", "lv2", "lv3"}, store.ListRange("lk1", -100, 100))
-	assert.Equal(t, []string{}, store.ListRange("lk1", 5, 10))
-
-	assert.Equal(t, []string{"lv1", "lv2", "lv3"}, store.ListRange("lk1", 0, -1))
-	assert.Equal(t, []string{"lv1", "lv2"}, store.ListRange("lk1", 0, -2))
-	assert.Equal(t, []string{}, store.ListRange("lk1", 0, -20))
-	assert.Equal(t, []string{}, store.ListRange("lk1", -10, -20))
-
-	assert.Equal(t, 4, store.ListLeftPush("lk1", "lv0"))
-	assert.Equal(t, 4, store.ListLength("lk1"))
-	assert.Equal(t, []string{"lv0", "lv1", "lv2", "lv3"}, store.ListRange("lk1", 0, 10))
-	assert.Equal(t, 6, store.ListLeftPush("lk1", "lv-1", "lv-2"))
-	assert.Equal(t, []string{"lv-2", "lv-1", "lv0", "lv1", "lv2", "lv3"}, store.ListRange("lk1", 0, 10))
-
-	assert.Equal(t, "lv-2", store.ListLeftPop("lk1"))
-	assert.Equal(t, 5, store.ListLength("lk1"))
-	assert.Equal(t, []string{"lv-1", "lv0", "lv1", "lv2", "lv3"}, store.ListRange("lk1", 0, 10))
-
-	assert.Equal(t, "lv3", store.ListRightPop("lk1"))
-	assert.Equal(t, 4, store.ListLength("lk1"))
-	assert.Equal(t, []string{"lv-1", "lv0", "lv1", "lv2"}, store.ListRange("lk1", 0, 10))
-
-	assert.False(t, store.ListSet("lk1", 34, "outofrange"))
-	assert.Equal(t, []string{"lv-1", "lv0", "lv1", "lv2"}, store.ListRange("lk1", 0, 10))
-	assert.True(t, store.ListSet("lk1", 0, "lv-1.2"))
-	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2"}, store.ListRange("lk1", 0, 10))
-	assert.False(t, store.ListSet("lk1", 4, "lv-1.2"))
-	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2"}, store.ListRange("lk1", 0, 10))
-	assert.True(t, store.ListSet("lk1", -1, "lv2.2"))
-	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2.2"}, store.ListRange("lk1", 0, 10))
-
-	assert.False(t, store.ListSet("lk1", -5, "oob"))
-	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2.2"}, store.ListRange("lk1", 0, 10))
-	assert.Equal(t, "lv-1.2", store.ListIndex("lk1", 0))
-	assert.Equal(t, "lv0", store.ListIndex("lk1", 1))
-	assert.Equal(t, "lv2.2", store.ListIndex("lk1", -1))
-	assert.Equal(t, "", store.ListIndex("lk1", -10))
-
-	store.ListTrim("lk1", 1, -2)
-	assert.Equal(t, []string{"lv0", "lv1"}, store.ListRange("lk1", 0, 10))
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.ListRightPush("lk1", "lv1")))
+	assert.Equal(t, 1, ok(store.ListLength("lk1")))
+	assert.Equal(t, 3, ok(store.ListRightPush("lk1", "lv2", "lv3")))
+	assert.Equal(t, 3, ok(store.ListLength("lk1")))
+
+	assert.Equal(t, []string{"lv1"}, ok(store.ListRange("lk1", 0, 0)))
+	assert.Equal(t, []string{"lv1", "lv2"}, ok(store.ListRange("lk1", 0, 1)))
+	assert.Equal(t, []string{"lv2", "lv3"}, ok(store.ListRange("lk1", 1, 10)))
+
+	assert.Equal(t, []string{"lv1", "lv2", "lv3"}, ok(store.ListRange("lk1", -3, 2)))
+	assert.Equal(t, []string{"lv1", "lv2", "lv3"}, ok(store.ListRange("lk1", -100, 100)))
+	assert.Equal(t, []string{}, ok(store.ListRange("lk1", 5, 10)))
+
+	assert.Equal(t, []string{"lv1", "lv2", "lv3"}, ok(store.ListRange("lk1", 0, -1)))
+	assert.Equal(t, []string{"lv1", "lv2"}, ok(store.ListRange("lk1", 0, -2)))
+	assert.Equal(t, []string{}, ok(store.ListRange("lk1", 0, -20)))
+	assert.Equal(t, []string{}, ok(store.ListRange("lk1", -10, -20)))
+
+	assert.Equal(t, 4, ok(store.ListLeftPush("lk1", "lv0")))
+	assert.Equal(t, 4, ok(store.ListLength("lk1")))
+	assert.Equal(t, []string{"lv0", "lv1", "lv2", "lv3"}, ok(store.ListRange("lk1", 0, 10)))
+	assert.Equal(t, 6, ok(store.ListLeftPush("lk1", "lv-1", "lv-2")))
+	assert.Equal(t, []string{"lv-2", "lv-1", "lv0", "lv1", "lv2", "lv3"}, ok(store.ListRange("lk1", 0, 10)))
+
+	assert.Equal(t, "lv-2", ok(store.ListLeftPop("lk1")))
+	assert.Equal(t, 5, ok(store.ListLength("lk1")))
+	assert.Equal(t, []string{"lv-1", "lv0", "lv1", "lv2", "lv3"}, ok(store.ListRange("lk1", 0, 10)))
+
+	assert.Equal(t, "lv3", ok(store.ListRightPop("lk1")))
+	assert.Equal(t, 4, ok(store.ListLength("lk1")))
+	assert.Equal(t, []string{"lv-1", "lv0", "lv1", "lv2"}, ok(store.ListRange("lk1", 0, 10)))
+
+	assert.Equal(t, ErrOutOfRange, store.ListSet("lk1", 34, "outofrange"))
+	assert.Equal(t, []string{"lv-1", "lv0", "lv1", "lv2"}, ok(store.ListRange("lk1", 0, 10)))
+	assert.NoError(t, store.ListSet("lk1", 0, "lv-1.2"))
+	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2"}, ok(store.ListRange("lk1", 0, 10)))
+	assert.Equal(t, ErrOutOfRange, store.ListSet("lk1", 4, "lv-1.2"))
+	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2"}, ok(store.ListRange("lk1", 0, 10)))
+	assert.NoError(t, store.ListSet("lk1", -1, "lv2.2"))
+	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2.2"}, ok(store.ListRange("lk1", 0, 10)))
+
+	assert.Equal(t, ErrOutOfRange, store.ListSet("lk1", -5, "oob"))
+	assert.Equal(t, []string{"lv-1.2", "lv0", "lv1", "lv2.2"}, ok(store.ListRange("lk1", 0, 10)))
+	assert.Equal(t, "lv-1.2", ok(store.ListIndex("lk1", 0)))
+	assert.Equal(t, "lv0", ok(store.ListIndex("lk1", 1)))
+	assert.Equal(t, "lv2.2", ok(store.ListIndex("lk1", -1)))
+	assert.Equal(t, "", ok(store.ListIndex("lk1", -10)))
+
+	assert.NoError(t, store.ListTrim("lk1", 1, -2))
+	assert.Equal(t, []string{"lv0", "lv1"}, ok(store.ListRange("lk1", 0, 10)))
+
+	assert.Equal(t, "lv0", ok(store.ListLeftPop("lk1")))
+	assert.Equal(t, "lv1", ok(store.ListRightPop("lk1")))
+	assert.Equal(t, ErrNoSuchKey, failure(store.ListLeftPop("lk1")))
+	assert.Equal(t, ErrNoSuchKey, failure(store.ListRightPop("lk1")))
+	assert.Equal(t, ErrNoSuchKey, store.ListSet("lk1", 0, "v"))
+
+}
 
+func CheckListEditing(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.Equal(t, 0, ok(store.ListRightPushIfExists("le", "a")))
+	assert.Equal(t, 0, ok(store.ListLeftPushIfExists("le", "a")))
+	assert.Equal(t, 0, ok(store.Exists("le")))
+	assert.Equal(t, 0, ok(store.ListInsertBefore("le", "a", "b")))
+	assert.Equal(t, 0, ok(store.ListRemove("le", 0, "a")))
+	assert.Equal(t, []int64{}, ok(store.ListPosition("le", "a", ListPositionOptions{})))
+	assert.Equal(t, ErrNoSuchKey, failure(store.ListLeftPopCount("le", 2)))
+	_, _, err := store.ListMultiPop(ListLeft, 1, "le", "le2")
+	assert.Equal(t, ErrNoSuchKey, err)
+
+	assert.Equal(t, 3, ok(store.ListRightPush("le", "a", "b", "a")))
+	assert.Equal(t, 5, ok(store.ListRightPushIfExists("le", "c", "a")))
+	assert.Equal(t, 6, ok(store.ListLeftPushIfExists("le", "z")))
+	assert.Equal(t, []string{"z", "a", "b", "a", "c", "a"}, ok(store.ListRange("le", 0, -1)))
+
+	assert.Equal(t, 7, ok(store.ListInsertBefore("le", "a", "x")))
+	assert.Equal(t, 8, ok(store.ListInsertAfter("le", "c", "y")))
+	assert.Equal(t, -1, ok(store.ListInsertAfter("le", "missing", "y")))
+	assert.Equal(t, []string{"z", "x", "a", "b", "a", "c", "y", "a"}, ok(store.ListRange("le", 0, -1)))
+
+	assert.Equal(t, []int64{2, 4, 7}, ok(store.ListPosition("le", "a", ListPositionOptions{})))
+	assert.Equal(t, []int64{2}, ok(store.ListPosition("le", "a", ListPositionOptions{Count: 1})))
+	assert.Equal(t, []int64{4, 7}, ok(store.ListPosition("le", "a", ListPositionOptions{Rank: 2})))
+	assert.Equal(t, []int64{4, 2}, ok(store.ListPosition("le", "a", ListPositionOptions{Rank: -2})))
+	assert.Equal(t, []int64{2, 4}, ok(store.ListPosition("le", "a", ListPositionOptions{MaxLen: 5})))
+	assert.Equal(t, []int64{7}, ok(store.ListPosition("le", "a", ListPositionOptions{Rank: -1, MaxLen: 1})))
+	assert.Equal(t, []int64{}, ok(store.ListPosition("le", "a", ListPositionOptions{Rank: 4})))
+	assert.Equal(t, ErrNegativeCount, failure(store.ListPosition("le", "a", ListPositionOptions{Count: -1})))
+	assert.Equal(t, ErrNegativeMaxLen, failure(store.ListPosition("le", "a", ListPositionOptions{MaxLen: -1})))
+
+	assert.Equal(t, 1, ok(store.ListRemove("le", -1, "a")))
+	assert.Equal(t, []string{"z", "x", "a", "b", "a", "c", "y"}, ok(store.ListRange("le", 0, -1)))
+	assert.Equal(t, 1, ok(store.ListRemove("le", 1, "a")))
+	assert.Equal(t, []string{"z", "x", "b", "a", "c", "y"}, ok(store.ListRange("le", 0, -1)))
+	assert.Equal(t, 0, ok(store.ListRemove("le", 0, "missing")))
+
+	assert.Equal(t, []string{}, ok(store.ListLeftPopCount("le", 0)))
+	assert.Equal(t, []string{"z", "x"}, ok(store.ListLeftPopCount("le", 2)))
+	assert.Equal(t, []string{"y", "c"}, ok(store.ListRightPopCount("le", 2)))
+	assert.Equal(t, ErrOutOfRange, failure(store.ListRightPopCount("le", -1)))
+
+	assert.Equal(t, 2, ok(store.ListRightPush("le2", "m", "n")))
+	key, items, err := store.ListMultiPop(ListRight, 5, "missing", "le2", "le")
+	assert.NoError(t, err)
+	assert.Equal(t, "le2", key)
+	assert.Equal(t, []string{"n", "m"}, items)
+	assert.Equal(t, 0, ok(store.Exists("le2")))
+	key, items, err = store.ListMultiPop(ListLeft, 1, "le2", "le")
+	assert.NoError(t, err)
+	assert.Equal(t, "le", key)
+	assert.Equal(t, []string{"b"}, items)
+	_, _, err = store.ListMultiPop(ListLeft, 0, "le")
+	assert.Equal(t, ErrOutOfRange, err)
+
+	assert.Equal(t, 1, ok(store.ListRemove("le", 0, "a")))
+	assert.Equal(t, 0, ok(store.Exists("le")))
+
+	assert.NoError(t, store.Set("str", "v"))
+	assert.Equal(t, ErrWrongType, failure(store.ListInsertBefore("str", "a", "b")))
+	assert.Equal(t, ErrWrongType, failure(store.ListRemove("str", 0, "a")))
+	assert.Equal(t, ErrWrongType, failure(store.ListPosition("str", "a", ListPositionOptions{})))
+	assert.Equal(t, ErrWrongType, failure(store.ListLeftPushIfExists("str", "a")))
+	assert.Equal(t, ErrWrongType, failure(store.ListLeftPopCount("str", 1)))
+	_, _, err = store.ListMultiPop(ListLeft, 1, "missing", "str")
+	assert.Equal(t, ErrWrongType, err)
+}
+
+func CheckBlockingListOperations(t *testing.T, store Store) {
+	ok := noError(t)
+	ctx := context.Background()
+	assert.Equal(t, 3, ok(store.ListRightPush("bl1", "a", "b", "c")))
+	assert.Equal(t, "c", ok(store.ListMove("bl1", "bl2", ListRight, ListLeft)))
+	assert.Equal(t, "a", ok(store.ListMove("bl1", "bl1", ListLeft, ListRight)))
+	assert.Equal(t, []string{"b", "a"}, ok(store.ListRange("bl1", 0, -1)))
+	assert.Equal(t, ErrNoSuchKey, failure(store.ListMove("missing", "bl2", ListLeft, ListLeft)))
+	assert.NoError(t, store.Set("str", "v"))
+	assert.Equal(t, ErrWrongType, failure(store.ListMove("bl1", "str", ListLeft, ListLeft)))
+
+	key, value, err := store.ListBlockingLeftPop(ctx, time.Second, "missing", "bl2", "bl1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bl2", "c"}, []string{key, value})
+	key, value, err = store.ListBlockingRightPop(ctx, time.Second, "bl2", "bl1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bl1", "a"}, []string{key, value})
+	_, _, err = store.ListBlockingLeftPop(ctx, 10*time.Millisecond, "missing")
+	assert.Equal(t, ErrNoSuchKey, err)
+	_, _, err = store.ListBlockingLeftPop(ctx, -time.Second, "bl1")
+	assert.Equal(t, ErrNegativeTimeout, err)
+	_, _, err = store.ListBlockingLeftPop(ctx, time.Second, "str", "bl1")
+	assert.Equal(t, ErrWrongType, err)
+	assert.Equal(t, "b", ok(store.ListBlockingMove(ctx, time.Second, "bl1", "bl3", ListLeft, ListRight)))
+	assert.Equal(t, typeNone, ok(store.Type("bl1")))
+	assert.Equal(t, ErrNoSuchKey, failure(store.ListBlockingMove(ctx, 10*time.Millisecond, "bl1", "bl3", ListLeft, ListRight)))
+
+	popped := make(chan string)
+	go func() {
+		_, value, err := store.ListBlockingLeftPop(ctx, 5*time.Second, "queue")
+		assert.NoError(t, err)
+		popped <- value
+	}()
+	moved := make(chan string)
+	go func() {
+		value, err := store.ListBlockingMove(ctx, 5*time.Second, "pending", "queue", ListRight, ListLeft)
+		assert.NoError(t, err)
+		moved <- value
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ok(store.ListLeftPush("pending", "job"))
+	assert.Equal(t, "job", <-moved)
+	assert.Equal(t, "job", <-popped)
+	assert.Equal(t, 0, ok(store.Exists("pending", "queue")))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err = store.ListBlockingLeftPop(cancelled, 0, "queue")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func CheckSortedSetOperations(t *testing.T, store Store) {
+	ok := noError(t)
+	none := SortedSetAddOptions{}
+	assert.Equal(t, 0, ok(store.SortedSetCardinality("z1")))
+	assert.Equal(t, []ScoredMember{}, ok(store.SortedSetRange("z1", everything())))
+	assert.Equal(t, 0, ok(store.SortedSetAdd("z1", SortedSetAddOptions{IfExists: true}, ScoredMember{"a", 1})))
+	assert.Equal(t, "none", ok(store.Type("z1")))
+
+	assert.Equal(t, 3, ok(store.SortedSetAdd("z1", none, ScoredMember{"a", 1}, ScoredMember{"b", 2}, ScoredMember{"c", 3})))
+	assert.Equal(t, "zset", ok(store.Type("z1")))
+	assert.Equal(t, 0, ok(store.SortedSetAdd("z1", none, ScoredMember{"a", 10})))
+	assert.Equal(t, 1, ok(store.SortedSetAdd("z1", SortedSetAddOptions{Changed: true}, ScoredMember{"a", 1}, ScoredMember{"b", 2})))
+	assert.Equal(t, 1, ok(store.SortedSetAdd("z1", SortedSetAddOptions{IfNotExists: true}, ScoredMember{"a", 5}, ScoredMember{"d", 4})))
+	assert.Equal(t, 0, ok(store.SortedSetAdd("z1", SortedSetAddOptions{IfExists: true}, ScoredMember{"a", 0.5}, ScoredMember{"e", 5})))
+	assert.Equal(t, 1, ok(store.SortedSetAdd("z1", SortedSetAddOptions{GreaterThan: true, Changed: true}, ScoredMember{"a", 0}, ScoredMember{"b", 2.5})))
+	assert.Equal(t, 2, ok(store.SortedSetAdd("z1", SortedSetAddOptions{LessThan: true, Changed: true}, ScoredMember{"c", 3.5}, ScoredMember{"d", -1}, ScoredMember{"e", 5})))
+	assert.Equal(t, []ScoredMember{{"d", -1}, {"a", 0.5}, {"b", 2.5}, {"c", 3}, {"e", 5}}, ok(store.SortedSetRange("z1", everything())))
+
+	assert.Equal(t, ErrSyntax, failure(store.SortedSetAdd("z1", SortedSetAddOptions{IfExists: true, IfNotExists: true}, ScoredMember{"a", 1})))
+	assert.Equal(t, ErrSyntax, failure(store.SortedSetAdd("z1", SortedSetAddOptions{GreaterThan: true, LessThan: true}, ScoredMember{"a", 1})))
+	assert.Equal(t, ErrSyntax, failure(store.SortedSetAdd("z1", SortedSetAddOptions{IfNotExists: true, GreaterThan: true}, ScoredMember{"a", 1})))
+	assert.Equal(t, ErrNotFloat, failure(store.SortedSetAdd("z1", none, ScoredMember{"a", 1}, ScoredMember{"f", math.NaN()})))
+	assert.Equal(t, 5, ok(store.SortedSetCardinality("z1")))
+
+	score, applied, err := store.SortedSetAddIncrement("z1", SortedSetAddOptions{IfNotExists: true}, "a", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, false, applied)
+	score, applied, err = store.SortedSetAddIncrement("z1", SortedSetAddOptions{GreaterThan: true}, "a", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, false, applied)
+	score, applied, err = store.SortedSetAddIncrement("z1", SortedSetAddOptions{IfExists: true}, "a", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, true, applied)
+	assert.Equal(t, 1.5, score)
+	assert.Equal(t, 2.0, ok(store.SortedSetIncrementBy("z1", "f", 2)))
+	assert.Equal(t, math.Inf(1), ok(store.SortedSetIncrementBy("z1", "f", math.Inf(1))))
+	assert.Equal(t, ErrScoreNaN, failure(store.SortedSetIncrementBy("z1", "f", math.Inf(-1))))
+	score, found, err := store.SortedSetScore("z1", "f")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, math.Inf(1), score)
+	_, found, err = store.SortedSetScore("z1", "g")
+	assert.NoError(t, err)
+	assert.Equal(t, false, found)
+
+	assert.Equal(t, 6, ok(store.SortedSetCount("z1", "-inf", "inf")))
+	assert.Equal(t, 3, ok(store.SortedSetCount("z1", "1.5", "(5")))
+	assert.Equal(t, 0, ok(store.SortedSetCount("z1", "(5", "5")))
+	assert.Equal(t, 0, ok(store.SortedSetCount("z1", "10", "1")))
+	assert.Equal(t, ErrMinMaxNotFloat, failure(store.SortedSetCount("z1", "one", "5")))
+
+	rank, found, err := store.SortedSetRank("z1", "e")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 4, rank)
+	rank, found, err = store.SortedSetReverseRank("z1", "e")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 1, rank)
+
+	assert.Equal(t, []ScoredMember{{"f", math.Inf(1)}, {"e", 5}}, ok(store.SortedSetRange("z1", SortedSetRange{Start: "0", Stop: "1", Reverse: true})))
+	assert.Equal(t, []ScoredMember{{"b", 2.5}, {"c", 3}}, ok(store.SortedSetRange("z1", SortedSetRange{Start: "1.5", Stop: "(5", ByScore: true, Limit: &RangeLimit{1, -1}})))
+	assert.Equal(t, []ScoredMember{{"c", 3}, {"b", 2.5}}, ok(store.SortedSetRange("z1", SortedSetRange{Start: "(5", Stop: "-inf", ByScore: true, Reverse: true, Limit: &RangeLimit{0, 2}})))
+	assert.Equal(t, []ScoredMember{}, ok(store.SortedSetRange("z1", SortedSetRange{Start: "-inf", Stop: "+inf", ByScore: true, Limit: &RangeLimit{10, 2}})))
+	assert.Equal(t, ErrSyntax, failure(store.SortedSetRange("z1", SortedSetRange{Start: "0", Stop: "1", Limit: &RangeLimit{0, 1}})))
+	assert.Equal(t, ErrSyntax, failure(store.SortedSetRange("z1", SortedSetRange{Start: "0", Stop: "1", ByScore: true, ByLex: true})))
+	assert.Equal(t, ErrNotInteger, failure(store.SortedSetRange("z1", SortedSetRange{Start: "a", Stop: "1"})))
+	assert.Equal(t, ErrLexRange, failure(store.SortedSetRange("z1", SortedSetRange{Start: "a", Stop: "+", ByLex: true})))
+
+	assert.Equal(t, 2, ok(store.SortedSetRemove("z1", "d", "f", "g")))
+	assert.Equal(t, []ScoredMember{{"a", 1.5}, {"b", 2.5}}, ok(store.SortedSetPopMin("z1", 2)))
+	assert.Equal(t, []ScoredMember{{"e", 5}}, ok(store.SortedSetPopMax("z1", 1)))
+	assert.Equal(t, []ScoredMember{}, ok(store.SortedSetPopMax("z1", 0)))
+	assert.Equal(t, ErrOutOfRange, failure(store.SortedSetPopMin("z1", -1)))
+	assert.Equal(t, []ScoredMember{{"c", 3}}, ok(store.SortedSetPopMax("z1", 5)))
+	assert.Equal(t, "none", ok(store.Type("z1")))
+	assert.Equal(t, []ScoredMember{}, ok(store.SortedSetPopMin("z1", 1)))
+
+	assert.Equal(t, 3, ok(store.SortedSetAdd("z2", none, ScoredMember{"x", 1}, ScoredMember{"y", 2}, ScoredMember{"z", 3})))
+	assert.NoError(t, store.Set("s1", "v"))
+	assert.Equal(t, 2, ok(store.SortedSetRangeStore("s1", "z2", SortedSetRange{Start: "2", Stop: "+inf", ByScore: true})))
+	assert.Equal(t, "zset", ok(store.Type("s1")))
+	assert.Equal(t, 0, ok(store.SortedSetRangeStore("s1", "z2", SortedSetRange{Start: "5", Stop: "10"})))
+	assert.Equal(t, "none", ok(store.Type("s1")))
+	assert.Equal(t, 1, ok(store.SortedSetRangeStore("z2", "z2", SortedSetRange{Start: "-1", Stop: "-1"})))
+	assert.Equal(t, true, ok(store.Copy("z2", "z3", false)))
+	assert.Equal(t, 1, ok(store.SortedSetAdd("z3", none, ScoredMember{"w", 0})))
+	assert.Equal(t, []ScoredMember{{"z", 3}}, ok(store.SortedSetRange("z2", everything())))
+
+	assert.NoError(t, store.Set("k1", "v"))
+	assert.Equal(t, ErrWrongType, failure(store.SortedSetAdd("k1", none)))
+	assert.Equal(t, ErrWrongType, failure(store.SortedSetCardinality("k1")))
+	assert.Equal(t, ErrWrongType, failure(store.SortedSetRangeStore("z4", "k1", everything())))
+	assert.Equal(t, ErrWrongType, failure(store.SetMembers("z2")))
+}
+
+func CheckKeyspace(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.Equal(t, "none", ok(store.Type("k")))
+	assert.NoError(t, store.Set("k", "v"))
+	assert.Equal(t, "string", ok(store.Type("k")))
+	assert.NoError(t, store.SetAdd("s", "m1", "m2"))
+	assert.Equal(t, "set", ok(store.Type("s")))
+	assert.NoError(t, store.HashSet("h", "f", "v"))
+	assert.Equal(t, "hash", ok(store.Type("h")))
+	ok(store.ListRightPush("l", "i1", "i2"))
+	assert.Equal(t, "list", ok(store.Type("l")))
+
+	assert.Equal(t, ErrWrongType, store.SetAdd("k", "m"))
+	assert.Equal(t, ErrWrongType, failure(store.HashGet("s", "f")))
+	assert.Equal(t, ErrWrongType, failure(store.ListRightPush("h", "i")))
+	assert.Equal(t, ErrWrongType, failure(store.Append("l", "v")))
+	assert.Equal(t, ErrWrongType, failure(store.Increment("s")))
+	assert.Equal(t, "v", ok(store.Get("k")))
+	assert.Equal(t, map[string]string{"k": "v"}, ok(store.MultiGet([]string{"k", "s", "h", "l"})))
+
+	assert.Equal(t, 1, ok(store.Exists("l")))
+	assert.Equal(t, false, ok(store.SetIfNotExists("l", "v")))
+	assert.Equal(t, true, ok(store.SetIfExists("l", "v")))
+	assert.Equal(t, "string", ok(store.Type("l")))
+	assert.Equal(t, ErrWrongType, failure(store.ListLength("l")))
+
+	assert.NoError(t, store.SetRemove("s", "m1", "m2"))
+	assert.Equal(t, "none", ok(store.Type("s")))
+	assert.Equal(t, 0, ok(store.Exists("s")))
+	ok(store.ListRightPush("l2", "i1"))
+	ok(store.ListLeftPop("l2"))
+	assert.Equal(t, "none", ok(store.Type("l2")))
+	ok(store.ListRightPush("l3", "i1", "i2"))
+	assert.NoError(t, store.ListTrim("l3", 5, 10))
+	assert.Equal(t, "none", ok(store.Type("l3")))
+	assert.NoError(t, store.ListTrim("l4", 0, -1))
+	assert.Equal(t, "none", ok(store.Type("l4")))
+	assert.NoError(t, store.SetAdd("s2"))
+	assert.Equal(t, "none", ok(store.Type("s2")))
+	assert.Equal(t, 0, ok(store.SetRange("r", 5, "")))
+	assert.Equal(t, "none", ok(store.Type("r")))
+
+	assert.NoError(t, store.Set("h", "overwritten"))
+	assert.Equal(t, "string", ok(store.Type("h")))
+	assert.Equal(t, 0, ok(store.HashLength("h2")))
+	assert.NoError(t, store.MultiSet(map[string]string{"s": "v", "l3": "v"}))
+	assert.Equal(t, "string", ok(store.Type("l3")))
+}
+
+func CheckKeyOperations(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("k1", "v1"))
+	assert.NoError(t, store.SetAdd("s1", "m1", "m2"))
+	assert.NoError(t, store.HashSet("h1", "f1", "v1"))
+	ok(store.ListRightPush("l1", "i1", "i2"))
+
+	assert.Equal(t, 4, ok(store.Exists("k1", "s1", "h1", "l1", "missing")))
+	assert.Equal(t, 2, ok(store.Exists("k1", "k1")))
+	assert.Equal(t, 0, ok(store.Exists()))
+
+	assert.NoError(t, store.Rename("s1", "s2"))
+	assert.Equal(t, "none", ok(store.Type("s1")))
+	members := ok(store.SetMembers("s2")).([]string)
+	sort.Strings(members)
+	assert.Equal(t, []string{"m1", "m2"}, members)
+	assert.NoError(t, store.Rename("s2", "s2"))
+	assert.Equal(t, "set", ok(store.Type("s2")))
+	assert.Equal(t, ErrNoSuchKey, store.Rename("s1", "s3"))
+	assert.NoError(t, store.Rename("l1", "k1"))
+	assert.Equal(t, []string{"i1", "i2"}, ok(store.ListRange("k1", 0, -1)))
+
+	assert.Equal(t, false, ok(store.RenameIfNotExists("k1", "h1")))
+	assert.Equal(t, "list", ok(store.Type("k1")))
+	assert.Equal(t, true, ok(store.RenameIfNotExists("k1", "l1")))
+	assert.Equal(t, 0, ok(store.Exists("k1")))
+	assert.Equal(t, ErrNoSuchKey, failure(store.RenameIfNotExists("k1", "l2")))
+
+	assert.Equal(t, true, ok(store.Copy("h1", "h2", false)))
+	assert.NoError(t, store.HashSet("h2", "f2", "v2"))
+	assert.Equal(t, 1, ok(store.HashLength("h1")))
+	assert.Equal(t, 2, ok(store.HashLength("h2")))
+	assert.Equal(t, false, ok(store.Copy("h1", "h2", false)))
+	assert.Equal(t, true, ok(store.Copy("h1", "h2", true)))
+	assert.Equal(t, 1, ok(store.HashLength("h2")))
+	assert.Equal(t, false, ok(store.Copy("missing", "h3", true)))
+	assert.Equal(t, false, ok(store.Copy("h1", "h1", true)))
+	assert.Equal(t, true, ok(store.Copy("l1", "l2", false)))
+	ok(store.ListRightPop("l2"))
+	assert.Equal(t, []string{"i1", "i2"}, ok(store.ListRange("l1", 0, -1)))
+
+	assert.Equal(t, 2, ok(store.Delete("l1", "h1", "missing")))
+	assert.Equal(t, 0, ok(store.Exists("l1", "h1")))
+	assert.Equal(t, 3, ok(store.Delete("s2", "h2", "l2")))
+
+	assert.Equal(t, ErrNoSuchKey, failure(store.RandomKey()))
+	assert.NoError(t, store.Set("only", "v"))
+	assert.Equal(t, "only", ok(store.RandomKey()))
+}
+
+func CheckExpiry(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("k1", "v1"))
+	assert.Equal(t, -1, ok(store.TTL("k1")))
+	assert.Equal(t, -1, ok(store.PTTL("k1")))
+	assert.Equal(t, -2, ok(store.TTL("missing")))
+	assert.Equal(t, -2, ok(store.PTTL("missing")))
+
+	assert.Equal(t, true, ok(store.Expire("k1", 100)))
+	assert.Equal(t, 100, ok(store.TTL("k1")))
+	assert.InDelta(t, 100000, ok(store.PTTL("k1")), 1000)
+	assert.Equal(t, true, ok(store.Persist("k1")))
+	assert.Equal(t, false, ok(store.Persist("k1")))
+	assert.Equal(t, -1, ok(store.TTL("k1")))
+	assert.Equal(t, false, ok(store.Expire("missing", 100)))
+	assert.Equal(t, false, ok(store.Persist("missing")))
+
+	assert.Equal(t, true, ok(store.PExpire("k1", 50000)))
+	assert.Equal(t, 50, ok(store.TTL("k1")))
+	ok(store.Append("k1", "+"))
+	assert.Equal(t, 50, ok(store.TTL("k1")))
+	assert.NoError(t, store.Rename("k1", "k2"))
+	assert.Equal(t, 50, ok(store.TTL("k2")))
+	assert.Equal(t, true, ok(store.Copy("k2", "k3", false)))
+	assert.Equal(t, 50, ok(store.TTL("k3")))
+	ok(store.GetSet("k3", "v3"))
+	assert.Equal(t, -1, ok(store.TTL("k3")))
+	assert.NoError(t, store.Set("k2", "v2"))
+	assert.Equal(t, -1, ok(store.TTL("k2")))
+
+	assert.NoError(t, store.SetAdd("s1", "m1"))
+	assert.Equal(t, true, ok(store.Expire("s1", 0)))
+	assert.Equal(t, 0, ok(store.Exists("s1")))
+	assert.NoError(t, store.HashSet("h1", "f1", "v1"))
+	assert.Equal(t, true, ok(store.ExpireAt("h1", 1)))
+	assert.Equal(t, "none", ok(store.Type("h1")))
+	ok(store.ListRightPush("l1", "i1"))
+	assert.Equal(t, true, ok(store.PExpireAt("l1", 32503680000000)))
+	assert.Equal(t, true, ok(store.TTL("l1")).(int64) > 0)
+
+	assert.Equal(t, true, ok(store.SetWithOptions("o1", "v1", SetOptions{ExpireSeconds: 100})))
+	assert.Equal(t, 100, ok(store.TTL("o1")))
+	assert.Equal(t, true, ok(store.SetWithOptions("o1", "v2", SetOptions{KeepTTL: true})))
+	assert.Equal(t, "v2", ok(store.Get("o1")))
+	assert.Equal(t, 100, ok(store.TTL("o1")))
+	assert.Equal(t, true, ok(store.SetWithOptions("o1", "v3", SetOptions{ExpireMilliseconds: 20000})))
+	assert.Equal(t, 20, ok(store.TTL("o1")))
+	assert.Equal(t, true, ok(store.SetWithOptions("o1", "v4", SetOptions{})))
+	assert.Equal(t, -1, ok(store.TTL("o1")))
+	assert.Equal(t, true, ok(store.SetWithOptions("o1", "v5", SetOptions{ExpireAt: 1})))
+	assert.Equal(t, 0, ok(store.Exists("o1")))
+	assert.Equal(t, true, ok(store.SetWithOptions("o1", "v6", SetOptions{ExpireAtMilliseconds: 32503680000000})))
+	assert.Equal(t, true, ok(store.TTL("o1")).(int64) > 0)
+
+	assert.Equal(t, false, ok(store.SetWithOptions("o1", "v7", SetOptions{IfNotExists: true})))
+	assert.Equal(t, false, ok(store.SetWithOptions("o2", "v7", SetOptions{IfExists: true})))
+	assert.Equal(t, true, ok(store.SetWithOptions("o2", "v7", SetOptions{IfNotExists: true, ExpireSeconds: 10})))
+	assert.Equal(t, 10, ok(store.TTL("o2")))
+	assert.Equal(t, "v6", ok(store.Get("o1")))
+
+	assert.Equal(t, ErrSyntax, failure(store.SetWithOptions("o3", "v", SetOptions{ExpireSeconds: 1, ExpireMilliseconds: 1})))
+	assert.Equal(t, ErrSyntax, failure(store.SetWithOptions("o3", "v", SetOptions{ExpireSeconds: 1, KeepTTL: true})))
+	assert.Equal(t, ErrSyntax, failure(store.SetWithOptions("o3", "v", SetOptions{IfExists: true, IfNotExists: true})))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.SetWithOptions("o3", "v", SetOptions{ExpireSeconds: -1})))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.SetWithOptions("o3", "v", SetOptions{ExpireSeconds: math.MaxInt64})))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.SetWithOptions("o3", "v", SetOptions{ExpireMilliseconds: math.MaxInt64})))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.SetWithOptions("o3", "v", SetOptions{ExpireAt: math.MaxInt64})))
+	assert.Equal(t, true, ok(store.SetWithOptions("o3", "v", SetOptions{ExpireAtMilliseconds: math.MaxInt64})))
+	assert.Equal(t, true, ok(store.PTTL("o3")).(int64) > 0)
+	assert.Equal(t, 1, ok(store.Delete("o3")))
+
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.Expire("o2", math.MaxInt64)))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.Expire("o2", math.MinInt64)))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.PExpire("o2", math.MaxInt64)))
+	assert.Equal(t, ErrInvalidExpireTime, failure(store.ExpireAt("o2", math.MaxInt64)))
+	assert.Equal(t, 10, ok(store.TTL("o2")))
+	assert.Equal(t, true, ok(store.PExpireAt("o2", math.MaxInt64)))
+	assert.Equal(t, true, ok(store.TTL("o2")).(int64) > 0)
+}
+
+// scanAll follows a scan from cursor 0 until it ends, and returns everything
+// it found in order.
+func scanAll(t *testing.T, scan func(cursor uint64) (uint64, []string, error)) []string {
+	found := []string{}
+	var cursor uint64
+	for {
+		next, page, err := scan(cursor)
+		assert.NoError(t, err)
+		found = append(found, page...)
+		if cursor = next; cursor == 0 || err != nil {
+			sort.Strings(found)
+			return found
+		}
+	}
+}
+
+func CheckScanOperations(t *testing.T, store Store) {
+	ok := noError(t)
+	keys := []string{"h1", "s1"}
+	for i := 0; i < 25; i++ {
+		key := "k" + strconv.Itoa(i)
+		assert.NoError(t, store.Set(key, "v"))
+		keys = append(keys, key)
+	}
+	members := []string{}
+	for i := 0; i < 30; i++ {
+		members = append(members, "m"+strconv.Itoa(i))
+	}
+	assert.NoError(t, store.SetAdd("s1", members...))
+	assert.NoError(t, store.HashMultiSet("h1", map[string]string{"f1": "v1", "f2": "v2", "g1": "v3"}))
+	sort.Strings(keys)
+	sort.Strings(members)
+
+	all := ok(store.Keys("*")).([]string)
+	sort.Strings(all)
+	assert.Equal(t, keys, all)
+	teens := ok(store.Keys("k1?")).([]string)
+	sort.Strings(teens)
+	assert.Equal(t, []string{"k10", "k11", "k12", "k13", "k14", "k15", "k16", "k17", "k18", "k19"}, teens)
+	assert.Equal(t, []string{"s1"}, ok(store.Keys("s[0-9]")))
+	assert.Equal(t, []string{}, ok(store.Keys("missing*")))
+
+	for _, count := range []int64{0, 1, 7, 100} {
+		assert.Equal(t, keys, scanAll(t, func(cursor uint64) (uint64, []string, error) {
+			return store.Scan(cursor, ScanOptions{Count: count})
+		}))
+		assert.Equal(t, members, scanAll(t, func(cursor uint64) (uint64, []string, error) {
+			return store.SetScan("s1", cursor, ScanOptions{Count: count})
+		}))
+	}
+	assert.Equal(t, []string{"k2", "k20", "k21", "k22", "k23", "k24"}, scanAll(t, func(cursor uint64) (uint64, []string, error) {
+		return store.Scan(cursor, ScanOptions{Match: "k2*", Count: 3})
+	}))
+	assert.Equal(t, []string{"h1"}, scanAll(t, func(cursor uint64) (uint64, []string, error) {
+		return store.Scan(cursor, ScanOptions{Type: "hash"})
+	}))
+	assert.Equal(t, []string{"m1", "m10", "m11", "m12", "m13", "m14", "m15", "m16", "m17", "m18", "m19"}, scanAll(t, func(cursor uint64) (uint64, []string, error) {
+		return store.SetScan("s1", cursor, ScanOptions{Match: "m1*", Count: 4})
+	}))
+
+	fields := map[string]string{}
+	var cursor uint64
+	for {
+		next, page, err := store.HashScan("h1", cursor, ScanOptions{Match: "f*", Count: 1})
+		assert.NoError(t, err)
+		for field, value := range page {
+			fields[field] = value
+		}
+		if cursor = next; cursor == 0 || err != nil {
+			break
+		}
+	}
+	assert.Equal(t, map[string]string{"f1": "v1", "f2": "v2"}, fields)
+
+	next, page, err := store.HashScan("missing", 0, ScanOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, next)
+	assert.Empty(t, page)
+	_, _, err = store.SetScan("h1", 0, ScanOptions{})
+	assert.Equal(t, ErrWrongType, err)
+	_, _, err = store.HashScan("s1", 0, ScanOptions{})
+	assert.Equal(t, ErrWrongType, err)
+	_, _, err = store.Scan(0, ScanOptions{Count: -1})
+	assert.Equal(t, ErrSyntax, err)
 }
 
 func RunAllTestsOnStore(t *testing.T, storeGen storeGenerator) {
+	CheckKeyspace(t, storeGen())
+	CheckKeyOperations(t, storeGen())
+	CheckExpiry(t, storeGen())
 	CheckStringOperations(t, storeGen())
 	CheckSetOperations(t, storeGen())
+	CheckSetAlgebra(t, storeGen())
 	CheckHashOperations(t, storeGen())
+	CheckHashEditing(t, storeGen())
+	CheckHashFieldExpiry(t, storeGen())
 	CheckListOperations(t, storeGen())
+	CheckListEditing(t, storeGen())
+	CheckBlockingListOperations(t, storeGen())
+	CheckSortedSetOperations(t, storeGen())
+	CheckScanOperations(t, storeGen())
 }
@@ -0,0 +1,229 @@
+package restis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNegativeTimeout = errors.New("ERR timeout is negative")
+
+// listWaiters queues the callers blocked on each key in the order they
+// arrived. Only the first caller in a key's queue is woken when the key gets
+// items, and it wakes the next one when it leaves, so that callers are served
+// first come, first served however many items arrive at once.
+type listWaiters struct {
+	mu      sync.Mutex
+	waiting int64 // callers in any queue, read atomically to skip the lock
+	queues  map[string][]*listWaiter
+}
+
+type listWaiter struct {
+	keys  []string
+	ready chan struct{}
+}
+
+func (w *listWaiter) wake() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds a caller to the back of the queue of each of keys. If it's
+// first in any of them it's woken straight away, in case items arrived since
+// it last tried; otherwise whoever is ahead of it will wake it.
+func (h *listWaiters) enqueue(keys []string) *listWaiter {
+	w := &listWaiter{ready: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.queues == nil {
+		h.queues = map[string][]*listWaiter{}
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			w.keys = append(w.keys, key)
+			h.queues[key] = append(h.queues[key], w)
+			if len(h.queues[key]) == 1 {
+				w.wake()
+			}
+		}
+	}
+	atomic.AddInt64(&h.waiting, 1)
+	return w
+}
+
+// dequeue removes w from its queues, and wakes whoever is now first in any
+// queue w was first in, since it may have been woken for items that w
+// didn't take.
+func (h *listWaiters) dequeue(w *listWaiter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range w.keys {
+		queue := h.queues[key]
+		for i, waiter := range queue {
+			if waiter != w {
+				continue
+			}
+			queue = append(queue[:i:i], queue[i+1:]...)
+			if i == 0 && len(queue) > 0 {
+				queue[0].wake()
+			}
+			break
+		}
+		if len(queue) == 0 {
+			delete(h.queues, key)
+		} else {
+			h.queues[key] = queue
+		}
+	}
+	atomic.AddInt64(&h.waiting, -1)
+}
+
+// signal wakes the first caller waiting on key, which has just been given
+// items. It's called with the key's shard locked.
+func (h *listWaiters) signal(key string) {
+	if atomic.LoadInt64(&h.waiting) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if queue := h.queues[key]; len(queue) > 0 {
+		queue[0].wake()
+	}
+}
+
+// idle reports whether nobody is waiting on any of keys.
+func (h *listWaiters) idle(keys []string) bool {
+	if atomic.LoadInt64(&h.waiting) == 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range keys {
+		if len(h.queues[key]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// await calls take, and then again whenever one of keys may have items for
+// it, until take gets something or fails. It only calls take straight away
+// when nobody is already waiting on keys, so that a new caller can't jump
+// the queue. It gives up with ErrNoSuchKey once timeout has passed, unless
+// timeout is 0, or when closed is closed, and with ctx's error if ctx ends
+// first.
+func (h *listWaiters) await(ctx context.Context, timeout time.Duration, closed <-chan struct{}, keys []string, take func() (bool, error)) error {
+	if timeout < 0 {
+		return ErrNegativeTimeout
+	}
+	if h.idle(keys) {
+		if took, err := take(); took || err != nil {
+			return err
+		}
+	}
+	w := h.enqueue(keys)
+	defer h.dequeue(w)
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-w.ready:
+			if took, err := take(); took || err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expired:
+			return ErrNoSuchKey
+		case <-closed:
+			return ErrNoSuchKey
+		}
+	}
+}
+
+// takeOnce is how blocking operations run inside a transaction, which holds
+// the store so that nothing could arrive while it waited. Like Redis, they
+// don't block there.
+func takeOnce(timeout time.Duration, take func() (bool, error)) error {
+	if timeout < 0 {
+		return ErrNegativeTimeout
+	}
+	took, err := take()
+	if err == nil && !took {
+		err = ErrNoSuchKey
+	}
+	return err
+}
+
+func (s *MemoryStore) awaitLists(ctx context.Context, timeout time.Duration, keys []string, take func() (bool, error)) error {
+	if s.parent != nil {
+		return takeOnce(timeout, take)
+	}
+	return s.waiters.await(ctx, timeout, s.closed, keys, take)
+}
+
+// ListBlockingLeftPop pops the head of the first of keys that holds a
+// non-empty list, returning that key and the item. If none do, it waits
+// until one does, for up to timeout or without a limit if timeout is 0.
+// Callers waiting on the same key are served in the order they started
+// waiting. It returns ErrNoSuchKey if the wait times out or the store is
+// closed, and ctx's error if ctx is cancelled first.
+func (s *MemoryStore) ListBlockingLeftPop(ctx context.Context, timeout time.Duration, keys ...string) (key, value string, err error) {
+	return s.listBlockingPop(ctx, timeout, keys, ListLeft)
+}
+
+// ListBlockingRightPop is ListBlockingLeftPop from the tail of the list.
+func (s *MemoryStore) ListBlockingRightPop(ctx context.Context, timeout time.Duration, keys ...string) (key, value string, err error) {
+	return s.listBlockingPop(ctx, timeout, keys, ListRight)
+}
+
+func (s *MemoryStore) listBlockingPop(ctx context.Context, timeout time.Duration, keys []string, side ListSide) (key, value string, err error) {
+	err = s.awaitLists(ctx, timeout, keys, func() (popped bool, err error) {
+		var values []string
+		key, values, popped, err = s.listPopFirst(keys, side, 1)
+		if popped {
+			value = values[0]
+		}
+		return popped, err
+	})
+	return key, value, err
+}
+
+// listPopFirst pops up to count items from the first of keys that holds a
+// non-empty list.
+func (s *MemoryStore) listPopFirst(keys []string, side ListSide, count int64) (key string, values []string, popped bool, err error) {
+	defer s.lockKeys(keys)()
+	for _, key := range keys {
+		sh := s.shard(key)
+		if err := sh.expectType(key, typeList); err != nil {
+			return "", nil, false, err
+		}
+		if sh.list(key).length() > 0 {
+			return key, s.listPopN(sh, key, side, count), true, nil
+		}
+	}
+	return "", nil, false, nil
+}
+
+// ListBlockingMove is ListMove, waiting for source to have an item as
+// ListBlockingLeftPop does.
+func (s *MemoryStore) ListBlockingMove(ctx context.Context, timeout time.Duration, source, destination string, from, to ListSide) (value string, err error) {
+	err = s.awaitLists(ctx, timeout, []string{source}, func() (moved bool, err error) {
+		value, err = s.ListMove(source, destination, from, to)
+		if err == ErrNoSuchKey {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	return value, err
+}
@@ -0,0 +1,1401 @@
+// Package client talks to a restis server over HTTP. A Client satisfies
+// restis.Store, so code written against a MemoryStore can switch to a remote
+// server without changes.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sudhirj/restis"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+	DefaultRetries = 2
+)
+
+// keysPageSize is the COUNT Keys asks for on each page of its scan.
+const keysPageSize = 1000
+
+var _ restis.Store = (*Client)(nil)
+
+// errConditionNotMet is what a 412 response turns into, and is reported to
+// callers as a false result rather than an error.
+var errConditionNotMet = errors.New("condition not met")
+
+// storeErrors are recognised by their message in error responses, so that
+// callers can compare against them just as they would with a MemoryStore.
+var storeErrors = []error{
+	restis.ErrWrongType,
+	restis.ErrNotInteger,
+	restis.ErrOverflow,
+	restis.ErrNoSuchKey,
+	restis.ErrOutOfRange,
+	restis.ErrSyntax,
+	restis.ErrInvalidExpireTime,
+	restis.ErrNotFloat,
+	restis.ErrMinMaxNotFloat,
+	restis.ErrLexRange,
+	restis.ErrScoreNaN,
+	restis.ErrInvalidCursor,
+	restis.ErrNegativeLimit,
+	restis.ErrNegativeCount,
+	restis.ErrNegativeMaxLen,
+	restis.ErrCountOutOfRange,
+	restis.ErrNegativeTimeout,
+	restis.ErrHashNotInteger,
+	restis.ErrHashNotFloat,
+	restis.ErrNaNOrInfinity,
+	restis.ErrIncrementNaNOrInfinity,
+	restis.ErrSaveInProgress,
+	restis.ErrSnapshotsDisabled,
+	restis.ErrRewriteInProgress,
+	restis.ErrAppendOnlyDisabled,
+	restis.ErrPubSubDisabled,
+	restis.ErrInvalidKeyspaceEvents,
+	restis.ErrKeyspaceEventsDisabled,
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the pooled HTTP client that New sets up.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTimeout limits how long a single request, including reading the
+// response, may take.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		httpClient := *c.httpClient
+		httpClient.Timeout = timeout
+		c.httpClient = &httpClient
+	}
+}
+
+// WithRetries sets how many times a read is retried after a network error or
+// a 502, 503 or 504 response. Writes are never retried, because they may
+// already have been applied.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// New returns a Client for the restis server at baseURL, like
+// "http://localhost:8080". Connections are pooled and reused across calls,
+// and the Client is safe for concurrent use.
+func New(baseURL string, options ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 256
+	transport.MaxIdleConnsPerHost = 64
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Transport: transport, Timeout: DefaultTimeout},
+		retries:    DefaultRetries,
+		backoff:    50 * time.Millisecond,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+func path(segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// do sends a request and decodes a successful response into result. Error
+// responses come back as the matching restis error, with 404 as
+// restis.ErrNoSuchKey and 412 as errConditionNotMet.
+func (c *Client) do(method, path string, query url.Values, body, result interface{}) error {
+	return c.send(context.Background(), c.httpClient, method, path, query, body, result)
+}
+
+// doWaiting is do for requests the server holds for up to wait, which the
+// client's timeout is extended to allow for. Cancelling ctx abandons the
+// request, which ends the server's wait.
+func (c *Client) doWaiting(ctx context.Context, wait time.Duration, method, path string, query url.Values, body, result interface{}) error {
+	httpClient := *c.httpClient
+	if httpClient.Timeout > 0 && wait >= 0 {
+		if wait == 0 {
+			httpClient.Timeout = 0
+		} else {
+			httpClient.Timeout += wait
+		}
+	}
+	err := c.send(ctx, &httpClient, method, path, query, body, result)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (c *Client) send(ctx context.Context, httpClient *http.Client, method, path string, query url.Values, body, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	idempotent := method == "GET" || method == "HEAD"
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := httpClient.Do(req)
+		retry := idempotent && attempt < c.retries
+		if err != nil {
+			if retry {
+				c.sleep(attempt)
+				continue
+			}
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			if retry {
+				discard(resp)
+				c.sleep(attempt)
+				continue
+			}
+		}
+		return decode(resp, result)
+	}
+}
+
+func (c *Client) sleep(attempt int) {
+	time.Sleep(c.backoff << uint(attempt))
+}
+
+// discard drains the body so the connection can go back to the pool.
+func discard(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func decode(resp *http.Response, result interface{}) error {
+	defer discard(resp)
+	if resp.StatusCode >= 400 {
+		return responseError(resp)
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func responseError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return restis.ErrNoSuchKey
+	case http.StatusPreconditionFailed:
+		return errConditionNotMet
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	for _, err := range storeErrors {
+		if body.Error == err.Error() {
+			return err
+		}
+	}
+	if body.Error == "" {
+		body.Error = resp.Status
+	}
+	return fmt.Errorf("restis: %s (%d)", body.Error, resp.StatusCode)
+}
+
+// found turns a 404 into a false result.
+func found(err error) (bool, error) {
+	if err == restis.ErrNoSuchKey {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// succeeded turns a 412 into a false result.
+func succeeded(err error) (bool, error) {
+	if err == errConditionNotMet {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func keysQuery(keys []string) url.Values {
+	return url.Values{"key": keys}
+}
+
+func rangeQuery(start, stop int64) url.Values {
+	return url.Values{
+		"start": {strconv.FormatInt(start, 10)},
+		"stop":  {strconv.FormatInt(stop, 10)},
+	}
+}
+
+func scanQuery(cursor uint64, options restis.ScanOptions) url.Values {
+	query := url.Values{"cursor": {strconv.FormatUint(cursor, 10)}}
+	if options.Match != "" {
+		query.Set("match", options.Match)
+	}
+	if options.Count != 0 {
+		query.Set("count", strconv.FormatInt(options.Count, 10))
+	}
+	if options.Type != "" {
+		query.Set("type", options.Type)
+	}
+	return query
+}
+
+func (c *Client) Delete(keys ...string) (int64, error) {
+	var body struct {
+		Deleted int64 `json:"deleted"`
+	}
+	err := c.do("DELETE", "/keys", keysQuery(keys), nil, &body)
+	return body.Deleted, err
+}
+
+func (c *Client) Exists(keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		// Without keys the route scans the keyspace instead.
+		return 0, nil
+	}
+	var body struct {
+		Exists int64 `json:"exists"`
+	}
+	err := c.do("GET", "/keys", keysQuery(keys), nil, &body)
+	return body.Exists, err
+}
+
+func (c *Client) Rename(key, newKey string) error {
+	return c.do("POST", path("keys", key, "rename"), nil, map[string]string{"destination": newKey}, nil)
+}
+
+func (c *Client) RenameIfNotExists(key, newKey string) (bool, error) {
+	return succeeded(c.do("POST", path("keys", key, "rename"), url.Values{"if": {"absent"}}, map[string]string{"destination": newKey}, nil))
+}
+
+func (c *Client) Copy(source, destination string, replace bool) (bool, error) {
+	body := map[string]interface{}{"destination": destination, "replace": replace}
+	return succeeded(c.do("POST", path("keys", source, "copy"), nil, body, nil))
+}
+
+func (c *Client) Type(key string) (string, error) {
+	var body struct {
+		Type string `json:"type"`
+	}
+	err := c.do("GET", path("keys", key, "type"), nil, nil, &body)
+	return body.Type, err
+}
+
+func (c *Client) RandomKey() (string, error) {
+	var body struct {
+		Key string `json:"key"`
+	}
+	err := c.do("GET", "/random-key", nil, nil, &body)
+	return body.Key, err
+}
+
+// Keys pages through a scan of the whole keyspace, since the server has no
+// route that lists every key at once.
+func (c *Client) Keys(pattern string) ([]string, error) {
+	keys := []string{}
+	var cursor uint64
+	for {
+		next, page, err := c.Scan(cursor, restis.ScanOptions{Match: pattern, Count: keysPageSize})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if cursor = next; cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+func (c *Client) Scan(cursor uint64, options restis.ScanOptions) (uint64, []string, error) {
+	var body struct {
+		Cursor string   `json:"cursor"`
+		Keys   []string `json:"keys"`
+	}
+	err := c.do("GET", "/keys", scanQuery(cursor, options), nil, &body)
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseUint(body.Cursor, 10, 64)
+	return next, body.Keys, err
+}
+
+func (c *Client) expire(key, field string, value int64) (bool, error) {
+	return found(c.do("PUT", path("keys", key, "expiry"), nil, map[string]int64{field: value}, nil))
+}
+
+func (c *Client) Expire(key string, seconds int64) (bool, error) {
+	return c.expire(key, "seconds", seconds)
+}
+
+func (c *Client) PExpire(key string, milliseconds int64) (bool, error) {
+	return c.expire(key, "milliseconds", milliseconds)
+}
+
+func (c *Client) ExpireAt(key string, timestamp int64) (bool, error) {
+	return c.expire(key, "at", timestamp)
+}
+
+func (c *Client) PExpireAt(key string, timestamp int64) (bool, error) {
+	return c.expire(key, "at_milliseconds", timestamp)
+}
+
+func (c *Client) expiry(key string) (int64, int64, error) {
+	var body struct {
+		TTL  int64 `json:"ttl"`
+		PTTL int64 `json:"pttl"`
+	}
+	err := c.do("GET", path("keys", key, "expiry"), nil, nil, &body)
+	return body.TTL, body.PTTL, err
+}
+
+func (c *Client) TTL(key string) (int64, error) {
+	ttl, _, err := c.expiry(key)
+	return ttl, err
+}
+
+func (c *Client) PTTL(key string) (int64, error) {
+	_, pttl, err := c.expiry(key)
+	return pttl, err
+}
+
+func (c *Client) Persist(key string) (bool, error) {
+	return found(c.do("DELETE", path("keys", key, "expiry"), nil, nil, nil))
+}
+
+func (c *Client) Append(key, value string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("POST", path("strings", key, "append"), nil, map[string]string{"value": value}, &body)
+	return body.Length, err
+}
+
+func (c *Client) Get(key string) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	_, err := found(c.do("GET", path("strings", key), nil, nil, &body))
+	return body.Value, err
+}
+
+func (c *Client) GetRange(key string, start, stop int64) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	err := c.do("GET", path("strings", key, "range"), rangeQuery(start, stop), nil, &body)
+	return body.Value, err
+}
+
+func (c *Client) GetSet(key, value string) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	err := c.do("POST", path("strings", key, "getset"), nil, map[string]string{"value": value}, &body)
+	return body.Value, err
+}
+
+func (c *Client) Set(key string, value string) error {
+	_, err := c.SetWithOptions(key, value, restis.SetOptions{})
+	return err
+}
+
+func (c *Client) SetWithOptions(key string, value string, options restis.SetOptions) (bool, error) {
+	query := url.Values{}
+	switch {
+	case options.IfExists && options.IfNotExists:
+		return false, restis.ErrSyntax
+	case options.IfExists:
+		query.Set("if", "exists")
+	case options.IfNotExists:
+		query.Set("if", "absent")
+	}
+	body := map[string]interface{}{
+		"value":   value,
+		"ex":      options.ExpireSeconds,
+		"px":      options.ExpireMilliseconds,
+		"exat":    options.ExpireAt,
+		"pxat":    options.ExpireAtMilliseconds,
+		"keepttl": options.KeepTTL,
+	}
+	return succeeded(c.do("PUT", path("strings", key), query, body, nil))
+}
+
+func (c *Client) SetIfExists(key string, value string) (bool, error) {
+	return c.SetWithOptions(key, value, restis.SetOptions{IfExists: true})
+}
+
+func (c *Client) SetIfNotExists(key string, value string) (bool, error) {
+	return c.SetWithOptions(key, value, restis.SetOptions{IfNotExists: true})
+}
+
+func (c *Client) MultiGet(keys []string) (map[string]string, error) {
+	var body struct {
+		Values map[string]string `json:"values"`
+	}
+	err := c.do("GET", "/strings", keysQuery(keys), nil, &body)
+	return body.Values, err
+}
+
+func (c *Client) MultiSet(data map[string]string) error {
+	return c.do("POST", "/strings", nil, map[string]interface{}{"values": data}, nil)
+}
+
+func (c *Client) MultiSetIfNotExists(data map[string]string) (bool, error) {
+	return succeeded(c.do("POST", "/strings", url.Values{"if": {"absent"}}, map[string]interface{}{"values": data}, nil))
+}
+
+func (c *Client) Increment(key string) (int64, error) {
+	return c.IncrementBy(key, 1)
+}
+
+func (c *Client) Decrement(key string) (int64, error) {
+	return c.DecrementBy(key, 1)
+}
+
+func (c *Client) IncrementBy(key string, delta int64) (int64, error) {
+	return c.step(key, "increment", delta)
+}
+
+func (c *Client) IncrementByFloat(key string, delta float64) (string, error) {
+	// NaN has no JSON form at all, so it's refused here as the server would.
+	if math.IsNaN(delta) {
+		return "", restis.ErrNaNOrInfinity
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	query := url.Values{"float": {"true"}}
+	err := c.do("POST", path("strings", key, "increment"), query, map[string]score{"by": score(delta)}, &body)
+	return body.Value, err
+}
+
+func (c *Client) DecrementBy(key string, delta int64) (int64, error) {
+	return c.step(key, "decrement", delta)
+}
+
+func (c *Client) step(key, direction string, delta int64) (int64, error) {
+	var body struct {
+		Value int64 `json:"value"`
+	}
+	err := c.do("POST", path("strings", key, direction), nil, map[string]int64{"by": delta}, &body)
+	return body.Value, err
+}
+
+func (c *Client) SetRange(key string, offset int64, value string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("PUT", path("strings", key, "range"), nil, map[string]interface{}{"offset": offset, "value": value}, &body)
+	return body.Length, err
+}
+
+func (c *Client) Length(key string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("GET", path("strings", key, "length"), nil, nil, &body)
+	return body.Length, err
+}
+
+func (c *Client) SetAdd(key string, values ...string) error {
+	return c.do("POST", path("sets", key, "members"), nil, map[string][]string{"members": values}, nil)
+}
+
+func (c *Client) SetRemove(key string, values ...string) error {
+	return c.do("DELETE", path("sets", key, "members"), url.Values{"member": values}, nil, nil)
+}
+
+func (c *Client) SetIsMember(key string, value string) (bool, error) {
+	return found(c.do("GET", path("sets", key, "members", value), nil, nil, nil))
+}
+
+func (c *Client) SetMembers(key string) ([]string, error) {
+	var body struct {
+		Members []string `json:"members"`
+	}
+	err := c.do("GET", path("sets", key, "members"), nil, nil, &body)
+	return body.Members, err
+}
+
+func (c *Client) SetCardinality(key string) (int64, error) {
+	var body struct {
+		Cardinality int64 `json:"cardinality"`
+	}
+	err := c.do("GET", path("sets", key, "cardinality"), nil, nil, &body)
+	return body.Cardinality, err
+}
+
+func (c *Client) SetScan(key string, cursor uint64, options restis.ScanOptions) (uint64, []string, error) {
+	var body struct {
+		Cursor  string   `json:"cursor"`
+		Members []string `json:"members"`
+	}
+	err := c.do("GET", path("sets", key, "members"), scanQuery(cursor, options), nil, &body)
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseUint(body.Cursor, 10, 64)
+	return next, body.Members, err
+}
+
+func (c *Client) SetMultiIsMember(key string, values ...string) ([]bool, error) {
+	if len(values) == 0 {
+		// Without members the route lists the members instead, so only
+		// check the key's type.
+		_, err := c.SetCardinality(key)
+		if err != nil {
+			return nil, err
+		}
+		return []bool{}, nil
+	}
+	var body struct {
+		IsMember []bool `json:"is_member"`
+	}
+	err := c.do("GET", path("sets", key, "members"), url.Values{"member": values}, nil, &body)
+	return body.IsMember, err
+}
+
+func (c *Client) SetMove(source, destination, value string) (bool, error) {
+	return succeeded(c.do("POST", path("sets", source, "members", value, "move"), nil, map[string]string{"destination": destination}, nil))
+}
+
+func (c *Client) SetPop(key string, count int64) ([]string, error) {
+	var body struct {
+		Members []string `json:"members"`
+	}
+	err := c.do("POST", path("sets", key, "pop"), url.Values{"count": {strconv.FormatInt(count, 10)}}, nil, &body)
+	return body.Members, err
+}
+
+func (c *Client) SetRandomMember(key string, count int64) ([]string, error) {
+	var body struct {
+		Members []string `json:"members"`
+	}
+	err := c.do("GET", path("sets", key, "random"), url.Values{"count": {strconv.FormatInt(count, 10)}}, nil, &body)
+	return body.Members, err
+}
+
+func (c *Client) SetIntersect(keys ...string) ([]string, error) {
+	return c.combineSets("intersection", keys)
+}
+
+func (c *Client) SetUnion(keys ...string) ([]string, error) {
+	return c.combineSets("union", keys)
+}
+
+func (c *Client) SetDifference(keys ...string) ([]string, error) {
+	return c.combineSets("difference", keys)
+}
+
+// combineSets and combineSetsStore send the first key in the path and the
+// rest as with parameters. With no keys there's nothing to name in the path,
+// so the result is empty.
+func (c *Client) combineSets(operation string, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return []string{}, nil
+	}
+	var body struct {
+		Members []string `json:"members"`
+	}
+	err := c.do("GET", path("sets", keys[0], operation), url.Values{"with": keys[1:]}, nil, &body)
+	return body.Members, err
+}
+
+func (c *Client) SetIntersectStore(destination string, keys ...string) (int64, error) {
+	return c.combineSetsStore("intersection", destination, keys)
+}
+
+func (c *Client) SetUnionStore(destination string, keys ...string) (int64, error) {
+	return c.combineSetsStore("union", destination, keys)
+}
+
+func (c *Client) SetDifferenceStore(destination string, keys ...string) (int64, error) {
+	return c.combineSetsStore("difference", destination, keys)
+}
+
+func (c *Client) combineSetsStore(operation, destination string, keys []string) (int64, error) {
+	if len(keys) == 0 {
+		_, err := c.Delete(destination)
+		return 0, err
+	}
+	var body struct {
+		Cardinality int64 `json:"cardinality"`
+	}
+	err := c.do("POST", path("sets", keys[0], operation), url.Values{"with": keys[1:]}, map[string]string{"destination": destination}, &body)
+	return body.Cardinality, err
+}
+
+func (c *Client) SetIntersectCardinality(limit int64, keys ...string) (int64, error) {
+	if limit < 0 {
+		return 0, restis.ErrNegativeLimit
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	var body struct {
+		Cardinality int64 `json:"cardinality"`
+	}
+	query := url.Values{"with": keys[1:], "limit": {strconv.FormatInt(limit, 10)}}
+	err := c.do("GET", path("sets", keys[0], "intersection", "cardinality"), query, nil, &body)
+	return body.Cardinality, err
+}
+
+func (c *Client) HashGet(key, field string) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	_, err := found(c.do("GET", path("hashes", key, "fields", field), nil, nil, &body))
+	return body.Value, err
+}
+
+func (c *Client) HashSet(key, field, value string) error {
+	return c.do("PUT", path("hashes", key, "fields", field), nil, map[string]string{"value": value}, nil)
+}
+
+func (c *Client) HashLength(key string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("GET", path("hashes", key, "length"), nil, nil, &body)
+	return body.Length, err
+}
+
+func (c *Client) HashMultiGet(key string, fields ...string) ([]string, error) {
+	if len(fields) == 0 {
+		// Without fields the route lists the field names instead, so only
+		// check the key's type.
+		_, err := c.HashLength(key)
+		if err != nil {
+			return nil, err
+		}
+		return []string{}, nil
+	}
+	var body struct {
+		Values []string `json:"values"`
+	}
+	err := c.do("GET", path("hashes", key, "fields"), url.Values{"field": fields}, nil, &body)
+	return body.Values, err
+}
+
+func (c *Client) HashMultiSet(key string, data map[string]string) error {
+	return c.do("POST", path("hashes", key, "fields"), nil, map[string]interface{}{"fields": data}, nil)
+}
+
+func (c *Client) HashExists(key, field string) (bool, error) {
+	return found(c.do("GET", path("hashes", key, "fields", field), nil, nil, nil))
+}
+
+func (c *Client) HashKeys(key string) ([]string, error) {
+	var body struct {
+		Fields []string `json:"fields"`
+	}
+	err := c.do("GET", path("hashes", key, "fields"), nil, nil, &body)
+	return body.Fields, err
+}
+
+func (c *Client) HashValues(key string) ([]string, error) {
+	var body struct {
+		Values []string `json:"values"`
+	}
+	err := c.do("GET", path("hashes", key, "values"), nil, nil, &body)
+	return body.Values, err
+}
+
+func (c *Client) HashScan(key string, cursor uint64, options restis.ScanOptions) (uint64, map[string]string, error) {
+	var body struct {
+		Cursor string            `json:"cursor"`
+		Fields map[string]string `json:"fields"`
+	}
+	err := c.do("GET", path("hashes", key, "fields"), scanQuery(cursor, options), nil, &body)
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseUint(body.Cursor, 10, 64)
+	return next, body.Fields, err
+}
+
+func (c *Client) HashSetIfExists(key, field string, value string) (bool, error) {
+	return c.hashSetIf(key, field, value, "exists")
+}
+
+func (c *Client) HashSetIfNotExists(key, field string, value string) (bool, error) {
+	return c.hashSetIf(key, field, value, "absent")
+}
+
+func (c *Client) hashSetIf(key, field, value, condition string) (bool, error) {
+	return succeeded(c.do("PUT", path("hashes", key, "fields", field), url.Values{"if": {condition}}, map[string]string{"value": value}, nil))
+}
+
+func (c *Client) HashDelete(key string, fields ...string) (int64, error) {
+	var body struct {
+		Deleted int64 `json:"deleted"`
+	}
+	err := c.do("DELETE", path("hashes", key, "fields"), url.Values{"field": fields}, nil, &body)
+	return body.Deleted, err
+}
+
+func (c *Client) HashGetAll(key string) (map[string]string, error) {
+	var body struct {
+		Fields map[string]string `json:"fields"`
+	}
+	err := c.do("GET", path("hashes", key), nil, nil, &body)
+	return body.Fields, err
+}
+
+func (c *Client) HashStringLength(key, field string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("GET", path("hashes", key, "fields", field, "length"), nil, nil, &body)
+	return body.Length, err
+}
+
+func (c *Client) HashIncrementBy(key, field string, delta int64) (int64, error) {
+	var body struct {
+		Value int64 `json:"value"`
+	}
+	err := c.do("POST", path("hashes", key, "fields", field, "increment"), nil, map[string]int64{"by": delta}, &body)
+	return body.Value, err
+}
+
+func (c *Client) HashIncrementByFloat(key, field string, delta float64) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	query := url.Values{"float": {"true"}}
+	err := c.do("POST", path("hashes", key, "fields", field, "increment"), query, map[string]score{"by": score(delta)}, &body)
+	return body.Value, err
+}
+
+func (c *Client) HashRandomField(key string, count int64) ([]string, error) {
+	var body struct {
+		Fields []string `json:"fields"`
+	}
+	err := c.do("GET", path("hashes", key, "random"), url.Values{"count": {strconv.FormatInt(count, 10)}}, nil, &body)
+	return body.Fields, err
+}
+
+func (c *Client) HashRandomFieldWithValues(key string, count int64) ([]restis.HashField, error) {
+	var body struct {
+		Fields []struct {
+			Field string `json:"field"`
+			Value string `json:"value"`
+		} `json:"fields"`
+	}
+	query := url.Values{"count": {strconv.FormatInt(count, 10)}, "values": {"true"}}
+	err := c.do("GET", path("hashes", key, "random"), query, nil, &body)
+	fields := make([]restis.HashField, len(body.Fields))
+	for i, f := range body.Fields {
+		fields[i] = restis.HashField{Field: f.Field, Value: f.Value}
+	}
+	return fields, err
+}
+
+func (c *Client) HashExpire(key string, seconds int64, options restis.HashExpireOptions, fields ...string) ([]int64, error) {
+	return c.hashExpire(key, "seconds", seconds, options, fields)
+}
+
+func (c *Client) HashPExpire(key string, milliseconds int64, options restis.HashExpireOptions, fields ...string) ([]int64, error) {
+	return c.hashExpire(key, "milliseconds", milliseconds, options, fields)
+}
+
+func (c *Client) HashExpireAt(key string, timestamp int64, options restis.HashExpireOptions, fields ...string) ([]int64, error) {
+	return c.hashExpire(key, "at", timestamp, options, fields)
+}
+
+func (c *Client) HashPExpireAt(key string, timestamp int64, options restis.HashExpireOptions, fields ...string) ([]int64, error) {
+	return c.hashExpire(key, "at_milliseconds", timestamp, options, fields)
+}
+
+func (c *Client) hashExpire(key, unit string, value int64, options restis.HashExpireOptions, fields []string) ([]int64, error) {
+	query := url.Values{"field": fields}
+	given := 0
+	for condition, set := range map[string]bool{
+		"absent":  options.IfNotExists,
+		"exists":  options.IfExists,
+		"greater": options.GreaterThan,
+		"less":    options.LessThan,
+	} {
+		if set {
+			query.Set("if", condition)
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, restis.ErrSyntax
+	}
+	var body struct {
+		Results []int64 `json:"results"`
+	}
+	err := c.do("PUT", path("hashes", key, "expiry"), query, map[string]int64{unit: value}, &body)
+	return body.Results, err
+}
+
+func (c *Client) hashExpiry(key string, fields []string) ([]int64, []int64, error) {
+	var body struct {
+		TTL  []int64 `json:"ttl"`
+		PTTL []int64 `json:"pttl"`
+	}
+	err := c.do("GET", path("hashes", key, "expiry"), url.Values{"field": fields}, nil, &body)
+	return body.TTL, body.PTTL, err
+}
+
+func (c *Client) HashTTL(key string, fields ...string) ([]int64, error) {
+	ttls, _, err := c.hashExpiry(key, fields)
+	return ttls, err
+}
+
+func (c *Client) HashPTTL(key string, fields ...string) ([]int64, error) {
+	_, pttls, err := c.hashExpiry(key, fields)
+	return pttls, err
+}
+
+func (c *Client) HashPersist(key string, fields ...string) ([]int64, error) {
+	var body struct {
+		Results []int64 `json:"results"`
+	}
+	err := c.do("DELETE", path("hashes", key, "expiry"), url.Values{"field": fields}, nil, &body)
+	return body.Results, err
+}
+
+func (c *Client) HashGetWithOptions(key string, options restis.HashFieldOptions, fields ...string) (map[string]string, error) {
+	if options.KeepTTL || options.IfExists || options.IfNotExists {
+		return nil, restis.ErrSyntax
+	}
+	var body struct {
+		Values map[string]string `json:"values"`
+	}
+	err := c.do("POST", path("hashes", key, "getex"), nil, map[string]interface{}{
+		"fields":  fields,
+		"ex":      options.ExpireSeconds,
+		"px":      options.ExpireMilliseconds,
+		"exat":    options.ExpireAt,
+		"pxat":    options.ExpireAtMilliseconds,
+		"persist": options.Persist,
+	}, &body)
+	return body.Values, err
+}
+
+func (c *Client) HashSetWithOptions(key string, data map[string]string, options restis.HashFieldOptions) (bool, error) {
+	query := url.Values{}
+	switch {
+	case options.Persist || (options.IfExists && options.IfNotExists):
+		return false, restis.ErrSyntax
+	case options.IfExists:
+		query.Set("if", "exists")
+	case options.IfNotExists:
+		query.Set("if", "absent")
+	}
+	body := map[string]interface{}{
+		"fields":  data,
+		"ex":      options.ExpireSeconds,
+		"px":      options.ExpireMilliseconds,
+		"exat":    options.ExpireAt,
+		"pxat":    options.ExpireAtMilliseconds,
+		"keepttl": options.KeepTTL,
+	}
+	return succeeded(c.do("POST", path("hashes", key, "fields"), query, body, nil))
+}
+
+func (c *Client) ListLeftPush(key string, values ...string) (int64, error) {
+	return c.push(key, "left", values)
+}
+
+func (c *Client) ListRightPush(key string, values ...string) (int64, error) {
+	return c.push(key, "right", values)
+}
+
+func (c *Client) ListLeftPushIfExists(key string, values ...string) (int64, error) {
+	return c.push(key, "left", values, "exists")
+}
+
+func (c *Client) ListRightPushIfExists(key string, values ...string) (int64, error) {
+	return c.push(key, "right", values, "exists")
+}
+
+func (c *Client) push(key, side string, values []string, condition ...string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("POST", path("lists", key, "items"), url.Values{"side": {side}, "if": condition}, map[string][]string{"items": values}, &body)
+	return body.Length, err
+}
+
+func (c *Client) ListLeftPop(key string) (string, error) {
+	return c.pop(key, "left")
+}
+
+func (c *Client) ListRightPop(key string) (string, error) {
+	return c.pop(key, "right")
+}
+
+func (c *Client) pop(key, side string) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	err := c.do("POST", path("lists", key, "pop"), url.Values{"side": {side}}, nil, &body)
+	return body.Value, err
+}
+
+func (c *Client) ListLeftPopCount(key string, count int64) ([]string, error) {
+	_, items, err := c.popCount(key, "left", count, nil)
+	return items, err
+}
+
+func (c *Client) ListRightPopCount(key string, count int64) ([]string, error) {
+	_, items, err := c.popCount(key, "right", count, nil)
+	return items, err
+}
+
+// ListMultiPop sends the first key in the path and the rest as with
+// parameters, like blockingPop.
+func (c *Client) ListMultiPop(side restis.ListSide, count int64, keys ...string) (string, []string, error) {
+	if count <= 0 {
+		return "", nil, restis.ErrOutOfRange
+	}
+	if len(keys) == 0 {
+		return "", nil, restis.ErrNoSuchKey
+	}
+	return c.popCount(keys[0], sideName(side), count, keys[1:])
+}
+
+func (c *Client) popCount(key, side string, count int64, with []string) (string, []string, error) {
+	var body struct {
+		Key   string   `json:"key"`
+		Items []string `json:"items"`
+	}
+	query := url.Values{"side": {side}, "count": {strconv.FormatInt(count, 10)}, "with": with}
+	err := c.do("POST", path("lists", key, "pop"), query, nil, &body)
+	return body.Key, body.Items, err
+}
+
+func (c *Client) ListInsertBefore(key, pivot, value string) (int64, error) {
+	return c.insert(key, "before", pivot, value)
+}
+
+func (c *Client) ListInsertAfter(key, pivot, value string) (int64, error) {
+	return c.insert(key, "after", pivot, value)
+}
+
+// insert turns the 404 for a missing list and the 412 for a missing pivot
+// back into the 0 and -1 that LINSERT returns.
+func (c *Client) insert(key, where, pivot, value string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("POST", path("lists", key, "insert"), nil, map[string]string{where: pivot, "value": value}, &body)
+	switch err {
+	case restis.ErrNoSuchKey:
+		return 0, nil
+	case errConditionNotMet:
+		return -1, nil
+	}
+	return body.Length, err
+}
+
+func (c *Client) ListRemove(key string, count int64, value string) (int64, error) {
+	var body struct {
+		Removed int64 `json:"removed"`
+	}
+	err := c.do("POST", path("lists", key, "remove"), nil, map[string]interface{}{"value": value, "count": count}, &body)
+	return body.Removed, err
+}
+
+func (c *Client) ListPosition(key, value string, options restis.ListPositionOptions) ([]int64, error) {
+	var body struct {
+		Positions []int64 `json:"positions"`
+	}
+	query := url.Values{
+		"value":  {value},
+		"rank":   {strconv.FormatInt(options.Rank, 10)},
+		"count":  {strconv.FormatInt(options.Count, 10)},
+		"maxlen": {strconv.FormatInt(options.MaxLen, 10)},
+	}
+	err := c.do("GET", path("lists", key, "positions"), query, nil, &body)
+	return body.Positions, err
+}
+
+func (c *Client) ListMove(source, destination string, from, to restis.ListSide) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	err := c.do("POST", path("lists", source, "move"), moveQuery(from, to), map[string]string{"destination": destination}, &body)
+	return body.Value, err
+}
+
+func moveQuery(from, to restis.ListSide) url.Values {
+	return url.Values{"from": {sideName(from)}, "to": {sideName(to)}}
+}
+
+func sideName(side restis.ListSide) string {
+	return strings.ToLower(side.String())
+}
+
+func (c *Client) ListBlockingLeftPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	return c.blockingPop(ctx, timeout, keys, "left")
+}
+
+func (c *Client) ListBlockingRightPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	return c.blockingPop(ctx, timeout, keys, "right")
+}
+
+// blockingPop sends the first key in the path and the rest as with
+// parameters. With no keys there's nothing to name in the path, or to wait
+// on, so it reports a timeout straight away.
+func (c *Client) blockingPop(ctx context.Context, timeout time.Duration, keys []string, side string) (string, string, error) {
+	if timeout < 0 {
+		return "", "", restis.ErrNegativeTimeout
+	}
+	if len(keys) == 0 {
+		return "", "", restis.ErrNoSuchKey
+	}
+	var body struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	query := url.Values{"side": {side}, "wait": {timeout.String()}, "with": keys[1:]}
+	err := c.doWaiting(ctx, timeout, "POST", path("lists", keys[0], "pop"), query, nil, &body)
+	return body.Key, body.Value, err
+}
+
+func (c *Client) ListBlockingMove(ctx context.Context, timeout time.Duration, source, destination string, from, to restis.ListSide) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	query := moveQuery(from, to)
+	query.Set("wait", timeout.String())
+	err := c.doWaiting(ctx, timeout, "POST", path("lists", source, "move"), query, map[string]string{"destination": destination}, &body)
+	return body.Value, err
+}
+
+func (c *Client) ListLength(key string) (int64, error) {
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err := c.do("GET", path("lists", key, "length"), nil, nil, &body)
+	return body.Length, err
+}
+
+func (c *Client) ListRange(key string, start, stop int64) ([]string, error) {
+	var body struct {
+		Items []string `json:"items"`
+	}
+	err := c.do("GET", path("lists", key, "items"), rangeQuery(start, stop), nil, &body)
+	return body.Items, err
+}
+
+func (c *Client) ListSet(key string, index int64, value string) error {
+	err := c.do("PUT", path("lists", key, "items", strconv.FormatInt(index, 10)), nil, map[string]string{"value": value}, nil)
+	if err != restis.ErrNoSuchKey {
+		return err
+	}
+	// The item route answers 404 both for a missing list and for an index
+	// past either end of it.
+	length, err := c.ListLength(key)
+	if err != nil {
+		return err
+	}
+	if length > 0 {
+		return restis.ErrOutOfRange
+	}
+	return restis.ErrNoSuchKey
+}
+
+func (c *Client) ListIndex(key string, index int64) (string, error) {
+	var body struct {
+		Value string `json:"value"`
+	}
+	_, err := found(c.do("GET", path("lists", key, "items", strconv.FormatInt(index, 10)), nil, nil, &body))
+	return body.Value, err
+}
+
+func (c *Client) ListTrim(key string, start, stop int64) error {
+	return c.do("POST", path("lists", key, "trim"), nil, map[string]int64{"start": start, "stop": stop}, nil)
+}
+
+// score encodes infinite scores as "+inf" and "-inf", the way the server
+// does, since JSON numbers can't represent them.
+type score float64
+
+func (s score) MarshalJSON() ([]byte, error) {
+	switch {
+	case math.IsInf(float64(s), 1):
+		return []byte(`"+inf"`), nil
+	case math.IsInf(float64(s), -1):
+		return []byte(`"-inf"`), nil
+	}
+	return json.Marshal(float64(s))
+}
+
+func (s *score) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"+inf"`, `"inf"`:
+		*s = score(math.Inf(1))
+		return nil
+	case `"-inf"`:
+		*s = score(math.Inf(-1))
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*s = score(f)
+	return nil
+}
+
+type scoredMembers []struct {
+	Member string `json:"member"`
+	Score  score  `json:"score"`
+}
+
+func (members scoredMembers) decode() []restis.ScoredMember {
+	decoded := make([]restis.ScoredMember, len(members))
+	for i, m := range members {
+		decoded[i] = restis.ScoredMember{Member: m.Member, Score: float64(m.Score)}
+	}
+	return decoded
+}
+
+func addOptionsQuery(options restis.SortedSetAddOptions) url.Values {
+	query := url.Values{}
+	for condition, given := range map[string]bool{
+		"exists":  options.IfExists,
+		"absent":  options.IfNotExists,
+		"greater": options.GreaterThan,
+		"less":    options.LessThan,
+	} {
+		if given {
+			query.Add("if", condition)
+		}
+	}
+	if options.Changed {
+		query.Set("changed", "true")
+	}
+	return query
+}
+
+func sortedSetRangeQuery(query restis.SortedSetRange) (url.Values, error) {
+	values := url.Values{"start": {query.Start}, "stop": {query.Stop}}
+	switch {
+	case query.ByScore && query.ByLex:
+		return nil, restis.ErrSyntax
+	case query.ByScore:
+		values.Set("by", "score")
+	case query.ByLex:
+		values.Set("by", "lex")
+	}
+	if query.Reverse {
+		values.Set("rev", "true")
+	}
+	if query.Limit != nil {
+		values.Set("offset", strconv.FormatInt(query.Limit.Offset, 10))
+		values.Set("count", strconv.FormatInt(query.Limit.Count, 10))
+	}
+	return values, nil
+}
+
+func (c *Client) SortedSetAdd(key string, options restis.SortedSetAddOptions, members ...restis.ScoredMember) (int64, error) {
+	scores := make(map[string]score, len(members))
+	for _, m := range members {
+		if math.IsNaN(m.Score) {
+			return 0, restis.ErrNotFloat
+		}
+		scores[m.Member] = score(m.Score)
+	}
+	var body struct {
+		Added   int64 `json:"added"`
+		Changed int64 `json:"changed"`
+	}
+	err := c.do("POST", path("sorted-sets", key, "members"), addOptionsQuery(options), map[string]interface{}{"members": scores}, &body)
+	if options.Changed {
+		return body.Changed, err
+	}
+	return body.Added, err
+}
+
+func (c *Client) SortedSetAddIncrement(key string, options restis.SortedSetAddOptions, member string, delta float64) (float64, bool, error) {
+	if math.IsNaN(delta) {
+		return 0, false, restis.ErrNotFloat
+	}
+	var body struct {
+		Score score `json:"score"`
+	}
+	applied, err := succeeded(c.do("POST", path("sorted-sets", key, "members", member, "increment"), addOptionsQuery(options), map[string]score{"by": score(delta)}, &body))
+	return float64(body.Score), applied, err
+}
+
+func (c *Client) SortedSetRemove(key string, members ...string) (int64, error) {
+	var body struct {
+		Removed int64 `json:"removed"`
+	}
+	err := c.do("DELETE", path("sorted-sets", key, "members"), url.Values{"member": members}, nil, &body)
+	return body.Removed, err
+}
+
+func (c *Client) SortedSetScore(key, member string) (float64, bool, error) {
+	var body struct {
+		Score score `json:"score"`
+	}
+	exists, err := found(c.do("GET", path("sorted-sets", key, "members", member), nil, nil, &body))
+	return float64(body.Score), exists, err
+}
+
+func (c *Client) SortedSetIncrementBy(key, member string, delta float64) (float64, error) {
+	score, _, err := c.SortedSetAddIncrement(key, restis.SortedSetAddOptions{}, member, delta)
+	return score, err
+}
+
+func (c *Client) SortedSetCardinality(key string) (int64, error) {
+	var body struct {
+		Cardinality int64 `json:"cardinality"`
+	}
+	err := c.do("GET", path("sorted-sets", key, "cardinality"), nil, nil, &body)
+	return body.Cardinality, err
+}
+
+func (c *Client) SortedSetCount(key, min, max string) (int64, error) {
+	var body struct {
+		Count int64 `json:"count"`
+	}
+	err := c.do("GET", path("sorted-sets", key, "count"), url.Values{"min": {min}, "max": {max}}, nil, &body)
+	return body.Count, err
+}
+
+func (c *Client) SortedSetRank(key, member string) (int64, bool, error) {
+	return c.rank(key, member, false)
+}
+
+func (c *Client) SortedSetReverseRank(key, member string) (int64, bool, error) {
+	return c.rank(key, member, true)
+}
+
+func (c *Client) rank(key, member string, reverse bool) (int64, bool, error) {
+	var body struct {
+		Rank int64 `json:"rank"`
+	}
+	query := url.Values{"rev": {strconv.FormatBool(reverse)}}
+	exists, err := found(c.do("GET", path("sorted-sets", key, "members", member, "rank"), query, nil, &body))
+	return body.Rank, exists, err
+}
+
+func (c *Client) SortedSetRange(key string, query restis.SortedSetRange) ([]restis.ScoredMember, error) {
+	values, err := sortedSetRangeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Members scoredMembers `json:"members"`
+	}
+	if err := c.do("GET", path("sorted-sets", key, "members"), values, nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Members.decode(), nil
+}
+
+func (c *Client) SortedSetRangeStore(destination, key string, query restis.SortedSetRange) (int64, error) {
+	values, err := sortedSetRangeQuery(query)
+	if err != nil {
+		return 0, err
+	}
+	var body struct {
+		Length int64 `json:"length"`
+	}
+	err = c.do("POST", path("sorted-sets", key, "store"), values, map[string]string{"destination": destination}, &body)
+	return body.Length, err
+}
+
+func (c *Client) SortedSetPopMin(key string, count int64) ([]restis.ScoredMember, error) {
+	return c.sortedSetPop(key, "min", count)
+}
+
+func (c *Client) SortedSetPopMax(key string, count int64) ([]restis.ScoredMember, error) {
+	return c.sortedSetPop(key, "max", count)
+}
+
+func (c *Client) sortedSetPop(key, side string, count int64) ([]restis.ScoredMember, error) {
+	var body struct {
+		Members scoredMembers `json:"members"`
+	}
+	query := url.Values{"side": {side}, "count": {strconv.FormatInt(count, 10)}}
+	if err := c.do("POST", path("sorted-sets", key, "pop"), query, nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Members.decode(), nil
+}
+
+// Save asks the server to write a snapshot and waits until it has.
+func (c *Client) Save() error {
+	return c.do("POST", "/snapshots", nil, nil, nil)
+}
+
+// BackgroundSave asks the server to write a snapshot without waiting for it.
+func (c *Client) BackgroundSave() error {
+	return c.do("POST", "/snapshots", url.Values{"background": {"true"}}, nil, nil)
+}
+
+func (c *Client) LastSave() (time.Time, error) {
+	var body struct {
+		LastSave int64 `json:"last_save"`
+	}
+	err := c.do("GET", "/snapshots", nil, nil, &body)
+	return time.Unix(body.LastSave, 0), err
+}
+
+// BackgroundRewrite asks the server to compact its append-only log.
+func (c *Client) BackgroundRewrite() error {
+	return c.do("POST", "/append-only-log/rewrite", nil, nil, nil)
+}
+
+// Publish sends message to everyone subscribed to channel on the server,
+// and returns how many received it.
+func (c *Client) Publish(channel, message string) (int64, error) {
+	var body struct {
+		Receivers int64 `json:"receivers"`
+	}
+	err := c.do("POST", path("channels", channel), nil, map[string]interface{}{"message": message}, &body)
+	return body.Receivers, err
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sudhirj/restis"
+)
+
+// flaky answers with 503 until it has failed the given number of times.
+func flaky(failures int64, next http.Handler) (http.Handler, *int64) {
+	var calls int64
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &calls
+}
+
+func TestClientRetriesReads(t *testing.T) {
+	store := restis.NewMemoryStore()
+	store.Set("k", "v")
+	handler, calls := flaky(2, restis.NewHandler(store))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(2, time.Millisecond))
+	value, err := c.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v", value)
+	assert.Equal(t, 3, atomic.LoadInt64(calls))
+
+	atomic.StoreInt64(calls, 0)
+	c = New(server.URL, WithRetries(1, time.Millisecond))
+	_, err = c.Get("k")
+	assert.Error(t, err)
+	assert.Equal(t, 2, atomic.LoadInt64(calls))
+}
+
+func TestClientDoesNotRetryWrites(t *testing.T) {
+	handler, calls := flaky(1, restis.NewHandler(restis.NewMemoryStore()))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+	_, err := c.Increment("counter")
+	assert.Error(t, err)
+	assert.Equal(t, 1, atomic.LoadInt64(calls))
+	value, err := c.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := New(server.URL, WithTimeout(20*time.Millisecond), WithRetries(0, 0))
+	start := time.Now()
+	_, err := c.Get("k")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestClientErrors(t *testing.T) {
+	server := httptest.NewServer(restis.NewHandler(restis.NewMemoryStore()))
+	defer server.Close()
+
+	c := New(server.URL + "/")
+	assert.NoError(t, c.Set("a key/with slashes", "v"))
+	value, err := c.Get("a key/with slashes")
+	assert.NoError(t, err)
+	assert.Equal(t, "v", value)
+	_, err = c.ListLength("a key/with slashes")
+	assert.Equal(t, restis.ErrWrongType, err)
+	_, err = c.RandomKey()
+	assert.NoError(t, err)
+	assert.Equal(t, restis.ErrNoSuchKey, c.Rename("missing", "other"))
+}
+
+func TestClientPublish(t *testing.T) {
+	store := restis.NewMemoryStore().(*restis.MemoryStore)
+	server := httptest.NewServer(restis.NewHandler(store))
+	defer server.Close()
+	sub := store.Broker().NewSubscription()
+	defer sub.Close()
+	sub.Subscribe("news")
+
+	c := New(server.URL)
+	receivers, err := c.Publish("news", "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, receivers)
+	assert.Equal(t, restis.Message{Channel: "news", Payload: "hello"}, <-sub.Messages())
+
+	server.Config.Handler = restis.NewHandler(struct{ restis.Store }{store})
+	_, err = c.Publish("news", "hello")
+	assert.Equal(t, restis.ErrPubSubDisabled, err)
+}
@@ -0,0 +1,19 @@
+package restis_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sudhirj/restis"
+	"github.com/sudhirj/restis/client"
+)
+
+func TestClient(t *testing.T) {
+	storeGenerator := func() restis.Store {
+		server := httptest.NewServer(restis.NewHandler(restis.NewMemoryStore()))
+		t.Cleanup(server.Close)
+		return client.New(server.URL)
+	}
+	restis.RunAllTestsOnStore(t, storeGenerator)
+	restis.RunAllRedisDocChecksOnStore(t, storeGenerator)
+}
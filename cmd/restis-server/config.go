@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sudhirj/restis"
+)
+
+type config struct {
+	Addr            string
+	RESPAddr        string
+	Snapshot        string
+	SaveRules       []restis.SaveRule
+	AppendOnly      string
+	AppendFsync     restis.FsyncPolicy
+	Disk            string
+	KeyspaceEvents  restis.KeyspaceEvents
+	ScriptTimeout   time.Duration
+	TLSCert         string
+	TLSKey          string
+	MaxBodyBytes    int64
+	MaxHeaderBytes  int
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// loadConfig resolves settings from, in increasing order of precedence, the
+// defaults, a JSON config file, RESTIS_* environment variables and flags.
+// Config file keys and environment variables use the flag names, so
+// -max-body-bytes can also be set as "max-body-bytes" or RESTIS_MAX_BODY_BYTES.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (config, error) {
+	var cfg config
+	var configPath, saveRules, appendFsync, keyspaceEvents string
+	fs := flag.NewFlagSet("restis-server", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "path to a JSON config file")
+	fs.StringVar(&cfg.Addr, "addr", ":8080", "address to listen on")
+	fs.StringVar(&cfg.RESPAddr, "resp-addr", "", "address to serve the Redis protocol on, such as :6379; disabled when empty")
+	fs.StringVar(&cfg.Snapshot, "snapshot", "", "snapshot file to load on start and save to; snapshots are disabled when empty")
+	fs.StringVar(&saveRules, "save", "3600 1 300 100 60 10000", "snapshot rules as pairs of seconds and changes, as in Redis; empty for none")
+	fs.StringVar(&cfg.AppendOnly, "appendonly", "", "append-only log to replay on start and log every write to; disabled when empty")
+	fs.StringVar(&appendFsync, "appendfsync", "everysec", "when to fsync the append-only log, or the disk store's log: always, everysec or no")
+	fs.StringVar(&cfg.Disk, "disk", "", "directory to keep the data in on disk, instead of in memory")
+	fs.StringVar(&keyspaceEvents, "notify-keyspace-events", "", "keyspace events to publish to pub/sub channels, as in Redis, like KEA; none when empty")
+	fs.DurationVar(&cfg.ScriptTimeout, "script-timeout", restis.DefaultScriptTimeout, "how long scripts can run before they're stopped, 0 for no limit")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file; serves HTTPS when set")
+	fs.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", 1<<20, "maximum request body size, 0 for no limit")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", 1<<20, "maximum request header size")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 30*time.Second, "maximum duration for reading a request")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "maximum duration for writing a response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", 2*time.Minute, "maximum time to keep idle connections open")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "time allowed for in-flight requests on shutdown")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if !explicit["config"] {
+		if path, ok := lookupEnv(envName("config")); ok {
+			configPath = path
+		}
+	}
+	if configPath != "" {
+		if err := applyConfigFile(fs, configPath, explicit); err != nil {
+			return cfg, err
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || f.Name == "config" || envErr != nil {
+			return
+		}
+		if value, ok := lookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return cfg, envErr
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, errors.New("tls-cert and tls-key must be set together")
+	}
+	persistence := 0
+	for _, path := range []string{cfg.Snapshot, cfg.AppendOnly, cfg.Disk} {
+		if path != "" {
+			persistence++
+		}
+	}
+	if persistence > 1 {
+		return cfg, errors.New("only one of snapshot, appendonly and disk can be set")
+	}
+	switch appendFsync {
+	case "always":
+		cfg.AppendFsync = restis.FsyncAlways
+	case "everysec":
+		cfg.AppendFsync = restis.FsyncEverySecond
+	case "no":
+		cfg.AppendFsync = restis.FsyncNever
+	default:
+		return cfg, fmt.Errorf("appendfsync: %q must be always, everysec or no", appendFsync)
+	}
+	events, err := restis.ParseKeyspaceEvents(keyspaceEvents)
+	if err != nil {
+		return cfg, fmt.Errorf("notify-keyspace-events: %q can only use the flags g$lshzxAKE", keyspaceEvents)
+	}
+	cfg.KeyspaceEvents = events
+	rules, err := parseSaveRules(saveRules)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SaveRules = rules
+	return cfg, nil
+}
+
+// parseSaveRules reads rules written as in Redis' save setting, like
+// "3600 1 300 100": after 3600 seconds if 1 key changed, or after 300
+// seconds if 100 keys changed.
+func parseSaveRules(value string) ([]restis.SaveRule, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("save: %q must be pairs of seconds and changes", value)
+	}
+	rules := []restis.SaveRule{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("save: invalid seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("save: invalid changes %q", fields[i+1])
+		}
+		rules = append(rules, restis.SaveRule{Interval: time.Duration(seconds) * time.Second, Changes: changes})
+	}
+	return rules, nil
+}
+
+func applyConfigFile(fs *flag.FlagSet, path string, explicit map[string]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	settings := map[string]interface{}{}
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for name, value := range settings {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+func envName(flagName string) string {
+	return "RESTIS_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sudhirj/restis"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(nil, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", cfg.Addr)
+	assert.Equal(t, "", cfg.RESPAddr)
+	assert.Equal(t, "", cfg.Snapshot)
+	assert.Equal(t, []restis.SaveRule{{Interval: time.Hour, Changes: 1}, {Interval: 5 * time.Minute, Changes: 100}, {Interval: time.Minute, Changes: 10000}}, cfg.SaveRules)
+	assert.Equal(t, "", cfg.AppendOnly)
+	assert.Equal(t, restis.FsyncEverySecond, cfg.AppendFsync)
+	assert.Equal(t, 1<<20, cfg.MaxBodyBytes)
+	assert.Equal(t, 30*time.Second, cfg.ReadTimeout)
+	assert.Equal(t, 5*time.Second, cfg.ScriptTimeout)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restis-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "restis.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"addr": ":9000", "max-body-bytes": 2048, "read-timeout": "5s", "idle-timeout": "1m"}`), 0644))
+
+	cfg, err := loadConfig([]string{"-config", path, "-read-timeout", "7s"}, env(map[string]string{
+		"RESTIS_ADDR":         ":9001",
+		"RESTIS_RESP_ADDR":    ":6380",
+		"RESTIS_READ_TIMEOUT": "6s",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, ":9001", cfg.Addr)
+	assert.Equal(t, ":6380", cfg.RESPAddr)
+	assert.Equal(t, 2048, cfg.MaxBodyBytes)
+	assert.Equal(t, 7*time.Second, cfg.ReadTimeout)
+	assert.Equal(t, time.Minute, cfg.IdleTimeout)
+
+	cfg, err = loadConfig(nil, env(map[string]string{"RESTIS_CONFIG": path}))
+	assert.NoError(t, err)
+	assert.Equal(t, ":9000", cfg.Addr)
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, err := loadConfig([]string{"-tls-cert", "cert.pem"}, env(nil))
+	assert.EqualError(t, err, "tls-cert and tls-key must be set together")
+
+	_, err = loadConfig(nil, env(map[string]string{"RESTIS_READ_TIMEOUT": "soon"}))
+	assert.Error(t, err)
+
+	_, err = loadConfig([]string{"-save", "60 10 300"}, env(nil))
+	assert.EqualError(t, err, `save: "60 10 300" must be pairs of seconds and changes`)
+	_, err = loadConfig([]string{"-save", "60 often"}, env(nil))
+	assert.EqualError(t, err, `save: invalid changes "often"`)
+	cfg, err := loadConfig([]string{"-save", ""}, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []restis.SaveRule{}, cfg.SaveRules)
+
+	_, err = loadConfig([]string{"-appendfsync", "sometimes"}, env(nil))
+	assert.EqualError(t, err, `appendfsync: "sometimes" must be always, everysec or no`)
+	_, err = loadConfig([]string{"-appendonly", "restis.aof", "-snapshot", "dump.restis"}, env(nil))
+	assert.EqualError(t, err, "only one of snapshot, appendonly and disk can be set")
+	_, err = loadConfig([]string{"-disk", "data", "-appendonly", "restis.aof"}, env(nil))
+	assert.EqualError(t, err, "only one of snapshot, appendonly and disk can be set")
+	cfg, err = loadConfig([]string{"-appendonly", "restis.aof", "-appendfsync", "always"}, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, restis.FsyncAlways, cfg.AppendFsync)
+
+	_, err = loadConfig([]string{"-notify-keyspace-events", "KEm"}, env(nil))
+	assert.EqualError(t, err, `notify-keyspace-events: "KEm" can only use the flags g$lshzxAKE`)
+	cfg, err = loadConfig(nil, env(map[string]string{"RESTIS_NOTIFY_KEYSPACE_EVENTS": "Kx"}))
+	assert.NoError(t, err)
+	assert.Equal(t, restis.KeyspaceChannels|restis.ExpiredEvents, cfg.KeyspaceEvents)
+
+	dir, err := ioutil.TempDir("", "restis-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "restis.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"port": 80}`), 0644))
+	_, err = loadConfig([]string{"-config", path}, env(nil))
+	assert.EqualError(t, err, path+`: unknown setting "port"`)
+}
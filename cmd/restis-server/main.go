@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sudhirj/restis"
+)
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(cfg config) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("closing store: %v", err)
+		}
+	}()
+	store.SetKeyspaceEvents(cfg.KeyspaceEvents)
+	store.Scripts().SetTimeout(cfg.ScriptTimeout)
+	server := &http.Server{
+		Addr:           cfg.Addr,
+		Handler:        limitBody(restis.NewHandler(store), cfg.MaxBodyBytes),
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+
+	serveErr := make(chan error, 2)
+	respServer := restis.NewRESPServer(store)
+	if cfg.RESPAddr != "" {
+		go func() {
+			log.Printf("restis serving RESP on %s", cfg.RESPAddr)
+			serveErr <- respServer.ListenAndServe(cfg.RESPAddr)
+		}()
+	}
+	go func() {
+		log.Printf("restis listening on %s", cfg.Addr)
+		if cfg.TLSCert != "" {
+			serveErr <- server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		respServer.Close()
+		server.Close()
+		return err
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	}
+
+	respServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, restis.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// closableStore is a Store that has to be closed to flush it to disk, that
+// reports changes to its keys and that runs scripts.
+type closableStore interface {
+	restis.Store
+	Close() error
+	SetKeyspaceEvents(events restis.KeyspaceEvents)
+	Scripts() *restis.Scripts
+}
+
+func openStore(cfg config) (closableStore, error) {
+	switch {
+	case cfg.AppendOnly != "":
+		store, err := restis.OpenAppendOnlyStore(restis.AppendOnlyOptions{
+			Path:              cfg.AppendOnly,
+			Fsync:             cfg.AppendFsync,
+			RewritePercentage: 100,
+			RewriteMinSize:    64 << 20,
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("replayed %s", cfg.AppendOnly)
+		return store, nil
+	case cfg.Disk != "":
+		store, err := restis.OpenDiskStore(restis.DiskOptions{Path: cfg.Disk, Fsync: cfg.AppendFsync})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("opened %s", cfg.Disk)
+		return store, nil
+	case cfg.Snapshot != "":
+		store, err := restis.NewMemoryStoreWithSnapshots(restis.SnapshotOptions{Path: cfg.Snapshot, Rules: cfg.SaveRules})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("loaded %s", cfg.Snapshot)
+		return store, nil
+	default:
+		return restis.NewMemoryStore().(*restis.MemoryStore), nil
+	}
+}
+
+func limitBody(next http.Handler, limit int64) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,190 @@
+package restis
+
+// dequeChunkSize is how many items each chunk of a deque holds.
+const dequeChunkSize = 64
+
+// A deque holds a list's items in fixed-size chunks, kept in order in a ring
+// that grows at either end, much like Redis' quicklist keeps them in small
+// blocks. Pushing and popping at either end touches only the chunk there,
+// and since every chunk but the first and last is full, any index can be
+// found directly. Chunks are dropped as soon as they're emptied, and the
+// ring shrinks once most of it is unused, so a list that has shrunk doesn't
+// hold on to the memory it needed when it was long.
+type deque struct {
+	chunks [][]string // the ring, with unused slots nil
+	head   int        // the slot of the first chunk in chunks
+	used   int        // how many chunks are in use
+	first  int        // the position of the first item in the first chunk
+	count  int
+}
+
+func newDeque(items ...string) *deque {
+	d := &deque{}
+	for _, item := range items {
+		d.pushBack(item)
+	}
+	return d
+}
+
+func (d *deque) length() int64 {
+	return int64(d.count)
+}
+
+// chunk returns the nth chunk in use.
+func (d *deque) chunk(n int) []string {
+	return d.chunks[(d.head+n)%len(d.chunks)]
+}
+
+func (d *deque) at(i int64) string {
+	p := d.first + int(i)
+	return d.chunk(p / dequeChunkSize)[p%dequeChunkSize]
+}
+
+func (d *deque) set(i int64, item string) {
+	p := d.first + int(i)
+	d.chunk(p / dequeChunkSize)[p%dequeChunkSize] = item
+}
+
+func (d *deque) pushBack(item string) {
+	p := d.first + d.count
+	if p/dequeChunkSize == d.used {
+		d.reserve()
+		d.chunks[(d.head+d.used)%len(d.chunks)] = make([]string, dequeChunkSize)
+		d.used++
+	}
+	d.chunk(p / dequeChunkSize)[p%dequeChunkSize] = item
+	d.count++
+}
+
+func (d *deque) pushFront(item string) {
+	if d.first == 0 {
+		d.reserve()
+		d.head = (d.head + len(d.chunks) - 1) % len(d.chunks)
+		d.chunks[d.head] = make([]string, dequeChunkSize)
+		d.used++
+		d.first = dequeChunkSize
+	}
+	d.first--
+	d.chunks[d.head][d.first] = item
+	d.count++
+}
+
+func (d *deque) popFront() string {
+	item := d.chunks[d.head][d.first]
+	d.chunks[d.head][d.first] = ""
+	d.first++
+	d.count--
+	if d.first == dequeChunkSize || d.count == 0 {
+		d.chunks[d.head] = nil
+		d.head = (d.head + 1) % len(d.chunks)
+		d.used--
+		d.first = 0
+		d.release()
+	}
+	return item
+}
+
+func (d *deque) popBack() string {
+	p := d.first + d.count - 1
+	last := d.chunk(p / dequeChunkSize)
+	item := last[p%dequeChunkSize]
+	last[p%dequeChunkSize] = ""
+	d.count--
+	if p%dequeChunkSize == 0 || d.count == 0 {
+		d.chunks[(d.head+d.used-1)%len(d.chunks)] = nil
+		d.used--
+		if d.used == 0 {
+			d.first = 0
+		}
+		d.release()
+	}
+	return item
+}
+
+func (d *deque) push(side ListSide, item string) {
+	if side == ListLeft {
+		d.pushFront(item)
+	} else {
+		d.pushBack(item)
+	}
+}
+
+func (d *deque) pop(side ListSide) string {
+	if side == ListLeft {
+		return d.popFront()
+	}
+	return d.popBack()
+}
+
+// reserve makes room in the ring for one more chunk.
+func (d *deque) reserve() {
+	if d.used < len(d.chunks) {
+		return
+	}
+	d.resize(2*len(d.chunks) + 1)
+}
+
+// release shrinks the ring when no more than a quarter of it is in use.
+func (d *deque) release() {
+	if len(d.chunks) > 8 && d.used <= len(d.chunks)/4 {
+		d.resize(2 * d.used)
+	}
+}
+
+// resize moves the chunks in use into a ring of size slots, starting from
+// its first slot.
+func (d *deque) resize(size int) {
+	chunks := make([][]string, size)
+	for n := 0; n < d.used; n++ {
+		chunks[n] = d.chunk(n)
+	}
+	d.chunks, d.head = chunks, 0
+}
+
+// slice returns a copy of the items from start up to but not including
+// stop.
+func (d *deque) slice(start, stop int64) []string {
+	items := make([]string, 0, stop-start)
+	for i := start; i < stop; {
+		p := d.first + int(i)
+		chunk := d.chunk(p / dequeChunkSize)[p%dequeChunkSize:]
+		if n := stop - i; int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		items = append(items, chunk...)
+		i += int64(len(chunk))
+	}
+	return items
+}
+
+func (d *deque) items() []string {
+	return d.slice(0, d.length())
+}
+
+func (d *deque) clone() *deque {
+	return newDeque(d.items()...)
+}
+
+// insert puts item at index i, moving whichever side of it is shorter out
+// of the way.
+func (d *deque) insert(i int64, item string) {
+	if i <= d.length()/2 {
+		moved := make([]string, i)
+		for n := range moved {
+			moved[n] = d.popFront()
+		}
+		d.pushFront(item)
+		for n := len(moved) - 1; n >= 0; n-- {
+			d.pushFront(moved[n])
+		}
+		return
+	}
+	moved := make([]string, d.length()-i)
+	for n := range moved {
+		moved[n] = d.popBack()
+	}
+	d.pushBack(item)
+	for n := len(moved) - 1; n >= 0; n-- {
+		d.pushBack(moved[n])
+	}
+}
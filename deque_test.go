@@ -0,0 +1,132 @@
+package restis
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDequeAgainstSlice(t *testing.T) {
+	d := newDeque()
+	expected := []string{}
+	for i := 0; i < 20000; i++ {
+		item := strconv.Itoa(i)
+		switch op := rand.Intn(10); {
+		case op < 3:
+			d.pushFront(item)
+			expected = append([]string{item}, expected...)
+		case op < 6:
+			d.pushBack(item)
+			expected = append(expected, item)
+		case op < 7 && len(expected) > 0:
+			assert.Equal(t, expected[0], d.popFront())
+			expected = expected[1:]
+		case op < 8 && len(expected) > 0:
+			assert.Equal(t, expected[len(expected)-1], d.popBack())
+			expected = expected[:len(expected)-1]
+		case op < 9:
+			at := rand.Int63n(int64(len(expected)) + 1)
+			d.insert(at, item)
+			expected = append(expected[:at:at], append([]string{item}, expected[at:]...)...)
+		case len(expected) > 0:
+			at := rand.Int63n(int64(len(expected)))
+			d.set(at, item)
+			expected[at] = item
+		}
+		assert.Equal(t, int64(len(expected)), d.length())
+	}
+
+	assert.Equal(t, expected, d.items())
+	for i, item := range expected {
+		assert.Equal(t, item, d.at(int64(i)))
+	}
+	for i := 0; i < 100; i++ {
+		start := rand.Int63n(int64(len(expected)) + 1)
+		stop := start + rand.Int63n(int64(len(expected))-start+1)
+		assert.Equal(t, expected[start:stop], d.slice(start, stop))
+	}
+	assert.Equal(t, expected, d.clone().items())
+}
+
+func TestDequeReleasesChunks(t *testing.T) {
+	d := newDeque()
+	for i := 0; i < 100*dequeChunkSize; i++ {
+		d.pushBack(strconv.Itoa(i))
+	}
+	assert.Equal(t, 100, d.used)
+	for i := 0; i < 99*dequeChunkSize; i++ {
+		d.popFront()
+	}
+	assert.Equal(t, 1, d.used)
+	assert.LessOrEqual(t, len(d.chunks), 8)
+	assert.Equal(t, strconv.Itoa(99*dequeChunkSize), d.at(0))
+
+	// Going back and forth over a chunk boundary at either end mustn't leave
+	// empty chunks behind.
+	for i := 0; i < 10; i++ {
+		d.pushFront("front")
+		d.pushBack("back")
+		assert.Equal(t, "front", d.popFront())
+		assert.Equal(t, "back", d.popBack())
+	}
+	assert.Equal(t, 1, d.used)
+	for d.length() > 0 {
+		d.popBack()
+	}
+	assert.Equal(t, 0, d.used)
+}
+
+const benchmarkListLength = 1000000
+
+func benchmarkList(b *testing.B) Store {
+	store := NewMemoryStore()
+	items := make([]string, benchmarkListLength)
+	for i := range items {
+		items[i] = strconv.Itoa(i)
+	}
+	if _, err := store.ListRightPush("list", items...); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	return store
+}
+
+func BenchmarkListLeftPush(b *testing.B) {
+	store := benchmarkList(b)
+	for i := 0; i < b.N; i++ {
+		store.ListLeftPush("list", "item")
+	}
+}
+
+func BenchmarkListRightPush(b *testing.B) {
+	store := benchmarkList(b)
+	for i := 0; i < b.N; i++ {
+		store.ListRightPush("list", "item")
+	}
+}
+
+func BenchmarkListLeftPop(b *testing.B) {
+	store := benchmarkList(b)
+	for i := 0; i < b.N; i++ {
+		// Push it back so the list stays a million items long.
+		value, _ := store.ListLeftPop("list")
+		store.ListRightPush("list", value)
+	}
+}
+
+func BenchmarkListIndex(b *testing.B) {
+	store := benchmarkList(b)
+	for i := 0; i < b.N; i++ {
+		store.ListIndex("list", int64(i%benchmarkListLength))
+	}
+}
+
+func BenchmarkListRange(b *testing.B) {
+	store := benchmarkList(b)
+	for i := 0; i < b.N; i++ {
+		start := int64(i % (benchmarkListLength - 100))
+		store.ListRange("list", start, start+99)
+	}
+}
@@ -0,0 +1,800 @@
+package restis
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrDiskCorrupt = errors.New("restis: disk store is corrupt")
+
+const (
+	diskManifestName    = "MANIFEST"
+	diskManifestHeader  = "restis-disk 1"
+	diskLogName         = "wal.log"
+	diskTableSuffix     = ".table"
+	diskTableBlockSize  = 4 << 10
+	diskTableMagic      = "RESTISTB"
+	diskTableFooterSize = len(diskTableMagic) + 8 + 4 + 4
+)
+
+const (
+	diskPut byte = iota
+	diskDelete
+)
+
+// A diskEntry is a value, or a tombstone that hides older values of its key.
+type diskEntry struct {
+	value   string
+	deleted bool
+}
+
+// A diskBatch is a set of changes that are logged and applied together.
+type diskBatch struct {
+	keys    []string
+	entries []diskEntry
+}
+
+func (b *diskBatch) put(key, value string) {
+	b.keys = append(b.keys, key)
+	b.entries = append(b.entries, diskEntry{value: value})
+}
+
+func (b *diskBatch) delete(key string) {
+	b.keys = append(b.keys, key)
+	b.entries = append(b.entries, diskEntry{deleted: true})
+}
+
+// A diskEngine is a small log-structured key-value engine. Writes go to a
+// write-ahead log and a memtable; full memtables are flushed to immutable,
+// sorted tables, and tables of similar size are merged so that there are only
+// ever a logarithmic number of them. The manifest lists the live tables,
+// newest first, and is replaced atomically whenever that changes.
+//
+// A diskEngine isn't safe for concurrent use.
+type diskEngine struct {
+	dir          string
+	fsync        FsyncPolicy
+	memtableSize int64
+	memtable     *memtable
+	tables       []*diskTable
+	nextID       int64
+	log          *os.File
+	pending      *diskBatch // writes held back from the log, see begin
+}
+
+func openDiskEngine(dir string, fsync FsyncPolicy, memtableSize int64) (*diskEngine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &diskEngine{dir: dir, fsync: fsync, memtableSize: memtableSize, memtable: newMemtable(), nextID: 1}
+	if err := e.readManifest(); err != nil {
+		e.close()
+		return nil, err
+	}
+	if err := e.replayLog(); err != nil {
+		e.close()
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, diskLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		e.close()
+		return nil, err
+	}
+	e.log = log
+	return e, nil
+}
+
+func (e *diskEngine) readManifest() error {
+	data, err := ioutil.ReadFile(filepath.Join(e.dir, diskManifestName))
+	if os.IsNotExist(err) {
+		return e.removeOrphans()
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) < 2 || lines[0] != diskManifestHeader || !strings.HasPrefix(lines[1], "next ") {
+		return fmt.Errorf("%s: %w", diskManifestName, ErrDiskCorrupt)
+	}
+	if e.nextID, err = strconv.ParseInt(strings.TrimPrefix(lines[1], "next "), 10, 64); err != nil {
+		return fmt.Errorf("%s: %w", diskManifestName, ErrDiskCorrupt)
+	}
+	for _, name := range lines[2:] {
+		table, err := openDiskTable(filepath.Join(e.dir, name))
+		if err != nil {
+			return err
+		}
+		e.tables = append(e.tables, table)
+	}
+	return e.removeOrphans()
+}
+
+// removeOrphans deletes tables that a crash left behind before they made it
+// into the manifest, or after they were merged out of it.
+func (e *diskEngine) removeOrphans() error {
+	live := map[string]bool{}
+	for _, table := range e.tables {
+		live[filepath.Base(table.path)] = true
+	}
+	names, err := filepath.Glob(filepath.Join(e.dir, "*"+diskTableSuffix))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !live[filepath.Base(name)] {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *diskEngine) writeManifest() error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\nnext %d\n", diskManifestHeader, e.nextID)
+	for _, table := range e.tables {
+		fmt.Fprintln(&buf, filepath.Base(table.path))
+	}
+	return writeFileAtomic(filepath.Join(e.dir, diskManifestName), buf.Bytes())
+}
+
+// replayLog applies the write-ahead log to the memtable. A record cut short
+// at the end of the log, as a crash mid-write leaves it, is dropped and the
+// log truncated before it.
+func (e *diskEngine) replayLog() error {
+	path := filepath.Join(e.dir, diskLogName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	offset := 0
+	for offset < len(data) {
+		rest := data[offset:]
+		if len(rest) < 8 || len(rest) < 8+int(binary.BigEndian.Uint32(rest)) {
+			return os.Truncate(path, int64(offset))
+		}
+		length := int(binary.BigEndian.Uint32(rest))
+		payload := rest[8 : 8+length]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(rest[4:]) {
+			if 8+length == len(rest) {
+				return os.Truncate(path, int64(offset))
+			}
+			return fmt.Errorf("%s: offset %d: %w", diskLogName, offset, ErrDiskCorrupt)
+		}
+		batch, err := decodeDiskBatch(payload)
+		if err != nil {
+			return fmt.Errorf("%s: offset %d: %w", diskLogName, offset, err)
+		}
+		for i, key := range batch.keys {
+			e.memtable.set(key, batch.entries[i])
+		}
+		offset += 8 + length
+	}
+	return nil
+}
+
+func encodeDiskBatch(b *diskBatch) []byte {
+	var payload snapshotEncoder
+	payload.writeUvarint(uint64(len(b.keys)))
+	for i, key := range b.keys {
+		if b.entries[i].deleted {
+			payload.WriteByte(diskDelete)
+		} else {
+			payload.WriteByte(diskPut)
+		}
+		payload.writeString(key)
+		payload.writeString(b.entries[i].value)
+	}
+	record := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(record, uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(record, payload.Bytes()...)
+}
+
+func decodeDiskBatch(payload []byte) (*diskBatch, error) {
+	d := &snapshotDecoder{data: payload}
+	count := d.length()
+	batch := &diskBatch{}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		kind := d.byte()
+		key := d.string()
+		value := d.string()
+		if kind == diskDelete {
+			batch.delete(key)
+		} else {
+			batch.put(key, value)
+		}
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return nil, ErrDiskCorrupt
+	}
+	return batch, nil
+}
+
+// apply logs the batch and then applies it, flushing the memtable if it's
+// grown past its limit.
+func (e *diskEngine) apply(b *diskBatch) error {
+	if len(b.keys) == 0 {
+		return nil
+	}
+	if e.pending != nil {
+		e.pending.keys = append(e.pending.keys, b.keys...)
+		e.pending.entries = append(e.pending.entries, b.entries...)
+	} else if err := e.writeLog(b); err != nil {
+		return err
+	}
+	for i, key := range b.keys {
+		e.memtable.set(key, b.entries[i])
+	}
+	if e.pending == nil && e.memtable.size >= e.memtableSize {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *diskEngine) writeLog(b *diskBatch) error {
+	if _, err := e.log.Write(encodeDiskBatch(b)); err != nil {
+		return err
+	}
+	if e.fsync == FsyncAlways {
+		return e.log.Sync()
+	}
+	return nil
+}
+
+// begin holds writes back from the log until commit, which logs them as a
+// single batch so that a crash loses either all of them or none. They can be
+// read in the meantime. It reports false if writes were already held back.
+func (e *diskEngine) begin() bool {
+	if e.pending != nil {
+		return false
+	}
+	e.pending = &diskBatch{}
+	return true
+}
+
+func (e *diskEngine) commit() error {
+	b := e.pending
+	e.pending = nil
+	if len(b.keys) == 0 {
+		return nil
+	}
+	if err := e.writeLog(b); err != nil {
+		return err
+	}
+	if e.memtable.size >= e.memtableSize {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *diskEngine) get(key string) (string, bool, error) {
+	if entry, ok := e.memtable.entries[key]; ok {
+		return entry.value, !entry.deleted, nil
+	}
+	for _, table := range e.tables {
+		entry, ok, err := table.get(key)
+		if err != nil || ok {
+			return entry.value, ok && !entry.deleted, err
+		}
+	}
+	return "", false, nil
+}
+
+// scan calls fn with each live key in [start, end) in order, until fn
+// returns false. An empty end means no upper bound.
+func (e *diskEngine) scan(start, end string, fn func(key, value string) bool) error {
+	iterators := []diskIterator{e.memtable.iterator(start)}
+	for _, table := range e.tables {
+		iterators = append(iterators, table.iterator(start))
+	}
+	return mergeDiskIterators(iterators, func(key string, entry diskEntry) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		return entry.deleted || fn(key, entry.value)
+	})
+}
+
+// prefixEnd returns the first key after every key that starts with prefix,
+// or "" if there's none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// flush writes the memtable out as the newest table, empties the log and
+// merges tables that have become similar in size.
+func (e *diskEngine) flush() error {
+	if len(e.memtable.entries) > 0 {
+		table, err := e.writeTable(e.memtable.iterator(""), false)
+		if err != nil {
+			return err
+		}
+		if table != nil {
+			e.tables = append([]*diskTable{table}, e.tables...)
+		}
+		if err := e.writeManifest(); err != nil {
+			return err
+		}
+		if err := e.resetLog(); err != nil {
+			return err
+		}
+		e.memtable = newMemtable()
+	}
+	for len(e.tables) >= 2 && e.tables[0].size*2 >= e.tables[1].size {
+		if err := e.mergeNewest(2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *diskEngine) resetLog() error {
+	if err := e.log.Close(); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(filepath.Join(e.dir, diskLogName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	e.log = log
+	return log.Sync()
+}
+
+// mergeNewest replaces the n newest tables with one. Tombstones are only
+// dropped when the oldest table is included, as there's nothing older left
+// for them to hide.
+func (e *diskEngine) mergeNewest(n int) error {
+	merging := e.tables[:n]
+	iterators := make([]diskIterator, n)
+	for i, table := range merging {
+		iterators[i] = table.iterator("")
+	}
+	table, err := e.writeTable(&mergingIterator{iterators: iterators}, n == len(e.tables))
+	if err != nil {
+		return err
+	}
+	remaining := append([]*diskTable{}, e.tables[n:]...)
+	if table != nil {
+		remaining = append([]*diskTable{table}, remaining...)
+	}
+	e.tables = remaining
+	if err := e.writeManifest(); err != nil {
+		return err
+	}
+	for _, old := range merging {
+		old.file.Close()
+		os.Remove(old.path)
+	}
+	return nil
+}
+
+// writeTable writes the entries of it to a new table, returning nil if there
+// were none to write.
+func (e *diskEngine) writeTable(it diskIterator, dropTombstones bool) (*diskTable, error) {
+	path := filepath.Join(e.dir, fmt.Sprintf("%06d%s", e.nextID, diskTableSuffix))
+	e.nextID++
+	w, err := newDiskTableWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	for ; it.valid(); it.next() {
+		if entry := it.entry(); !entry.deleted || !dropTombstones {
+			if err := w.add(it.key(), entry); err != nil {
+				w.abort()
+				return nil, err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if w.count == 0 {
+		w.abort()
+		return nil, nil
+	}
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+	return openDiskTable(path)
+}
+
+func (e *diskEngine) sync() error {
+	return e.log.Sync()
+}
+
+// close flushes the memtable, so that the next open has no log to replay,
+// and closes every file.
+func (e *diskEngine) close() error {
+	var err error
+	if e.log != nil {
+		err = e.flush()
+		if closeErr := e.log.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for _, table := range e.tables {
+		table.file.Close()
+	}
+	return err
+}
+
+// A memtable holds recent writes in memory, ordered by a skiplist in which
+// every key has the same score.
+type memtable struct {
+	entries map[string]diskEntry
+	order   *skiplist
+	size    int64
+}
+
+func newMemtable() *memtable {
+	return &memtable{entries: make(map[string]diskEntry), order: newSkiplist()}
+}
+
+func (m *memtable) set(key string, entry diskEntry) {
+	if _, ok := m.entries[key]; !ok {
+		m.order.insert(0, key)
+	}
+	m.entries[key] = entry
+	m.size += int64(len(key) + len(entry.value) + 32)
+}
+
+func (m *memtable) iterator(start string) diskIterator {
+	return &memtableIterator{memtable: m, node: m.order.first(lexBound{value: start})}
+}
+
+type diskIterator interface {
+	valid() bool
+	key() string
+	entry() diskEntry
+	next()
+	err() error
+}
+
+type memtableIterator struct {
+	memtable *memtable
+	node     *skiplistNode
+}
+
+func (it *memtableIterator) valid() bool      { return it.node != nil }
+func (it *memtableIterator) key() string      { return it.node.member }
+func (it *memtableIterator) entry() diskEntry { return it.memtable.entries[it.node.member] }
+func (it *memtableIterator) next()            { it.node = it.node.levels[0].next }
+func (it *memtableIterator) err() error       { return nil }
+
+// A mergingIterator merges iterators ordered newest first, yielding each key
+// once with its newest entry.
+type mergingIterator struct {
+	iterators []diskIterator
+	current   int
+	started   bool
+}
+
+func (it *mergingIterator) pick() {
+	it.current = -1
+	for i, source := range it.iterators {
+		if source.valid() && (it.current < 0 || source.key() < it.iterators[it.current].key()) {
+			it.current = i
+		}
+	}
+}
+
+func (it *mergingIterator) valid() bool {
+	if !it.started {
+		it.started = true
+		it.pick()
+	}
+	return it.current >= 0
+}
+
+func (it *mergingIterator) key() string      { return it.iterators[it.current].key() }
+func (it *mergingIterator) entry() diskEntry { return it.iterators[it.current].entry() }
+
+func (it *mergingIterator) next() {
+	key := it.key()
+	for _, source := range it.iterators {
+		if source.valid() && source.key() == key {
+			source.next()
+		}
+	}
+	it.pick()
+}
+
+func (it *mergingIterator) err() error {
+	for _, source := range it.iterators {
+		if err := source.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeDiskIterators(iterators []diskIterator, fn func(key string, entry diskEntry) bool) error {
+	it := &mergingIterator{iterators: iterators}
+	for it.valid() && fn(it.key(), it.entry()) {
+		it.next()
+	}
+	return it.err()
+}
+
+// A diskTable is an immutable file of sorted entries in checksummed blocks,
+// followed by an index holding the first key of every block and a footer
+// locating the index. Only the index is kept in memory.
+type diskTable struct {
+	path   string
+	file   *os.File
+	size   int64
+	blocks []diskTableBlock
+}
+
+type diskTableBlock struct {
+	first    string
+	offset   int64
+	length   int64
+	checksum uint32
+}
+
+type diskTableEntry struct {
+	key   string
+	entry diskEntry
+}
+
+func openDiskTable(path string) (*diskTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	table, err := readDiskTable(path, file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	return table, nil
+}
+
+func readDiskTable(path string, file *os.File) (*diskTable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(diskTableFooterSize) {
+		return nil, ErrDiskCorrupt
+	}
+	footer := make([]byte, diskTableFooterSize)
+	if _, err := file.ReadAt(footer, size-int64(diskTableFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[:len(diskTableMagic)]) != diskTableMagic {
+		return nil, ErrDiskCorrupt
+	}
+	footer = footer[len(diskTableMagic):]
+	indexOffset := int64(binary.BigEndian.Uint64(footer))
+	indexLength := int64(binary.BigEndian.Uint32(footer[8:]))
+	if indexOffset < 0 || indexOffset+indexLength > size-int64(diskTableFooterSize) {
+		return nil, ErrDiskCorrupt
+	}
+	index := make([]byte, indexLength)
+	if _, err := file.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(index) != binary.BigEndian.Uint32(footer[12:]) {
+		return nil, ErrDiskCorrupt
+	}
+	table := &diskTable{path: path, file: file, size: size}
+	d := &snapshotDecoder{data: index}
+	for len(d.data) > 0 && d.err == nil {
+		block := diskTableBlock{first: d.string(), offset: int64(d.uvarint()), length: int64(d.uvarint())}
+		if checksum := d.take(4); d.err == nil {
+			block.checksum = binary.BigEndian.Uint32(checksum)
+		}
+		table.blocks = append(table.blocks, block)
+	}
+	if d.err != nil {
+		return nil, ErrDiskCorrupt
+	}
+	return table, nil
+}
+
+func (t *diskTable) readBlock(i int) ([]diskTableEntry, error) {
+	block := t.blocks[i]
+	data := make([]byte, block.length)
+	if _, err := t.file.ReadAt(data, block.offset); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(t.path), err)
+	}
+	if crc32.ChecksumIEEE(data) != block.checksum {
+		return nil, fmt.Errorf("%s: block %d: %w", filepath.Base(t.path), i, ErrDiskCorrupt)
+	}
+	entries := []diskTableEntry{}
+	d := &snapshotDecoder{data: data}
+	for len(d.data) > 0 && d.err == nil {
+		kind := d.byte()
+		entry := diskTableEntry{key: d.string()}
+		entry.entry.value = d.string()
+		entry.entry.deleted = kind == diskDelete
+		entries = append(entries, entry)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%s: block %d: %w", filepath.Base(t.path), i, ErrDiskCorrupt)
+	}
+	return entries, nil
+}
+
+// blockFor returns the index of the block that would hold key, or -1 if key
+// sorts before every block.
+func (t *diskTable) blockFor(key string) int {
+	return sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].first > key }) - 1
+}
+
+func (t *diskTable) get(key string) (diskEntry, bool, error) {
+	i := t.blockFor(key)
+	if i < 0 {
+		return diskEntry{}, false, nil
+	}
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return diskEntry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].key >= key })
+	if j < len(entries) && entries[j].key == key {
+		return entries[j].entry, true, nil
+	}
+	return diskEntry{}, false, nil
+}
+
+func (t *diskTable) iterator(start string) diskIterator {
+	it := &diskTableIterator{table: t, block: t.blockFor(start)}
+	if it.block < 0 {
+		it.block = 0
+	}
+	it.load()
+	for it.valid() && it.key() < start {
+		it.next()
+	}
+	return it
+}
+
+type diskTableIterator struct {
+	table   *diskTable
+	block   int
+	entries []diskTableEntry
+	pos     int
+	failure error
+}
+
+// load reads blocks from it.block on until it finds one with entries.
+func (it *diskTableIterator) load() {
+	it.entries, it.pos = nil, 0
+	for ; it.block < len(it.table.blocks) && len(it.entries) == 0; it.block++ {
+		if it.entries, it.failure = it.table.readBlock(it.block); it.failure != nil {
+			it.entries = nil
+			return
+		}
+	}
+}
+
+func (it *diskTableIterator) valid() bool      { return it.pos < len(it.entries) }
+func (it *diskTableIterator) key() string      { return it.entries[it.pos].key }
+func (it *diskTableIterator) entry() diskEntry { return it.entries[it.pos].entry }
+func (it *diskTableIterator) err() error       { return it.failure }
+
+func (it *diskTableIterator) next() {
+	it.pos++
+	if it.pos == len(it.entries) {
+		it.load()
+	}
+}
+
+type diskTableWriter struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	offset int64
+	block  snapshotEncoder
+	first  string
+	index  snapshotEncoder
+	count  int
+}
+
+func newDiskTableWriter(path string) (*diskTableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &diskTableWriter{path: path, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (w *diskTableWriter) add(key string, entry diskEntry) error {
+	if w.block.Len() == 0 {
+		w.first = key
+	}
+	if entry.deleted {
+		w.block.WriteByte(diskDelete)
+	} else {
+		w.block.WriteByte(diskPut)
+	}
+	w.block.writeString(key)
+	w.block.writeString(entry.value)
+	w.count++
+	if w.block.Len() >= diskTableBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *diskTableWriter) flushBlock() error {
+	data := w.block.Bytes()
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	w.index.writeString(w.first)
+	w.index.writeUvarint(uint64(w.offset))
+	w.index.writeUvarint(uint64(len(data)))
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(data))
+	w.index.Write(checksum[:])
+	w.offset += int64(len(data))
+	w.block.Reset()
+	return nil
+}
+
+func (w *diskTableWriter) finish() error {
+	err := w.writeIndex()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.path)
+	}
+	return err
+}
+
+func (w *diskTableWriter) writeIndex() error {
+	if w.block.Len() > 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	index := w.index.Bytes()
+	footer := make([]byte, diskTableFooterSize)
+	copy(footer, diskTableMagic)
+	binary.BigEndian.PutUint64(footer[len(diskTableMagic):], uint64(w.offset))
+	binary.BigEndian.PutUint32(footer[len(diskTableMagic)+8:], uint32(len(index)))
+	binary.BigEndian.PutUint32(footer[len(diskTableMagic)+12:], crc32.ChecksumIEEE(index))
+	for _, data := range [][]byte{index, footer} {
+		if _, err := w.writer.Write(data); err != nil {
+			return err
+		}
+	}
+	return w.writer.Flush()
+}
+
+func (w *diskTableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
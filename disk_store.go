@@ -0,0 +1,2068 @@
+package restis
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const defaultMemtableSize = 4 << 20
+
+// Keys in the engine start with one of these, so that each kind of record
+// sorts together.
+const (
+	diskMetaPrefix    = "m" // key → diskMeta
+	diskElementPrefix = "e" // key, member → collection element
+	diskExpiryPrefix  = "x" // expiry, key → "" for keys with a TTL or fields with one
+	diskFieldPrefix   = "f" // key, field → expiry of a hash field with a TTL
+)
+
+const (
+	diskString byte = iota + 1
+	diskSet
+	diskHash
+	diskList
+	diskZSet
+)
+
+var diskTypes = map[byte]string{diskString: typeString, diskSet: typeSet, diskHash: typeHash, diskList: typeList, diskZSet: typeZSet}
+
+type DiskOptions struct {
+	Path         string      // directory holding the store's files
+	Fsync        FsyncPolicy // when to sync the write-ahead log
+	MemtableSize int64       // bytes of writes held in memory; defaults to 4MB
+	Clock        Clock       // defaults to the system clock
+}
+
+// A DiskStore keeps its data on disk, so it can hold more than fits in
+// memory. Every key has a meta record holding its type, TTL and, for strings,
+// its value; each member of a set, field of a hash, item of a list and member
+// of a sorted set is a record of its own, ordered under its key, as is the
+// expiry of each hash field that has one.
+//
+// Operations are serialised. Those that need more than a key's meta record
+// and a few elements load the keys they touch into a scratch MemoryStore, run
+// there, and write back only the records that changed, so each key has to
+// fit in memory even though the dataset needn't. Keys with a TTL are expired
+// lazily and by a background cycle that walks them in expiry order.
+type DiskStore struct {
+	mu        sync.Mutex
+	engine    *diskEngine
+	scratch   *MemoryStore
+	versions  *diskVersions
+	closeOnce sync.Once
+	closed    chan struct{}
+	// transaction is set on the store a transaction runs against, where
+	// blocking operations don't wait.
+	transaction bool
+}
+
+// diskVersions numbers the writes to watched keys. Only keys that have been
+// watched are numbered, so that the store doesn't hold a number for every key
+// it has.
+type diskVersions struct {
+	last uint64
+	keys map[string]uint64
+}
+
+var _ Store = (*DiskStore)(nil)
+
+// OpenDiskStore opens the store in options.Path, creating it if needed.
+func OpenDiskStore(options DiskOptions) (*DiskStore, error) {
+	if options.Clock == nil {
+		options.Clock = systemClock{}
+	}
+	if options.MemtableSize <= 0 {
+		options.MemtableSize = defaultMemtableSize
+	}
+	engine, err := openDiskEngine(options.Path, options.Fsync, options.MemtableSize)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskStore{
+		engine:   engine,
+		scratch:  NewMemoryStoreWithClock(options.Clock),
+		versions: &diskVersions{keys: make(map[string]uint64)},
+		closed:   make(chan struct{}),
+	}
+	if options.Fsync == FsyncEverySecond {
+		go d.runFsync()
+	}
+	go d.runExpiryCycle()
+	return d, nil
+}
+
+// Close flushes the store to its tables and closes it.
+func (d *DiskStore) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.scratch.Close()
+	return d.engine.close()
+}
+
+// Broker returns the store's pub/sub broker. Messages are not stored.
+func (d *DiskStore) Broker() *Broker {
+	return d.scratch.Broker()
+}
+
+// Scripts returns the scratch store's script cache, running scripts against
+// d.
+func (d *DiskStore) Scripts() *Scripts {
+	return d.scratch.Scripts().on(d)
+}
+
+// KeyspaceEvents, SetKeyspaceEvents and WatchKeyspace report changes to
+// keys, which are made in the scratch store.
+func (d *DiskStore) KeyspaceEvents() KeyspaceEvents {
+	return d.scratch.KeyspaceEvents()
+}
+
+func (d *DiskStore) SetKeyspaceEvents(events KeyspaceEvents) {
+	d.scratch.SetKeyspaceEvents(events)
+}
+
+func (d *DiskStore) WatchKeyspace(events KeyspaceEvents) *KeyspaceWatcher {
+	return d.scratch.WatchKeyspace(events)
+}
+
+func (d *DiskStore) Transaction(fn func(tx Store) error) error {
+	return d.WatchedTransaction(nil, fn)
+}
+
+func (d *DiskStore) Watch(keys ...string) (versions map[string]uint64, err error) {
+	err = d.locked(func() error {
+		versions = make(map[string]uint64, len(keys))
+		for _, key := range keys {
+			version, err := d.version(key)
+			if err != nil {
+				return err
+			}
+			versions[key] = version
+		}
+		return nil
+	})
+	return versions, err
+}
+
+// WatchedTransaction writes the transaction to the log as a single batch, so
+// that a crash loses either all of it or none.
+func (d *DiskStore) WatchedTransaction(watched map[string]uint64, fn func(tx Store) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, version := range watched {
+		current, err := d.version(key)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			return ErrWatchedKeyChanged
+		}
+	}
+	// The store the transaction runs against shares everything but the
+	// lock, which is held until it ends.
+	tx := &DiskStore{engine: d.engine, scratch: d.scratch, versions: d.versions, closed: d.closed, transaction: true}
+	if !d.engine.begin() {
+		return fn(tx)
+	}
+	err := fn(tx)
+	if commitErr := d.engine.commit(); err == nil {
+		err = commitErr
+	}
+	return err
+}
+
+// version returns the version of key, 0 if it doesn't exist, and starts
+// numbering its writes if they weren't already. It's called with d.mu held.
+func (d *DiskStore) version(key string) (uint64, error) {
+	_, ok, err := d.meta(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	version, ok := d.versions.keys[key]
+	if !ok {
+		d.versions.last++
+		version = d.versions.last
+		d.versions.keys[key] = version
+	}
+	return version, nil
+}
+
+func (d *DiskStore) runFsync() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			d.engine.sync()
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *DiskStore) runExpiryCycle() {
+	ticker := time.NewTicker(expiryCycleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+			d.expireCycle()
+		}
+	}
+}
+
+func (d *DiskStore) expireCycle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expireDue()
+}
+
+// expireDue deletes keys and hash fields whose expiry has passed, a sample
+// of keys at a time so that the store isn't held up for long. It's called
+// with d.mu held.
+func (d *DiskStore) expireDue() {
+	for {
+		keys := []string{}
+		end := diskExpiryKey(d.scratch.now()+1, "")
+		d.engine.scan(diskExpiryPrefix, end, func(key, _ string) bool {
+			keys = append(keys, key[len(diskExpiryPrefix)+8:])
+			return len(keys) < expirySampleSize
+		})
+		if len(keys) == 0 {
+			return
+		}
+		// Locking the keys in the scratch store expires them, or their
+		// fields, there, which reports them as expired.
+		if err := d.run(keys, true, func(m *MemoryStore) error { m.lockKeys(keys)(); return nil }); err != nil {
+			return
+		}
+		if len(keys) < expirySampleSize {
+			return
+		}
+	}
+}
+
+// diskMeta is the record every key has.
+type diskMeta struct {
+	kind      byte
+	expiresAt int64
+	value     string // strings only
+	head      int64  // lists only, the position of the first item
+	count     int64  // collections only
+	// fieldsExpireAt is no later than the earliest expiry of any of a
+	// hash's fields, or 0 if none of them has one. Writes to a few fields
+	// leave it be when they clear the earliest, and the next check that
+	// finds it due sets it right.
+	fieldsExpireAt int64
+}
+
+func (m diskMeta) encode() string {
+	var e snapshotEncoder
+	e.WriteByte(m.kind)
+	e.writeUvarint(uint64(m.expiresAt))
+	switch m.kind {
+	case diskString:
+		e.WriteString(m.value)
+	case diskList:
+		var buf [binary.MaxVarintLen64]byte
+		e.Write(buf[:binary.PutVarint(buf[:], m.head)])
+		e.writeUvarint(uint64(m.count))
+	case diskHash:
+		e.writeUvarint(uint64(m.count))
+		if m.fieldsExpireAt != 0 {
+			e.writeUvarint(uint64(m.fieldsExpireAt))
+		}
+	default:
+		e.writeUvarint(uint64(m.count))
+	}
+	return e.String()
+}
+
+func decodeDiskMeta(raw string) (diskMeta, error) {
+	d := &snapshotDecoder{data: []byte(raw)}
+	m := diskMeta{kind: d.byte(), expiresAt: int64(d.uvarint())}
+	switch m.kind {
+	case diskString:
+		m.value = string(d.data)
+		d.data = nil
+	case diskList:
+		head, size := binary.Varint(d.data)
+		if size <= 0 {
+			return m, ErrDiskCorrupt
+		}
+		d.data = d.data[size:]
+		m.head = head
+		m.count = int64(d.uvarint())
+	case diskHash:
+		m.count = int64(d.uvarint())
+		if len(d.data) != 0 {
+			m.fieldsExpireAt = int64(d.uvarint())
+		}
+	case diskSet, diskZSet:
+		m.count = int64(d.uvarint())
+	default:
+		return m, ErrDiskCorrupt
+	}
+	if d.err != nil || len(d.data) != 0 {
+		return m, ErrDiskCorrupt
+	}
+	return m, nil
+}
+
+func diskMetaKey(key string) string {
+	return diskMetaPrefix + key
+}
+
+// diskElementsKey is the prefix of every element of key. Keys are length
+// prefixed so that no key's elements sort among another's.
+func diskElementsKey(key string) string {
+	var e snapshotEncoder
+	e.WriteString(diskElementPrefix)
+	e.writeString(key)
+	return e.String()
+}
+
+// diskFieldsKey is the prefix of the expiry of every field of key that has
+// one.
+func diskFieldsKey(key string) string {
+	var e snapshotEncoder
+	e.WriteString(diskFieldPrefix)
+	e.writeString(key)
+	return e.String()
+}
+
+func diskExpiryKey(at int64, key string) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(at))
+	return diskExpiryPrefix + string(buf[:]) + key
+}
+
+// encodeDiskScore encodes the score of a sorted set member, which is stored
+// as its element.
+func encodeDiskScore(score float64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(score))
+	return string(buf[:])
+}
+
+func decodeDiskScore(raw string) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64([]byte(raw)))
+}
+
+// diskListPosition encodes a list position so that positions sort in order,
+// negative ones first.
+func diskListPosition(position int64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(position)^(1<<63))
+	return string(buf[:])
+}
+
+// meta returns the meta record of key, treating expired keys as missing.
+// A hash with fields whose expiry has passed has them deleted first, so that
+// its count and elements can be relied on.
+func (d *DiskStore) meta(key string) (diskMeta, bool, error) {
+	raw, ok, err := d.engine.get(diskMetaKey(key))
+	if err != nil || !ok {
+		return diskMeta{}, false, err
+	}
+	m, err := decodeDiskMeta(raw)
+	if err != nil {
+		return m, false, err
+	}
+	now := d.scratch.now()
+	if m.expiresAt != 0 && m.expiresAt <= now {
+		return diskMeta{}, false, nil
+	}
+	if m.fieldsExpireAt != 0 && m.fieldsExpireAt <= now {
+		keys := []string{key}
+		if err := d.run(keys, true, func(m *MemoryStore) error { m.lockKeys(keys)(); return nil }); err != nil {
+			return m, false, err
+		}
+		return d.meta(key)
+	}
+	return m, true, nil
+}
+
+// typedMeta returns the meta record of key, or ErrWrongType if key holds
+// something other than kind.
+func (d *DiskStore) typedMeta(key string, kind byte) (diskMeta, bool, error) {
+	m, ok, err := d.meta(key)
+	if err == nil && ok && m.kind != kind {
+		return m, false, ErrWrongType
+	}
+	return m, ok, err
+}
+
+// element returns a single element of key, which must exist.
+func (d *DiskStore) element(key, member string) (string, bool, error) {
+	return d.engine.get(diskElementsKey(key) + member)
+}
+
+// A diskValue is everything stored under a key: its meta record and its
+// elements, keyed by their suffix after diskElementsKey.
+type diskValue struct {
+	meta         diskMeta
+	elements     map[string]string
+	list         []string
+	fieldExpires map[string]int64 // hashes only
+}
+
+// load reads a whole key, including expired ones so that writing it back
+// can delete them.
+func (d *DiskStore) load(key string) (*diskValue, error) {
+	raw, ok, err := d.engine.get(diskMetaKey(key))
+	if err != nil || !ok {
+		return nil, err
+	}
+	m, err := decodeDiskMeta(raw)
+	if err != nil {
+		return nil, err
+	}
+	v := &diskValue{meta: m, elements: map[string]string{}}
+	if m.kind == diskString {
+		return v, nil
+	}
+	prefix := diskElementsKey(key)
+	err = d.engine.scan(prefix, prefixEnd(prefix), func(k, value string) bool {
+		v.elements[k[len(prefix):]] = value
+		if m.kind == diskList {
+			v.list = append(v.list, value)
+		}
+		return true
+	})
+	if err != nil || m.fieldsExpireAt == 0 {
+		return v, err
+	}
+	v.fieldExpires = map[string]int64{}
+	prefix = diskFieldsKey(key)
+	err = d.engine.scan(prefix, prefixEnd(prefix), func(k, at string) bool {
+		v.fieldExpires[k[len(prefix):]] = int64(binary.BigEndian.Uint64([]byte(at)))
+		return true
+	})
+	return v, err
+}
+
+// install puts v into the scratch store under key.
+func (v *diskValue) install(sh *shard, key string) {
+	switch v.meta.kind {
+	case diskString:
+		sh.strings[key] = v.meta.value
+	case diskSet:
+		set := make(map[string]bool, len(v.elements))
+		for member := range v.elements {
+			set[member] = true
+		}
+		sh.sets[key] = set
+	case diskHash:
+		sh.hashes[key] = cloneHash(v.elements)
+		for field, at := range v.fieldExpires {
+			sh.setFieldExpiry(key, field, at)
+		}
+	case diskList:
+		sh.lists[key] = newDeque(v.list...)
+	case diskZSet:
+		z := newSortedSet()
+		for member, score := range v.elements {
+			z.set(member, decodeDiskScore(score))
+		}
+		sh.sortedSets[key] = z
+	}
+	if v.meta.expiresAt != 0 {
+		sh.expires[key] = v.meta.expiresAt
+	}
+}
+
+// captureDiskValue reads key back out of the scratch store, or returns nil
+// if it doesn't exist there.
+func captureDiskValue(sh *shard, key string, now int64) *diskValue {
+	if sh.expired(key, now) || !sh.exists(key) {
+		return nil
+	}
+	v := &diskValue{meta: diskMeta{expiresAt: sh.expires[key]}, elements: map[string]string{}}
+	switch sh.keyType(key) {
+	case typeString:
+		v.meta.kind = diskString
+		v.meta.value = sh.strings[key]
+	case typeSet:
+		v.meta.kind = diskSet
+		for member := range sh.sets[key] {
+			v.elements[member] = ""
+		}
+	case typeHash:
+		v.meta.kind = diskHash
+		v.elements = cloneHash(sh.hashes[key])
+		if e, ok := sh.fieldExpires[key]; ok {
+			v.fieldExpires = make(map[string]int64, len(e.at))
+			for field, at := range e.at {
+				v.fieldExpires[field] = at
+				if v.meta.fieldsExpireAt == 0 || at < v.meta.fieldsExpireAt {
+					v.meta.fieldsExpireAt = at
+				}
+			}
+		}
+	case typeList:
+		v.meta.kind = diskList
+		v.list = sh.lists[key].items()
+	case typeZSet:
+		v.meta.kind = diskZSet
+		for member, score := range sh.sortedSets[key].scores {
+			v.elements[member] = encodeDiskScore(score)
+		}
+	}
+	v.meta.count = int64(len(v.elements))
+	if v.meta.kind == diskList {
+		v.meta.count = int64(len(v.list))
+	}
+	return v
+}
+
+// diffDiskValues adds the records that turn before into after to b. Either
+// may be nil.
+func diffDiskValues(b *diskBatch, key string, before, after *diskValue) {
+	prefix := diskElementsKey(key)
+	oldExpiries, newExpiries := before.expiries(), after.expiries()
+	for at := range oldExpiries {
+		if !newExpiries[at] {
+			b.delete(diskExpiryKey(at, key))
+		}
+	}
+	for at := range newExpiries {
+		if !oldExpiries[at] {
+			b.put(diskExpiryKey(at, key), "")
+		}
+	}
+	var oldFields, newFields map[string]int64
+	if before != nil {
+		oldFields = before.fieldExpires
+	}
+	if after != nil {
+		newFields = after.fieldExpires
+	}
+	fieldsPrefix := diskFieldsKey(key)
+	for field := range oldFields {
+		if _, ok := newFields[field]; !ok {
+			b.delete(fieldsPrefix + field)
+		}
+	}
+	for field, at := range newFields {
+		if current, ok := oldFields[field]; !ok || current != at {
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], uint64(at))
+			b.put(fieldsPrefix+field, string(buf[:]))
+		}
+	}
+	if after == nil {
+		if before != nil {
+			b.delete(diskMetaKey(key))
+			for suffix := range before.elements {
+				b.delete(prefix + suffix)
+			}
+		}
+		return
+	}
+	if before == nil || before.meta.kind != after.meta.kind {
+		if before != nil {
+			for suffix := range before.elements {
+				b.delete(prefix + suffix)
+			}
+		}
+		before = &diskValue{meta: diskMeta{kind: after.meta.kind}, elements: map[string]string{}}
+	}
+	if after.meta.kind == diskList {
+		after.meta.head = diffDiskLists(b, prefix, before, after.list)
+		after.elements = nil
+	} else {
+		for suffix := range before.elements {
+			if _, ok := after.elements[suffix]; !ok {
+				b.delete(prefix + suffix)
+			}
+		}
+		for suffix, value := range after.elements {
+			if current, ok := before.elements[suffix]; !ok || current != value {
+				b.put(prefix+suffix, value)
+			}
+		}
+	}
+	if encoded := after.meta.encode(); before.meta.encode() != encoded {
+		b.put(diskMetaKey(key), encoded)
+	}
+}
+
+// expiries returns the times v is listed at in the expiry index: its own
+// expiry and the earliest of its fields'. v may be nil.
+func (v *diskValue) expiries() map[int64]bool {
+	expiries := map[int64]bool{}
+	if v == nil {
+		return expiries
+	}
+	for _, at := range []int64{v.meta.expiresAt, v.meta.fieldsExpireAt} {
+		if at != 0 {
+			expiries[at] = true
+		}
+	}
+	return expiries
+}
+
+// diffDiskLists writes items over the positions of the old list, and returns
+// the position of the first item. Items stay where they are if they were
+// pushed or popped at either end, so that those operations only write the
+// items they change.
+func diffDiskLists(b *diskBatch, prefix string, old *diskValue, items []string) int64 {
+	oldHead, oldLength := old.meta.head, int64(len(old.list))
+	at := func(position int64) (string, bool) {
+		if i := position - oldHead; i >= 0 && i < oldLength {
+			return old.list[i], true
+		}
+		return "", false
+	}
+	cost := func(head int64) int {
+		changes := 0
+		for i, item := range items {
+			if current, ok := at(head + int64(i)); !ok || current != item {
+				changes++
+			}
+		}
+		for i := int64(0); i < oldLength; i++ {
+			if position := oldHead + i; position < head || position >= head+int64(len(items)) {
+				changes++
+			}
+		}
+		return changes
+	}
+	head := oldHead
+	if aligned := oldHead + oldLength - int64(len(items)); cost(aligned) < cost(head) {
+		head = aligned
+	}
+	for i := int64(0); i < oldLength; i++ {
+		if position := oldHead + i; position < head || position >= head+int64(len(items)) {
+			b.delete(prefix + diskListPosition(position))
+		}
+	}
+	for i, item := range items {
+		if current, ok := at(head + int64(i)); !ok || current != item {
+			b.put(prefix+diskListPosition(head+int64(i)), item)
+		}
+	}
+	return head
+}
+
+// read runs fn against keys in the scratch store.
+func (d *DiskStore) read(keys []string, fn func(m *MemoryStore) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.run(keys, false, fn)
+}
+
+// update runs fn against keys in the scratch store, and writes back whatever
+// it changed.
+func (d *DiskStore) update(keys []string, fn func(m *MemoryStore) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.run(keys, true, fn)
+}
+
+// run loads keys into the scratch store, runs fn and, if write is set and fn
+// succeeds, writes the changes back. The scratch store is emptied
+// afterwards. It's called with d.mu held.
+func (d *DiskStore) run(keys []string, write bool, fn func(m *MemoryStore) error) error {
+	loaded := map[string]*diskValue{}
+	for _, key := range keys {
+		if _, ok := loaded[key]; ok {
+			continue
+		}
+		v, err := d.load(key)
+		if err != nil {
+			return err
+		}
+		loaded[key] = v
+		if v != nil {
+			sh := d.scratch.shard(key)
+			sh.Lock()
+			v.install(sh, key)
+			sh.Unlock()
+		}
+	}
+	defer func() {
+		for key := range loaded {
+			sh := d.scratch.shard(key)
+			sh.Lock()
+			sh.remove(key)
+			sh.Unlock()
+		}
+	}()
+	if err := fn(d.scratch); err != nil {
+		return err
+	}
+	if !write {
+		return nil
+	}
+	b := &diskBatch{}
+	now := d.scratch.now()
+	for key, old := range loaded {
+		sh := d.scratch.shard(key)
+		sh.Lock()
+		updated := captureDiskValue(sh, key, now)
+		_, written := sh.versions[key]
+		sh.Unlock()
+		diffDiskValues(b, key, old, updated)
+		if _, watched := d.versions.keys[key]; watched {
+			if updated == nil {
+				delete(d.versions.keys, key)
+			} else if written {
+				d.versions.last++
+				d.versions.keys[key] = d.versions.last
+			}
+		}
+	}
+	return d.engine.apply(b)
+}
+
+// A diskEdit changes a few elements of a single key in place, for writes
+// that would otherwise load the whole collection to change a member or two.
+// Its reads see its own writes.
+type diskEdit struct {
+	engine  *diskEngine
+	key     string
+	prefix  string
+	exists  bool
+	meta    diskMeta
+	batch   diskBatch
+	pending map[string]*string // suffix → value, or nil once deleted
+	events  []string
+	class   KeyspaceEvents
+}
+
+func (e *diskEdit) get(suffix string) (string, bool, error) {
+	if value, ok := e.pending[suffix]; ok {
+		if value == nil {
+			return "", false, nil
+		}
+		return *value, true, nil
+	}
+	if !e.exists {
+		return "", false, nil
+	}
+	return e.engine.get(e.prefix + suffix)
+}
+
+func (e *diskEdit) put(suffix, value string) {
+	e.pending[suffix] = &value
+	e.batch.put(e.prefix+suffix, value)
+}
+
+func (e *diskEdit) delete(suffix string) {
+	e.pending[suffix] = nil
+	e.batch.delete(e.prefix + suffix)
+}
+
+// notify records an event to report once the edit is written. An edit that
+// reports nothing changed nothing, and isn't written.
+func (e *diskEdit) notify(class KeyspaceEvents, event string) {
+	e.class = class
+	e.events = append(e.events, event)
+}
+
+// persistField deletes the expiry of a hash field, if it has one.
+func (e *diskEdit) persistField(field string) error {
+	if e.meta.fieldsExpireAt == 0 {
+		return nil
+	}
+	record := diskFieldsKey(e.key) + field
+	_, found, err := e.engine.get(record)
+	if found {
+		e.batch.delete(record)
+	}
+	return err
+}
+
+// setField sets a hash field, clearing any expiry it had.
+func (e *diskEdit) setField(field, value string) error {
+	_, found, err := e.get(field)
+	if err != nil {
+		return err
+	}
+	if !found {
+		e.meta.count++
+	}
+	e.put(field, value)
+	return e.persistField(field)
+}
+
+// popList removes up to count items from one end of a list, in the order
+// they're popped.
+func (e *diskEdit) popList(side ListSide, count int64) ([]string, error) {
+	popped := make([]string, min(count, e.meta.count))
+	for i := range popped {
+		position := e.meta.head
+		if side == ListRight {
+			position += e.meta.count - 1
+		}
+		item, _, err := e.get(diskListPosition(position))
+		if err != nil {
+			return nil, err
+		}
+		popped[i] = item
+		e.delete(diskListPosition(position))
+		if side == ListLeft {
+			e.meta.head++
+		}
+		e.meta.count--
+	}
+	if len(popped) > 0 {
+		e.notify(ListEvents, side.event("pop"))
+	}
+	return popped, nil
+}
+
+// edit runs fn against the records of key, which must hold kind if it
+// exists, and writes the elements it changed and the key's new meta record.
+// Unlike update it reads only the elements fn asks for, so it suits writes to
+// a few members of a collection of any size.
+func (d *DiskStore) edit(key string, kind byte, fn func(e *diskEdit) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.runEdit(key, kind, fn)
+}
+
+// runEdit is edit with d.mu held.
+func (d *DiskStore) runEdit(key string, kind byte, fn func(e *diskEdit) error) error {
+	if err := d.reap(key); err != nil {
+		return err
+	}
+	m, ok, err := d.typedMeta(key, kind)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		m = diskMeta{kind: kind}
+	}
+	e := &diskEdit{engine: d.engine, key: key, prefix: diskElementsKey(key), exists: ok, meta: m, pending: map[string]*string{}}
+	if err := fn(e); err != nil || len(e.events) == 0 {
+		return err
+	}
+	b := &e.batch
+	emptied := ok && e.meta.count == 0
+	if emptied {
+		b.delete(diskMetaKey(key))
+		for at := range (&diskValue{meta: m}).expiries() {
+			b.delete(diskExpiryKey(at, key))
+		}
+	} else if e.meta.count > 0 {
+		b.put(diskMetaKey(key), e.meta.encode())
+	}
+	if err := d.engine.apply(b); err != nil {
+		return err
+	}
+	if _, watched := d.versions.keys[key]; watched {
+		if e.meta.count == 0 {
+			delete(d.versions.keys, key)
+		} else {
+			d.versions.last++
+			d.versions.keys[key] = d.versions.last
+		}
+	}
+	for _, event := range e.events {
+		d.scratch.notify(e.class, event, key)
+	}
+	if emptied {
+		d.scratch.notify(GenericEvents, "del", key)
+	}
+	if kind == diskList && e.meta.count > 0 {
+		d.scratch.waiters.signal(key)
+	}
+	return nil
+}
+
+// reap deletes key if its expiry has passed, so that a write that starts it
+// afresh doesn't find its old elements. It's called with d.mu held.
+func (d *DiskStore) reap(key string) error {
+	raw, ok, err := d.engine.get(diskMetaKey(key))
+	if err != nil || !ok {
+		return err
+	}
+	m, err := decodeDiskMeta(raw)
+	if err != nil || m.expiresAt == 0 || m.expiresAt > d.scratch.now() {
+		return err
+	}
+	keys := []string{key}
+	return d.run(keys, true, func(m *MemoryStore) error { m.lockKeys(keys)(); return nil })
+}
+
+// locked runs fn with d.mu held, for operations that read records directly.
+func (d *DiskStore) locked(fn func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fn()
+}
+
+func (d *DiskStore) Delete(keys ...string) (deleted int64, err error) {
+	err = d.update(keys, func(m *MemoryStore) (err error) {
+		deleted, err = m.Delete(keys...)
+		return err
+	})
+	return deleted, err
+}
+
+func (d *DiskStore) Exists(keys ...string) (found int64, err error) {
+	err = d.locked(func() error {
+		for _, key := range keys {
+			_, ok, err := d.meta(key)
+			if err != nil {
+				return err
+			}
+			if ok {
+				found++
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func (d *DiskStore) Rename(key, newKey string) error {
+	return d.update([]string{key, newKey}, func(m *MemoryStore) error {
+		return m.Rename(key, newKey)
+	})
+}
+
+func (d *DiskStore) RenameIfNotExists(key, newKey string) (renamed bool, err error) {
+	err = d.update([]string{key, newKey}, func(m *MemoryStore) (err error) {
+		renamed, err = m.RenameIfNotExists(key, newKey)
+		return err
+	})
+	return renamed, err
+}
+
+func (d *DiskStore) Copy(source, destination string, replace bool) (copied bool, err error) {
+	err = d.update([]string{source, destination}, func(m *MemoryStore) (err error) {
+		copied, err = m.Copy(source, destination, replace)
+		return err
+	})
+	return copied, err
+}
+
+func (d *DiskStore) Type(key string) (kind string, err error) {
+	err = d.locked(func() error {
+		m, ok, err := d.meta(key)
+		kind = typeNone
+		if ok {
+			kind = diskTypes[m.kind]
+		}
+		return err
+	})
+	return kind, err
+}
+
+// RandomKey walks every key, so it takes time proportional to the size of
+// the store.
+func (d *DiskStore) RandomKey() (key string, err error) {
+	err = d.locked(func() error {
+		seen := 0
+		err := d.eachKey(func(k string, _ diskMeta) {
+			seen++
+			if rand.Intn(seen) == 0 {
+				key = k
+			}
+		})
+		if err == nil && seen == 0 {
+			err = ErrNoSuchKey
+		}
+		return err
+	})
+	return key, err
+}
+
+// eachKey calls fn with every key that hasn't expired and its meta record,
+// after deleting any hash fields whose expiry has passed. It's called with
+// d.mu held.
+func (d *DiskStore) eachKey(fn func(key string, m diskMeta)) error {
+	d.expireDue()
+	now := d.scratch.now()
+	return d.engine.scan(diskMetaPrefix, prefixEnd(diskMetaPrefix), func(k, raw string) bool {
+		if m, err := decodeDiskMeta(raw); err == nil && (m.expiresAt == 0 || m.expiresAt > now) {
+			fn(k[len(diskMetaPrefix):], m)
+		}
+		return true
+	})
+}
+
+// Keys walks every key, so it takes time proportional to the size of the
+// store.
+func (d *DiskStore) Keys(pattern string) (keys []string, err error) {
+	err = d.locked(func() error {
+		keys = []string{}
+		return d.eachKey(func(key string, _ diskMeta) {
+			if matchGlob(pattern, key) {
+				keys = append(keys, key)
+			}
+		})
+	})
+	return keys, err
+}
+
+// Scan walks every key on each call to find the page that comes next, so
+// it takes time proportional to the size of the store. Its cursors follow
+// the same order as a MemoryStore's.
+func (d *DiskStore) Scan(cursor uint64, options ScanOptions) (next uint64, keys []string, err error) {
+	count, err := options.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	err = d.locked(func() error {
+		all := []string{}
+		types := map[string]string{}
+		if err := d.eachKey(func(key string, m diskMeta) {
+			all = append(all, key)
+			types[key] = diskTypes[m.kind]
+		}); err != nil {
+			return err
+		}
+		var page []string
+		page, next = scanPage(all, keyScanPosition, cursor, count)
+		keys = []string{}
+		for _, key := range page {
+			if options.matches(key) && (options.Type == "" || types[key] == options.Type) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	return next, keys, err
+}
+
+func (d *DiskStore) Expire(key string, seconds int64) (bool, error) {
+	at, err := expiryAt(seconds, 1000, d.scratch.now())
+	if err != nil {
+		return false, err
+	}
+	return d.PExpireAt(key, at)
+}
+
+func (d *DiskStore) PExpire(key string, milliseconds int64) (bool, error) {
+	at, err := expiryAt(milliseconds, 1, d.scratch.now())
+	if err != nil {
+		return false, err
+	}
+	return d.PExpireAt(key, at)
+}
+
+func (d *DiskStore) ExpireAt(key string, timestamp int64) (bool, error) {
+	at, err := expiryAt(timestamp, 1000, 0)
+	if err != nil {
+		return false, err
+	}
+	return d.PExpireAt(key, at)
+}
+
+func (d *DiskStore) PExpireAt(key string, timestamp int64) (updated bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		updated, err = m.PExpireAt(key, timestamp)
+		return err
+	})
+	return updated, err
+}
+
+func (d *DiskStore) TTL(key string) (int64, error) {
+	ttl, err := d.PTTL(key)
+	if ttl < 0 || err != nil {
+		return ttl, err
+	}
+	return (ttl + 500) / 1000, nil
+}
+
+func (d *DiskStore) PTTL(key string) (ttl int64, err error) {
+	err = d.locked(func() error {
+		m, ok, err := d.meta(key)
+		switch {
+		case !ok:
+			ttl = -2
+		case m.expiresAt == 0:
+			ttl = -1
+		default:
+			ttl = m.expiresAt - d.scratch.now()
+		}
+		return err
+	})
+	return ttl, err
+}
+
+func (d *DiskStore) Persist(key string) (persisted bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		persisted, err = m.Persist(key)
+		return err
+	})
+	return persisted, err
+}
+
+func (d *DiskStore) Append(key, value string) (length int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		length, err = m.Append(key, value)
+		return err
+	})
+	return length, err
+}
+
+func (d *DiskStore) Get(key string) (value string, err error) {
+	err = d.locked(func() error {
+		m, _, err := d.typedMeta(key, diskString)
+		value = m.value
+		return err
+	})
+	return value, err
+}
+
+func (d *DiskStore) GetRange(key string, start, stop int64) (value string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		value, err = m.GetRange(key, start, stop)
+		return err
+	})
+	return value, err
+}
+
+func (d *DiskStore) GetSet(key, value string) (previous string, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		previous, err = m.GetSet(key, value)
+		return err
+	})
+	return previous, err
+}
+
+func (d *DiskStore) Set(key string, value string) error {
+	return d.update([]string{key}, func(m *MemoryStore) error {
+		return m.Set(key, value)
+	})
+}
+
+func (d *DiskStore) SetWithOptions(key string, value string, options SetOptions) (set bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		set, err = m.SetWithOptions(key, value, options)
+		return err
+	})
+	return set, err
+}
+
+func (d *DiskStore) SetIfExists(key string, value string) (set bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		set, err = m.SetIfExists(key, value)
+		return err
+	})
+	return set, err
+}
+
+func (d *DiskStore) SetIfNotExists(key string, value string) (set bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		set, err = m.SetIfNotExists(key, value)
+		return err
+	})
+	return set, err
+}
+
+func (d *DiskStore) MultiGet(keys []string) (values map[string]string, err error) {
+	err = d.locked(func() error {
+		values = map[string]string{}
+		for _, key := range keys {
+			m, ok, err := d.meta(key)
+			if err != nil {
+				return err
+			}
+			if ok && m.kind == diskString {
+				values[key] = m.value
+			}
+		}
+		return nil
+	})
+	return values, err
+}
+
+func (d *DiskStore) MultiSet(data map[string]string) error {
+	return d.update(mapKeys(data), func(m *MemoryStore) error {
+		return m.MultiSet(data)
+	})
+}
+
+func (d *DiskStore) MultiSetIfNotExists(data map[string]string) (set bool, err error) {
+	err = d.update(mapKeys(data), func(m *MemoryStore) (err error) {
+		set, err = m.MultiSetIfNotExists(data)
+		return err
+	})
+	return set, err
+}
+
+func (d *DiskStore) Increment(key string) (int64, error) {
+	return d.IncrementBy(key, 1)
+}
+
+func (d *DiskStore) Decrement(key string) (int64, error) {
+	return d.DecrementBy(key, 1)
+}
+
+func (d *DiskStore) IncrementBy(key string, delta int64) (n int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		n, err = m.IncrementBy(key, delta)
+		return err
+	})
+	return n, err
+}
+
+func (d *DiskStore) IncrementByFloat(key string, delta float64) (value string, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		value, err = m.IncrementByFloat(key, delta)
+		return err
+	})
+	return value, err
+}
+
+func (d *DiskStore) DecrementBy(key string, delta int64) (n int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		n, err = m.DecrementBy(key, delta)
+		return err
+	})
+	return n, err
+}
+
+func (d *DiskStore) SetRange(key string, offset int64, value string) (length int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		length, err = m.SetRange(key, offset, value)
+		return err
+	})
+	return length, err
+}
+
+func (d *DiskStore) Length(key string) (length int64, err error) {
+	err = d.locked(func() error {
+		m, _, err := d.typedMeta(key, diskString)
+		length = int64(len(m.value))
+		return err
+	})
+	return length, err
+}
+
+// count returns the number of elements in the collection at key.
+func (d *DiskStore) count(key string, kind byte) (count int64, err error) {
+	err = d.locked(func() error {
+		m, ok, err := d.typedMeta(key, kind)
+		if ok {
+			count = m.count
+		}
+		return err
+	})
+	return count, err
+}
+
+// has returns an element of the collection at key.
+func (d *DiskStore) has(key string, kind byte, member string) (value string, found bool, err error) {
+	err = d.locked(func() error {
+		_, ok, err := d.typedMeta(key, kind)
+		if err != nil || !ok {
+			return err
+		}
+		value, found, err = d.element(key, member)
+		return err
+	})
+	return value, found, err
+}
+
+func (d *DiskStore) SetAdd(key string, values ...string) error {
+	return d.edit(key, diskSet, func(e *diskEdit) error {
+		added := false
+		for _, value := range values {
+			_, found, err := e.get(value)
+			if err != nil {
+				return err
+			}
+			if !found {
+				e.put(value, "")
+				e.meta.count++
+				added = true
+			}
+		}
+		if added {
+			e.notify(SetEvents, "sadd")
+		}
+		return nil
+	})
+}
+
+func (d *DiskStore) SetRemove(key string, values ...string) error {
+	return d.edit(key, diskSet, func(e *diskEdit) error {
+		removed := false
+		for _, value := range values {
+			_, found, err := e.get(value)
+			if err != nil {
+				return err
+			}
+			if found {
+				e.delete(value)
+				e.meta.count--
+				removed = true
+			}
+		}
+		if removed {
+			e.notify(SetEvents, "srem")
+		}
+		return nil
+	})
+}
+
+func (d *DiskStore) SetIsMember(key string, value string) (bool, error) {
+	_, found, err := d.has(key, diskSet, value)
+	return found, err
+}
+
+func (d *DiskStore) SetMembers(key string) (members []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		members, err = m.SetMembers(key)
+		return err
+	})
+	return members, err
+}
+
+func (d *DiskStore) SetCardinality(key string) (int64, error) {
+	return d.count(key, diskSet)
+}
+
+func (d *DiskStore) SetScan(key string, cursor uint64, options ScanOptions) (next uint64, members []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		next, members, err = m.SetScan(key, cursor, options)
+		return err
+	})
+	return next, members, err
+}
+
+func (d *DiskStore) SetMultiIsMember(key string, values ...string) (found []bool, err error) {
+	err = d.locked(func() error {
+		_, ok, err := d.typedMeta(key, diskSet)
+		if err != nil {
+			return err
+		}
+		found = make([]bool, len(values))
+		for i, value := range values {
+			if ok {
+				if _, found[i], err = d.element(key, value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func (d *DiskStore) SetMove(source, destination, value string) (moved bool, err error) {
+	err = d.update([]string{source, destination}, func(m *MemoryStore) (err error) {
+		moved, err = m.SetMove(source, destination, value)
+		return err
+	})
+	return moved, err
+}
+
+func (d *DiskStore) SetPop(key string, count int64) (popped []string, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		popped, err = m.SetPop(key, count)
+		return err
+	})
+	return popped, err
+}
+
+func (d *DiskStore) SetRandomMember(key string, count int64) (members []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		members, err = m.SetRandomMember(key, count)
+		return err
+	})
+	return members, err
+}
+
+func (d *DiskStore) SetIntersect(keys ...string) (members []string, err error) {
+	err = d.read(keys, func(m *MemoryStore) (err error) {
+		members, err = m.SetIntersect(keys...)
+		return err
+	})
+	return members, err
+}
+
+func (d *DiskStore) SetUnion(keys ...string) (members []string, err error) {
+	err = d.read(keys, func(m *MemoryStore) (err error) {
+		members, err = m.SetUnion(keys...)
+		return err
+	})
+	return members, err
+}
+
+func (d *DiskStore) SetDifference(keys ...string) (members []string, err error) {
+	err = d.read(keys, func(m *MemoryStore) (err error) {
+		members, err = m.SetDifference(keys...)
+		return err
+	})
+	return members, err
+}
+
+func (d *DiskStore) SetIntersectStore(destination string, keys ...string) (cardinality int64, err error) {
+	err = d.update(append([]string{destination}, keys...), func(m *MemoryStore) (err error) {
+		cardinality, err = m.SetIntersectStore(destination, keys...)
+		return err
+	})
+	return cardinality, err
+}
+
+func (d *DiskStore) SetUnionStore(destination string, keys ...string) (cardinality int64, err error) {
+	err = d.update(append([]string{destination}, keys...), func(m *MemoryStore) (err error) {
+		cardinality, err = m.SetUnionStore(destination, keys...)
+		return err
+	})
+	return cardinality, err
+}
+
+func (d *DiskStore) SetDifferenceStore(destination string, keys ...string) (cardinality int64, err error) {
+	err = d.update(append([]string{destination}, keys...), func(m *MemoryStore) (err error) {
+		cardinality, err = m.SetDifferenceStore(destination, keys...)
+		return err
+	})
+	return cardinality, err
+}
+
+func (d *DiskStore) SetIntersectCardinality(limit int64, keys ...string) (cardinality int64, err error) {
+	err = d.read(keys, func(m *MemoryStore) (err error) {
+		cardinality, err = m.SetIntersectCardinality(limit, keys...)
+		return err
+	})
+	return cardinality, err
+}
+
+func (d *DiskStore) HashGet(key, field string) (string, error) {
+	value, _, err := d.has(key, diskHash, field)
+	return value, err
+}
+
+func (d *DiskStore) HashSet(key, field, value string) error {
+	return d.edit(key, diskHash, func(e *diskEdit) error {
+		e.notify(HashEvents, "hset")
+		return e.setField(field, value)
+	})
+}
+
+func (d *DiskStore) HashLength(key string) (int64, error) {
+	return d.count(key, diskHash)
+}
+
+func (d *DiskStore) HashMultiGet(key string, fields ...string) (values []string, err error) {
+	err = d.locked(func() error {
+		_, ok, err := d.typedMeta(key, diskHash)
+		if err != nil {
+			return err
+		}
+		values = []string{}
+		for _, field := range fields {
+			var value string
+			if ok {
+				if value, _, err = d.element(key, field); err != nil {
+					return err
+				}
+			}
+			values = append(values, value)
+		}
+		return nil
+	})
+	return values, err
+}
+
+func (d *DiskStore) HashMultiSet(key string, data map[string]string) error {
+	return d.edit(key, diskHash, func(e *diskEdit) error {
+		for field, value := range data {
+			if err := e.setField(field, value); err != nil {
+				return err
+			}
+		}
+		if len(data) > 0 {
+			e.notify(HashEvents, "hset")
+		}
+		return nil
+	})
+}
+
+func (d *DiskStore) HashExists(key, field string) (bool, error) {
+	_, found, err := d.has(key, diskHash, field)
+	return found, err
+}
+
+func (d *DiskStore) HashKeys(key string) (fields []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		fields, err = m.HashKeys(key)
+		return err
+	})
+	return fields, err
+}
+
+func (d *DiskStore) HashValues(key string) (values []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		values, err = m.HashValues(key)
+		return err
+	})
+	return values, err
+}
+
+func (d *DiskStore) HashScan(key string, cursor uint64, options ScanOptions) (next uint64, fields map[string]string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		next, fields, err = m.HashScan(key, cursor, options)
+		return err
+	})
+	return next, fields, err
+}
+
+func (d *DiskStore) HashDelete(key string, fields ...string) (deleted int64, err error) {
+	err = d.edit(key, diskHash, func(e *diskEdit) error {
+		for _, field := range fields {
+			_, found, err := e.get(field)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			e.delete(field)
+			e.meta.count--
+			deleted++
+			if err := e.persistField(field); err != nil {
+				return err
+			}
+		}
+		if deleted > 0 {
+			e.notify(HashEvents, "hdel")
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (d *DiskStore) HashGetAll(key string) (fields map[string]string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		fields, err = m.HashGetAll(key)
+		return err
+	})
+	return fields, err
+}
+
+func (d *DiskStore) HashStringLength(key, field string) (int64, error) {
+	value, _, err := d.has(key, diskHash, field)
+	return int64(len(value)), err
+}
+
+func (d *DiskStore) HashIncrementBy(key, field string, delta int64) (n int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		n, err = m.HashIncrementBy(key, field, delta)
+		return err
+	})
+	return n, err
+}
+
+func (d *DiskStore) HashIncrementByFloat(key, field string, delta float64) (value string, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		value, err = m.HashIncrementByFloat(key, field, delta)
+		return err
+	})
+	return value, err
+}
+
+func (d *DiskStore) HashRandomField(key string, count int64) (fields []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		fields, err = m.HashRandomField(key, count)
+		return err
+	})
+	return fields, err
+}
+
+func (d *DiskStore) HashRandomFieldWithValues(key string, count int64) (fields []HashField, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		fields, err = m.HashRandomFieldWithValues(key, count)
+		return err
+	})
+	return fields, err
+}
+
+func (d *DiskStore) HashExpire(key string, seconds int64, options HashExpireOptions, fields ...string) (results []int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		results, err = m.HashExpire(key, seconds, options, fields...)
+		return err
+	})
+	return results, err
+}
+
+func (d *DiskStore) HashPExpire(key string, milliseconds int64, options HashExpireOptions, fields ...string) (results []int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		results, err = m.HashPExpire(key, milliseconds, options, fields...)
+		return err
+	})
+	return results, err
+}
+
+func (d *DiskStore) HashExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) (results []int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		results, err = m.HashExpireAt(key, timestamp, options, fields...)
+		return err
+	})
+	return results, err
+}
+
+func (d *DiskStore) HashPExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) (results []int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		results, err = m.HashPExpireAt(key, timestamp, options, fields...)
+		return err
+	})
+	return results, err
+}
+
+func (d *DiskStore) HashTTL(key string, fields ...string) (ttls []int64, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		ttls, err = m.HashTTL(key, fields...)
+		return err
+	})
+	return ttls, err
+}
+
+func (d *DiskStore) HashPTTL(key string, fields ...string) (ttls []int64, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		ttls, err = m.HashPTTL(key, fields...)
+		return err
+	})
+	return ttls, err
+}
+
+func (d *DiskStore) HashPersist(key string, fields ...string) (results []int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		results, err = m.HashPersist(key, fields...)
+		return err
+	})
+	return results, err
+}
+
+func (d *DiskStore) HashGetWithOptions(key string, options HashFieldOptions, fields ...string) (values map[string]string, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		values, err = m.HashGetWithOptions(key, options, fields...)
+		return err
+	})
+	return values, err
+}
+
+func (d *DiskStore) HashSetWithOptions(key string, data map[string]string, options HashFieldOptions) (set bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		set, err = m.HashSetWithOptions(key, data, options)
+		return err
+	})
+	return set, err
+}
+
+func (d *DiskStore) HashSetIfExists(key, field string, value string) (set bool, err error) {
+	err = d.edit(key, diskHash, func(e *diskEdit) (err error) {
+		if _, set, err = e.get(field); err != nil || !set {
+			return err
+		}
+		e.notify(HashEvents, "hset")
+		return e.setField(field, value)
+	})
+	return set, err
+}
+
+func (d *DiskStore) HashSetIfNotExists(key, field string, value string) (set bool, err error) {
+	err = d.edit(key, diskHash, func(e *diskEdit) error {
+		_, found, err := e.get(field)
+		if err != nil || found {
+			return err
+		}
+		set = true
+		e.notify(HashEvents, "hset")
+		return e.setField(field, value)
+	})
+	return set, err
+}
+
+// listPush writes each of values at the position past the end of the list
+// on side, so pushes write only the items they add.
+func (d *DiskStore) listPush(key string, side ListSide, ifExists bool, values []string) (length int64, err error) {
+	err = d.edit(key, diskList, func(e *diskEdit) error {
+		length = e.meta.count
+		if ifExists && !e.exists {
+			return nil
+		}
+		for _, value := range values {
+			position := e.meta.head + e.meta.count
+			if side == ListLeft {
+				e.meta.head--
+				position = e.meta.head
+			}
+			e.put(diskListPosition(position), value)
+			e.meta.count++
+		}
+		if len(values) > 0 {
+			e.notify(ListEvents, side.event("push"))
+		}
+		length = e.meta.count
+		return nil
+	})
+	return length, err
+}
+
+func (d *DiskStore) ListLeftPush(key string, values ...string) (int64, error) {
+	return d.listPush(key, ListLeft, false, values)
+}
+
+func (d *DiskStore) ListRightPush(key string, values ...string) (int64, error) {
+	return d.listPush(key, ListRight, false, values)
+}
+
+// listPop pops up to count items from one end of the list at key, or
+// returns ErrNoSuchKey if it's empty.
+func (d *DiskStore) listPop(key string, side ListSide, count int64) (values []string, err error) {
+	err = d.edit(key, diskList, func(e *diskEdit) (err error) {
+		if e.meta.count == 0 {
+			return ErrNoSuchKey
+		}
+		values, err = e.popList(side, count)
+		return err
+	})
+	return values, err
+}
+
+func (d *DiskStore) ListLeftPop(key string) (string, error) {
+	values, err := d.listPop(key, ListLeft, 1)
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+func (d *DiskStore) ListRightPop(key string) (string, error) {
+	values, err := d.listPop(key, ListRight, 1)
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+func (d *DiskStore) ListLength(key string) (int64, error) {
+	return d.count(key, diskList)
+}
+
+func (d *DiskStore) ListRange(key string, start, stop int64) (items []string, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		items, err = m.ListRange(key, start, stop)
+		return err
+	})
+	return items, err
+}
+
+func (d *DiskStore) ListSet(key string, index int64, value string) error {
+	return d.update([]string{key}, func(m *MemoryStore) error {
+		return m.ListSet(key, index, value)
+	})
+}
+
+func (d *DiskStore) ListIndex(key string, index int64) (item string, err error) {
+	err = d.locked(func() error {
+		m, ok, err := d.typedMeta(key, diskList)
+		if err != nil || !ok {
+			return err
+		}
+		index = normalize(m.count, index)
+		if outOfBounds(m.count, index) {
+			return nil
+		}
+		item, _, err = d.element(key, diskListPosition(m.head+index))
+		return err
+	})
+	return item, err
+}
+
+func (d *DiskStore) ListTrim(key string, start, stop int64) error {
+	return d.update([]string{key}, func(m *MemoryStore) error {
+		return m.ListTrim(key, start, stop)
+	})
+}
+
+func (d *DiskStore) ListInsertBefore(key, pivot, value string) (length int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		length, err = m.ListInsertBefore(key, pivot, value)
+		return err
+	})
+	return length, err
+}
+
+func (d *DiskStore) ListInsertAfter(key, pivot, value string) (length int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		length, err = m.ListInsertAfter(key, pivot, value)
+		return err
+	})
+	return length, err
+}
+
+func (d *DiskStore) ListRemove(key string, count int64, value string) (removed int64, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		removed, err = m.ListRemove(key, count, value)
+		return err
+	})
+	return removed, err
+}
+
+func (d *DiskStore) ListPosition(key, value string, options ListPositionOptions) (positions []int64, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		positions, err = m.ListPosition(key, value, options)
+		return err
+	})
+	return positions, err
+}
+
+func (d *DiskStore) ListLeftPushIfExists(key string, values ...string) (int64, error) {
+	return d.listPush(key, ListLeft, true, values)
+}
+
+func (d *DiskStore) ListRightPushIfExists(key string, values ...string) (int64, error) {
+	return d.listPush(key, ListRight, true, values)
+}
+
+func (d *DiskStore) ListLeftPopCount(key string, count int64) ([]string, error) {
+	if count < 0 {
+		return nil, ErrOutOfRange
+	}
+	return d.listPop(key, ListLeft, count)
+}
+
+func (d *DiskStore) ListRightPopCount(key string, count int64) ([]string, error) {
+	if count < 0 {
+		return nil, ErrOutOfRange
+	}
+	return d.listPop(key, ListRight, count)
+}
+
+func (d *DiskStore) ListMultiPop(side ListSide, count int64, keys ...string) (key string, values []string, err error) {
+	if count <= 0 {
+		return "", nil, ErrOutOfRange
+	}
+	err = d.locked(func() (err error) {
+		var popped bool
+		key, values, popped, err = d.listPopFirst(keys, side, count)
+		if err == nil && !popped {
+			err = ErrNoSuchKey
+		}
+		return err
+	})
+	return key, values, err
+}
+
+// listPopFirst pops up to count items from the first of keys that holds a
+// non-empty list. It's called with d.mu held.
+func (d *DiskStore) listPopFirst(keys []string, side ListSide, count int64) (key string, values []string, popped bool, err error) {
+	for _, key := range keys {
+		m, ok, err := d.typedMeta(key, diskList)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if ok && m.count > 0 {
+			err = d.runEdit(key, diskList, func(e *diskEdit) (err error) {
+				values, err = e.popList(side, count)
+				return err
+			})
+			return key, values, err == nil, err
+		}
+	}
+	return "", nil, false, nil
+}
+
+func (d *DiskStore) ListMove(source, destination string, from, to ListSide) (value string, err error) {
+	err = d.update([]string{source, destination}, func(m *MemoryStore) (err error) {
+		value, err = m.ListMove(source, destination, from, to)
+		return err
+	})
+	return value, err
+}
+
+// awaitLists waits on the scratch store's queues, since that's where writes
+// are made and so where they wake waiting callers.
+func (d *DiskStore) awaitLists(ctx context.Context, timeout time.Duration, keys []string, take func() (bool, error)) error {
+	if d.transaction {
+		return takeOnce(timeout, take)
+	}
+	return d.scratch.waiters.await(ctx, timeout, d.closed, keys, take)
+}
+
+func (d *DiskStore) ListBlockingLeftPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	return d.listBlockingPop(ctx, timeout, keys, ListLeft)
+}
+
+func (d *DiskStore) ListBlockingRightPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error) {
+	return d.listBlockingPop(ctx, timeout, keys, ListRight)
+}
+
+func (d *DiskStore) listBlockingPop(ctx context.Context, timeout time.Duration, keys []string, side ListSide) (key, value string, err error) {
+	err = d.awaitLists(ctx, timeout, keys, func() (popped bool, err error) {
+		err = d.locked(func() (err error) {
+			var values []string
+			key, values, popped, err = d.listPopFirst(keys, side, 1)
+			if popped {
+				value = values[0]
+			}
+			return err
+		})
+		return popped, err
+	})
+	return key, value, err
+}
+
+func (d *DiskStore) ListBlockingMove(ctx context.Context, timeout time.Duration, source, destination string, from, to ListSide) (value string, err error) {
+	err = d.awaitLists(ctx, timeout, []string{source}, func() (bool, error) {
+		value, err = d.ListMove(source, destination, from, to)
+		if err == ErrNoSuchKey {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	return value, err
+}
+
+func (d *DiskStore) SortedSetAdd(key string, options SortedSetAddOptions, members ...ScoredMember) (count int64, err error) {
+	if err := options.validate(); err != nil {
+		return 0, err
+	}
+	for _, m := range members {
+		if math.IsNaN(m.Score) {
+			return 0, ErrNotFloat
+		}
+	}
+	err = d.edit(key, diskZSet, func(e *diskEdit) error {
+		updated := false
+		for _, m := range members {
+			raw, exists, err := e.get(m.Member)
+			if err != nil {
+				return err
+			}
+			var current float64
+			if exists {
+				current = decodeDiskScore(raw)
+			}
+			added, changed, applied := options.apply(current, exists, m.Score)
+			if !applied {
+				continue
+			}
+			e.put(m.Member, encodeDiskScore(m.Score))
+			if added {
+				e.meta.count++
+			}
+			if added || (changed && options.Changed) {
+				count++
+			}
+			updated = updated || added || changed
+		}
+		if updated {
+			e.notify(SortedSetEvents, "zadd")
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (d *DiskStore) SortedSetAddIncrement(key string, options SortedSetAddOptions, member string, delta float64) (score float64, applied bool, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		score, applied, err = m.SortedSetAddIncrement(key, options, member, delta)
+		return err
+	})
+	return score, applied, err
+}
+
+func (d *DiskStore) SortedSetRemove(key string, members ...string) (removed int64, err error) {
+	err = d.edit(key, diskZSet, func(e *diskEdit) error {
+		for _, member := range members {
+			_, found, err := e.get(member)
+			if err != nil {
+				return err
+			}
+			if found {
+				e.delete(member)
+				e.meta.count--
+				removed++
+			}
+		}
+		if removed > 0 {
+			e.notify(SortedSetEvents, "zrem")
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (d *DiskStore) SortedSetScore(key, member string) (float64, bool, error) {
+	raw, found, err := d.has(key, diskZSet, member)
+	if !found || err != nil {
+		return 0, false, err
+	}
+	return decodeDiskScore(raw), true, nil
+}
+
+func (d *DiskStore) SortedSetIncrementBy(key, member string, delta float64) (float64, error) {
+	score, _, err := d.SortedSetAddIncrement(key, SortedSetAddOptions{}, member, delta)
+	return score, err
+}
+
+func (d *DiskStore) SortedSetCardinality(key string) (int64, error) {
+	return d.count(key, diskZSet)
+}
+
+func (d *DiskStore) SortedSetCount(key, min, max string) (count int64, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		count, err = m.SortedSetCount(key, min, max)
+		return err
+	})
+	return count, err
+}
+
+func (d *DiskStore) SortedSetRank(key, member string) (rank int64, found bool, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		rank, found, err = m.SortedSetRank(key, member)
+		return err
+	})
+	return rank, found, err
+}
+
+func (d *DiskStore) SortedSetReverseRank(key, member string) (rank int64, found bool, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		rank, found, err = m.SortedSetReverseRank(key, member)
+		return err
+	})
+	return rank, found, err
+}
+
+func (d *DiskStore) SortedSetRange(key string, query SortedSetRange) (members []ScoredMember, err error) {
+	err = d.read([]string{key}, func(m *MemoryStore) (err error) {
+		members, err = m.SortedSetRange(key, query)
+		return err
+	})
+	return members, err
+}
+
+func (d *DiskStore) SortedSetRangeStore(destination, key string, query SortedSetRange) (length int64, err error) {
+	err = d.update([]string{destination, key}, func(m *MemoryStore) (err error) {
+		length, err = m.SortedSetRangeStore(destination, key, query)
+		return err
+	})
+	return length, err
+}
+
+func (d *DiskStore) SortedSetPopMin(key string, count int64) (popped []ScoredMember, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		popped, err = m.SortedSetPopMin(key, count)
+		return err
+	})
+	return popped, err
+}
+
+func (d *DiskStore) SortedSetPopMax(key string, count int64) (popped []ScoredMember, err error) {
+	err = d.update([]string{key}, func(m *MemoryStore) (err error) {
+		popped, err = m.SortedSetPopMax(key, count)
+		return err
+	})
+	return popped, err
+}
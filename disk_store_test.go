@@ -0,0 +1,222 @@
+package restis
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openDisk(t *testing.T, options DiskOptions) *DiskStore {
+	store, err := OpenDiskStore(options)
+	return opened(t, store, err)
+}
+
+func TestDiskStore(t *testing.T) {
+	storeGen := func() Store {
+		return openDisk(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store"), Fsync: FsyncNever})
+	}
+	RunAllTestsOnStore(t, storeGen)
+	RunAllRedisDocChecksOnStore(t, storeGen)
+}
+
+func TestDiskStoreSmallMemtable(t *testing.T) {
+	// A tiny memtable flushes and merges tables all the time.
+	storeGen := func() Store {
+		return openDisk(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store"), Fsync: FsyncNever, MemtableSize: 256})
+	}
+	RunAllTestsOnStore(t, storeGen)
+	RunAllRedisDocChecksOnStore(t, storeGen)
+}
+
+func TestDiskStoreRestart(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := DiskOptions{Path: filepath.Join(t.TempDir(), "store"), Fsync: FsyncAlways, Clock: clock, MemtableSize: 1024}
+	store := openDisk(t, options)
+	assert.NoError(t, store.Set("s", "string"))
+	assert.NoError(t, store.SetAdd("set", "a", "b", "c"))
+	assert.NoError(t, store.SetRemove("set", "b"))
+	assert.NoError(t, store.HashMultiSet("hash", map[string]string{"f1": "v1", "f2": ""}))
+	ok(store.ListRightPush("list", "x", "y", "z"))
+	ok(store.ListLeftPush("list", "w"))
+	ok(store.ListRightPop("list"))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"low", math.Inf(-1)}, ScoredMember{"mid", 1.5}))
+	ok(store.SetWithOptions("volatile", "v", SetOptions{ExpireSeconds: 100}))
+	ok(store.SetWithOptions("short", "v", SetOptions{ExpireSeconds: 1}))
+	assert.NoError(t, store.HashMultiSet("fields", map[string]string{"f1": "v1", "f2": "v2", "f3": "v3"}))
+	ok(store.HashExpire("fields", 100, HashExpireOptions{}, "f1"))
+	ok(store.HashExpire("fields", 1, HashExpireOptions{}, "f2"))
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, store.Set(fmt.Sprintf("bulk:%03d", i), fmt.Sprint(i)))
+	}
+	assert.NoError(t, store.Close())
+
+	clock.Advance(2 * time.Second)
+	store = openDisk(t, options)
+	assert.Equal(t, 9, ok(store.Exists("s", "set", "hash", "fields", "list", "zset", "volatile", "short", "bulk:000", "bulk:199")))
+	assert.Equal(t, "string", ok(store.Get("s")))
+	members := ok(store.SetMembers("set")).([]string)
+	sort.Strings(members)
+	assert.Equal(t, []string{"a", "c"}, members)
+	assert.Equal(t, []string{"v1", ""}, ok(store.HashMultiGet("hash", "f1", "f2")))
+	assert.Equal(t, []string{"w", "x", "y"}, ok(store.ListRange("list", 0, -1)))
+	assert.Equal(t, "x", ok(store.ListIndex("list", 1)))
+	assert.Equal(t, []ScoredMember{{"low", math.Inf(-1)}, {"mid", 1.5}}, ok(store.SortedSetRange("zset", everything())))
+	assert.Equal(t, 98000, ok(store.PTTL("volatile")))
+	assert.Equal(t, []int64{98000, -2, -1}, ok(store.HashPTTL("fields", "f1", "f2", "f3")))
+	assert.Equal(t, map[string]string{"f1": "v1", "f3": "v3"}, ok(store.HashGetAll("fields")))
+	assert.Equal(t, "123", ok(store.Get("bulk:123")))
+	assert.True(t, len(store.engine.tables) > 0)
+}
+
+func TestDiskStoreEdits(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := DiskOptions{Path: filepath.Join(t.TempDir(), "store"), Clock: clock, MemtableSize: 1024}
+	store := openDisk(t, options)
+	for i := 0; i < 100; i++ {
+		ok(store.ListRightPush("list", fmt.Sprint(i)))
+		ok(store.ListLeftPush("list", fmt.Sprint(-i)))
+	}
+	assert.Equal(t, []string{"-99", "-98"}, ok(store.ListLeftPopCount("list", 2)))
+	assert.Equal(t, "99", ok(store.ListRightPop("list")))
+	assert.Equal(t, 197, ok(store.ListLength("list")))
+	ok(store.Expire("list", 1))
+	assert.NoError(t, store.SetAdd("set", "a", "b", "a"))
+	assert.NoError(t, store.SetRemove("set", "a", "c"))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"a", 1}, ScoredMember{"b", 2}))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{GreaterThan: true}, ScoredMember{"a", 0}, ScoredMember{"b", 3}))
+	assert.NoError(t, store.Close())
+
+	clock.Advance(2 * time.Second)
+	store = openDisk(t, options)
+	assert.Equal(t, 1, ok(store.ListRightPush("list", "fresh")))
+	assert.Equal(t, []string{"fresh"}, ok(store.ListRange("list", 0, -1)))
+	assert.Equal(t, -1, ok(store.TTL("list")))
+	assert.Equal(t, []string{"b"}, ok(store.SetMembers("set")))
+	assert.Equal(t, []ScoredMember{{"a", 1}, {"b", 3}}, ok(store.SortedSetRange("zset", everything())))
+	assert.Equal(t, ErrWrongType, failure(store.ListLeftPush("set", "x")))
+
+	remaining := 0
+	prefix := diskElementsKey("list")
+	store.engine.scan(prefix, prefixEnd(prefix), func(string, string) bool {
+		remaining++
+		return true
+	})
+	assert.Equal(t, 1, remaining)
+}
+
+func TestDiskStoreExpiryCycle(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := openDisk(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store"), Clock: clock})
+	for i := 0; i < 3*expirySampleSize; i++ {
+		noError(t)(store.SetWithOptions(fmt.Sprint(i), "v", SetOptions{ExpireSeconds: 1}))
+	}
+	assert.NoError(t, store.SetAdd("set", "a"))
+	noError(t)(store.Expire("set", 1))
+	assert.NoError(t, store.Set("kept", "v"))
+	clock.Advance(2 * time.Second)
+	store.expireCycle()
+
+	remaining := 0
+	store.engine.scan("", "", func(string, string) bool {
+		remaining++
+		return true
+	})
+	assert.Equal(t, 1, remaining)
+}
+
+func TestDiskStoreTornLog(t *testing.T) {
+	options := DiskOptions{Path: filepath.Join(t.TempDir(), "store")}
+	store := openDisk(t, options)
+	assert.NoError(t, store.Set("k1", "v"))
+	// Leave the write in the log, as a crash would, rather than flushing it.
+	store.engine.sync()
+	log := filepath.Join(options.Path, diskLogName)
+	data, err := ioutil.ReadFile(log)
+	assert.NoError(t, err)
+
+	record := encodeDiskBatch(&diskBatch{keys: []string{diskMetaKey("k2")}, entries: []diskEntry{{value: "x"}}})
+	for name, tail := range map[string][]byte{
+		"short header": record[:5],
+		"short record": record[:len(record)-1],
+		"bad checksum": append(append([]byte{}, record[:len(record)-1]...), record[len(record)-1]^1),
+	} {
+		assert.NoError(t, ioutil.WriteFile(log, append(append([]byte{}, data...), tail...), 0644))
+		reopened, err := OpenDiskStore(options)
+		assert.NoError(t, err, name)
+		assert.Equal(t, 1, noError(t)(reopened.Exists("k1", "k2")), name)
+		info, err := os.Stat(log)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), info.Size(), name)
+		// Closing would flush the log away, which the next case needs.
+		close(reopened.closed)
+		reopened.engine.log.Close()
+	}
+
+	corrupt := append(append([]byte{}, record...), data...)
+	corrupt[len(record)-1] ^= 1
+	assert.NoError(t, ioutil.WriteFile(log, corrupt, 0644))
+	_, err = OpenDiskStore(options)
+	assert.True(t, errors.Is(err, ErrDiskCorrupt))
+}
+
+func TestDiskStoreCorruptTable(t *testing.T) {
+	options := DiskOptions{Path: filepath.Join(t.TempDir(), "store")}
+	store := openDisk(t, options)
+	assert.NoError(t, store.Set("k", "value"))
+	assert.NoError(t, store.Close())
+	tables, err := filepath.Glob(filepath.Join(options.Path, "*"+diskTableSuffix))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tables))
+	data, err := ioutil.ReadFile(tables[0])
+	assert.NoError(t, err)
+
+	data[3] ^= 1
+	assert.NoError(t, ioutil.WriteFile(tables[0], data, 0644))
+	store = openDisk(t, options)
+	_, err = store.Get("k")
+	assert.True(t, errors.Is(err, ErrDiskCorrupt))
+
+	assert.NoError(t, ioutil.WriteFile(tables[0], data[:len(data)-1], 0644))
+	_, err = OpenDiskStore(options)
+	assert.True(t, errors.Is(err, ErrDiskCorrupt))
+}
+
+func TestDiskEngineMerges(t *testing.T) {
+	engine, err := openDiskEngine(filepath.Join(t.TempDir(), "store"), FsyncNever, 512)
+	assert.NoError(t, err)
+	defer engine.close()
+	for i := 0; i < 2000; i++ {
+		b := &diskBatch{}
+		b.put(fmt.Sprintf("key:%04d", i%500), fmt.Sprint(i))
+		if i%7 == 0 {
+			b.delete(fmt.Sprintf("key:%04d", (i+1)%500))
+		}
+		assert.NoError(t, engine.apply(b))
+	}
+	assert.True(t, len(engine.tables) <= 12, len(engine.tables))
+
+	value, found, err := engine.get("key:0123")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "1623", value)
+
+	keys := []string{}
+	assert.NoError(t, engine.scan("key:0100", "key:0110", func(key, _ string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.True(t, sort.StringsAreSorted(keys))
+	for _, key := range keys {
+		assert.True(t, key >= "key:0100" && key < "key:0110")
+	}
+}
@@ -0,0 +1,28 @@
+package restis
+
+import "errors"
+
+var (
+	ErrWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrOverflow   = errors.New("ERR increment or decrement would overflow")
+	ErrNoSuchKey  = errors.New("ERR no such key")
+	ErrOutOfRange = errors.New("ERR index out of range")
+	ErrSyntax     = errors.New("ERR syntax error")
+
+	ErrInvalidExpireTime = errors.New("ERR invalid expire time")
+	ErrNotFloat          = errors.New("ERR value is not a valid float")
+	ErrMinMaxNotFloat    = errors.New("ERR min or max is not a float")
+	ErrLexRange          = errors.New("ERR min or max not valid string range item")
+	ErrScoreNaN          = errors.New("ERR resulting score is not a number (NaN)")
+	ErrInvalidCursor     = errors.New("ERR invalid cursor")
+	ErrNegativeLimit     = errors.New("ERR LIMIT can't be negative")
+	ErrNegativeCount     = errors.New("ERR COUNT can't be negative")
+	ErrNegativeMaxLen    = errors.New("ERR MAXLEN can't be negative")
+	ErrCountOutOfRange   = errors.New("ERR value is out of range")
+
+	ErrHashNotInteger         = errors.New("ERR hash value is not an integer")
+	ErrHashNotFloat           = errors.New("ERR hash value is not a float")
+	ErrNaNOrInfinity          = errors.New("ERR value is NaN or Infinity")
+	ErrIncrementNaNOrInfinity = errors.New("ERR increment would produce NaN or Infinity")
+)
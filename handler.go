@@ -0,0 +1,1933 @@
+package restis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type handler struct {
+	store Store
+}
+
+// NewHandler exposes store over HTTP, with each data type mounted under
+// /strings, /sets, /hashes, /lists and /sorted-sets, snapshots under
+// /snapshots, the append-only log under /append-only-log, pub/sub under
+// /channels, keyspace notification settings under /keyspace-events, batches
+// of requests run atomically under /transactions and registered scripts
+// under /scripts. See the README for the route table.
+func NewHandler(store Store) http.Handler {
+	return &handler{store: store}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, err := pathSegments(r.URL)
+	if err != nil || len(path) == 0 {
+		notFound(w)
+		return
+	}
+	switch path[0] {
+	case "random-key":
+		h.serveRandomKey(w, r, path[1:])
+	case "keys":
+		h.serveKeys(w, r, path[1:])
+	case "strings":
+		h.serveStrings(w, r, path[1:])
+	case "sets":
+		h.serveSets(w, r, path[1:])
+	case "hashes":
+		h.serveHashes(w, r, path[1:])
+	case "lists":
+		h.serveLists(w, r, path[1:])
+	case "sorted-sets":
+		h.serveSortedSets(w, r, path[1:])
+	case "snapshots":
+		h.serveSnapshots(w, r, path[1:])
+	case "append-only-log":
+		h.serveAppendOnlyLog(w, r, path[1:])
+	case "channels":
+		h.serveChannels(w, r, path[1:])
+	case "keyspace-events":
+		h.serveKeyspaceEvents(w, r, path[1:])
+	case "transactions":
+		h.serveTransactions(w, r, path[1:])
+	case "scripts":
+		h.serveScripts(w, r, path[1:])
+	default:
+		notFound(w)
+	}
+}
+
+func (h *handler) serveKeys(w http.ResponseWriter, r *http.Request, path []string) {
+	switch len(path) {
+	case 0:
+		keys, given := r.URL.Query()["key"]
+		switch r.Method {
+		case "GET":
+			if !given {
+				cursor, options, ok := queryScan(w, r)
+				if !ok {
+					return
+				}
+				next, page, err := h.store.Scan(cursor, options)
+				respondScan(w, "keys", next, page, err)
+				return
+			}
+			found, err := h.store.Exists(keys...)
+			respond(w, "exists", found, err)
+		case "DELETE":
+			deleted, err := h.store.Delete(keys...)
+			respond(w, "deleted", deleted, err)
+		default:
+			methodNotAllowed(w)
+		}
+	case 1:
+		key := path[0]
+		switch r.Method {
+		case "GET", "HEAD":
+			keyType, err := h.store.Type(key)
+			if err != nil || keyType == typeNone {
+				respondFound(w, false, err)
+				return
+			}
+			respond(w, "type", keyType, err)
+		case "DELETE":
+			deleted, err := h.store.Delete(key)
+			respond(w, "deleted", deleted, err)
+		default:
+			methodNotAllowed(w)
+		}
+	case 2:
+		key := path[0]
+		switch path[1] + " " + r.Method {
+		case "type GET":
+			keyType, err := h.store.Type(key)
+			respond(w, "type", keyType, err)
+		case "version GET":
+			store, ok := h.store.(transactionStore)
+			if !ok {
+				writeStoreError(w, ErrTransactionsDisabled)
+				return
+			}
+			versions, err := store.Watch(key)
+			respond(w, "version", versions[key], err)
+		case "expiry GET":
+			pttl, err := h.store.PTTL(key)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			ttl := pttl
+			if pttl >= 0 {
+				ttl = (pttl + 500) / 1000
+			}
+			writeJSON(w, http.StatusOK, jsonObject{"ttl": ttl, "pttl": pttl})
+		case "expiry PUT":
+			var body struct {
+				Seconds        *int64 `json:"seconds"`
+				Milliseconds   *int64 `json:"milliseconds"`
+				At             *int64 `json:"at"`
+				AtMilliseconds *int64 `json:"at_milliseconds"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			var updated bool
+			var err error
+			switch {
+			case body.Seconds != nil:
+				updated, err = h.store.Expire(key, *body.Seconds)
+			case body.Milliseconds != nil:
+				updated, err = h.store.PExpire(key, *body.Milliseconds)
+			case body.At != nil:
+				updated, err = h.store.ExpireAt(key, *body.At)
+			case body.AtMilliseconds != nil:
+				updated, err = h.store.PExpireAt(key, *body.AtMilliseconds)
+			default:
+				badRequest(w, "one of seconds, milliseconds, at or at_milliseconds is required")
+				return
+			}
+			respondFound(w, updated, err)
+		case "expiry DELETE":
+			persisted, err := h.store.Persist(key)
+			respondFound(w, persisted, err)
+		case "rename POST":
+			var body struct {
+				Destination string `json:"destination"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			switch r.URL.Query().Get("if") {
+			case "":
+				respondEmpty(w, h.store.Rename(key, body.Destination))
+			case "absent":
+				succeeded, err := h.store.RenameIfNotExists(key, body.Destination)
+				respondCondition(w, succeeded, err)
+			default:
+				badRequest(w, "if must be absent")
+			}
+		case "copy POST":
+			var body struct {
+				Destination string `json:"destination"`
+				Replace     bool   `json:"replace"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			copied, err := h.store.Copy(key, body.Destination, body.Replace)
+			respondCondition(w, copied, err)
+		default:
+			notFoundOrNotAllowed(w, path[1], "type", "version", "expiry", "rename", "copy")
+		}
+	default:
+		notFound(w)
+	}
+}
+
+func (h *handler) serveRandomKey(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 0 {
+		notFound(w)
+		return
+	}
+	if r.Method != "GET" {
+		methodNotAllowed(w)
+		return
+	}
+	key, err := h.store.RandomKey()
+	respond(w, "key", key, err)
+}
+
+func (h *handler) serveSnapshots(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 0 {
+		notFound(w)
+		return
+	}
+	store, ok := h.store.(snapshotStore)
+	if !ok {
+		writeStoreError(w, ErrSnapshotsDisabled)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		respond(w, "last_save", store.LastSave().Unix(), nil)
+	case "POST":
+		background, ok := queryBool(w, r, "background")
+		if !ok {
+			return
+		}
+		if !background {
+			respondEmpty(w, store.Save())
+			return
+		}
+		if err := store.BackgroundSave(); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (h *handler) serveAppendOnlyLog(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 1 || path[0] != "rewrite" {
+		notFound(w)
+		return
+	}
+	if r.Method != "POST" {
+		methodNotAllowed(w)
+		return
+	}
+	store, ok := h.store.(rewriteStore)
+	if !ok {
+		writeStoreError(w, ErrAppendOnlyDisabled)
+		return
+	}
+	if err := store.BackgroundRewrite(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *handler) serveKeyspaceEvents(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 0 {
+		notFound(w)
+		return
+	}
+	store, ok := h.store.(keyspaceEventsStore)
+	if !ok {
+		writeStoreError(w, ErrKeyspaceEventsDisabled)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		respond(w, "events", store.KeyspaceEvents().String(), nil)
+	case "PUT":
+		var body struct {
+			Events *string `json:"events"`
+		}
+		if !readJSON(w, r, &body) {
+			return
+		}
+		if body.Events == nil {
+			badRequest(w, "events is required")
+			return
+		}
+		events, err := ParseKeyspaceEvents(*body.Events)
+		if err == nil {
+			store.SetKeyspaceEvents(events)
+		}
+		respondEmpty(w, err)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// transactionRoutes are the first path segments a request in a transaction
+// can have: those that only read and write keys.
+var transactionRoutes = map[string]bool{
+	"keys": true, "random-key": true, "strings": true, "sets": true, "hashes": true, "lists": true, "sorted-sets": true,
+}
+
+type transactionRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type transactionResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// serveTransactions runs a batch of requests in a single transaction and
+// responds with each of their responses, in order.
+func (h *handler) serveTransactions(w http.ResponseWriter, r *http.Request, path []string) {
+	if len(path) != 0 {
+		notFound(w)
+		return
+	}
+	if r.Method != "POST" {
+		methodNotAllowed(w)
+		return
+	}
+	store, ok := h.store.(transactionStore)
+	if !ok {
+		writeStoreError(w, ErrTransactionsDisabled)
+		return
+	}
+	var body struct {
+		Watch    map[string]uint64    `json:"watch"`
+		Requests []transactionRequest `json:"requests"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	requests := make([]*http.Request, len(body.Requests))
+	for i, request := range body.Requests {
+		var err error
+		requests[i], err = http.NewRequest(request.Method, request.Path, bytes.NewReader(request.Body))
+		if err == nil && requests[i].URL.IsAbs() {
+			err = errors.New("path must not include a host")
+		}
+		if err != nil {
+			badRequest(w, fmt.Sprintf("requests[%d]: %s", i, err))
+			return
+		}
+		segments, err := pathSegments(requests[i].URL)
+		if err != nil || len(segments) == 0 || !transactionRoutes[segments[0]] {
+			badRequest(w, fmt.Sprintf("requests[%d]: %s can't be part of a transaction", i, request.Path))
+			return
+		}
+	}
+	responses := make([]transactionResponse, len(requests))
+	err := store.WatchedTransaction(body.Watch, func(tx Store) error {
+		txHandler := &handler{store: tx}
+		for i, request := range requests {
+			recorder := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+			txHandler.ServeHTTP(recorder, request)
+			responses[i] = transactionResponse{Status: recorder.status, Body: bytes.TrimSpace(recorder.body.Bytes())}
+		}
+		return nil
+	})
+	respond(w, "responses", responses, err)
+}
+
+// responseRecorder holds on to the response to a request in a transaction.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+// sseKeepAlive is how often an idle event stream gets a comment, so that
+// proxies don't time it out.
+const sseKeepAlive = 15 * time.Second
+
+// serveScripts registers scripts by name and runs them with the keys and
+// arguments posted to them.
+func (h *handler) serveScripts(w http.ResponseWriter, r *http.Request, path []string) {
+	store, ok := h.store.(scriptStore)
+	if !ok {
+		writeStoreError(w, ErrScriptsDisabled)
+		return
+	}
+	scripts := store.Scripts()
+	switch len(path) {
+	case 0:
+		if r.Method != "GET" {
+			methodNotAllowed(w)
+			return
+		}
+		respond(w, "scripts", scripts.Names(), nil)
+	case 1:
+		name := path[0]
+		switch r.Method {
+		case "GET":
+			source, sha, ok := scripts.Registered(name)
+			if !ok {
+				notFound(w)
+				return
+			}
+			writeJSON(w, http.StatusOK, jsonObject{"source": source, "sha": sha})
+		case "PUT":
+			var body struct {
+				Source *string `json:"source"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			if body.Source == nil {
+				badRequest(w, "source is required")
+				return
+			}
+			sha, err := scripts.Register(name, *body.Source)
+			respond(w, "sha", sha, err)
+		case "DELETE":
+			respondFound(w, scripts.Unregister(name), nil)
+		case "POST":
+			var body struct {
+				Keys []string `json:"keys"`
+				Args []string `json:"args"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			result, err := scripts.Run(name, body.Keys, body.Args)
+			if err == ErrNoScript {
+				notFound(w)
+				return
+			}
+			respond(w, "result", scriptJSON(result), err)
+		default:
+			methodNotAllowed(w)
+		}
+	default:
+		notFound(w)
+	}
+}
+
+// scriptJSON converts a script's result for encoding, with the errors it
+// can contain as {"error": message} objects.
+func scriptJSON(result interface{}) interface{} {
+	switch r := result.(type) {
+	case error:
+		return jsonObject{"error": r.Error()}
+	case []interface{}:
+		items := make([]interface{}, len(r))
+		for i, item := range r {
+			items[i] = scriptJSON(item)
+		}
+		return items
+	}
+	return result
+}
+
+func (h *handler) serveChannels(w http.ResponseWriter, r *http.Request, path []string) {
+	store, ok := h.store.(pubSubStore)
+	if !ok {
+		writeStoreError(w, ErrPubSubDisabled)
+		return
+	}
+	broker := store.Broker()
+	switch len(path) {
+	case 0:
+		if r.Method != "GET" {
+			methodNotAllowed(w)
+			return
+		}
+		respond(w, "channels", broker.Channels(r.URL.Query().Get("pattern")), nil)
+	case 1:
+		channel := path[0]
+		switch r.Method {
+		case "GET":
+			respond(w, "subscribers", broker.NumSub(channel)[0], nil)
+		case "POST":
+			var body struct {
+				Message *string `json:"message"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			if body.Message == nil {
+				badRequest(w, "message is required")
+				return
+			}
+			respond(w, "receivers", broker.Publish(channel, *body.Message), nil)
+		default:
+			methodNotAllowed(w)
+		}
+	case 2:
+		if path[1] != "events" {
+			notFound(w)
+			return
+		}
+		if r.Method != "GET" {
+			methodNotAllowed(w)
+			return
+		}
+		pattern, ok := queryBool(w, r, "pattern")
+		if !ok {
+			return
+		}
+		serveEvents(w, r, broker, path[0], pattern)
+	default:
+		notFound(w)
+	}
+}
+
+// serveEvents streams the messages on a channel, or on every channel
+// matching a pattern, as server-sent events until the client goes away or
+// falls too far behind.
+func serveEvents(w http.ResponseWriter, r *http.Request, broker *Broker, name string, pattern bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	sub := broker.NewSubscription()
+	defer sub.Close()
+	if pattern {
+		sub.PSubscribe(name)
+	} else {
+		sub.Subscribe(name)
+	}
+	// The stream lasts as long as the client stays, so the server's write
+	// timeout mustn't end it.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, ": subscribed\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case message, ok := <-sub.Messages():
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(jsonMessage{message.Channel, message.Pattern, message.Payload})
+			io.WriteString(w, "event: message\ndata: "+string(data)+"\n\n")
+			if len(sub.Messages()) > 0 {
+				continue
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+type jsonMessage struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Message string `json:"message"`
+}
+
+func (h *handler) serveStrings(w http.ResponseWriter, r *http.Request, path []string) {
+	switch len(path) {
+	case 0:
+		switch r.Method {
+		case "GET":
+			values, err := h.store.MultiGet(r.URL.Query()["key"])
+			respond(w, "values", values, err)
+		case "POST":
+			var body struct {
+				Values map[string]string `json:"values"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			switch r.URL.Query().Get("if") {
+			case "":
+				respondEmpty(w, h.store.MultiSet(body.Values))
+			case "absent":
+				succeeded, err := h.store.MultiSetIfNotExists(body.Values)
+				respondCondition(w, succeeded, err)
+			default:
+				badRequest(w, "if must be absent")
+			}
+		default:
+			methodNotAllowed(w)
+		}
+	case 1:
+		key := path[0]
+		switch r.Method {
+		case "GET", "HEAD":
+			// MultiGet tells a missing key from an empty one in a single
+			// read, but skips keys of other types, so Get is only asked
+			// about those.
+			values, err := h.store.MultiGet([]string{key})
+			value, found := values[key]
+			if err == nil && !found {
+				_, err = h.store.Get(key)
+			}
+			if err != nil || !found {
+				respondFound(w, false, err)
+				return
+			}
+			respond(w, "value", value, nil)
+		case "PUT":
+			var body struct {
+				Value   *string `json:"value"`
+				EX      int64   `json:"ex"`
+				PX      int64   `json:"px"`
+				EXAT    int64   `json:"exat"`
+				PXAT    int64   `json:"pxat"`
+				KeepTTL bool    `json:"keepttl"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			if body.Value == nil {
+				badRequest(w, "value is required")
+				return
+			}
+			options := SetOptions{
+				ExpireSeconds:        body.EX,
+				ExpireMilliseconds:   body.PX,
+				ExpireAt:             body.EXAT,
+				ExpireAtMilliseconds: body.PXAT,
+				KeepTTL:              body.KeepTTL,
+			}
+			switch r.URL.Query().Get("if") {
+			case "":
+			case "exists":
+				options.IfExists = true
+			case "absent":
+				options.IfNotExists = true
+			default:
+				badRequest(w, "if must be exists or absent")
+				return
+			}
+			succeeded, err := h.store.SetWithOptions(key, *body.Value, options)
+			respondCondition(w, succeeded, err)
+		default:
+			methodNotAllowed(w)
+		}
+	case 2:
+		key := path[0]
+		switch path[1] + " " + r.Method {
+		case "append POST":
+			value, ok := readValue(w, r)
+			if !ok {
+				return
+			}
+			length, err := h.store.Append(key, value)
+			respond(w, "length", length, err)
+		case "getset POST":
+			value, ok := readValue(w, r)
+			if !ok {
+				return
+			}
+			previous, err := h.store.GetSet(key, value)
+			respond(w, "value", previous, err)
+		case "increment POST", "decrement POST":
+			float, ok := queryBool(w, r, "float")
+			if !ok {
+				return
+			}
+			if float {
+				delta, ok := readFloatDelta(w, r)
+				if !ok {
+					return
+				}
+				if path[1] == "decrement" {
+					delta = -delta
+				}
+				value, err := h.store.IncrementByFloat(key, delta)
+				respond(w, "value", value, err)
+				return
+			}
+			delta, ok := readDelta(w, r)
+			if !ok {
+				return
+			}
+			var n int64
+			var err error
+			if path[1] == "decrement" {
+				n, err = h.store.DecrementBy(key, delta)
+			} else {
+				n, err = h.store.IncrementBy(key, delta)
+			}
+			respond(w, "value", n, err)
+		case "range GET":
+			start, stop, ok := queryRange(w, r)
+			if !ok {
+				return
+			}
+			value, err := h.store.GetRange(key, start, stop)
+			respond(w, "value", value, err)
+		case "range PUT":
+			var body struct {
+				Offset int64   `json:"offset"`
+				Value  *string `json:"value"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			if body.Value == nil {
+				badRequest(w, "value is required")
+				return
+			}
+			length, err := h.store.SetRange(key, body.Offset, *body.Value)
+			respond(w, "length", length, err)
+		case "length GET":
+			length, err := h.store.Length(key)
+			respond(w, "length", length, err)
+		default:
+			notFoundOrNotAllowed(w, path[1], "append", "getset", "increment", "decrement", "range", "length")
+		}
+	default:
+		notFound(w)
+	}
+}
+
+func (h *handler) serveSets(w http.ResponseWriter, r *http.Request, path []string) {
+	switch len(path) {
+	case 2:
+		key := path[0]
+		switch path[1] + " " + r.Method {
+		case "members GET":
+			if members, ok := r.URL.Query()["member"]; ok {
+				isMember, err := h.store.SetMultiIsMember(key, members...)
+				respond(w, "is_member", isMember, err)
+				return
+			}
+			if _, paged := r.URL.Query()["cursor"]; paged {
+				cursor, options, ok := queryScan(w, r)
+				if !ok {
+					return
+				}
+				next, members, err := h.store.SetScan(key, cursor, options)
+				respondScan(w, "members", next, members, err)
+				return
+			}
+			members, err := h.store.SetMembers(key)
+			respond(w, "members", members, err)
+		case "members POST":
+			var body struct {
+				Members []string `json:"members"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			respondEmpty(w, h.store.SetAdd(key, body.Members...))
+		case "members DELETE":
+			respondEmpty(w, h.store.SetRemove(key, r.URL.Query()["member"]...))
+		case "cardinality GET":
+			cardinality, err := h.store.SetCardinality(key)
+			respond(w, "cardinality", cardinality, err)
+		case "pop POST":
+			count, ok := queryInt(w, r, "count", 1)
+			if !ok {
+				return
+			}
+			members, err := h.store.SetPop(key, count)
+			respond(w, "members", members, err)
+		case "random GET":
+			count, ok := queryInt(w, r, "count", 1)
+			if !ok {
+				return
+			}
+			members, err := h.store.SetRandomMember(key, count)
+			respond(w, "members", members, err)
+		case "intersection GET", "union GET", "difference GET":
+			keys := append([]string{key}, r.URL.Query()["with"]...)
+			var members []string
+			var err error
+			switch path[1] {
+			case "intersection":
+				members, err = h.store.SetIntersect(keys...)
+			case "union":
+				members, err = h.store.SetUnion(keys...)
+			case "difference":
+				members, err = h.store.SetDifference(keys...)
+			}
+			respond(w, "members", members, err)
+		case "intersection POST", "union POST", "difference POST":
+			var body struct {
+				Destination string `json:"destination"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			keys := append([]string{key}, r.URL.Query()["with"]...)
+			var cardinality int64
+			var err error
+			switch path[1] {
+			case "intersection":
+				cardinality, err = h.store.SetIntersectStore(body.Destination, keys...)
+			case "union":
+				cardinality, err = h.store.SetUnionStore(body.Destination, keys...)
+			case "difference":
+				cardinality, err = h.store.SetDifferenceStore(body.Destination, keys...)
+			}
+			respond(w, "cardinality", cardinality, err)
+		default:
+			notFoundOrNotAllowed(w, path[1], "members", "cardinality", "pop", "random", "intersection", "union", "difference")
+		}
+	case 3:
+		if path[1] == "intersection" && path[2] == "cardinality" {
+			if r.Method != "GET" {
+				methodNotAllowed(w)
+				return
+			}
+			limit, ok := queryInt(w, r, "limit", 0)
+			if !ok {
+				return
+			}
+			keys := append([]string{path[0]}, r.URL.Query()["with"]...)
+			cardinality, err := h.store.SetIntersectCardinality(limit, keys...)
+			respond(w, "cardinality", cardinality, err)
+			return
+		}
+		if path[1] != "members" {
+			notFound(w)
+			return
+		}
+		key, member := path[0], path[2]
+		switch r.Method {
+		case "GET", "HEAD":
+			isMember, err := h.store.SetIsMember(key, member)
+			if err != nil || !isMember {
+				respondFound(w, isMember, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, jsonObject{"member": member})
+		case "PUT":
+			respondEmpty(w, h.store.SetAdd(key, member))
+		case "DELETE":
+			respondEmpty(w, h.store.SetRemove(key, member))
+		default:
+			methodNotAllowed(w)
+		}
+	case 4:
+		if path[1] != "members" || path[3] != "move" {
+			notFound(w)
+			return
+		}
+		if r.Method != "POST" {
+			methodNotAllowed(w)
+			return
+		}
+		var body struct {
+			Destination string `json:"destination"`
+		}
+		if !readJSON(w, r, &body) {
+			return
+		}
+		moved, err := h.store.SetMove(path[0], body.Destination, path[2])
+		respondCondition(w, moved, err)
+	default:
+		notFound(w)
+	}
+}
+
+func (h *handler) serveHashes(w http.ResponseWriter, r *http.Request, path []string) {
+	switch len(path) {
+	case 1:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			methodNotAllowed(w)
+			return
+		}
+		fields, err := h.store.HashGetAll(path[0])
+		respond(w, "fields", fields, err)
+	case 2:
+		key := path[0]
+		switch path[1] + " " + r.Method {
+		case "fields GET":
+			if fields, ok := r.URL.Query()["field"]; ok {
+				values, err := h.store.HashMultiGet(key, fields...)
+				respond(w, "values", values, err)
+				return
+			}
+			if _, paged := r.URL.Query()["cursor"]; paged {
+				cursor, options, ok := queryScan(w, r)
+				if !ok {
+					return
+				}
+				next, fields, err := h.store.HashScan(key, cursor, options)
+				respondScan(w, "fields", next, fields, err)
+				return
+			}
+			fields, err := h.store.HashKeys(key)
+			respond(w, "fields", fields, err)
+		case "fields POST":
+			var body struct {
+				Fields  map[string]string `json:"fields"`
+				EX      int64             `json:"ex"`
+				PX      int64             `json:"px"`
+				EXAT    int64             `json:"exat"`
+				PXAT    int64             `json:"pxat"`
+				KeepTTL bool              `json:"keepttl"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			options := HashFieldOptions{
+				ExpireSeconds:        body.EX,
+				ExpireMilliseconds:   body.PX,
+				ExpireAt:             body.EXAT,
+				ExpireAtMilliseconds: body.PXAT,
+				KeepTTL:              body.KeepTTL,
+			}
+			switch r.URL.Query().Get("if") {
+			case "":
+			case "exists":
+				options.IfExists = true
+			case "absent":
+				options.IfNotExists = true
+			default:
+				badRequest(w, "if must be exists or absent")
+				return
+			}
+			if options == (HashFieldOptions{}) {
+				respondEmpty(w, h.store.HashMultiSet(key, body.Fields))
+				return
+			}
+			succeeded, err := h.store.HashSetWithOptions(key, body.Fields, options)
+			respondCondition(w, succeeded, err)
+		case "fields DELETE":
+			deleted, err := h.store.HashDelete(key, r.URL.Query()["field"]...)
+			respond(w, "deleted", deleted, err)
+		case "values GET":
+			values, err := h.store.HashValues(key)
+			respond(w, "values", values, err)
+		case "length GET":
+			length, err := h.store.HashLength(key)
+			respond(w, "length", length, err)
+		case "expiry GET":
+			pttls, err := h.store.HashPTTL(key, r.URL.Query()["field"]...)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			ttls := make([]int64, len(pttls))
+			for i, pttl := range pttls {
+				ttls[i] = pttl
+				if pttl >= 0 {
+					ttls[i] = (pttl + 500) / 1000
+				}
+			}
+			writeJSON(w, http.StatusOK, jsonObject{"ttl": ttls, "pttl": pttls})
+		case "expiry PUT":
+			var body struct {
+				Seconds        *int64 `json:"seconds"`
+				Milliseconds   *int64 `json:"milliseconds"`
+				At             *int64 `json:"at"`
+				AtMilliseconds *int64 `json:"at_milliseconds"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			options, ok := queryExpireOptions(w, r)
+			if !ok {
+				return
+			}
+			fields := r.URL.Query()["field"]
+			var results []int64
+			var err error
+			switch {
+			case body.Seconds != nil:
+				results, err = h.store.HashExpire(key, *body.Seconds, options, fields...)
+			case body.Milliseconds != nil:
+				results, err = h.store.HashPExpire(key, *body.Milliseconds, options, fields...)
+			case body.At != nil:
+				results, err = h.store.HashExpireAt(key, *body.At, options, fields...)
+			case body.AtMilliseconds != nil:
+				results, err = h.store.HashPExpireAt(key, *body.AtMilliseconds, options, fields...)
+			default:
+				badRequest(w, "one of seconds, milliseconds, at or at_milliseconds is required")
+				return
+			}
+			respond(w, "results", results, err)
+		case "expiry DELETE":
+			results, err := h.store.HashPersist(key, r.URL.Query()["field"]...)
+			respond(w, "results", results, err)
+		case "getex POST":
+			var body struct {
+				Fields  []string `json:"fields"`
+				EX      int64    `json:"ex"`
+				PX      int64    `json:"px"`
+				EXAT    int64    `json:"exat"`
+				PXAT    int64    `json:"pxat"`
+				Persist bool     `json:"persist"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			values, err := h.store.HashGetWithOptions(key, HashFieldOptions{
+				ExpireSeconds:        body.EX,
+				ExpireMilliseconds:   body.PX,
+				ExpireAt:             body.EXAT,
+				ExpireAtMilliseconds: body.PXAT,
+				Persist:              body.Persist,
+			}, body.Fields...)
+			respond(w, "values", values, err)
+		case "random GET":
+			count, ok := queryInt(w, r, "count", 1)
+			if !ok {
+				return
+			}
+			withValues, ok := queryBool(w, r, "values")
+			if !ok {
+				return
+			}
+			if withValues {
+				fields, err := h.store.HashRandomFieldWithValues(key, count)
+				respond(w, "fields", hashFields(fields), err)
+				return
+			}
+			fields, err := h.store.HashRandomField(key, count)
+			respond(w, "fields", fields, err)
+		default:
+			notFoundOrNotAllowed(w, path[1], "fields", "values", "length", "expiry", "getex", "random")
+		}
+	case 3:
+		if path[1] != "fields" {
+			notFound(w)
+			return
+		}
+		key, field := path[0], path[2]
+		switch r.Method {
+		case "GET", "HEAD":
+			exists, err := h.store.HashExists(key, field)
+			if err != nil || !exists {
+				respondFound(w, exists, err)
+				return
+			}
+			value, err := h.store.HashGet(key, field)
+			respond(w, "value", value, err)
+		case "PUT":
+			value, ok := readValue(w, r)
+			if !ok {
+				return
+			}
+			switch r.URL.Query().Get("if") {
+			case "":
+				respondEmpty(w, h.store.HashSet(key, field, value))
+			case "exists":
+				succeeded, err := h.store.HashSetIfExists(key, field, value)
+				respondCondition(w, succeeded, err)
+			case "absent":
+				succeeded, err := h.store.HashSetIfNotExists(key, field, value)
+				respondCondition(w, succeeded, err)
+			default:
+				badRequest(w, "if must be exists or absent")
+			}
+		case "DELETE":
+			deleted, err := h.store.HashDelete(key, field)
+			respondFound(w, deleted > 0, err)
+		default:
+			methodNotAllowed(w)
+		}
+	case 4:
+		if path[1] != "fields" {
+			notFound(w)
+			return
+		}
+		key, field := path[0], path[2]
+		switch path[3] + " " + r.Method {
+		case "increment POST":
+			float, ok := queryBool(w, r, "float")
+			if !ok {
+				return
+			}
+			if float {
+				delta, ok := readFloatDelta(w, r)
+				if !ok {
+					return
+				}
+				value, err := h.store.HashIncrementByFloat(key, field, delta)
+				respond(w, "value", value, err)
+				return
+			}
+			delta, ok := readDelta(w, r)
+			if !ok {
+				return
+			}
+			value, err := h.store.HashIncrementBy(key, field, delta)
+			respond(w, "value", value, err)
+		case "length GET":
+			length, err := h.store.HashStringLength(key, field)
+			respond(w, "length", length, err)
+		default:
+			notFoundOrNotAllowed(w, path[3], "increment", "length")
+		}
+	default:
+		notFound(w)
+	}
+}
+
+// blockingWriteMargin is how long a blocking request has to write its
+// response once its wait is over.
+const blockingWriteMargin = 10 * time.Second
+
+// queryWait reads the wait of a blocking request, and moves the response's
+// write deadline past it, so that the server's write timeout can't fail the
+// response after an item has been taken for it. A wait of 0 has no limit, so
+// neither does the write.
+func queryWait(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	wait, ok := queryDuration(w, r, "wait")
+	if !ok || wait < 0 {
+		return wait, ok
+	}
+	deadline := time.Time{}
+	if wait > 0 {
+		deadline = time.Now().Add(wait + blockingWriteMargin)
+	}
+	http.NewResponseController(w).SetWriteDeadline(deadline)
+	return wait, true
+}
+
+// serveBlockingPop long-polls for an item from key or any of the keys given
+// as with, for up to wait, and responds with the key it came from. A client
+// that goes away stops the wait.
+func (h *handler) serveBlockingPop(w http.ResponseWriter, r *http.Request, key string, side ListSide) {
+	wait, ok := queryWait(w, r)
+	if !ok {
+		return
+	}
+	keys := append([]string{key}, r.URL.Query()["with"]...)
+	var popped, value string
+	var err error
+	if side == ListRight {
+		popped, value, err = h.store.ListBlockingRightPop(r.Context(), wait, keys...)
+	} else {
+		popped, value, err = h.store.ListBlockingLeftPop(r.Context(), wait, keys...)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"key": popped, "value": value})
+}
+
+// serveCountedPop pops up to count items, from key alone or, with keys
+// given as with, from the first of them that has any, and responds with the
+// key they came from.
+func (h *handler) serveCountedPop(w http.ResponseWriter, r *http.Request, key string, side ListSide) {
+	with := r.URL.Query()["with"]
+	count, ok := queryInt(w, r, "count", 1)
+	if !ok {
+		return
+	}
+	var items []string
+	var err error
+	switch {
+	case len(with) > 0:
+		key, items, err = h.store.ListMultiPop(side, count, append([]string{key}, with...)...)
+	case side == ListRight:
+		items, err = h.store.ListRightPopCount(key, count)
+	default:
+		items, err = h.store.ListLeftPopCount(key, count)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"key": key, "items": items})
+}
+
+func (h *handler) serveLists(w http.ResponseWriter, r *http.Request, path []string) {
+	switch len(path) {
+	case 2:
+		key := path[0]
+		switch path[1] + " " + r.Method {
+		case "items GET":
+			start, stop, ok := queryRange(w, r)
+			if !ok {
+				return
+			}
+			items, err := h.store.ListRange(key, start, stop)
+			respond(w, "items", items, err)
+		case "items POST":
+			var body struct {
+				Items []string `json:"items"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			side, ok := querySide(w, r, "side", ListRight)
+			if !ok {
+				return
+			}
+			var ifExists bool
+			switch r.URL.Query().Get("if") {
+			case "":
+			case "exists":
+				ifExists = true
+			default:
+				badRequest(w, "if must be exists")
+				return
+			}
+			var length int64
+			var err error
+			switch {
+			case side == ListLeft && ifExists:
+				length, err = h.store.ListLeftPushIfExists(key, body.Items...)
+			case side == ListLeft:
+				length, err = h.store.ListLeftPush(key, body.Items...)
+			case ifExists:
+				length, err = h.store.ListRightPushIfExists(key, body.Items...)
+			default:
+				length, err = h.store.ListRightPush(key, body.Items...)
+			}
+			respond(w, "length", length, err)
+		case "pop POST":
+			side, ok := querySide(w, r, "side", ListLeft)
+			if !ok {
+				return
+			}
+			query := r.URL.Query()
+			if _, blocking := query["wait"]; blocking {
+				h.serveBlockingPop(w, r, key, side)
+				return
+			}
+			if _, counted := query["count"]; counted || len(query["with"]) > 0 {
+				h.serveCountedPop(w, r, key, side)
+				return
+			}
+			var value string
+			var err error
+			if side == ListRight {
+				value, err = h.store.ListRightPop(key)
+			} else {
+				value, err = h.store.ListLeftPop(key)
+			}
+			respond(w, "value", value, err)
+		case "move POST":
+			var body struct {
+				Destination string `json:"destination"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			from, ok := querySide(w, r, "from", ListLeft)
+			if !ok {
+				return
+			}
+			to, ok := querySide(w, r, "to", ListRight)
+			if !ok {
+				return
+			}
+			if _, blocking := r.URL.Query()["wait"]; !blocking {
+				value, err := h.store.ListMove(key, body.Destination, from, to)
+				respond(w, "value", value, err)
+				return
+			}
+			wait, ok := queryWait(w, r)
+			if !ok {
+				return
+			}
+			value, err := h.store.ListBlockingMove(r.Context(), wait, key, body.Destination, from, to)
+			respond(w, "value", value, err)
+		case "insert POST":
+			var body struct {
+				Before *string `json:"before"`
+				After  *string `json:"after"`
+				Value  string  `json:"value"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			var length int64
+			var err error
+			switch {
+			case body.Before != nil && body.After == nil:
+				length, err = h.store.ListInsertBefore(key, *body.Before, body.Value)
+			case body.After != nil && body.Before == nil:
+				length, err = h.store.ListInsertAfter(key, *body.After, body.Value)
+			default:
+				badRequest(w, "exactly one of before and after is required")
+				return
+			}
+			switch {
+			case err == nil && length == 0:
+				notFound(w)
+			case err == nil && length < 0:
+				respondCondition(w, false, nil)
+			default:
+				respond(w, "length", length, err)
+			}
+		case "remove POST":
+			var body struct {
+				Value string `json:"value"`
+				Count int64  `json:"count"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			removed, err := h.store.ListRemove(key, body.Count, body.Value)
+			respond(w, "removed", removed, err)
+		case "positions GET":
+			var options ListPositionOptions
+			var ok bool
+			if options.Rank, ok = queryInt(w, r, "rank", 0); !ok {
+				return
+			}
+			if options.Count, ok = queryInt(w, r, "count", 0); !ok {
+				return
+			}
+			if options.MaxLen, ok = queryInt(w, r, "maxlen", 0); !ok {
+				return
+			}
+			positions, err := h.store.ListPosition(key, r.URL.Query().Get("value"), options)
+			respond(w, "positions", positions, err)
+		case "trim POST":
+			var body struct {
+				Start int64 `json:"start"`
+				Stop  int64 `json:"stop"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			respondEmpty(w, h.store.ListTrim(key, body.Start, body.Stop))
+		case "length GET":
+			length, err := h.store.ListLength(key)
+			respond(w, "length", length, err)
+		default:
+			notFoundOrNotAllowed(w, path[1], "items", "pop", "move", "insert", "remove", "positions", "trim", "length")
+		}
+	case 3:
+		if path[1] != "items" {
+			notFound(w)
+			return
+		}
+		key := path[0]
+		index, err := strconv.ParseInt(path[2], 10, 64)
+		if err != nil {
+			badRequest(w, "index must be an integer")
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			// A range of one tells an index that's out of range from an
+			// empty item in a single read.
+			items, err := h.store.ListRange(key, index, index)
+			if err != nil || len(items) == 0 {
+				respondFound(w, false, err)
+				return
+			}
+			respond(w, "value", items[0], nil)
+		case "PUT":
+			value, ok := readValue(w, r)
+			if !ok {
+				return
+			}
+			err := h.store.ListSet(key, index, value)
+			if err == ErrOutOfRange {
+				err = ErrNoSuchKey
+			}
+			respondEmpty(w, err)
+		default:
+			methodNotAllowed(w)
+		}
+	default:
+		notFound(w)
+	}
+}
+
+func (h *handler) serveSortedSets(w http.ResponseWriter, r *http.Request, path []string) {
+	switch len(path) {
+	case 2:
+		key := path[0]
+		switch path[1] + " " + r.Method {
+		case "members GET":
+			query, ok := querySortedSetRange(w, r)
+			if !ok {
+				return
+			}
+			members, err := h.store.SortedSetRange(key, query)
+			respond(w, "members", scoredMembers(members), err)
+		case "members POST":
+			var body struct {
+				Members map[string]jsonScore `json:"members"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			options, ok := queryAddOptions(w, r)
+			if !ok {
+				return
+			}
+			members := make([]ScoredMember, 0, len(body.Members))
+			for member, score := range body.Members {
+				members = append(members, ScoredMember{Member: member, Score: float64(score)})
+			}
+			count, err := h.store.SortedSetAdd(key, options, members...)
+			if options.Changed {
+				respond(w, "changed", count, err)
+			} else {
+				respond(w, "added", count, err)
+			}
+		case "members DELETE":
+			removed, err := h.store.SortedSetRemove(key, r.URL.Query()["member"]...)
+			respond(w, "removed", removed, err)
+		case "cardinality GET":
+			cardinality, err := h.store.SortedSetCardinality(key)
+			respond(w, "cardinality", cardinality, err)
+		case "count GET":
+			min, max := queryDefault(r, "min", "-inf"), queryDefault(r, "max", "+inf")
+			count, err := h.store.SortedSetCount(key, min, max)
+			respond(w, "count", count, err)
+		case "pop POST":
+			count, ok := queryInt(w, r, "count", 1)
+			if !ok {
+				return
+			}
+			var members []ScoredMember
+			var err error
+			switch r.URL.Query().Get("side") {
+			case "", "min":
+				members, err = h.store.SortedSetPopMin(key, count)
+			case "max":
+				members, err = h.store.SortedSetPopMax(key, count)
+			default:
+				badRequest(w, "side must be min or max")
+				return
+			}
+			respond(w, "members", scoredMembers(members), err)
+		case "store POST":
+			var body struct {
+				Destination string `json:"destination"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			query, ok := querySortedSetRange(w, r)
+			if !ok {
+				return
+			}
+			length, err := h.store.SortedSetRangeStore(body.Destination, key, query)
+			respond(w, "length", length, err)
+		default:
+			notFoundOrNotAllowed(w, path[1], "members", "cardinality", "count", "pop", "store")
+		}
+	case 3:
+		if path[1] != "members" {
+			notFound(w)
+			return
+		}
+		key, member := path[0], path[2]
+		switch r.Method {
+		case "GET", "HEAD":
+			score, found, err := h.store.SortedSetScore(key, member)
+			if err != nil || !found {
+				respondFound(w, found, err)
+				return
+			}
+			respond(w, "score", jsonScore(score), err)
+		case "PUT":
+			var body struct {
+				Score *jsonScore `json:"score"`
+			}
+			if !readJSON(w, r, &body) {
+				return
+			}
+			if body.Score == nil {
+				badRequest(w, "score is required")
+				return
+			}
+			_, err := h.store.SortedSetAdd(key, SortedSetAddOptions{}, ScoredMember{Member: member, Score: float64(*body.Score)})
+			respondEmpty(w, err)
+		case "DELETE":
+			removed, err := h.store.SortedSetRemove(key, member)
+			respondFound(w, removed > 0, err)
+		default:
+			methodNotAllowed(w)
+		}
+	case 4:
+		if path[1] != "members" {
+			notFound(w)
+			return
+		}
+		key, member := path[0], path[2]
+		switch path[3] + " " + r.Method {
+		case "increment POST":
+			body := struct {
+				By jsonScore `json:"by"`
+			}{By: 1}
+			if r.ContentLength != 0 && !readJSON(w, r, &body) {
+				return
+			}
+			options, ok := queryAddOptions(w, r)
+			if !ok {
+				return
+			}
+			score, applied, err := h.store.SortedSetAddIncrement(key, options, member, float64(body.By))
+			if err != nil || !applied {
+				respondCondition(w, applied, err)
+				return
+			}
+			respond(w, "score", jsonScore(score), err)
+		case "rank GET":
+			reverse, ok := queryBool(w, r, "rev")
+			if !ok {
+				return
+			}
+			var rank int64
+			var found bool
+			var err error
+			if reverse {
+				rank, found, err = h.store.SortedSetReverseRank(key, member)
+			} else {
+				rank, found, err = h.store.SortedSetRank(key, member)
+			}
+			if err != nil || !found {
+				respondFound(w, found, err)
+				return
+			}
+			respond(w, "rank", rank, err)
+		default:
+			notFoundOrNotAllowed(w, path[3], "increment", "rank")
+		}
+	default:
+		notFound(w)
+	}
+}
+
+// jsonScore encodes infinite scores as the strings "+inf" and "-inf", which
+// JSON numbers can't represent, and accepts either form when decoding.
+type jsonScore float64
+
+func (s jsonScore) MarshalJSON() ([]byte, error) {
+	switch {
+	case math.IsInf(float64(s), 1):
+		return []byte(`"+inf"`), nil
+	case math.IsInf(float64(s), -1):
+		return []byte(`"-inf"`), nil
+	}
+	return json.Marshal(float64(s))
+}
+
+func (s *jsonScore) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var f float64
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+		*s = jsonScore(f)
+		return nil
+	}
+	f, err := parseScore(raw)
+	if err != nil {
+		return err
+	}
+	*s = jsonScore(f)
+	return nil
+}
+
+type scoredMember struct {
+	Member string    `json:"member"`
+	Score  jsonScore `json:"score"`
+}
+
+func scoredMembers(members []ScoredMember) []scoredMember {
+	encoded := make([]scoredMember, len(members))
+	for i, m := range members {
+		encoded[i] = scoredMember{Member: m.Member, Score: jsonScore(m.Score)}
+	}
+	return encoded
+}
+
+type hashField struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+func hashFields(fields []HashField) []hashField {
+	encoded := make([]hashField, len(fields))
+	for i, f := range fields {
+		encoded[i] = hashField{Field: f.Field, Value: f.Value}
+	}
+	return encoded
+}
+
+func querySortedSetRange(w http.ResponseWriter, r *http.Request) (SortedSetRange, bool) {
+	query := SortedSetRange{}
+	reverse, ok := queryBool(w, r, "rev")
+	if !ok {
+		return query, false
+	}
+	query.Reverse = reverse
+	low, high := "0", "-1"
+	switch r.URL.Query().Get("by") {
+	case "", "rank":
+	case "score":
+		query.ByScore = true
+		low, high = "-inf", "+inf"
+	case "lex":
+		query.ByLex = true
+		low, high = "-", "+"
+	default:
+		badRequest(w, "by must be rank, score or lex")
+		return query, false
+	}
+	if reverse && (query.ByScore || query.ByLex) {
+		low, high = high, low
+	}
+	query.Start, query.Stop = queryDefault(r, "start", low), queryDefault(r, "stop", high)
+	values := r.URL.Query()
+	if values.Get("offset") != "" || values.Get("count") != "" {
+		offset, ok := queryInt(w, r, "offset", 0)
+		if !ok {
+			return query, false
+		}
+		count, ok := queryInt(w, r, "count", -1)
+		if !ok {
+			return query, false
+		}
+		query.Limit = &RangeLimit{Offset: offset, Count: count}
+	}
+	return query, true
+}
+
+func queryAddOptions(w http.ResponseWriter, r *http.Request) (SortedSetAddOptions, bool) {
+	options := SortedSetAddOptions{}
+	for _, condition := range r.URL.Query()["if"] {
+		switch condition {
+		case "exists":
+			options.IfExists = true
+		case "absent":
+			options.IfNotExists = true
+		case "greater":
+			options.GreaterThan = true
+		case "less":
+			options.LessThan = true
+		default:
+			badRequest(w, "if must be exists, absent, greater or less")
+			return options, false
+		}
+	}
+	changed, ok := queryBool(w, r, "changed")
+	options.Changed = changed
+	return options, ok
+}
+
+func queryExpireOptions(w http.ResponseWriter, r *http.Request) (HashExpireOptions, bool) {
+	options := HashExpireOptions{}
+	switch r.URL.Query().Get("if") {
+	case "":
+	case "absent":
+		options.IfNotExists = true
+	case "exists":
+		options.IfExists = true
+	case "greater":
+		options.GreaterThan = true
+	case "less":
+		options.LessThan = true
+	default:
+		badRequest(w, "if must be absent, exists, greater or less")
+		return options, false
+	}
+	return options, true
+}
+
+type jsonObject map[string]interface{}
+
+func pathSegments(u *url.URL) ([]string, error) {
+	escaped := strings.Trim(u.EscapedPath(), "/")
+	if escaped == "" {
+		return nil, nil
+	}
+	segments := strings.Split(escaped, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		err = errors.New("request body is empty")
+	}
+	if err != nil {
+		badRequest(w, err.Error())
+		return false
+	}
+	return true
+}
+
+func readValue(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if !readJSON(w, r, &body) {
+		return "", false
+	}
+	if body.Value == nil {
+		badRequest(w, "value is required")
+		return "", false
+	}
+	return *body.Value, true
+}
+
+func readDelta(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	body := struct {
+		By int64 `json:"by"`
+	}{By: 1}
+	if r.ContentLength == 0 {
+		return body.By, true
+	}
+	if !readJSON(w, r, &body) {
+		return 0, false
+	}
+	return body.By, true
+}
+
+// readFloatDelta is readDelta for increments by a float, which may be given
+// as "+inf" or "-inf" just like a score, if only to be refused by the store.
+func readFloatDelta(w http.ResponseWriter, r *http.Request) (float64, bool) {
+	body := struct {
+		By jsonScore `json:"by"`
+	}{By: 1}
+	if r.ContentLength == 0 {
+		return float64(body.By), true
+	}
+	if !readJSON(w, r, &body) {
+		return 0, false
+	}
+	return float64(body.By), true
+}
+
+func queryInt(w http.ResponseWriter, r *http.Request, name string, fallback int64) (int64, bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, true
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		badRequest(w, name+" must be an integer")
+		return 0, false
+	}
+	return n, true
+}
+
+func queryRange(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	start, ok := queryInt(w, r, "start", 0)
+	if !ok {
+		return 0, 0, false
+	}
+	stop, ok := queryInt(w, r, "stop", -1)
+	if !ok {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// queryScan reads a scan's cursor, which is a decimal string and 0 if it's
+// missing, and its options from ?match=, ?count= and ?type=.
+func queryScan(w http.ResponseWriter, r *http.Request) (uint64, ScanOptions, bool) {
+	query := r.URL.Query()
+	var cursor uint64
+	if raw := query.Get("cursor"); raw != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			writeStoreError(w, ErrInvalidCursor)
+			return 0, ScanOptions{}, false
+		}
+	}
+	count, ok := queryInt(w, r, "count", 0)
+	if !ok {
+		return 0, ScanOptions{}, false
+	}
+	return cursor, ScanOptions{Match: query.Get("match"), Count: count, Type: query.Get("type")}, true
+}
+
+func queryDefault(r *http.Request, name, fallback string) string {
+	if value := r.URL.Query().Get(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func queryBool(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return false, true
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		badRequest(w, name+" must be true or false")
+		return false, false
+	}
+	return b, true
+}
+
+func querySide(w http.ResponseWriter, r *http.Request, name string, fallback ListSide) (ListSide, bool) {
+	switch r.URL.Query().Get(name) {
+	case "":
+		return fallback, true
+	case "left":
+		return ListLeft, true
+	case "right":
+		return ListRight, true
+	}
+	badRequest(w, name+" must be left or right")
+	return 0, false
+}
+
+// queryDuration reads a duration like 30s or 1.5m. 0 waits without a limit.
+func queryDuration(w http.ResponseWriter, r *http.Request, name string) (time.Duration, bool) {
+	d, err := time.ParseDuration(r.URL.Query().Get(name))
+	if err != nil {
+		badRequest(w, name+" must be a duration, like 30s")
+		return 0, false
+	}
+	return d, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func respond(w http.ResponseWriter, name string, value interface{}, err error) {
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{name: value})
+}
+
+// respondScan writes a page of a scan with the cursor of the next page as a
+// string, since cursors can be too big for a JSON number.
+func respondScan(w http.ResponseWriter, name string, next uint64, page interface{}, err error) {
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"cursor": strconv.FormatUint(next, 10), name: page})
+}
+
+func respondEmpty(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	noContent(w)
+}
+
+func respondCondition(w http.ResponseWriter, succeeded bool, err error) {
+	if err == nil && !succeeded {
+		writeError(w, http.StatusPreconditionFailed, "condition not met")
+		return
+	}
+	respondEmpty(w, err)
+}
+
+func respondFound(w http.ResponseWriter, found bool, err error) {
+	if err == nil && !found {
+		err = ErrNoSuchKey
+	}
+	respondEmpty(w, err)
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*ScriptError); ok {
+		badRequest(w, err.Error())
+		return
+	}
+	switch err {
+	case ErrNoSuchKey:
+		notFound(w)
+	case ErrWrongType, ErrNotInteger, ErrOverflow, ErrScoreNaN, ErrWatchedKeyChanged, ErrHashNotInteger, ErrHashNotFloat, ErrIncrementNaNOrInfinity:
+		writeError(w, http.StatusConflict, err.Error())
+	case ErrOutOfRange, ErrSyntax, ErrInvalidExpireTime, ErrNotFloat, ErrMinMaxNotFloat, ErrLexRange, ErrInvalidCursor, ErrNegativeLimit, ErrNegativeCount, ErrNegativeMaxLen, ErrCountOutOfRange, ErrNegativeTimeout, ErrInvalidKeyspaceEvents, ErrNaNOrInfinity:
+		badRequest(w, err.Error())
+	case ErrSaveInProgress, ErrRewriteInProgress:
+		writeError(w, http.StatusConflict, err.Error())
+	case ErrScriptTimeout, ErrScriptKilled:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case ErrSnapshotsDisabled, ErrAppendOnlyDisabled, ErrPubSubDisabled, ErrKeyspaceEventsDisabled, ErrTransactionsDisabled, ErrScriptsDisabled:
+		writeError(w, http.StatusNotImplemented, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, jsonObject{"error": message})
+}
+
+func noContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func badRequest(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusBadRequest, message)
+}
+
+func notFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "not found")
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func notFoundOrNotAllowed(w http.ResponseWriter, resource string, known ...string) {
+	for _, k := range known {
+		if resource == k {
+			methodNotAllowed(w)
+			return
+		}
+	}
+	notFound(w)
+}
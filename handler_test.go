@@ -0,0 +1,532 @@
+package restis
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type httpChecker struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func (c httpChecker) check(method, path, body string, expectedStatus int, expectedBody string) {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	c.handler.ServeHTTP(recorder, request)
+	assert.Equal(c.t, expectedStatus, recorder.Code, method+" "+path)
+	assert.Equal(c.t, expectedBody, strings.TrimSpace(recorder.Body.String()), method+" "+path)
+}
+
+func TestHandlerStrings(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("GET", "/strings/k1", "", 404, `{"error":"not found"}`)
+	c.check("PUT", "/strings/k1", `{"value":"v1"}`, 204, "")
+	c.check("GET", "/strings/k1", "", 200, `{"value":"v1"}`)
+	c.check("HEAD", "/strings/k1", "", 200, `{"value":"v1"}`)
+	c.check("PUT", "/strings/k1", `{}`, 400, `{"error":"value is required"}`)
+	c.check("PUT", "/strings/k1", `{"value":`, 400, `{"error":"unexpected EOF"}`)
+	c.check("PUT", "/strings/blank", `{"value":""}`, 204, "")
+	c.check("GET", "/strings/blank", "", 200, `{"value":""}`)
+	c.check("POST", "/lists/queue/items", `{"items":[""]}`, 200, `{"length":1}`)
+	c.check("GET", "/strings/queue", "", 409, `{"error":"WRONGTYPE Operation against a key holding the wrong kind of value"}`)
+
+	c.check("PUT", "/strings/k2?if=exists", `{"value":"v2"}`, 412, `{"error":"condition not met"}`)
+	c.check("PUT", "/strings/k2?if=absent", `{"value":"v2"}`, 204, "")
+	c.check("PUT", "/strings/k2?if=absent", `{"value":"v2.1"}`, 412, `{"error":"condition not met"}`)
+	c.check("PUT", "/strings/k2?if=exists", `{"value":"v2.2"}`, 204, "")
+	c.check("PUT", "/strings/k2?if=sometimes", `{"value":"v2.3"}`, 400, `{"error":"if must be exists or absent"}`)
+	c.check("GET", "/strings?key=k1&key=k2&key=k3", "", 200, `{"values":{"k1":"v1","k2":"v2.2"}}`)
+
+	c.check("POST", "/strings", `{"values":{"k3":"v3","k4":"v4"}}`, 204, "")
+	c.check("POST", "/strings?if=absent", `{"values":{"k4":"v4.1","k5":"v5"}}`, 412, `{"error":"condition not met"}`)
+	c.check("GET", "/strings?key=k3&key=k4&key=k5", "", 200, `{"values":{"k3":"v3","k4":"v4"}}`)
+
+	c.check("POST", "/strings/greeting/append", `{"value":"Hello"}`, 200, `{"length":5}`)
+	c.check("POST", "/strings/greeting/append", `{"value":" World"}`, 200, `{"length":11}`)
+	c.check("GET", "/strings/greeting/range?start=-5", "", 200, `{"value":"World"}`)
+	c.check("GET", "/strings/greeting/range?start=0&stop=4", "", 200, `{"value":"Hello"}`)
+	c.check("GET", "/strings/greeting/range?start=zero", "", 400, `{"error":"start must be an integer"}`)
+	c.check("PUT", "/strings/greeting/range", `{"offset":6,"value":"Redis"}`, 200, `{"length":11}`)
+	c.check("GET", "/strings/greeting/length", "", 200, `{"length":11}`)
+	c.check("POST", "/strings/greeting/getset", `{"value":"Bye"}`, 200, `{"value":"Hello Redis"}`)
+	c.check("GET", "/strings/greeting", "", 200, `{"value":"Bye"}`)
+
+	c.check("POST", "/strings/counter/increment", "", 200, `{"value":1}`)
+	c.check("POST", "/strings/counter/increment", `{"by":10}`, 200, `{"value":11}`)
+	c.check("POST", "/strings/counter/decrement", "", 200, `{"value":10}`)
+	c.check("POST", "/strings/counter/decrement", `{"by":4}`, 200, `{"value":6}`)
+	c.check("POST", "/strings/greeting/increment", "", 409, `{"error":"ERR value is not an integer or out of range"}`)
+	c.check("POST", "/strings/counter/increment?float=true", `{"by":0.5}`, 200, `{"value":"6.5"}`)
+	c.check("POST", "/strings/counter/increment?float=true", "", 200, `{"value":"7.5"}`)
+	c.check("POST", "/strings/counter/decrement?float=true", `{"by":0.25}`, 200, `{"value":"7.25"}`)
+	c.check("POST", "/strings/counter/decrement?float=true", "", 200, `{"value":"6.25"}`)
+	c.check("POST", "/strings/counter/increment", "", 409, `{"error":"ERR value is not an integer or out of range"}`)
+	c.check("POST", "/strings/greeting/increment?float=true", `{"by":1}`, 400, `{"error":"ERR value is not a valid float"}`)
+	c.check("PUT", "/strings/greeting/range", `{"offset":-1,"value":"x"}`, 400, `{"error":"ERR index out of range"}`)
+
+	c.check("DELETE", "/strings/k1", "", 405, `{"error":"method not allowed"}`)
+	c.check("GET", "/strings/k1/append", "", 405, `{"error":"method not allowed"}`)
+	c.check("GET", "/strings/k1/unknown", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/unknown/k1", "", 404, `{"error":"not found"}`)
+
+	c.check("PUT", "/strings/a%2Fb", `{"value":"slashed"}`, 204, "")
+	c.check("GET", "/strings/a%2Fb", "", 200, `{"value":"slashed"}`)
+}
+
+func TestHandlerKeys(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("GET", "/keys/k1/type", "", 200, `{"type":"none"}`)
+	c.check("PUT", "/strings/k1", `{"value":"v1"}`, 204, "")
+	c.check("GET", "/keys/k1/type", "", 200, `{"type":"string"}`)
+	c.check("POST", "/keys/k1/type", "", 405, `{"error":"method not allowed"}`)
+	c.check("POST", "/lists/k1/items", `{"items":["a"]}`, 409, `{"error":"WRONGTYPE Operation against a key holding the wrong kind of value"}`)
+	c.check("GET", "/hashes/k1/fields/f1", "", 409, `{"error":"WRONGTYPE Operation against a key holding the wrong kind of value"}`)
+
+	c.check("GET", "/random-key", "", 200, `{"key":"k1"}`)
+	c.check("GET", "/keys/k1", "", 200, `{"type":"string"}`)
+	c.check("GET", "/keys/k2", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/keys/k1/rename", `{"destination":"k2"}`, 204, "")
+	c.check("POST", "/keys/k1/rename", `{"destination":"k3"}`, 404, `{"error":"not found"}`)
+	c.check("POST", "/keys/k2/copy", `{"destination":"k3"}`, 204, "")
+	c.check("POST", "/keys/k2/copy", `{"destination":"k3"}`, 412, `{"error":"condition not met"}`)
+	c.check("POST", "/keys/k2/copy", `{"destination":"k3","replace":true}`, 204, "")
+	c.check("PUT", "/strings/k4", `{"value":"v4"}`, 204, "")
+	c.check("POST", "/keys/k2/rename?if=absent", `{"destination":"k3"}`, 412, `{"error":"condition not met"}`)
+	c.check("GET", "/keys?key=k2&key=k3&key=k4&key=k5", "", 200, `{"exists":3}`)
+	c.check("GET", "/keys?match=k[4-9]&type=string", "", 200, `{"cursor":"0","keys":["k4"]}`)
+	c.check("DELETE", "/keys?key=k2&key=k3", "", 200, `{"deleted":2}`)
+	c.check("DELETE", "/keys/k4", "", 200, `{"deleted":1}`)
+	c.check("GET", "/keys?cursor=0&type=set", "", 200, `{"cursor":"0","keys":[]}`)
+	c.check("GET", "/keys?cursor=x", "", 400, `{"error":"ERR invalid cursor"}`)
+	c.check("GET", "/keys?count=-1", "", 400, `{"error":"ERR syntax error"}`)
+	c.check("GET", "/random-key", "", 404, `{"error":"not found"}`)
+}
+
+func TestHandlerExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := httpChecker{t, NewHandler(NewMemoryStoreWithClock(clock))}
+	c.check("GET", "/keys/k1/expiry", "", 200, `{"pttl":-2,"ttl":-2}`)
+	c.check("PUT", "/keys/k1/expiry", `{"seconds":10}`, 404, `{"error":"not found"}`)
+	c.check("PUT", "/strings/k1", `{"value":"v1"}`, 204, "")
+	c.check("GET", "/keys/k1/expiry", "", 200, `{"pttl":-1,"ttl":-1}`)
+	c.check("PUT", "/keys/k1/expiry", `{"seconds":10}`, 204, "")
+	c.check("GET", "/keys/k1/expiry", "", 200, `{"pttl":10000,"ttl":10}`)
+	c.check("PUT", "/keys/k1/expiry", `{"milliseconds":2500}`, 204, "")
+	c.check("GET", "/keys/k1/expiry", "", 200, `{"pttl":2500,"ttl":3}`)
+	c.check("PUT", "/keys/k1/expiry", `{}`, 400, `{"error":"one of seconds, milliseconds, at or at_milliseconds is required"}`)
+	c.check("DELETE", "/keys/k1/expiry", "", 204, "")
+	c.check("DELETE", "/keys/k1/expiry", "", 404, `{"error":"not found"}`)
+	c.check("PUT", "/keys/k1/expiry", `{"at":1001}`, 204, "")
+	clock.Advance(time.Second)
+	c.check("GET", "/strings/k1", "", 404, `{"error":"not found"}`)
+
+	c.check("PUT", "/strings/k2", `{"value":"v2","ex":60}`, 204, "")
+	c.check("GET", "/keys/k2/expiry", "", 200, `{"pttl":60000,"ttl":60}`)
+	c.check("PUT", "/strings/k2", `{"value":"v2.1","keepttl":true}`, 204, "")
+	c.check("GET", "/keys/k2/expiry", "", 200, `{"pttl":60000,"ttl":60}`)
+	c.check("PUT", "/strings/k2", `{"value":"v2.2","ex":60,"px":60000}`, 400, `{"error":"ERR syntax error"}`)
+	c.check("PUT", "/strings/k2", `{"value":"v2.2","ex":-1}`, 400, `{"error":"ERR invalid expire time"}`)
+	c.check("PUT", "/strings/k3?if=absent", `{"value":"v3","px":1500}`, 204, "")
+	c.check("GET", "/keys/k3/expiry", "", 200, `{"pttl":1500,"ttl":2}`)
+}
+
+func TestHandlerSets(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("GET", "/sets/s1/cardinality", "", 200, `{"cardinality":0}`)
+	c.check("POST", "/sets/s1/members", `{"members":["a","b"]}`, 204, "")
+	c.check("PUT", "/sets/s1/members/c", "", 204, "")
+	c.check("GET", "/sets/s1/cardinality", "", 200, `{"cardinality":3}`)
+	c.check("GET", "/sets/s1/members/a", "", 200, `{"member":"a"}`)
+	c.check("GET", "/sets/s1/members/z", "", 404, `{"error":"not found"}`)
+	c.check("DELETE", "/sets/s1/members/a", "", 204, "")
+	c.check("DELETE", "/sets/s1/members?member=b", "", 204, "")
+	c.check("GET", "/sets/s1/members", "", 200, `{"members":["c"]}`)
+	c.check("GET", "/sets/s1/members?cursor=0&count=5", "", 200, `{"cursor":"0","members":["c"]}`)
+	c.check("GET", "/sets/s1/members?cursor=0&match=a*", "", 200, `{"cursor":"0","members":[]}`)
+	c.check("GET", "/sets/s1", "", 404, `{"error":"not found"}`)
+}
+
+func TestHandlerSetAlgebra(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("POST", "/sets/s1/members", `{"members":["a","b","c"]}`, 204, "")
+	c.check("POST", "/sets/s2/members", `{"members":["b","c"]}`, 204, "")
+	c.check("POST", "/sets/s3/members", `{"members":["c","d"]}`, 204, "")
+	c.check("GET", "/sets/s1/intersection?with=s2&with=s3", "", 200, `{"members":["c"]}`)
+	c.check("GET", "/sets/s1/difference?with=s2", "", 200, `{"members":["a"]}`)
+	c.check("GET", "/sets/s9/union", "", 200, `{"members":[]}`)
+	c.check("POST", "/sets/s1/union?with=s3", `{"destination":"u"}`, 200, `{"cardinality":4}`)
+	c.check("POST", "/sets/s1/intersection?with=s2", `{"destination":"u"}`, 200, `{"cardinality":2}`)
+	c.check("GET", "/sets/u/cardinality", "", 200, `{"cardinality":2}`)
+	c.check("GET", "/sets/s1/intersection/cardinality?with=s2&limit=1", "", 200, `{"cardinality":1}`)
+	c.check("GET", "/sets/s1/intersection/cardinality?with=s2&limit=-1", "", 400, `{"error":"ERR LIMIT can't be negative"}`)
+	c.check("GET", "/sets/s1/members?member=a&member=d", "", 200, `{"is_member":[true,false]}`)
+	c.check("POST", "/sets/s1/members/a/move", `{"destination":"s3"}`, 204, "")
+	c.check("POST", "/sets/s1/members/a/move", `{"destination":"s3"}`, 412, `{"error":"condition not met"}`)
+	c.check("GET", "/sets/s1/difference?with=s2", "", 200, `{"members":[]}`)
+	c.check("POST", "/sets/s2/pop?count=-1", "", 400, `{"error":"ERR index out of range"}`)
+	c.check("GET", "/sets/u/random?count=0", "", 200, `{"members":[]}`)
+	c.check("GET", "/sets/s9/random?count=-2", "", 200, `{"members":[]}`)
+	c.check("POST", "/sets/s9/pop", "", 200, `{"members":[]}`)
+	c.check("PUT", "/sets/s1/intersection", "", 405, `{"error":"method not allowed"}`)
+}
+
+func TestHandlerHashes(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("GET", "/hashes/h1/fields/f1", "", 404, `{"error":"not found"}`)
+	c.check("PUT", "/hashes/h1/fields/f1", `{"value":"v1"}`, 204, "")
+	c.check("GET", "/hashes/h1/fields/f1", "", 200, `{"value":"v1"}`)
+	c.check("PUT", "/hashes/h1/fields/f2?if=exists", `{"value":"v2"}`, 412, `{"error":"condition not met"}`)
+	c.check("PUT", "/hashes/h1/fields/f2?if=absent", `{"value":"v2"}`, 204, "")
+	c.check("POST", "/hashes/h1/fields", `{"fields":{"f3":"v3"}}`, 204, "")
+	c.check("GET", "/hashes/h1/length", "", 200, `{"length":3}`)
+	c.check("GET", "/hashes/h1/fields?field=f1&field=f3&field=f9", "", 200, `{"values":["v1","v3",""]}`)
+	c.check("GET", "/hashes/h1/fields?cursor=0&match=f[12]", "", 200, `{"cursor":"0","fields":{"f1":"v1","f2":"v2"}}`)
+	c.check("GET", "/hashes/h2/fields?cursor=0", "", 200, `{"cursor":"0","fields":{}}`)
+	c.check("HEAD", "/hashes/h1/fields/f9", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/hashes/h1", "", 200, `{"fields":{"f1":"v1","f2":"v2","f3":"v3"}}`)
+	c.check("GET", "/hashes/h1/fields/f1/length", "", 200, `{"length":2}`)
+	c.check("POST", "/hashes/h1/fields/n/increment", `{"by":5}`, 200, `{"value":5}`)
+	c.check("POST", "/hashes/h1/fields/n/increment", "", 200, `{"value":6}`)
+	c.check("POST", "/hashes/h1/fields/n/increment?float=true", `{"by":0.5}`, 200, `{"value":"6.5"}`)
+	c.check("POST", "/hashes/h1/fields/n/increment", "", 409, `{"error":"ERR hash value is not an integer"}`)
+	c.check("POST", "/hashes/h1/fields/f1/increment?float=true", "", 409, `{"error":"ERR hash value is not a float"}`)
+	c.check("GET", "/hashes/h1/random?count=0&values=true", "", 200, `{"fields":[]}`)
+	c.check("GET", "/hashes/h2/random", "", 200, `{"fields":[]}`)
+	c.check("DELETE", "/hashes/h1/fields?field=f2&field=f3&field=f9", "", 200, `{"deleted":2}`)
+	c.check("DELETE", "/hashes/h1/fields/f1", "", 204, "")
+	c.check("DELETE", "/hashes/h1/fields/f1", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/hashes/h1/random?values=true", "", 200, `{"fields":[{"field":"n","value":"6.5"}]}`)
+	c.check("PUT", "/hashes/h1/expiry?field=n&field=f9", `{"seconds":100}`, 200, `{"results":[1,-2]}`)
+	c.check("PUT", "/hashes/h1/expiry?field=n&if=greater", `{"milliseconds":1000}`, 200, `{"results":[0]}`)
+	c.check("PUT", "/hashes/h1/expiry?field=n&if=never", `{"seconds":1}`, 400, `{"error":"if must be absent, exists, greater or less"}`)
+	c.check("PUT", "/hashes/h1/expiry?field=n", `{}`, 400, `{"error":"one of seconds, milliseconds, at or at_milliseconds is required"}`)
+	c.check("GET", "/hashes/h1/expiry?field=f9", "", 200, `{"pttl":[-2],"ttl":[-2]}`)
+	c.check("DELETE", "/hashes/h1/expiry?field=n&field=n", "", 200, `{"results":[1,-1]}`)
+	c.check("POST", "/hashes/h1/getex", `{"fields":["n","f9"],"px":90000}`, 200, `{"values":{"n":"6.5"}}`)
+	c.check("POST", "/hashes/h1/fields?if=absent", `{"fields":{"n":"1"},"ex":10}`, 412, `{"error":"condition not met"}`)
+	c.check("POST", "/hashes/h1/fields?if=exists", `{"fields":{"n":"1"},"keepttl":true}`, 204, "")
+	c.check("DELETE", "/hashes/h1/expiry?field=n", "", 200, `{"results":[1]}`)
+	c.check("PUT", "/hashes/h1", "", 405, `{"error":"method not allowed"}`)
+}
+
+func TestHandlerLists(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("POST", "/lists/l1/pop", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/lists/l1/items", `{"items":["b","c"]}`, 200, `{"length":2}`)
+	c.check("POST", "/lists/l1/items?side=left", `{"items":["a"]}`, 200, `{"length":3}`)
+	c.check("POST", "/lists/l1/items?side=up", `{"items":["a"]}`, 400, `{"error":"side must be left or right"}`)
+	c.check("GET", "/lists/l1/items", "", 200, `{"items":["a","b","c"]}`)
+	c.check("GET", "/lists/l1/items?start=1&stop=1", "", 200, `{"items":["b"]}`)
+	c.check("GET", "/lists/l1/items/-1", "", 200, `{"value":"c"}`)
+	c.check("GET", "/lists/l1/items/3", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/lists/l1/items/-4", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/lists/l9/items/0", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/lists/blank/items", `{"items":[""]}`, 200, `{"length":1}`)
+	c.check("GET", "/lists/blank/items/0", "", 200, `{"value":""}`)
+	c.check("GET", "/lists/l1/items/first", "", 400, `{"error":"index must be an integer"}`)
+	c.check("PUT", "/lists/l1/items/1", `{"value":"B"}`, 204, "")
+	c.check("PUT", "/lists/l1/items/5", `{"value":"F"}`, 404, `{"error":"not found"}`)
+	c.check("GET", "/lists/l1/length", "", 200, `{"length":3}`)
+	c.check("POST", "/lists/l1/pop", "", 200, `{"value":"a"}`)
+	c.check("POST", "/lists/l1/pop?side=right", "", 200, `{"value":"c"}`)
+	c.check("POST", "/lists/l1/items", `{"items":["d","e"]}`, 200, `{"length":3}`)
+	c.check("POST", "/lists/l1/trim", `{"start":1,"stop":-1}`, 204, "")
+	c.check("GET", "/lists/l1/items", "", 200, `{"items":["d","e"]}`)
+}
+
+func TestHandlerListEditing(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("POST", "/lists/l1/items?if=exists", `{"items":["a"]}`, 200, `{"length":0}`)
+	c.check("POST", "/lists/l1/items?if=absent", `{"items":["a"]}`, 400, `{"error":"if must be exists"}`)
+	c.check("POST", "/lists/l1/insert", `{"before":"a","value":"b"}`, 404, `{"error":"not found"}`)
+	c.check("POST", "/lists/l1/items", `{"items":["a","b","a"]}`, 200, `{"length":3}`)
+	c.check("POST", "/lists/l1/items?side=left&if=exists", `{"items":["z"]}`, 200, `{"length":4}`)
+	c.check("POST", "/lists/l1/insert", `{"after":"b","value":"c"}`, 200, `{"length":5}`)
+	c.check("POST", "/lists/l1/insert", `{"before":"x","value":"c"}`, 412, `{"error":"condition not met"}`)
+	c.check("POST", "/lists/l1/insert", `{"before":"a","after":"b","value":"c"}`, 400, `{"error":"exactly one of before and after is required"}`)
+	c.check("GET", "/lists/l1/items", "", 200, `{"items":["z","a","b","c","a"]}`)
+	c.check("GET", "/lists/l1/positions?value=a", "", 200, `{"positions":[1,4]}`)
+	c.check("GET", "/lists/l1/positions?value=a&rank=-1&count=1", "", 200, `{"positions":[4]}`)
+	c.check("GET", "/lists/l1/positions?value=a&maxlen=-1", "", 400, `{"error":"ERR MAXLEN can't be negative"}`)
+	c.check("GET", "/lists/l1/positions?value=a&rank=first", "", 400, `{"error":"rank must be an integer"}`)
+	c.check("POST", "/lists/l1/remove", `{"value":"a","count":-1}`, 200, `{"removed":1}`)
+	c.check("POST", "/lists/l1/pop?count=2", "", 200, `{"items":["z","a"],"key":"l1"}`)
+	c.check("POST", "/lists/l1/pop?count=-1", "", 400, `{"error":"ERR index out of range"}`)
+	c.check("POST", "/lists/l2/items", `{"items":["x","y"]}`, 200, `{"length":2}`)
+	c.check("POST", "/lists/l3/pop?side=right&count=5&with=l2&with=l1", "", 200, `{"items":["y","x"],"key":"l2"}`)
+	c.check("POST", "/lists/l3/pop?count=5", "", 404, `{"error":"not found"}`)
+}
+
+func TestHandlerBlockingLists(t *testing.T) {
+	store := NewMemoryStore()
+	c := httpChecker{t, NewHandler(store)}
+	c.check("POST", "/lists/l1/pop?wait=10ms", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/lists/l1/pop?wait=soon", "", 400, `{"error":"wait must be a duration, like 30s"}`)
+	c.check("POST", "/lists/l1/pop?wait=-1s", "", 400, `{"error":"ERR timeout is negative"}`)
+	c.check("POST", "/lists/l2/items", `{"items":["a","b","c"]}`, 200, `{"length":3}`)
+	c.check("POST", "/lists/l1/pop?wait=1s&with=l2&side=right", "", 200, `{"key":"l2","value":"c"}`)
+	c.check("POST", "/lists/l2/move?from=left&to=left", `{"destination":"l1"}`, 200, `{"value":"a"}`)
+	c.check("POST", "/lists/l2/move?from=up", `{"destination":"l1"}`, 400, `{"error":"from must be left or right"}`)
+	c.check("POST", "/lists/l2/move?wait=1s", `{"destination":"l1"}`, 200, `{"value":"b"}`)
+	c.check("POST", "/lists/l2/move?wait=10ms", `{"destination":"l1"}`, 404, `{"error":"not found"}`)
+	c.check("GET", "/lists/l1/items", "", 200, `{"items":["a","b"]}`)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.check("POST", "/lists/l3/pop?wait=5s", "", 200, `{"key":"l3","value":"job"}`)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, err := store.ListRightPush("l3", "job")
+	assert.NoError(t, err)
+	<-done
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("POST", "/lists/l3/pop?wait=0s", nil).WithContext(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	recorder := httptest.NewRecorder()
+	NewHandler(store).ServeHTTP(recorder, request)
+	assert.Equal(t, 0, atomic.LoadInt64(&store.(*MemoryStore).waiters.waiting))
+}
+
+func TestHandlerBlockingOutlastsWriteTimeout(t *testing.T) {
+	store := NewMemoryStore()
+	server := httptest.NewUnstartedServer(NewHandler(store))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	for path, expected := range map[string]string{
+		"/lists/q/pop?wait=0":    `{"key":"q","value":"job"}`,
+		"/lists/q/move?wait=10s": `{"value":"job"}`,
+	} {
+		response := make(chan string, 1)
+		go func() {
+			res, err := http.Post(server.URL+path, "application/json", strings.NewReader(`{"destination":"done"}`))
+			if !assert.NoError(t, err, path) {
+				response <- ""
+				return
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			assert.NoError(t, err, path)
+			response <- strings.TrimSpace(string(body))
+		}()
+		waitUntil(t, "caller never started waiting", func() bool {
+			return atomic.LoadInt64(&store.(*MemoryStore).waiters.waiting) == 1
+		})
+		time.Sleep(200 * time.Millisecond)
+		_, err := store.ListRightPush("q", "job")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, <-response, path)
+	}
+}
+
+func TestHandlerSortedSets(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("GET", "/sorted-sets/z1/cardinality", "", 200, `{"cardinality":0}`)
+	c.check("POST", "/sorted-sets/z1/members", `{"members":{"a":1,"b":2,"c":"+inf"}}`, 200, `{"added":3}`)
+	c.check("POST", "/sorted-sets/z1/members?if=greater&changed=true", `{"members":{"a":0,"b":2.5}}`, 200, `{"changed":1}`)
+	c.check("POST", "/sorted-sets/z1/members?if=absent&if=greater", `{"members":{"a":0}}`, 400, `{"error":"ERR syntax error"}`)
+	c.check("POST", "/sorted-sets/z1/members?if=maybe", `{"members":{"a":0}}`, 400, `{"error":"if must be exists, absent, greater or less"}`)
+	c.check("POST", "/sorted-sets/z1/members", `{"members":{"a":"many"}}`, 400, `{"error":"ERR value is not a valid float"}`)
+	c.check("PUT", "/sorted-sets/z1/members/d", `{"score":-1}`, 204, "")
+	c.check("PUT", "/sorted-sets/z1/members/d", `{}`, 400, `{"error":"score is required"}`)
+	c.check("GET", "/sorted-sets/z1/members/d", "", 200, `{"score":-1}`)
+	c.check("GET", "/sorted-sets/z1/members/c", "", 200, `{"score":"+inf"}`)
+	c.check("GET", "/sorted-sets/z1/members/z", "", 404, `{"error":"not found"}`)
+
+	c.check("GET", "/sorted-sets/z1/members", "", 200, `{"members":[{"member":"d","score":-1},{"member":"a","score":1},{"member":"b","score":2.5},{"member":"c","score":"+inf"}]}`)
+	c.check("GET", "/sorted-sets/z1/members?start=0&stop=1&rev=true", "", 200, `{"members":[{"member":"c","score":"+inf"},{"member":"b","score":2.5}]}`)
+	c.check("GET", "/sorted-sets/z1/members?by=score&start=(1&stop=3", "", 200, `{"members":[{"member":"b","score":2.5}]}`)
+	c.check("GET", "/sorted-sets/z1/members?by=score&rev=true&offset=1&count=2", "", 200, `{"members":[{"member":"b","score":2.5},{"member":"a","score":1}]}`)
+	c.check("POST", "/sorted-sets/letters/members", `{"members":{"a":0,"b":0,"c":0}}`, 200, `{"added":3}`)
+	c.check("GET", "/sorted-sets/letters/members?by=lex&start=[b", "", 200, `{"members":[{"member":"b","score":0},{"member":"c","score":0}]}`)
+	c.check("GET", "/sorted-sets/letters/members?by=lex&rev=true&stop=(b", "", 200, `{"members":[{"member":"c","score":0}]}`)
+	c.check("GET", "/sorted-sets/z1/members?by=size", "", 400, `{"error":"by must be rank, score or lex"}`)
+	c.check("GET", "/sorted-sets/z1/members?offset=1", "", 400, `{"error":"ERR syntax error"}`)
+	c.check("GET", "/sorted-sets/z1/count?min=0&max=(2.5", "", 200, `{"count":1}`)
+	c.check("GET", "/sorted-sets/z1/count?min=low", "", 400, `{"error":"ERR min or max is not a float"}`)
+
+	c.check("GET", "/sorted-sets/z1/members/a/rank", "", 200, `{"rank":1}`)
+	c.check("GET", "/sorted-sets/z1/members/a/rank?rev=true", "", 200, `{"rank":2}`)
+	c.check("GET", "/sorted-sets/z1/members/z/rank", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/sorted-sets/z1/members/a/increment", "", 200, `{"score":2}`)
+	c.check("POST", "/sorted-sets/z1/members/a/increment", `{"by":0.5}`, 200, `{"score":2.5}`)
+	c.check("POST", "/sorted-sets/z1/members/e/increment?if=exists", "", 412, `{"error":"condition not met"}`)
+	c.check("POST", "/sorted-sets/z1/members/c/increment", `{"by":"-inf"}`, 409, `{"error":"ERR resulting score is not a number (NaN)"}`)
+
+	c.check("POST", "/sorted-sets/z1/store?by=score&start=0&stop=3", `{"destination":"z2"}`, 200, `{"length":2}`)
+	c.check("GET", "/sorted-sets/z2/members", "", 200, `{"members":[{"member":"a","score":2.5},{"member":"b","score":2.5}]}`)
+	c.check("DELETE", "/sorted-sets/z1/members/d", "", 204, "")
+	c.check("DELETE", "/sorted-sets/z1/members/d", "", 404, `{"error":"not found"}`)
+	c.check("DELETE", "/sorted-sets/z1/members?member=a&member=z", "", 200, `{"removed":1}`)
+	c.check("POST", "/sorted-sets/z1/pop?side=max", "", 200, `{"members":[{"member":"c","score":"+inf"}]}`)
+	c.check("POST", "/sorted-sets/z1/pop?count=5", "", 200, `{"members":[{"member":"b","score":2.5}]}`)
+	c.check("POST", "/sorted-sets/z1/pop?side=up", "", 400, `{"error":"side must be min or max"}`)
+	c.check("GET", "/keys/z1", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/keys/z2/type", "", 200, `{"type":"zset"}`)
+}
+
+func TestHandlerChannels(t *testing.T) {
+	store := NewMemoryStore()
+	c := httpChecker{t, NewHandler(store)}
+	server := httptest.NewServer(NewHandler(store))
+	defer server.Close()
+
+	events, err := http.Get(server.URL + "/channels/news/events")
+	assert.NoError(t, err)
+	defer events.Body.Close()
+	assert.Equal(t, "text/event-stream", events.Header.Get("Content-Type"))
+	patterns, err := http.Get(server.URL + "/channels/news.*/events?pattern=true")
+	assert.NoError(t, err)
+	defer patterns.Body.Close()
+	stream, patternStream := bufio.NewReader(events.Body), bufio.NewReader(patterns.Body)
+	readEvent := func(r *bufio.Reader) string {
+		event := ""
+		for {
+			line, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+	assert.Equal(t, ": subscribed\n", readEvent(stream))
+	assert.Equal(t, ": subscribed\n", readEvent(patternStream))
+
+	c.check("GET", "/channels", "", 200, `{"channels":["news"]}`)
+	c.check("GET", "/channels?pattern=sp*", "", 200, `{"channels":[]}`)
+	c.check("GET", "/channels/news", "", 200, `{"subscribers":1}`)
+	c.check("POST", "/channels/news", `{"message":"line one\nline two"}`, 200, `{"receivers":1}`)
+	c.check("POST", "/channels/news.tech", `{"message":"restis"}`, 200, `{"receivers":1}`)
+	c.check("POST", "/channels/sports", `{"message":"goal"}`, 200, `{"receivers":0}`)
+	c.check("POST", "/channels/news", `{}`, 400, `{"error":"message is required"}`)
+	c.check("PUT", "/channels/news", `{}`, 405, `{"error":"method not allowed"}`)
+	c.check("POST", "/channels/news/events", "", 405, `{"error":"method not allowed"}`)
+	c.check("GET", "/channels/news/other", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/channels/news/events?pattern=maybe", "", 400, `{"error":"pattern must be true or false"}`)
+
+	assert.Equal(t, "event: message\ndata: {\"channel\":\"news\",\"message\":\"line one\\nline two\"}\n", readEvent(stream))
+	assert.Equal(t, "event: message\ndata: {\"channel\":\"news.tech\",\"pattern\":\"news.*\",\"message\":\"restis\"}\n", readEvent(patternStream))
+
+	events.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for store.(*MemoryStore).Broker().NumSub("news")[0] != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.check("GET", "/channels/news", "", 200, `{"subscribers":0}`)
+
+	c = httpChecker{t, NewHandler(struct{ Store }{store})}
+	c.check("POST", "/channels/news", `{"message":"hello"}`, 501, `{"error":"ERR pub/sub is not available on this store"}`)
+}
+
+func TestHandlerEventsOutlastWriteTimeout(t *testing.T) {
+	store := NewMemoryStore()
+	server := httptest.NewUnstartedServer(NewHandler(store))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	events, err := http.Get(server.URL + "/channels/news/events")
+	assert.NoError(t, err)
+	defer events.Body.Close()
+	stream := bufio.NewReader(events.Body)
+	line, err := stream.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, ": subscribed\n", line)
+
+	time.Sleep(200 * time.Millisecond)
+	store.(*MemoryStore).Broker().Publish("news", "late")
+	for _, expected := range []string{"\n", "event: message\n", `data: {"channel":"news","message":"late"}` + "\n"} {
+		line, err := stream.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, expected, line)
+	}
+}
+
+func TestHandlerKeyspaceEvents(t *testing.T) {
+	store := NewMemoryStore()
+	c := httpChecker{t, NewHandler(store)}
+	c.check("GET", "/keyspace-events", "", 200, `{"events":""}`)
+	c.check("PUT", "/keyspace-events", `{"events":"Kx"}`, 204, "")
+	c.check("GET", "/keyspace-events", "", 200, `{"events":"xK"}`)
+	c.check("PUT", "/keyspace-events", `{"events":"KEm"}`, 400, `{"error":"ERR Invalid event class character. Use 'g$lshzxKEA'."}`)
+	c.check("PUT", "/keyspace-events", `{}`, 400, `{"error":"events is required"}`)
+	c.check("DELETE", "/keyspace-events", "", 405, `{"error":"method not allowed"}`)
+	c.check("GET", "/keyspace-events/x", "", 404, `{"error":"not found"}`)
+	assert.Equal(t, KeyspaceChannels|ExpiredEvents, store.(*MemoryStore).KeyspaceEvents())
+
+	c = httpChecker{t, NewHandler(struct{ Store }{store})}
+	c.check("GET", "/keyspace-events", "", 501, `{"error":"ERR keyspace events are not available on this store"}`)
+}
+
+func TestHandlerTransactions(t *testing.T) {
+	store := NewMemoryStore()
+	c := httpChecker{t, NewHandler(store)}
+	c.check("GET", "/keys/k/version", "", 200, `{"version":0}`)
+	c.check("POST", "/transactions", `{"requests":[
+		{"method":"PUT","path":"/strings/k","body":{"value":"1"}},
+		{"method":"POST","path":"/strings/k/increment","body":{"by":2}},
+		{"method":"GET","path":"/strings/k"},
+		{"method":"GET","path":"/strings/missing"}
+	]}`, 200, `{"responses":[{"status":204},{"status":200,"body":{"value":3}},{"status":200,"body":{"value":"3"}},{"status":404,"body":{"error":"not found"}}]}`)
+	c.check("GET", "/keys/k/version", "", 200, `{"version":3}`)
+
+	c.check("POST", "/transactions", `{"watch":{"k":3,"missing":0},"requests":[{"method":"DELETE","path":"/keys/k"}]}`, 200, `{"responses":[{"status":200,"body":{"deleted":1}}]}`)
+	c.check("POST", "/transactions", `{"watch":{"k":3},"requests":[{"method":"PUT","path":"/strings/k","body":{"value":"1"}}]}`, 409, `{"error":"restis: a watched key changed"}`)
+	c.check("GET", "/strings/k", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/transactions", `{}`, 200, `{"responses":[]}`)
+
+	c.check("POST", "/transactions", `{"requests":[{"method":"POST","path":"/snapshots"}]}`, 400, `{"error":"requests[0]: /snapshots can't be part of a transaction"}`)
+	c.check("POST", "/transactions", `{"requests":[{"method":"GET","path":"http://example.com/strings/k"}]}`, 400, `{"error":"requests[0]: path must not include a host"}`)
+	c.check("GET", "/transactions", "", 405, `{"error":"method not allowed"}`)
+	c.check("POST", "/transactions/x", "", 404, `{"error":"not found"}`)
+
+	c = httpChecker{t, NewHandler(struct{ Store }{store})}
+	c.check("POST", "/transactions", `{}`, 501, `{"error":"ERR transactions are not available on this store"}`)
+	c.check("GET", "/keys/k/version", "", 501, `{"error":"ERR transactions are not available on this store"}`)
+}
+
+func TestHandlerScripts(t *testing.T) {
+	store := NewMemoryStore()
+	c := httpChecker{t, NewHandler(store)}
+	c.check("GET", "/scripts", "", 200, `{"scripts":[]}`)
+	c.check("POST", "/scripts/add", `{}`, 404, `{"error":"not found"}`)
+	c.check("PUT", "/scripts/add", `{"source":"return redis.call('INCRBY', KEYS[1], ARGV[1])"}`, 200, `{"sha":"8cd00688c05c46bde4a2e60658ef20a2e5c0b248"}`)
+	c.check("GET", "/scripts", "", 200, `{"scripts":["add"]}`)
+	c.check("GET", "/scripts/add", "", 200, `{"sha":"8cd00688c05c46bde4a2e60658ef20a2e5c0b248","source":"return redis.call('INCRBY', KEYS[1], ARGV[1])"}`)
+	c.check("POST", "/scripts/add", `{"keys":["n"],"args":["5"]}`, 200, `{"result":5}`)
+	c.check("POST", "/scripts/add", `{"keys":["n"],"args":["x"]}`, 409, `{"error":"ERR value is not an integer or out of range"}`)
+
+	c.check("PUT", "/scripts/list", `{"source":"return {KEYS[1], redis.status_reply('OK'), redis.error_reply('no'), false}"}`, 200, `{"sha":"9228d307ae7c69bec0342cf1af8276adbd6f8e8c"}`)
+	c.check("POST", "/scripts/list", `{"keys":["k"]}`, 200, `{"result":["k","OK",{"error":"no"},null]}`)
+	c.check("PUT", "/scripts/broken", `{"source":"return +"}`, 400, `{"error":"Error compiling script (new function): user_script:1: unexpected symbol near '+'"}`)
+	c.check("PUT", "/scripts/fails", `{"source":"error('failed')"}`, 200, `{"sha":"31a581b6038a08a9c48158ae7622c150f225882a"}`)
+	c.check("POST", "/scripts/fails", `{}`, 400, `{"error":"user_script:1: failed"}`)
+	c.check("PUT", "/scripts/add", `{}`, 400, `{"error":"source is required"}`)
+
+	c.check("DELETE", "/scripts/add", "", 204, "")
+	c.check("DELETE", "/scripts/add", "", 404, `{"error":"not found"}`)
+	c.check("GET", "/scripts/add", "", 404, `{"error":"not found"}`)
+	c.check("POST", "/scripts", "", 405, `{"error":"method not allowed"}`)
+	c.check("PATCH", "/scripts/list", "", 405, `{"error":"method not allowed"}`)
+	c.check("GET", "/scripts/list/x", "", 404, `{"error":"not found"}`)
+
+	c = httpChecker{t, NewHandler(struct{ Store }{store})}
+	c.check("GET", "/scripts", "", 501, `{"error":"ERR scripting is not available on this store"}`)
+}
@@ -0,0 +1,360 @@
+package restis
+
+// maxFieldExpireAt is the latest expiry a hash field can have, in Unix
+// milliseconds, as in Redis.
+const maxFieldExpireAt = 1<<48 - 1
+
+// fieldExpiries holds the expiry times of a hash's volatile fields, in Unix
+// milliseconds. next is never later than the earliest of them, so checking
+// a hash none of whose fields are due doesn't have to look at each one.
+type fieldExpiries struct {
+	at   map[string]int64
+	next int64
+}
+
+// expiry returns the expiry of field, if it has one. e may be nil.
+func (e *fieldExpiries) expiry(field string) (int64, bool) {
+	if e == nil {
+		return 0, false
+	}
+	at, ok := e.at[field]
+	return at, ok
+}
+
+func (e *fieldExpiries) clone() *fieldExpiries {
+	clone := &fieldExpiries{at: make(map[string]int64, len(e.at)), next: e.next}
+	for field, at := range e.at {
+		clone.at[field] = at
+	}
+	return clone
+}
+
+func (sh *shard) setFieldExpiry(key, field string, at int64) {
+	e, ok := sh.fieldExpires[key]
+	if !ok {
+		e = &fieldExpiries{at: make(map[string]int64)}
+		sh.fieldExpires[key] = e
+	}
+	e.at[field] = at
+	if e.next == 0 || at < e.next {
+		e.next = at
+	}
+}
+
+// persistField removes the expiry of field, reporting whether it had one.
+func (sh *shard) persistField(key, field string) bool {
+	e, ok := sh.fieldExpires[key]
+	if !ok {
+		return false
+	}
+	if _, ok := e.at[field]; !ok {
+		return false
+	}
+	delete(e.at, field)
+	if len(e.at) == 0 {
+		delete(sh.fieldExpires, key)
+	}
+	return true
+}
+
+// deleteField removes field and its expiry from the hash at key.
+func (sh *shard) deleteField(key, field string) {
+	delete(sh.hashes[key], field)
+	sh.persistField(key, field)
+}
+
+// expireFields removes the fields of the hash at key whose expiry has
+// passed, along with the key if they were all it had, and reports whether
+// there were any.
+func (s *MemoryStore) expireFields(sh *shard, key string, now int64) bool {
+	e, ok := sh.fieldExpires[key]
+	if !ok || e.next > now {
+		return false
+	}
+	expired := false
+	e.next = 0
+	for field, at := range e.at {
+		if at <= now {
+			delete(e.at, field)
+			delete(sh.hashes[key], field)
+			expired = true
+		} else if e.next == 0 || at < e.next {
+			e.next = at
+		}
+	}
+	if len(e.at) == 0 {
+		delete(sh.fieldExpires, key)
+	}
+	if expired {
+		s.touch(key)
+		s.notify(HashEvents, "hexpired", key)
+		s.removeIfEmpty(sh, key)
+	}
+	return expired
+}
+
+// fieldExpiryAt turns an expiry given in units of scale milliseconds after
+// offset into Unix milliseconds, making sure it's one a field can have.
+func fieldExpiryAt(value, scale, offset int64) (int64, error) {
+	if value < 0 || value > (maxFieldExpireAt-offset)/scale {
+		return 0, ErrInvalidExpireTime
+	}
+	return value*scale + offset, nil
+}
+
+func (o HashExpireOptions) valid() bool {
+	given := 0
+	for _, condition := range []bool{o.IfNotExists, o.IfExists, o.GreaterThan, o.LessThan} {
+		if condition {
+			given++
+		}
+	}
+	return given <= 1
+}
+
+// allows reports whether a field whose expiry is current, if it's volatile,
+// may be given the expiry at.
+func (o HashExpireOptions) allows(current int64, volatile bool, at int64) bool {
+	switch {
+	case o.IfNotExists:
+		return !volatile
+	case o.IfExists:
+		return volatile
+	case o.GreaterThan:
+		return volatile && at > current
+	case o.LessThan:
+		return !volatile || at < current
+	}
+	return true
+}
+
+func (s *MemoryStore) HashExpire(key string, seconds int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	at, err := fieldExpiryAt(seconds, 1000, s.now())
+	if err != nil {
+		return nil, err
+	}
+	return s.HashPExpireAt(key, at, options, fields...)
+}
+
+func (s *MemoryStore) HashPExpire(key string, milliseconds int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	at, err := fieldExpiryAt(milliseconds, 1, s.now())
+	if err != nil {
+		return nil, err
+	}
+	return s.HashPExpireAt(key, at, options, fields...)
+}
+
+func (s *MemoryStore) HashExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	at, err := fieldExpiryAt(timestamp, 1000, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.HashPExpireAt(key, at, options, fields...)
+}
+
+// HashPExpireAt sets the expiry of each of fields that exists and meets the
+// condition in options, deleting those it sets in the past.
+func (s *MemoryStore) HashPExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) ([]int64, error) {
+	if _, err := fieldExpiryAt(timestamp, 1, 0); err != nil {
+		return nil, err
+	}
+	if !options.valid() {
+		return nil, ErrSyntax
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	results := make([]int64, len(fields))
+	set, deleted := false, false
+	for i, field := range fields {
+		if _, ok := sh.hashes[key][field]; !ok {
+			results[i] = -2
+			continue
+		}
+		current, volatile := sh.fieldExpires[key].expiry(field)
+		switch {
+		case !options.allows(current, volatile, timestamp):
+			results[i] = 0
+		case timestamp <= now:
+			sh.deleteField(key, field)
+			results[i] = 2
+			deleted = true
+		default:
+			sh.setFieldExpiry(key, field, timestamp)
+			results[i] = 1
+			set = true
+		}
+	}
+	if set || deleted {
+		s.touch(key)
+	}
+	if set {
+		s.notify(HashEvents, "hexpire", key)
+		s.startExpiryCycle()
+	}
+	if deleted {
+		s.notify(HashEvents, "hdel", key)
+		s.removeIfEmpty(sh, key)
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) HashTTL(key string, fields ...string) ([]int64, error) {
+	ttls, err := s.HashPTTL(key, fields...)
+	for i, ttl := range ttls {
+		if ttl >= 0 {
+			ttls[i] = (ttl + 500) / 1000
+		}
+	}
+	return ttls, err
+}
+
+func (s *MemoryStore) HashPTTL(key string, fields ...string) ([]int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	now := s.now()
+	ttls := make([]int64, len(fields))
+	for i, field := range fields {
+		if _, ok := sh.hashes[key][field]; !ok {
+			ttls[i] = -2
+		} else if at, ok := sh.fieldExpires[key].expiry(field); ok {
+			ttls[i] = at - now
+		} else {
+			ttls[i] = -1
+		}
+	}
+	return ttls, nil
+}
+
+func (s *MemoryStore) HashPersist(key string, fields ...string) ([]int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	results := make([]int64, len(fields))
+	persisted := false
+	for i, field := range fields {
+		if _, ok := sh.hashes[key][field]; !ok {
+			results[i] = -2
+		} else if sh.persistField(key, field) {
+			results[i] = 1
+			persisted = true
+		} else {
+			results[i] = -1
+		}
+	}
+	if persisted {
+		s.touch(key)
+		s.notify(HashEvents, "hpersist", key)
+	}
+	return results, nil
+}
+
+func (s *MemoryStore) HashGetWithOptions(key string, options HashFieldOptions, fields ...string) (map[string]string, error) {
+	if options.KeepTTL || options.IfExists || options.IfNotExists {
+		return nil, ErrSyntax
+	}
+	at, err := options.expiresAt(s.now())
+	if err != nil {
+		return nil, err
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, field := range fields {
+		if value, ok := sh.hashes[key][field]; ok {
+			values[field] = value
+		}
+	}
+	if len(values) == 0 || (at == 0 && !options.Persist) {
+		return values, nil
+	}
+	expired := at != 0 && at <= s.now()
+	changed := false
+	for field := range values {
+		switch {
+		case options.Persist:
+			changed = sh.persistField(key, field) || changed
+		case expired:
+			sh.deleteField(key, field)
+			changed = true
+		default:
+			sh.setFieldExpiry(key, field, at)
+			changed = true
+		}
+	}
+	if !changed {
+		return values, nil
+	}
+	s.touch(key)
+	switch {
+	case options.Persist:
+		s.notify(HashEvents, "hpersist", key)
+	case expired:
+		s.notify(HashEvents, "hdel", key)
+		s.removeIfEmpty(sh, key)
+	default:
+		s.notify(HashEvents, "hexpire", key)
+		s.startExpiryCycle()
+	}
+	return values, nil
+}
+
+func (s *MemoryStore) HashSetWithOptions(key string, data map[string]string, options HashFieldOptions) (bool, error) {
+	if options.Persist {
+		return false, ErrSyntax
+	}
+	at, err := options.expiresAt(s.now())
+	if err != nil {
+		return false, err
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return false, err
+	}
+	for field := range data {
+		_, exists := sh.hashes[key][field]
+		if (options.IfExists && !exists) || (options.IfNotExists && exists) {
+			return false, nil
+		}
+	}
+	if len(data) == 0 {
+		return true, nil
+	}
+	sh.ensureHash(key)
+	expired := at != 0 && at <= s.now()
+	for field, value := range data {
+		sh.hashes[key][field] = value
+		switch {
+		case options.KeepTTL:
+		case expired:
+			sh.deleteField(key, field)
+		case at != 0:
+			sh.setFieldExpiry(key, field, at)
+		default:
+			sh.persistField(key, field)
+		}
+	}
+	s.touch(key)
+	s.notify(HashEvents, "hset", key)
+	switch {
+	case expired:
+		s.notify(HashEvents, "hdel", key)
+		s.removeIfEmpty(sh, key)
+	case at != 0:
+		s.notify(HashEvents, "hexpire", key)
+		s.startExpiryCycle()
+	}
+	return true, nil
+}
@@ -0,0 +1,905 @@
+package restis
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values are nil, bool, float64, string, *luaTable, *luaClosure and
+// *luaGoFunction.
+
+type luaTable struct {
+	array    []interface{} // keys 1 to len(array), never ending in nil
+	hash     map[interface{}]interface{}
+	order    []interface{} // hash keys in insertion order, for pairs
+	readonly bool
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{hash: make(map[interface{}]interface{})}
+}
+
+// arrayIndex returns the position of key in the array part, or -1.
+func arrayIndex(key interface{}) int {
+	if n, ok := key.(float64); ok && n >= 1 && n == math.Floor(n) && n <= math.MaxInt32 {
+		return int(n) - 1
+	}
+	return -1
+}
+
+func (t *luaTable) get(key interface{}) interface{} {
+	if i := arrayIndex(key); i >= 0 && i < len(t.array) {
+		return t.array[i]
+	}
+	return t.hash[key]
+}
+
+// set stores value under key, which must not be nil or NaN.
+func (t *luaTable) set(key, value interface{}) {
+	i := arrayIndex(key)
+	switch {
+	case i >= 0 && i < len(t.array):
+		t.array[i] = value
+		for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+			t.array = t.array[:len(t.array)-1]
+		}
+		return
+	case i == len(t.array) && value != nil:
+		t.array = append(t.array, value)
+		delete(t.hash, key)
+		// Move any keys that now follow on from the array part into it.
+		for {
+			next := float64(len(t.array) + 1)
+			v, ok := t.hash[next]
+			if !ok {
+				return
+			}
+			t.array = append(t.array, v)
+			delete(t.hash, next)
+		}
+	case value == nil:
+		delete(t.hash, key)
+		return
+	}
+	if _, ok := t.hash[key]; !ok {
+		if len(t.order) > 2*len(t.hash)+8 {
+			t.compact()
+		}
+		t.order = append(t.order, key)
+	}
+	t.hash[key] = value
+}
+
+func (t *luaTable) compact() {
+	order := t.order[:0]
+	seen := make(map[interface{}]bool, len(t.hash))
+	for _, key := range t.order {
+		if _, ok := t.hash[key]; ok && !seen[key] {
+			seen[key] = true
+			order = append(order, key)
+		}
+	}
+	t.order = order
+}
+
+func (t *luaTable) length() int {
+	return len(t.array)
+}
+
+// keys returns the table's keys, array part first.
+func (t *luaTable) keys() []interface{} {
+	keys := make([]interface{}, 0, len(t.array)+len(t.hash))
+	for i, v := range t.array {
+		if v != nil {
+			keys = append(keys, float64(i+1))
+		}
+	}
+	seen := make(map[interface{}]bool, len(t.hash))
+	for _, key := range t.order {
+		if _, ok := t.hash[key]; ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+type luaClosure struct {
+	proto *luaFunctionProto
+	scope *luaScope
+}
+
+type luaGoFunction struct {
+	name string
+	fn   func(L *luaState, args []interface{}) ([]interface{}, error)
+}
+
+type luaScope struct {
+	vars   map[string]*interface{}
+	parent *luaScope
+}
+
+func (s *luaScope) lookup(name string) *interface{} {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *luaScope) declare(name string, value interface{}) {
+	if s.vars == nil {
+		s.vars = make(map[string]*interface{})
+	}
+	s.vars[name] = &value
+}
+
+// A luaError is an error raised by a script, which pcall can catch. Its
+// value is usually a message prefixed with where in the script it was
+// raised, but error can raise any value.
+type luaError struct {
+	value interface{}
+	// cause is the store error a failed redis.call raised, if any.
+	cause error
+}
+
+func (e *luaError) Error() string {
+	switch v := e.value.(type) {
+	case string:
+		return v
+	case float64:
+		return formatLuaNumber(v)
+	case *luaTable:
+		if err, ok := v.get("err").(string); ok {
+			return err
+		}
+	}
+	return "(error object is a " + luaTypeName(e.value) + " value)"
+}
+
+// luaMaxCallDepth caps how deeply scripts can recurse.
+const luaMaxCallDepth = 1000
+
+// luaCheckInterval is how many steps a script takes between checks of its
+// deadline.
+const luaCheckInterval = 1024
+
+// A luaState is a single run of a script.
+type luaState struct {
+	globals  *luaTable
+	env      map[string]interface{} // KEYS and ARGV
+	store    Store
+	deadline time.Time
+	killed   func() bool
+	steps    int
+	depth    int
+	line     int
+}
+
+func (L *luaState) errorf(format string, args ...interface{}) error {
+	return &luaError{value: fmt.Sprintf("user_script:%d: ", L.line) + fmt.Sprintf(format, args...)}
+}
+
+// step counts work done by the script, and stops it once it's out of time
+// or has been killed. Neither can be caught by pcall.
+func (L *luaState) step() error {
+	L.steps++
+	if L.steps%luaCheckInterval != 0 {
+		return nil
+	}
+	if L.killed != nil && L.killed() {
+		return ErrScriptKilled
+	}
+	if !L.deadline.IsZero() && time.Now().After(L.deadline) {
+		return ErrScriptTimeout
+	}
+	return nil
+}
+
+func luaTypeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	}
+	return "function"
+}
+
+func luaTruthy(v interface{}) bool {
+	return v != nil && v != false
+}
+
+// formatLuaNumber formats a number as Lua 5.1's %.14g does.
+func formatLuaNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	case n == math.Trunc(n) && math.Abs(n) < 1e15:
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func luaToNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		return parseLuaNumber(v)
+	}
+	return 0, false
+}
+
+func luaToString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return formatLuaNumber(v), true
+	}
+	return "", false
+}
+
+// describe names the variable an expression reads, for error messages.
+func (L *luaState) describe(expr luaExpr, scope *luaScope) string {
+	switch e := expr.(type) {
+	case *luaName:
+		if scope.lookup(e.name) != nil {
+			return fmt.Sprintf("local '%s'", e.name)
+		}
+		return fmt.Sprintf("global '%s'", e.name)
+	case *luaIndex:
+		if key, ok := e.key.(*luaConstant); ok {
+			if s, ok := key.value.(string); ok {
+				return fmt.Sprintf("field '%s'", s)
+			}
+		}
+	}
+	return ""
+}
+
+func (L *luaState) typeError(action string, expr luaExpr, scope *luaScope, v interface{}) error {
+	if name := L.describe(expr, scope); name != "" {
+		return L.errorf("attempt to %s %s (a %s value)", action, name, luaTypeName(v))
+	}
+	return L.errorf("attempt to %s a %s value", action, luaTypeName(v))
+}
+
+type luaFlow int
+
+const (
+	luaNormal luaFlow = iota
+	luaBreakFlow
+	luaReturnFlow
+)
+
+func (L *luaState) call(fn interface{}, args []interface{}) ([]interface{}, error) {
+	L.depth++
+	defer func() { L.depth-- }()
+	if L.depth > luaMaxCallDepth {
+		return nil, L.errorf("stack overflow")
+	}
+	switch f := fn.(type) {
+	case *luaGoFunction:
+		line := L.line
+		results, err := f.fn(L, args)
+		L.line = line
+		return results, err
+	case *luaClosure:
+		line := L.line
+		scope := &luaScope{parent: f.scope}
+		for i, name := range f.proto.params {
+			var arg interface{}
+			if i < len(args) {
+				arg = args[i]
+			}
+			scope.declare(name, arg)
+		}
+		if f.proto.vararg {
+			var varargs []interface{}
+			if len(args) > len(f.proto.params) {
+				varargs = append(varargs, args[len(f.proto.params):]...)
+			}
+			scope.declare("...", varargs)
+		}
+		flow, results, err := L.execBlock(f.proto.body, scope)
+		L.line = line
+		if flow != luaReturnFlow {
+			results = nil
+		}
+		return results, err
+	}
+	return nil, L.errorf("attempt to call a %s value", luaTypeName(fn))
+}
+
+func (L *luaState) execBlock(stats []luaStat, parent *luaScope) (luaFlow, []interface{}, error) {
+	scope := &luaScope{parent: parent}
+	for _, stat := range stats {
+		flow, results, err := L.exec(stat, scope)
+		if err != nil || flow != luaNormal {
+			return flow, results, err
+		}
+	}
+	return luaNormal, nil, nil
+}
+
+func (L *luaState) exec(stat luaStat, scope *luaScope) (luaFlow, []interface{}, error) {
+	if err := L.step(); err != nil {
+		return luaNormal, nil, err
+	}
+	switch s := stat.(type) {
+	case *luaLocal:
+		values, err := L.evalList(s.exprs, scope, len(s.names))
+		if err != nil {
+			return luaNormal, nil, err
+		}
+		for i, name := range s.names {
+			scope.declare(name, values[i])
+		}
+	case *luaLocalFunction:
+		// The function can refer to itself.
+		scope.declare(s.name, nil)
+		*scope.lookup(s.name) = &luaClosure{s.proto, scope}
+	case *luaAssign:
+		return luaNormal, nil, L.assign(s, scope)
+	case *luaCallStat:
+		_, err := L.evalCall(s.call, scope)
+		return luaNormal, nil, err
+	case *luaDo:
+		return L.execBlock(s.body, scope)
+	case *luaWhile:
+		for {
+			if err := L.step(); err != nil {
+				return luaNormal, nil, err
+			}
+			cond, err := L.eval(s.cond, scope)
+			if err != nil || !luaTruthy(cond) {
+				return luaNormal, nil, err
+			}
+			flow, results, err := L.execBlock(s.body, scope)
+			if err != nil || flow == luaReturnFlow {
+				return flow, results, err
+			}
+			if flow == luaBreakFlow {
+				return luaNormal, nil, nil
+			}
+		}
+	case *luaRepeat:
+		for {
+			if err := L.step(); err != nil {
+				return luaNormal, nil, err
+			}
+			// The condition can see the body's locals.
+			body := &luaScope{parent: scope}
+			for _, stat := range s.body {
+				flow, results, err := L.exec(stat, body)
+				if err != nil || flow == luaReturnFlow {
+					return flow, results, err
+				}
+				if flow == luaBreakFlow {
+					return luaNormal, nil, nil
+				}
+			}
+			cond, err := L.eval(s.cond, body)
+			if err != nil || luaTruthy(cond) {
+				return luaNormal, nil, err
+			}
+		}
+	case *luaIf:
+		for i, condExpr := range s.conds {
+			cond, err := L.eval(condExpr, scope)
+			if err != nil {
+				return luaNormal, nil, err
+			}
+			if luaTruthy(cond) {
+				return L.execBlock(s.blocks[i], scope)
+			}
+		}
+		if s.elseBlock != nil {
+			return L.execBlock(s.elseBlock, scope)
+		}
+	case *luaNumericFor:
+		return L.numericFor(s, scope)
+	case *luaGenericFor:
+		return L.genericFor(s, scope)
+	case *luaReturn:
+		results, err := L.evalList(s.exprs, scope, -1)
+		return luaReturnFlow, results, err
+	case *luaBreak:
+		return luaBreakFlow, nil, nil
+	}
+	return luaNormal, nil, nil
+}
+
+func (L *luaState) numericFor(s *luaNumericFor, scope *luaScope) (luaFlow, []interface{}, error) {
+	L.line = s.line
+	var bounds [3]float64
+	exprs := []luaExpr{s.start, s.stop, s.step}
+	names := []string{"initial", "limit", "step"}
+	bounds[2] = 1
+	for i, expr := range exprs {
+		if expr == nil {
+			continue
+		}
+		v, err := L.eval(expr, scope)
+		if err != nil {
+			return luaNormal, nil, err
+		}
+		n, ok := luaToNumber(v)
+		if !ok {
+			return luaNormal, nil, L.errorf("'for' %s value must be a number", names[i])
+		}
+		bounds[i] = n
+	}
+	for i := bounds[0]; (bounds[2] > 0 && i <= bounds[1]) || (bounds[2] <= 0 && i >= bounds[1]); i += bounds[2] {
+		body := &luaScope{parent: scope}
+		body.declare(s.name, i)
+		flow, results, err := L.execBlock(s.body, body)
+		if err != nil || flow == luaReturnFlow {
+			return flow, results, err
+		}
+		if flow == luaBreakFlow {
+			break
+		}
+		if err := L.step(); err != nil {
+			return luaNormal, nil, err
+		}
+	}
+	return luaNormal, nil, nil
+}
+
+func (L *luaState) genericFor(s *luaGenericFor, scope *luaScope) (luaFlow, []interface{}, error) {
+	values, err := L.evalList(s.exprs, scope, 3)
+	if err != nil {
+		return luaNormal, nil, err
+	}
+	fn, state, control := values[0], values[1], values[2]
+	for {
+		if err := L.step(); err != nil {
+			return luaNormal, nil, err
+		}
+		L.line = s.line
+		results, err := L.call(fn, []interface{}{state, control})
+		if err != nil {
+			return luaNormal, nil, err
+		}
+		if len(results) == 0 || results[0] == nil {
+			return luaNormal, nil, nil
+		}
+		control = results[0]
+		body := &luaScope{parent: scope}
+		for i, name := range s.names {
+			var v interface{}
+			if i < len(results) {
+				v = results[i]
+			}
+			body.declare(name, v)
+		}
+		flow, results, err := L.execBlock(s.body, body)
+		if err != nil || flow == luaReturnFlow {
+			return flow, results, err
+		}
+		if flow == luaBreakFlow {
+			return luaNormal, nil, nil
+		}
+	}
+}
+
+func (L *luaState) assign(s *luaAssign, scope *luaScope) error {
+	// Evaluate the tables and keys being assigned to before the values, as
+	// Lua does.
+	type target struct {
+		table *luaTable
+		key   interface{}
+		name  string
+	}
+	targets := make([]target, len(s.targets))
+	for i, expr := range s.targets {
+		switch t := expr.(type) {
+		case *luaName:
+			targets[i].name = t.name
+		case *luaIndex:
+			object, err := L.eval(t.object, scope)
+			if err != nil {
+				return err
+			}
+			key, err := L.eval(t.key, scope)
+			if err != nil {
+				return err
+			}
+			table, ok := object.(*luaTable)
+			if !ok {
+				L.line = t.line
+				return L.typeError("index", t.object, scope, object)
+			}
+			targets[i].table, targets[i].key = table, key
+		}
+	}
+	values, err := L.evalList(s.exprs, scope, len(s.targets))
+	if err != nil {
+		return err
+	}
+	L.line = s.line
+	for i, t := range targets {
+		if t.table == nil {
+			if v := scope.lookup(t.name); v != nil {
+				*v = values[i]
+				continue
+			}
+			if _, ok := L.env[t.name]; ok || L.globals.get(t.name) != nil {
+				return L.errorf("Attempt to modify a readonly table")
+			}
+			return L.errorf("Script attempted to create global variable '%s'", t.name)
+		}
+		if err := L.setIndex(t.table, t.key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (L *luaState) setIndex(table *luaTable, key, value interface{}) error {
+	switch k := key.(type) {
+	case nil:
+		return L.errorf("table index is nil")
+	case float64:
+		if math.IsNaN(k) {
+			return L.errorf("table index is NaN")
+		}
+	}
+	if table.readonly {
+		return L.errorf("Attempt to modify a readonly table")
+	}
+	table.set(key, value)
+	return nil
+}
+
+// evalList evaluates expressions to exactly want values, padding with nil,
+// or to all of them if want is negative. Only the last expression can
+// produce more than one value.
+func (L *luaState) evalList(exprs []luaExpr, scope *luaScope, want int) ([]interface{}, error) {
+	var values []interface{}
+	for i, expr := range exprs {
+		if i == len(exprs)-1 {
+			multi, err := L.evalMulti(expr, scope)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, multi...)
+			break
+		}
+		v, err := L.eval(expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	if want < 0 {
+		return values, nil
+	}
+	for len(values) < want {
+		values = append(values, nil)
+	}
+	return values[:want], nil
+}
+
+// evalMulti evaluates an expression that can produce several values.
+func (L *luaState) evalMulti(expr luaExpr, scope *luaScope) ([]interface{}, error) {
+	switch e := expr.(type) {
+	case *luaCall:
+		return L.evalCall(e, scope)
+	case *luaVarargs:
+		// The parser only allows ... in functions that take varargs.
+		varargs, _ := (*scope.lookup("...")).([]interface{})
+		return varargs, nil
+	}
+	v, err := L.eval(expr, scope)
+	return []interface{}{v}, err
+}
+
+func (L *luaState) eval(expr luaExpr, scope *luaScope) (interface{}, error) {
+	switch e := expr.(type) {
+	case *luaConstant:
+		return e.value, nil
+	case *luaName:
+		if v := scope.lookup(e.name); v != nil {
+			return *v, nil
+		}
+		if v, ok := L.env[e.name]; ok {
+			return v, nil
+		}
+		if v := L.globals.get(e.name); v != nil {
+			return v, nil
+		}
+		L.line = e.line
+		return nil, L.errorf("Script attempted to access nonexistent global variable '%s'", e.name)
+	case *luaIndex:
+		object, err := L.eval(e.object, scope)
+		if err != nil {
+			return nil, err
+		}
+		key, err := L.eval(e.key, scope)
+		if err != nil {
+			return nil, err
+		}
+		L.line = e.line
+		return L.index(object, key, e.object, scope)
+	case *luaCall, *luaVarargs:
+		values, err := L.evalMulti(e, scope)
+		if err != nil || len(values) == 0 {
+			return nil, err
+		}
+		return values[0], nil
+	case *luaParen:
+		return L.eval(e.expr, scope)
+	case *luaFunctionExpr:
+		return &luaClosure{e.proto, scope}, nil
+	case *luaTableExpr:
+		return L.evalTable(e, scope)
+	case *luaUnary:
+		return L.evalUnary(e, scope)
+	case *luaBinary:
+		return L.evalBinary(e, scope)
+	}
+	return nil, fmt.Errorf("restis: unknown expression %T", expr)
+}
+
+// index reads a key from a table, or a function from the string library
+// for strings, which is how s:upper() works.
+func (L *luaState) index(object, key interface{}, expr luaExpr, scope *luaScope) (interface{}, error) {
+	switch o := object.(type) {
+	case *luaTable:
+		return o.get(key), nil
+	case string:
+		if lib, ok := L.globals.get("string").(*luaTable); ok {
+			return lib.get(key), nil
+		}
+	}
+	return nil, L.typeError("index", expr, scope, object)
+}
+
+func (L *luaState) evalCall(e *luaCall, scope *luaScope) ([]interface{}, error) {
+	fn, err := L.eval(e.fn, scope)
+	if err != nil {
+		return nil, err
+	}
+	var args []interface{}
+	fnExpr := e.fn
+	if e.method != "" {
+		L.line = e.line
+		object := fn
+		if fn, err = L.index(object, e.method, e.fn, scope); err != nil {
+			return nil, err
+		}
+		args = append(args, object)
+		fnExpr = &luaIndex{e.fn, &luaConstant{e.method}, e.line}
+	}
+	rest, err := L.evalList(e.args, scope, -1)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, rest...)
+	L.line = e.line
+	switch fn.(type) {
+	case *luaClosure, *luaGoFunction:
+	default:
+		if e.method != "" {
+			return nil, L.errorf("attempt to call method '%s' (a %s value)", e.method, luaTypeName(fn))
+		}
+		return nil, L.typeError("call", fnExpr, scope, fn)
+	}
+	return L.call(fn, args)
+}
+
+func (L *luaState) evalTable(e *luaTableExpr, scope *luaScope) (interface{}, error) {
+	table := newLuaTable()
+	position := 1
+	for i, item := range e.items {
+		if item.key == nil {
+			if i == len(e.items)-1 {
+				values, err := L.evalMulti(item.value, scope)
+				if err != nil {
+					return nil, err
+				}
+				for _, v := range values {
+					table.set(float64(position), v)
+					position++
+				}
+				break
+			}
+			v, err := L.eval(item.value, scope)
+			if err != nil {
+				return nil, err
+			}
+			table.set(float64(position), v)
+			position++
+			continue
+		}
+		key, err := L.eval(item.key, scope)
+		if err != nil {
+			return nil, err
+		}
+		v, err := L.eval(item.value, scope)
+		if err != nil {
+			return nil, err
+		}
+		if err := L.setIndex(table, key, v); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+func (L *luaState) evalUnary(e *luaUnary, scope *luaScope) (interface{}, error) {
+	v, err := L.eval(e.operand, scope)
+	if err != nil {
+		return nil, err
+	}
+	L.line = e.line
+	switch e.op {
+	case "not":
+		return !luaTruthy(v), nil
+	case "-":
+		if n, ok := luaToNumber(v); ok {
+			return -n, nil
+		}
+		return nil, L.typeError("perform arithmetic on", e.operand, scope, v)
+	}
+	switch v := v.(type) {
+	case string:
+		return float64(len(v)), nil
+	case *luaTable:
+		return float64(v.length()), nil
+	}
+	return nil, L.typeError("get length of", e.operand, scope, v)
+}
+
+func (L *luaState) evalBinary(e *luaBinary, scope *luaScope) (interface{}, error) {
+	left, err := L.eval(e.left, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "and":
+		if !luaTruthy(left) {
+			return left, nil
+		}
+		return L.eval(e.right, scope)
+	case "or":
+		if luaTruthy(left) {
+			return left, nil
+		}
+		return L.eval(e.right, scope)
+	}
+	right, err := L.eval(e.right, scope)
+	if err != nil {
+		return nil, err
+	}
+	L.line = e.line
+	switch e.op {
+	case "==":
+		return luaEqual(left, right), nil
+	case "~=":
+		return !luaEqual(left, right), nil
+	case "<":
+		return L.less(left, right, false)
+	case "<=":
+		return L.less(left, right, true)
+	case ">":
+		return L.less(right, left, false)
+	case ">=":
+		return L.less(right, left, true)
+	case "..":
+		a, ok := luaToString(left)
+		if !ok {
+			return nil, L.typeError("concatenate", e.left, scope, left)
+		}
+		b, ok := luaToString(right)
+		if !ok {
+			return nil, L.typeError("concatenate", e.right, scope, right)
+		}
+		if len(a)+len(b) > maxStringLength {
+			return nil, L.errorf("string length overflow")
+		}
+		return a + b, nil
+	}
+	a, ok := luaToNumber(left)
+	if !ok {
+		return nil, L.typeError("perform arithmetic on", e.left, scope, left)
+	}
+	b, ok := luaToNumber(right)
+	if !ok {
+		return nil, L.typeError("perform arithmetic on", e.right, scope, right)
+	}
+	return luaArithmetic(e.op, a, b), nil
+}
+
+func luaArithmetic(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a - math.Floor(a/b)*b
+	}
+	return math.Pow(a, b)
+}
+
+func luaEqual(a, b interface{}) bool {
+	return a == b
+}
+
+func (L *luaState) less(a, b interface{}, orEqual bool) (interface{}, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y || (orEqual && x == y), nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y || (orEqual && x == y), nil
+		}
+	}
+	if luaTypeName(a) == luaTypeName(b) {
+		return nil, L.errorf("attempt to compare two %s values", luaTypeName(a))
+	}
+	return nil, L.errorf("attempt to compare %s with %s", luaTypeName(a), luaTypeName(b))
+}
+
+// luaValueString converts a value as tostring does.
+func luaValueString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatLuaNumber(v)
+	case string:
+		return v
+	case *luaGoFunction:
+		return "builtin: " + v.name
+	}
+	return fmt.Sprintf("%s: %p", luaTypeName(v), v)
+}
+
+// luaQuote quotes a string as string.format's %q does.
+func luaQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\000")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,799 @@
+package restis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// luaLibrary builds the global functions and the string, table and math
+// libraries scripts can use. They're read only, so one set serves every
+// script.
+func luaLibrary() *luaTable {
+	globals := newLuaTable()
+	functions := map[string]func(*luaState, []interface{}) ([]interface{}, error){
+		"assert":   luaAssert,
+		"error":    luaErrorFunction,
+		"ipairs":   luaIPairs,
+		"next":     luaNext,
+		"pairs":    luaPairs,
+		"pcall":    luaPCall,
+		"rawequal": luaRawEqual,
+		"rawget":   luaRawGet,
+		"rawset":   luaRawSet,
+		"select":   luaSelect,
+		"tonumber": luaToNumberFunction,
+		"tostring": luaToStringFunction,
+		"type":     luaType,
+		"unpack":   luaUnpack,
+	}
+	for name, fn := range functions {
+		globals.set(name, &luaGoFunction{name, fn})
+	}
+	globals.set("_VERSION", "Lua 5.1")
+	globals.set("string", luaLibraryTable(map[string]func(*luaState, []interface{}) ([]interface{}, error){
+		"byte":    luaStringByte,
+		"char":    luaStringChar,
+		"find":    luaStringFind,
+		"format":  luaStringFormat,
+		"len":     luaStringLen,
+		"lower":   luaStringMap(strings.ToLower, "lower"),
+		"rep":     luaStringRep,
+		"reverse": luaStringReverse,
+		"sub":     luaStringSub,
+		"upper":   luaStringMap(strings.ToUpper, "upper"),
+	}))
+	globals.set("table", luaLibraryTable(map[string]func(*luaState, []interface{}) ([]interface{}, error){
+		"concat": luaTableConcat,
+		"getn":   luaTableGetN,
+		"insert": luaTableInsert,
+		"remove": luaTableRemove,
+		"sort":   luaTableSort,
+	}))
+	mathLibrary := luaLibraryTable(map[string]func(*luaState, []interface{}) ([]interface{}, error){
+		"abs":   luaMathFunction(math.Abs, "abs"),
+		"ceil":  luaMathFunction(math.Ceil, "ceil"),
+		"exp":   luaMathFunction(math.Exp, "exp"),
+		"floor": luaMathFunction(math.Floor, "floor"),
+		"fmod":  luaMathFmod,
+		"log":   luaMathFunction(math.Log, "log"),
+		"log10": luaMathFunction(math.Log10, "log10"),
+		"max":   luaMathExtreme(false, "max"),
+		"min":   luaMathExtreme(true, "min"),
+		"pow":   luaMathPow,
+		"sqrt":  luaMathFunction(math.Sqrt, "sqrt"),
+	})
+	mathLibrary.readonly = false
+	mathLibrary.set("huge", math.Inf(1))
+	mathLibrary.set("pi", math.Pi)
+	mathLibrary.readonly = true
+	globals.set("math", mathLibrary)
+	globals.readonly = true
+	return globals
+}
+
+func luaLibraryTable(functions map[string]func(*luaState, []interface{}) ([]interface{}, error)) *luaTable {
+	table := newLuaTable()
+	for name, fn := range functions {
+		table.set(name, &luaGoFunction{name, fn})
+	}
+	table.readonly = true
+	return table
+}
+
+func luaArg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func (L *luaState) argError(i int, name, message string) error {
+	return L.errorf("bad argument #%d to '%s' (%s)", i+1, name, message)
+}
+
+func (L *luaState) checkString(args []interface{}, i int, name string) (string, error) {
+	s, ok := luaToString(luaArg(args, i))
+	if !ok {
+		return "", L.argError(i, name, "string expected, got "+luaArgType(args, i))
+	}
+	return s, nil
+}
+
+func (L *luaState) checkNumber(args []interface{}, i int, name string) (float64, error) {
+	n, ok := luaToNumber(luaArg(args, i))
+	if !ok {
+		return 0, L.argError(i, name, "number expected, got "+luaArgType(args, i))
+	}
+	return n, nil
+}
+
+// checkInteger checks for a number and truncates it, as Lua does.
+func (L *luaState) checkInteger(args []interface{}, i int, name string) (int, error) {
+	n, err := L.checkNumber(args, i, name)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32, nil
+	}
+	if n < math.MinInt32 {
+		return math.MinInt32, nil
+	}
+	return int(n), nil
+}
+
+// optInteger returns the integer argument i, or def if it's missing or nil.
+func (L *luaState) optInteger(args []interface{}, i int, name string, def int) (int, error) {
+	if luaArg(args, i) == nil {
+		return def, nil
+	}
+	return L.checkInteger(args, i, name)
+}
+
+func (L *luaState) checkTable(args []interface{}, i int, name string) (*luaTable, error) {
+	t, ok := luaArg(args, i).(*luaTable)
+	if !ok {
+		return nil, L.argError(i, name, "table expected, got "+luaArgType(args, i))
+	}
+	return t, nil
+}
+
+func luaArgType(args []interface{}, i int) string {
+	if i >= len(args) {
+		return "no value"
+	}
+	return luaTypeName(args[i])
+}
+
+func luaResults(values ...interface{}) ([]interface{}, error) {
+	return values, nil
+}
+
+func luaAssert(L *luaState, args []interface{}) ([]interface{}, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "assert", "value expected")
+	}
+	if luaTruthy(args[0]) {
+		return args, nil
+	}
+	if message, ok := luaToString(luaArg(args, 1)); ok {
+		return nil, &luaError{value: message}
+	}
+	return nil, L.errorf("assertion failed!")
+}
+
+// luaErrorFunction raises its argument, prefixed with the position of the
+// call unless the level is 0 or the value isn't a string.
+func luaErrorFunction(L *luaState, args []interface{}) ([]interface{}, error) {
+	value := luaArg(args, 0)
+	level, err := L.optInteger(args, 1, "error", 1)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := value.(string); ok && level > 0 {
+		value = fmt.Sprintf("user_script:%d: %s", L.line, s)
+	}
+	return nil, &luaError{value: value}
+}
+
+func luaIPairs(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "ipairs")
+	if err != nil {
+		return nil, err
+	}
+	iterate := &luaGoFunction{"ipairs_iterator", func(L *luaState, args []interface{}) ([]interface{}, error) {
+		i, _ := luaArg(args, 1).(float64)
+		v := t.get(i + 1)
+		if v == nil {
+			return luaResults(nil)
+		}
+		return luaResults(i+1, v)
+	}}
+	return luaResults(iterate, t, 0.0)
+}
+
+// luaNext finds the key after key by scanning the table, so it's slow on
+// large tables; pairs iterates without it.
+func luaNext(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "next")
+	if err != nil {
+		return nil, err
+	}
+	keys := t.keys()
+	i := 0
+	if key := luaArg(args, 1); key != nil {
+		for i < len(keys) && keys[i] != key {
+			i++
+		}
+		if i == len(keys) {
+			return nil, L.errorf("invalid key to 'next'")
+		}
+		i++
+	}
+	if i == len(keys) {
+		return luaResults(nil)
+	}
+	return luaResults(keys[i], t.get(keys[i]))
+}
+
+// luaPairs iterates over the keys the table had when the loop started,
+// skipping any removed since.
+func luaPairs(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "pairs")
+	if err != nil {
+		return nil, err
+	}
+	keys := t.keys()
+	iterate := &luaGoFunction{"pairs_iterator", func(L *luaState, args []interface{}) ([]interface{}, error) {
+		for len(keys) > 0 {
+			key := keys[0]
+			keys = keys[1:]
+			if v := t.get(key); v != nil {
+				return luaResults(key, v)
+			}
+		}
+		return luaResults(nil)
+	}}
+	return luaResults(iterate, t, nil)
+}
+
+// luaPCall catches errors raised by the function it calls, but not
+// timeouts, which always end the script.
+func luaPCall(L *luaState, args []interface{}) ([]interface{}, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "pcall", "value expected")
+	}
+	depth := L.depth
+	results, err := L.call(args[0], args[1:])
+	if luaErr, ok := err.(*luaError); ok {
+		L.depth = depth
+		return luaResults(false, luaErr.value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]interface{}{true}, results...), nil
+}
+
+func luaRawEqual(L *luaState, args []interface{}) ([]interface{}, error) {
+	return luaResults(luaEqual(luaArg(args, 0), luaArg(args, 1)))
+}
+
+func luaRawGet(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "rawget")
+	if err != nil {
+		return nil, err
+	}
+	return luaResults(t.get(luaArg(args, 1)))
+}
+
+func luaRawSet(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	if err := L.setIndex(t, luaArg(args, 1), luaArg(args, 2)); err != nil {
+		return nil, err
+	}
+	return luaResults(t)
+}
+
+func luaSelect(L *luaState, args []interface{}) ([]interface{}, error) {
+	if luaArg(args, 0) == "#" {
+		return luaResults(float64(len(args) - 1))
+	}
+	n, err := L.checkInteger(args, 0, "select")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case n < 0:
+		n += len(args)
+		if n < 1 {
+			return nil, L.argError(0, "select", "index out of range")
+		}
+	case n == 0:
+		return nil, L.argError(0, "select", "index out of range")
+	case n >= len(args):
+		return nil, nil
+	}
+	return args[n:], nil
+}
+
+func luaToNumberFunction(L *luaState, args []interface{}) ([]interface{}, error) {
+	base, err := L.optInteger(args, 1, "tonumber", 10)
+	if err != nil {
+		return nil, err
+	}
+	if base == 10 {
+		if n, ok := luaToNumber(luaArg(args, 0)); ok {
+			return luaResults(n)
+		}
+		return luaResults(nil)
+	}
+	if base < 2 || base > 36 {
+		return nil, L.argError(1, "tonumber", "base out of range")
+	}
+	s, err := L.checkString(args, 0, "tonumber")
+	if err != nil {
+		return nil, err
+	}
+	s = strings.ToLower(strings.TrimSpace(s))
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return luaResults(nil)
+	}
+	n := 0.0
+	for _, c := range s {
+		digit := strings.IndexRune("0123456789abcdefghijklmnopqrstuvwxyz", c)
+		if digit < 0 || digit >= base {
+			return luaResults(nil)
+		}
+		n = n*float64(base) + float64(digit)
+	}
+	if negative {
+		n = -n
+	}
+	return luaResults(n)
+}
+
+func luaToStringFunction(L *luaState, args []interface{}) ([]interface{}, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "tostring", "value expected")
+	}
+	return luaResults(luaValueString(args[0]))
+}
+
+func luaType(L *luaState, args []interface{}) ([]interface{}, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "type", "value expected")
+	}
+	return luaResults(luaTypeName(args[0]))
+}
+
+func luaUnpack(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "unpack")
+	if err != nil {
+		return nil, err
+	}
+	i, err := L.optInteger(args, 1, "unpack", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optInteger(args, 2, "unpack", t.length())
+	if err != nil {
+		return nil, err
+	}
+	if j-i >= 8000 {
+		return nil, L.errorf("too many results to unpack")
+	}
+	var values []interface{}
+	for ; i <= j; i++ {
+		values = append(values, t.get(float64(i)))
+	}
+	return values, nil
+}
+
+// luaStringRange converts Lua's 1-based, possibly negative, inclusive
+// positions into a slice of s.
+func luaStringRange(s string, i, j int) (int, int) {
+	if i < 0 {
+		i += len(s) + 1
+	}
+	if j < 0 {
+		j += len(s) + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > len(s) {
+		j = len(s)
+	}
+	if i > j {
+		return 0, 0
+	}
+	return i - 1, j
+}
+
+func luaStringByte(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "byte")
+	if err != nil {
+		return nil, err
+	}
+	i, err := L.optInteger(args, 1, "byte", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optInteger(args, 2, "byte", i)
+	if err != nil {
+		return nil, err
+	}
+	start, end := luaStringRange(s, i, j)
+	var values []interface{}
+	for _, b := range []byte(s[start:end]) {
+		values = append(values, float64(b))
+	}
+	return values, nil
+}
+
+func luaStringChar(L *luaState, args []interface{}) ([]interface{}, error) {
+	b := make([]byte, len(args))
+	for i := range args {
+		n, err := L.checkInteger(args, i, "char")
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, L.argError(i, "char", "invalid value")
+		}
+		b[i] = byte(n)
+	}
+	return luaResults(string(b))
+}
+
+// luaStringFind only finds plain substrings: Lua patterns aren't supported,
+// so a pattern with special characters is an error unless plain is set.
+func luaStringFind(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "find")
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := L.checkString(args, 1, "find")
+	if err != nil {
+		return nil, err
+	}
+	init, err := L.optInteger(args, 2, "find", 1)
+	if err != nil {
+		return nil, err
+	}
+	if !luaTruthy(luaArg(args, 3)) && strings.ContainsAny(pattern, "^$*+?.([%-") {
+		return nil, L.errorf("string patterns are not supported, pass true as the fourth argument to find plain text")
+	}
+	if init < 0 {
+		init += len(s) + 1
+	}
+	if init < 1 {
+		init = 1
+	}
+	if init > len(s)+1 {
+		return luaResults(nil)
+	}
+	i := strings.Index(s[init-1:], pattern)
+	if i < 0 {
+		return luaResults(nil)
+	}
+	start := init + i
+	return luaResults(float64(start), float64(start+len(pattern)-1))
+}
+
+// luaStringFormat formats as C's printf does, which Go's fmt mostly agrees
+// with.
+func luaStringFormat(L *luaState, args []interface{}) ([]interface{}, error) {
+	format, err := L.checkString(args, 0, "format")
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		start := i
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			return nil, L.errorf("invalid option '%%' to 'format'")
+		}
+		spec, verb := format[start:i], format[i]
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if arg >= len(args) {
+			return nil, L.argError(arg, "format", "no value")
+		}
+		switch verb {
+		case 'd', 'i':
+			n, err := L.checkNumber(args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+"d", int64(n))
+		case 'x', 'X', 'o':
+			n, err := L.checkNumber(args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+string(verb), int64(n))
+		case 'c':
+			n, err := L.checkInteger(args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			b.WriteByte(byte(n))
+		case 'e', 'E', 'f', 'g', 'G':
+			n, err := L.checkNumber(args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			if !strings.Contains(spec, ".") && (verb == 'g' || verb == 'G') {
+				spec += ".6"
+			}
+			fmt.Fprintf(&b, spec+string(verb), n)
+		case 's':
+			fmt.Fprintf(&b, spec+"s", luaValueString(args[arg]))
+		case 'q':
+			s, err := L.checkString(args, arg, "format")
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(luaQuote(s))
+		default:
+			return nil, L.errorf("invalid option '%%%c' to 'format'", verb)
+		}
+		if b.Len() > maxStringLength {
+			return nil, L.errorf("string length overflow")
+		}
+		arg++
+	}
+	return luaResults(b.String())
+}
+
+func luaStringLen(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "len")
+	if err != nil {
+		return nil, err
+	}
+	return luaResults(float64(len(s)))
+}
+
+func luaStringMap(mapping func(string) string, name string) func(*luaState, []interface{}) ([]interface{}, error) {
+	return func(L *luaState, args []interface{}) ([]interface{}, error) {
+		s, err := L.checkString(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		return luaResults(mapping(s))
+	}
+}
+
+func luaStringRep(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "rep")
+	if err != nil {
+		return nil, err
+	}
+	n, err := L.checkInteger(args, 1, "rep")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return luaResults("")
+	}
+	if len(s)*n > maxStringLength {
+		return nil, L.errorf("string length overflow")
+	}
+	return luaResults(strings.Repeat(s, n))
+}
+
+func luaStringReverse(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "reverse")
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return luaResults(string(b))
+}
+
+func luaStringSub(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "sub")
+	if err != nil {
+		return nil, err
+	}
+	i, err := L.optInteger(args, 1, "sub", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optInteger(args, 2, "sub", -1)
+	if err != nil {
+		return nil, err
+	}
+	start, end := luaStringRange(s, i, j)
+	return luaResults(s[start:end])
+}
+
+func luaTableConcat(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "concat")
+	if err != nil {
+		return nil, err
+	}
+	separator := ""
+	if luaArg(args, 1) != nil {
+		if separator, err = L.checkString(args, 1, "concat"); err != nil {
+			return nil, err
+		}
+	}
+	i, err := L.optInteger(args, 2, "concat", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optInteger(args, 3, "concat", t.length())
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for k := i; k <= j; k++ {
+		s, ok := luaToString(t.get(float64(k)))
+		if !ok {
+			return nil, L.errorf("invalid value (at index %d) in table for 'concat'", k)
+		}
+		b.WriteString(s)
+		if k < j {
+			b.WriteString(separator)
+		}
+		if b.Len() > maxStringLength {
+			return nil, L.errorf("string length overflow")
+		}
+	}
+	return luaResults(b.String())
+}
+
+func luaTableGetN(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "getn")
+	if err != nil {
+		return nil, err
+	}
+	return luaResults(float64(t.length()))
+}
+
+func luaTableInsert(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "insert")
+	if err != nil {
+		return nil, err
+	}
+	if t.readonly {
+		return nil, L.errorf("Attempt to modify a readonly table")
+	}
+	n := t.length()
+	switch len(args) {
+	case 2:
+		t.set(float64(n+1), args[1])
+	case 3:
+		pos, err := L.checkInteger(args, 1, "insert")
+		if err != nil {
+			return nil, err
+		}
+		for i := n; i >= pos; i-- {
+			t.set(float64(i+1), t.get(float64(i)))
+		}
+		if err := L.setIndex(t, float64(pos), args[2]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, L.errorf("wrong number of arguments to 'insert'")
+	}
+	return nil, nil
+}
+
+func luaTableRemove(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "remove")
+	if err != nil {
+		return nil, err
+	}
+	if t.readonly {
+		return nil, L.errorf("Attempt to modify a readonly table")
+	}
+	n := t.length()
+	pos, err := L.optInteger(args, 1, "remove", n)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return luaResults(nil)
+	}
+	removed := t.get(float64(pos))
+	for i := pos; i < n; i++ {
+		t.set(float64(i), t.get(float64(i+1)))
+	}
+	t.set(float64(n), nil)
+	return luaResults(removed)
+}
+
+// luaTableSort sorts the array part of a table, with < or with a comparison
+// function.
+func luaTableSort(L *luaState, args []interface{}) ([]interface{}, error) {
+	t, err := L.checkTable(args, 0, "sort")
+	if err != nil {
+		return nil, err
+	}
+	if t.readonly {
+		return nil, L.errorf("Attempt to modify a readonly table")
+	}
+	compare := luaArg(args, 1)
+	values := append([]interface{}(nil), t.array...)
+	var sortErr error
+	sort.SliceStable(values, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		var less interface{}
+		if compare == nil {
+			less, sortErr = L.less(values[i], values[j], false)
+		} else {
+			var results []interface{}
+			results, sortErr = L.call(compare, []interface{}{values[i], values[j]})
+			less = luaArg(results, 0)
+		}
+		if sortErr == nil {
+			sortErr = L.step()
+		}
+		return luaTruthy(less)
+	})
+	if sortErr != nil {
+		return nil, sortErr
+	}
+	copy(t.array, values)
+	return nil, nil
+}
+
+func luaMathFunction(fn func(float64) float64, name string) func(*luaState, []interface{}) ([]interface{}, error) {
+	return func(L *luaState, args []interface{}) ([]interface{}, error) {
+		n, err := L.checkNumber(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		return luaResults(fn(n))
+	}
+}
+
+func luaMathFmod(L *luaState, args []interface{}) ([]interface{}, error) {
+	a, err := L.checkNumber(args, 0, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	b, err := L.checkNumber(args, 1, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	return luaResults(math.Mod(a, b))
+}
+
+func luaMathPow(L *luaState, args []interface{}) ([]interface{}, error) {
+	a, err := L.checkNumber(args, 0, "pow")
+	if err != nil {
+		return nil, err
+	}
+	b, err := L.checkNumber(args, 1, "pow")
+	if err != nil {
+		return nil, err
+	}
+	return luaResults(math.Pow(a, b))
+}
+
+func luaMathExtreme(min bool, name string) func(*luaState, []interface{}) ([]interface{}, error) {
+	return func(L *luaState, args []interface{}) ([]interface{}, error) {
+		extreme, err := L.checkNumber(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(args); i++ {
+			n, err := L.checkNumber(args, i, name)
+			if err != nil {
+				return nil, err
+			}
+			if (min && n < extreme) || (!min && n > extreme) {
+				extreme = n
+			}
+		}
+		return luaResults(extreme)
+	}
+}
@@ -0,0 +1,1082 @@
+package restis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The scripting language is a subset of Lua 5.1, the version Redis embeds:
+// everything but metatables, coroutines, goto and string patterns. Scripts
+// are parsed into a tree of the types below and interpreted directly.
+
+// luaMaxDepth caps how deeply blocks and expressions nest, so that a
+// malicious script can't exhaust the Go stack while being parsed.
+const luaMaxDepth = 200
+
+type luaSyntaxError struct {
+	line    int
+	message string
+}
+
+func (e *luaSyntaxError) Error() string {
+	return fmt.Sprintf("user_script:%d: %s", e.line, e.message)
+}
+
+const (
+	luaEOF = iota
+	luaNameToken
+	luaNumberToken
+	luaStringToken
+	luaKeyword
+	luaSymbol
+)
+
+type luaToken struct {
+	kind  int
+	text  string
+	value interface{} // the number or string of literals
+	line  int
+}
+
+func (t luaToken) String() string {
+	if t.kind == luaEOF {
+		return "<eof>"
+	}
+	return t.text
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// luaSymbols are the operators and punctuation, longest first so that the
+// lexer prefers "..." to "..", and ".." to ".".
+var luaSymbols = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type luaLexer struct {
+	source string
+	pos    int
+	line   int
+}
+
+func (lx *luaLexer) errorf(format string, args ...interface{}) error {
+	return &luaSyntaxError{lx.line, fmt.Sprintf(format, args...)}
+}
+
+func (lx *luaLexer) next() (luaToken, error) {
+	if err := lx.skipSpace(); err != nil {
+		return luaToken{}, err
+	}
+	if lx.pos >= len(lx.source) {
+		return luaToken{kind: luaEOF, line: lx.line}, nil
+	}
+	start, c := lx.pos, lx.source[lx.pos]
+	switch {
+	case c == '_' || isLetter(c):
+		for lx.pos < len(lx.source) && (lx.source[lx.pos] == '_' || isLetter(lx.source[lx.pos]) || isDigit(lx.source[lx.pos])) {
+			lx.pos++
+		}
+		text := lx.source[start:lx.pos]
+		if luaKeywords[text] {
+			return luaToken{kind: luaKeyword, text: text, line: lx.line}, nil
+		}
+		return luaToken{kind: luaNameToken, text: text, line: lx.line}, nil
+	case isDigit(c) || (c == '.' && lx.pos+1 < len(lx.source) && isDigit(lx.source[lx.pos+1])):
+		return lx.number()
+	case c == '"' || c == '\'':
+		return lx.quoted(c)
+	case c == '[' && lx.longBracketLevel() >= 0:
+		line := lx.line
+		s, err := lx.longString()
+		if err != nil {
+			return luaToken{}, err
+		}
+		return luaToken{kind: luaStringToken, text: s, value: s, line: line}, nil
+	}
+	for _, symbol := range luaSymbols {
+		if strings.HasPrefix(lx.source[lx.pos:], symbol) {
+			lx.pos += len(symbol)
+			return luaToken{kind: luaSymbol, text: symbol, line: lx.line}, nil
+		}
+	}
+	return luaToken{}, lx.errorf("unexpected symbol near '%c'", c)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (lx *luaLexer) skipSpace() error {
+	for lx.pos < len(lx.source) {
+		switch c := lx.source[lx.pos]; {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case strings.HasPrefix(lx.source[lx.pos:], "--"):
+			lx.pos += 2
+			if lx.pos < len(lx.source) && lx.source[lx.pos] == '[' && lx.longBracketLevel() >= 0 {
+				if _, err := lx.longString(); err != nil {
+					return err
+				}
+				continue
+			}
+			for lx.pos < len(lx.source) && lx.source[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// longBracketLevel returns the number of = signs in the opening long
+// bracket at the current position, or -1 if there isn't one.
+func (lx *luaLexer) longBracketLevel() int {
+	i := lx.pos + 1
+	for i < len(lx.source) && lx.source[i] == '=' {
+		i++
+	}
+	if i < len(lx.source) && lx.source[i] == '[' {
+		return i - lx.pos - 1
+	}
+	return -1
+}
+
+func (lx *luaLexer) longString() (string, error) {
+	level := lx.longBracketLevel()
+	lx.pos += level + 2
+	// A newline straight after the opening bracket isn't part of the string.
+	if strings.HasPrefix(lx.source[lx.pos:], "\r\n") {
+		lx.pos += 2
+		lx.line++
+	} else if strings.HasPrefix(lx.source[lx.pos:], "\n") {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.source[lx.pos:], closing)
+	if end < 0 {
+		return "", lx.errorf("unfinished long string near '<eof>'")
+	}
+	s := lx.source[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, nil
+}
+
+func (lx *luaLexer) number() (luaToken, error) {
+	start := lx.pos
+	if strings.HasPrefix(lx.source[lx.pos:], "0x") || strings.HasPrefix(lx.source[lx.pos:], "0X") {
+		lx.pos += 2
+	}
+	for lx.pos < len(lx.source) {
+		c := lx.source[lx.pos]
+		if (c == '+' || c == '-') && (lx.source[lx.pos-1] == 'e' || lx.source[lx.pos-1] == 'E') && !strings.ContainsAny(lx.source[start:lx.pos], "xX") {
+			lx.pos++
+			continue
+		}
+		if c != '.' && c != '_' && !isLetter(c) && !isDigit(c) {
+			break
+		}
+		lx.pos++
+	}
+	text := lx.source[start:lx.pos]
+	n, ok := parseLuaNumber(text)
+	if !ok {
+		return luaToken{}, lx.errorf("malformed number near '%s'", text)
+	}
+	return luaToken{kind: luaNumberToken, text: text, value: n, line: lx.line}, nil
+}
+
+// parseLuaNumber parses a decimal or hexadecimal number as Lua's tonumber
+// does, allowing surrounding spaces.
+func parseLuaNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	unsigned := strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	if strings.HasPrefix(unsigned, "0x") || strings.HasPrefix(unsigned, "0X") {
+		n, err := strconv.ParseUint(unsigned[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if s[0] == '-' {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !isDigit(c) && c != '.' && c != 'e' && c != 'E' && c != '+' && c != '-' {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+var luaEscapes = map[byte]byte{'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v', '\\': '\\', '"': '"', '\'': '\'', '\n': '\n'}
+
+func (lx *luaLexer) quoted(quote byte) (luaToken, error) {
+	line := lx.line
+	lx.pos++
+	var b strings.Builder
+	for {
+		if lx.pos >= len(lx.source) || lx.source[lx.pos] == '\n' {
+			return luaToken{}, lx.errorf("unfinished string near '%c%s'", quote, b.String())
+		}
+		c := lx.source[lx.pos]
+		lx.pos++
+		if c == quote {
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if lx.pos >= len(lx.source) {
+			continue
+		}
+		c = lx.source[lx.pos]
+		if escaped, ok := luaEscapes[c]; ok {
+			if c == '\n' {
+				lx.line++
+			}
+			b.WriteByte(escaped)
+			lx.pos++
+			continue
+		}
+		if !isDigit(c) {
+			return luaToken{}, lx.errorf("invalid escape sequence '\\%c'", c)
+		}
+		n := 0
+		for i := 0; i < 3 && lx.pos < len(lx.source) && isDigit(lx.source[lx.pos]); i++ {
+			n = n*10 + int(lx.source[lx.pos]-'0')
+			lx.pos++
+		}
+		if n > 255 {
+			return luaToken{}, lx.errorf("escape sequence too large")
+		}
+		b.WriteByte(byte(n))
+	}
+	s := b.String()
+	return luaToken{kind: luaStringToken, text: string(quote) + s + string(quote), value: s, line: line}, nil
+}
+
+// Expressions.
+type (
+	luaExpr interface{}
+
+	luaConstant struct{ value interface{} }
+	luaVarargs  struct{}
+	luaName     struct {
+		name string
+		line int
+	}
+	luaIndex struct {
+		object, key luaExpr
+		line        int
+	}
+	luaCall struct {
+		fn     luaExpr
+		method string // set for obj:method(...) calls
+		args   []luaExpr
+		line   int
+	}
+	luaFunctionExpr struct{ proto *luaFunctionProto }
+	luaBinary       struct {
+		op          string
+		left, right luaExpr
+		line        int
+	}
+	luaUnary struct {
+		op      string
+		operand luaExpr
+		line    int
+	}
+	luaParen     struct{ expr luaExpr }
+	luaTableExpr struct{ items []luaTableItem }
+	luaTableItem struct {
+		key   luaExpr // nil for positional items
+		value luaExpr
+	}
+)
+
+// Statements.
+type (
+	luaStat interface{}
+
+	luaLocal struct {
+		names []string
+		exprs []luaExpr
+	}
+	luaAssign struct {
+		targets []luaExpr
+		exprs   []luaExpr
+		line    int
+	}
+	luaCallStat struct{ call *luaCall }
+	luaDo       struct{ body []luaStat }
+	luaWhile    struct {
+		cond luaExpr
+		body []luaStat
+	}
+	luaRepeat struct {
+		body []luaStat
+		cond luaExpr
+	}
+	luaIf struct {
+		conds     []luaExpr
+		blocks    [][]luaStat
+		elseBlock []luaStat
+	}
+	luaNumericFor struct {
+		name              string
+		start, stop, step luaExpr
+		body              []luaStat
+		line              int
+	}
+	luaGenericFor struct {
+		names []string
+		exprs []luaExpr
+		body  []luaStat
+		line  int
+	}
+	luaLocalFunction struct {
+		name  string
+		proto *luaFunctionProto
+	}
+	luaReturn struct{ exprs []luaExpr }
+	luaBreak  struct{}
+)
+
+type luaFunctionProto struct {
+	params []string
+	vararg bool
+	body   []luaStat
+}
+
+type luaParser struct {
+	lexer luaLexer
+	token luaToken
+	ahead *luaToken
+	depth int
+	// vararg is whether the function being parsed takes varargs.
+	vararg bool
+}
+
+// parseLua parses a chunk into the body of a function that takes varargs,
+// as Lua does.
+func parseLua(source string) (proto *luaFunctionProto, err error) {
+	p := &luaParser{lexer: luaLexer{source: source, line: 1}, vararg: true}
+	if strings.HasPrefix(source, "#") {
+		// Skip a shebang line.
+		for p.lexer.pos < len(source) && source[p.lexer.pos] != '\n' {
+			p.lexer.pos++
+		}
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != luaEOF {
+		return nil, p.errorf("'<eof>' expected")
+	}
+	return &luaFunctionProto{vararg: true, body: body}, nil
+}
+
+func (p *luaParser) errorf(format string, args ...interface{}) error {
+	return &luaSyntaxError{p.token.line, fmt.Sprintf(format, args...) + fmt.Sprintf(" near '%s'", p.token)}
+}
+
+func (p *luaParser) advance() error {
+	if p.ahead != nil {
+		p.token, p.ahead = *p.ahead, nil
+		return nil
+	}
+	token, err := p.lexer.next()
+	p.token = token
+	return err
+}
+
+func (p *luaParser) peek() (luaToken, error) {
+	if p.ahead == nil {
+		token, err := p.lexer.next()
+		if err != nil {
+			return token, err
+		}
+		p.ahead = &token
+	}
+	return *p.ahead, nil
+}
+
+func (p *luaParser) is(text string) bool {
+	return (p.token.kind == luaSymbol || p.token.kind == luaKeyword) && p.token.text == text
+}
+
+func (p *luaParser) accept(text string) (bool, error) {
+	if !p.is(text) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *luaParser) expect(text string) error {
+	if !p.is(text) {
+		return p.errorf("'%s' expected", text)
+	}
+	return p.advance()
+}
+
+// expectClosing expects the keyword that closes a construct opened on line.
+func (p *luaParser) expectClosing(text, opening string, line int) error {
+	if p.is(text) {
+		return p.advance()
+	}
+	if line == p.token.line {
+		return p.errorf("'%s' expected", text)
+	}
+	return p.errorf("'%s' expected (to close '%s' at line %d)", text, opening, line)
+}
+
+func (p *luaParser) name() (string, error) {
+	if p.token.kind != luaNameToken {
+		return "", p.errorf("<name> expected")
+	}
+	name := p.token.text
+	return name, p.advance()
+}
+
+func (p *luaParser) enter() error {
+	p.depth++
+	if p.depth > luaMaxDepth {
+		return p.errorf("chunk has too many syntax levels")
+	}
+	return nil
+}
+
+func (p *luaParser) blockEnds() bool {
+	return p.token.kind == luaEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *luaParser) block() ([]luaStat, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	var stats []luaStat
+	for !p.blockEnds() {
+		if p.is("return") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			var exprs []luaExpr
+			if !p.blockEnds() && !p.is(";") {
+				var err error
+				if exprs, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := p.accept(";"); err != nil {
+				return nil, err
+			}
+			if !p.blockEnds() {
+				return nil, p.errorf("'<eof>' expected")
+			}
+			return append(stats, &luaReturn{exprs}), nil
+		}
+		if p.is("break") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if _, err := p.accept(";"); err != nil {
+				return nil, err
+			}
+			stats = append(stats, &luaBreak{})
+			continue
+		}
+		stat, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if stat != nil {
+			stats = append(stats, stat)
+		}
+		if _, err := p.accept(";"); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func (p *luaParser) statement() (luaStat, error) {
+	line := p.token.line
+	switch {
+	case p.is(";"):
+		return nil, nil
+	case p.is("do"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &luaDo{body}, p.expectClosing("end", "do", line)
+	case p.is("while"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &luaWhile{cond, body}, p.expectClosing("end", "while", line)
+	case p.is("repeat"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectClosing("until", "repeat", line); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		return &luaRepeat{body, cond}, err
+	case p.is("if"):
+		return p.ifStatement()
+	case p.is("for"):
+		return p.forStatement()
+	case p.is("function"):
+		return p.functionStatement()
+	case p.is("local"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.accept("function"); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			proto, err := p.functionBody(false, line)
+			return &luaLocalFunction{name, proto}, err
+		}
+		var names []string
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+			if ok, err := p.accept(","); !ok || err != nil {
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		var exprs []luaExpr
+		if ok, err := p.accept("="); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			if exprs, err = p.exprList(); err != nil {
+				return nil, err
+			}
+		}
+		return &luaLocal{names, exprs}, nil
+	}
+	return p.exprStatement()
+}
+
+func (p *luaParser) ifStatement() (luaStat, error) {
+	line := p.token.line
+	stat := &luaIf{}
+	for {
+		// The current token is if or elseif.
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stat.conds = append(stat.conds, cond)
+		stat.blocks = append(stat.blocks, body)
+		if !p.is("elseif") {
+			break
+		}
+	}
+	if ok, err := p.accept("else"); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stat.elseBlock = body
+	}
+	return stat, p.expectClosing("end", "if", line)
+}
+
+func (p *luaParser) forStatement() (luaStat, error) {
+	line := p.token.line
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	first, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := p.accept("="); ok || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		stat := &luaNumericFor{name: first, line: line}
+		if stat.start, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if stat.stop, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.accept(","); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			if stat.step, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		if stat.body, err = p.block(); err != nil {
+			return nil, err
+		}
+		return stat, p.expectClosing("end", "for", line)
+	}
+	stat := &luaGenericFor{names: []string{first}, line: line}
+	for p.is(",") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		stat.names = append(stat.names, name)
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	if stat.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	if stat.body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return stat, p.expectClosing("end", "for", line)
+}
+
+// functionStatement parses function a.b.c:m() ... end into an assignment.
+func (p *luaParser) functionStatement() (luaStat, error) {
+	line := p.token.line
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	var target luaExpr = &luaName{name, line}
+	method := false
+	for p.is(".") || p.is(":") {
+		method = p.is(":")
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		key, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		target = &luaIndex{target, &luaConstant{key}, line}
+		if method {
+			break
+		}
+	}
+	proto, err := p.functionBody(method, line)
+	if err != nil {
+		return nil, err
+	}
+	return &luaAssign{[]luaExpr{target}, []luaExpr{&luaFunctionExpr{proto}}, line}, nil
+}
+
+func (p *luaParser) functionBody(method bool, line int) (*luaFunctionProto, error) {
+	proto := &luaFunctionProto{}
+	if method {
+		proto.params = []string{"self"}
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.is(")") {
+		if ok, err := p.accept("..."); ok || err != nil {
+			if err != nil {
+				return nil, err
+			}
+			proto.vararg = true
+			break
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		proto.params = append(proto.params, name)
+		if !p.is(")") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	vararg := p.vararg
+	p.vararg = proto.vararg
+	body, err := p.block()
+	p.vararg = vararg
+	if err != nil {
+		return nil, err
+	}
+	proto.body = body
+	return proto, p.expectClosing("end", "function", line)
+}
+
+func (p *luaParser) exprStatement() (luaStat, error) {
+	line := p.token.line
+	expr, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := expr.(*luaCall); ok && !p.is("=") && !p.is(",") {
+		return &luaCallStat{call}, nil
+	}
+	targets := []luaExpr{expr}
+	for p.is(",") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		target, err := p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	for _, target := range targets {
+		switch target.(type) {
+		case *luaName, *luaIndex:
+		default:
+			return nil, p.errorf("syntax error")
+		}
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	exprs, err := p.exprList()
+	return &luaAssign{targets, exprs, line}, err
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if ok, err := p.accept(","); !ok || err != nil {
+			return exprs, err
+		}
+	}
+}
+
+// luaBinaryPriority gives the left and right binding power of each binary
+// operator; .. and ^ are right associative.
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4}, "+": {6, 6}, "-": {6, 6}, "*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const luaUnaryPriority = 8
+
+func (p *luaParser) expr() (luaExpr, error) {
+	return p.subExpr(0)
+}
+
+func (p *luaParser) subExpr(limit int) (luaExpr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	var left luaExpr
+	if p.is("not") || p.is("-") || p.is("#") {
+		op, line := p.token.text, p.token.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.subExpr(luaUnaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &luaUnary{op, operand, line}
+	} else {
+		var err error
+		if left, err = p.simpleExpr(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		priority, ok := luaBinaryPriority[p.token.text]
+		if !ok || (p.token.kind != luaSymbol && p.token.kind != luaKeyword) || priority[0] <= limit {
+			return left, nil
+		}
+		op, line := p.token.text, p.token.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.subExpr(priority[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &luaBinary{op, left, right, line}
+	}
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	token := p.token
+	switch {
+	case token.kind == luaNumberToken || token.kind == luaStringToken:
+		return &luaConstant{token.value}, p.advance()
+	case p.is("nil"):
+		return &luaConstant{nil}, p.advance()
+	case p.is("true"):
+		return &luaConstant{true}, p.advance()
+	case p.is("false"):
+		return &luaConstant{false}, p.advance()
+	case p.is("..."):
+		if !p.vararg {
+			return nil, p.errorf("cannot use '...' outside a vararg function")
+		}
+		return &luaVarargs{}, p.advance()
+	case p.is("{"):
+		return p.tableConstructor()
+	case p.is("function"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		proto, err := p.functionBody(false, token.line)
+		return &luaFunctionExpr{proto}, err
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() (luaExpr, error) {
+	switch {
+	case p.token.kind == luaNameToken:
+		name := &luaName{p.token.text, p.token.line}
+		return name, p.advance()
+	case p.is("("):
+		line := p.token.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &luaParen{expr}, p.expectClosing(")", "(", line)
+	}
+	return nil, p.errorf("unexpected symbol")
+}
+
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	expr, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line := p.token.line
+		switch {
+		case p.is("."):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaIndex{expr, &luaConstant{key}, line}
+		case p.is("["):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = &luaIndex{expr, key, line}
+		case p.is(":"):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			method, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCall{expr, method, args, line}
+		case p.is("(") || p.is("{") || p.token.kind == luaStringToken:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCall{expr, "", args, line}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *luaParser) callArgs() ([]luaExpr, error) {
+	switch {
+	case p.token.kind == luaStringToken:
+		arg := &luaConstant{p.token.value}
+		return []luaExpr{arg}, p.advance()
+	case p.is("{"):
+		table, err := p.tableConstructor()
+		return []luaExpr{table}, err
+	}
+	line := p.token.line
+	if err := p.expect("("); err != nil {
+		return nil, p.errorf("function arguments expected")
+	}
+	if ok, err := p.accept(")"); ok || err != nil {
+		return nil, err
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return args, p.expectClosing(")", "(", line)
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	line := p.token.line
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	table := &luaTableExpr{}
+	for !p.is("}") {
+		var item luaTableItem
+		switch {
+		case p.is("["):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			item.key = key
+		case p.token.kind == luaNameToken:
+			next, err := p.peek()
+			if err != nil {
+				return nil, err
+			}
+			if next.kind == luaSymbol && next.text == "=" {
+				item.key = &luaConstant{p.token.text}
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		item.value = value
+		table.items = append(table.items, item)
+		if !p.is(",") && !p.is(";") {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return table, p.expectClosing("}", "{", line)
+}
@@ -1,284 +1,1690 @@
 package restis
 
 import (
+	"hash/fnv"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const shardCount = 64
+
+const (
+	expiryCycleInterval = 100 * time.Millisecond
+	expirySampleSize    = 20
+)
+
+const maxStringLength = 512 << 20
+
+// maxRandomCount bounds how many members a negative count can ask SRANDMEMBER
+// or HRANDFIELD for, since each one is allocated up front.
+const maxRandomCount = 1 << 20
+
+const (
+	typeNone   = "none"
+	typeString = "string"
+	typeSet    = "set"
+	typeHash   = "hash"
+	typeList   = "list"
+	typeZSet   = "zset"
+)
+
+// A MemoryStore spreads its keys over shards that are locked independently,
+// so operations on unrelated keys don't contend with each other. Operations
+// that touch several keys lock every shard involved, in index order.
+//
+// Each key lives in exactly one of the shard's typed maps; collections that
+// become empty are removed so that the key no longer exists.
+//
+// Keys with a TTL are expired lazily whenever they are locked, and by a
+// background cycle that starts with the first TTL and stops on Close.
 type MemoryStore struct {
-	strings map[string]string
-	sets    map[string]map[string]bool
-	hashes  map[string]map[string]string
-	lists   map[string][]string
+	dirty       int64  // writes since the last snapshot, updated atomically
+	lastVersion uint64 // the version of the latest write, updated atomically
+	shards      [shardCount]*shard
+	clock       Clock
+	expiryStart sync.Once
+	closeOnce   sync.Once
+	closed      chan struct{}
+	snapshots   *snapshotter
+	broker      *Broker
+	scripts     *scriptCache
+	keyspace    keyspaceHub
+	waiters     listWaiters  // callers blocked on lists
+	parent      *MemoryStore // set on the views transactions run against
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type shard struct {
+	sync.Mutex
+	strings    map[string]string
+	sets       map[string]map[string]bool
+	hashes     map[string]map[string]string
+	lists      map[string]*deque
+	sortedSets map[string]*sortedSet
+	expires    map[string]int64
+	// fieldExpires holds the expiries of hash fields, for hashes with any.
+	fieldExpires map[string]*fieldExpiries
+	versions     map[string]uint64
+}
+
+func newShard() *shard {
+	return &shard{
+		strings:      make(map[string]string),
+		sets:         make(map[string]map[string]bool),
+		hashes:       make(map[string]map[string]string),
+		lists:        make(map[string]*deque),
+		sortedSets:   make(map[string]*sortedSet),
+		expires:      make(map[string]int64),
+		fieldExpires: make(map[string]*fieldExpiries),
+		versions:     make(map[string]uint64),
+	}
+}
+
+func (sh *shard) keyType(key string) string {
+	if _, ok := sh.strings[key]; ok {
+		return typeString
+	}
+	if _, ok := sh.sets[key]; ok {
+		return typeSet
+	}
+	if _, ok := sh.hashes[key]; ok {
+		return typeHash
+	}
+	if _, ok := sh.lists[key]; ok {
+		return typeList
+	}
+	if _, ok := sh.sortedSets[key]; ok {
+		return typeZSet
+	}
+	return typeNone
+}
+
+func (sh *shard) exists(key string) bool {
+	return sh.keyType(key) != typeNone
+}
+
+func (sh *shard) expectType(key, expected string) error {
+	if actual := sh.keyType(key); actual != expected && actual != typeNone {
+		return ErrWrongType
+	}
+	return nil
+}
+
+func (sh *shard) remove(key string) {
+	delete(sh.strings, key)
+	delete(sh.sets, key)
+	delete(sh.hashes, key)
+	delete(sh.lists, key)
+	delete(sh.sortedSets, key)
+	delete(sh.expires, key)
+	delete(sh.fieldExpires, key)
+	delete(sh.versions, key)
+}
+
+// version returns the version of key: 0 if it doesn't exist, 1 if it hasn't
+// been written since it was loaded, and otherwise the number of its latest
+// write, which no other write shares.
+func (sh *shard) version(key string) uint64 {
+	if version, ok := sh.versions[key]; ok {
+		return version
+	}
+	if sh.exists(key) {
+		return 1
+	}
+	return 0
+}
+
+func (sh *shard) expired(key string, now int64) bool {
+	at, ok := sh.expires[key]
+	return ok && at <= now
+}
+
+// expireIfNeeded removes key if its expiry has passed, or otherwise any of
+// its fields whose expiry has, and reports whether key is gone.
+func (s *MemoryStore) expireIfNeeded(sh *shard, key string, now int64) bool {
+	if !sh.expired(key, now) {
+		return s.expireFields(sh, key, now) && !sh.exists(key)
+	}
+	sh.remove(key)
+	s.notify(ExpiredEvents, "expired", key)
+	return true
+}
+
+// expireSample removes expired keys from a random sample of the shard's
+// volatile keys, and expired fields from a sample of its hashes with
+// volatile fields, and reports whether enough of either sample had expired
+// that another pass is likely to find more.
+func (s *MemoryStore) expireSample(sh *shard, now int64) bool {
+	sampled, expired := 0, 0
+	for key := range sh.expires {
+		if sampled == expirySampleSize {
+			break
+		}
+		sampled++
+		if s.expireIfNeeded(sh, key, now) {
+			expired++
+		}
+	}
+	more := sampled == expirySampleSize && expired > expirySampleSize/4
+	sampled, expired = 0, 0
+	for key := range sh.fieldExpires {
+		if sampled == expirySampleSize {
+			break
+		}
+		sampled++
+		if s.expireFields(sh, key, now) {
+			expired++
+		}
+	}
+	return more || (sampled == expirySampleSize && expired > expirySampleSize/4)
+}
+
+func (sh *shard) setString(key, value string) {
+	sh.remove(key)
+	sh.strings[key] = value
+}
+
+// transfer writes the value of key into destination under newKey, replacing
+// whatever newKey held. Collections are cloned when the source is kept.
+func (sh *shard) transfer(key string, destination *shard, newKey string, keepSource bool) {
+	destination.remove(newKey)
+	if value, ok := sh.strings[key]; ok {
+		destination.strings[newKey] = value
+	}
+	if value, ok := sh.sets[key]; ok {
+		if keepSource {
+			value = cloneSet(value)
+		}
+		destination.sets[newKey] = value
+	}
+	if value, ok := sh.hashes[key]; ok {
+		if keepSource {
+			value = cloneHash(value)
+		}
+		destination.hashes[newKey] = value
+	}
+	if value, ok := sh.lists[key]; ok {
+		if keepSource {
+			value = value.clone()
+		}
+		destination.lists[newKey] = value
+	}
+	if value, ok := sh.sortedSets[key]; ok {
+		if keepSource {
+			value = value.clone()
+		}
+		destination.sortedSets[newKey] = value
+	}
+	if at, ok := sh.expires[key]; ok {
+		destination.expires[newKey] = at
+	}
+	if e, ok := sh.fieldExpires[key]; ok {
+		if keepSource {
+			e = e.clone()
+		}
+		destination.fieldExpires[newKey] = e
+	}
+	if !keepSource {
+		sh.remove(key)
+	}
+}
+
+func (sh *shard) size() int {
+	return len(sh.strings) + len(sh.sets) + len(sh.hashes) + len(sh.lists) + len(sh.sortedSets)
+}
+
+func (sh *shard) keyAt(n int) string {
+	for key := range sh.strings {
+		if n == 0 {
+			return key
+		}
+		n--
+	}
+	for key := range sh.sets {
+		if n == 0 {
+			return key
+		}
+		n--
+	}
+	for key := range sh.hashes {
+		if n == 0 {
+			return key
+		}
+		n--
+	}
+	for key := range sh.lists {
+		if n == 0 {
+			return key
+		}
+		n--
+	}
+	for key := range sh.sortedSets {
+		if n == 0 {
+			return key
+		}
+		n--
+	}
+	return ""
+}
+
+func cloneSet(set map[string]bool) map[string]bool {
+	clone := make(map[string]bool, len(set))
+	for member := range set {
+		clone[member] = true
+	}
+	return clone
+}
+
+func cloneHash(hash map[string]string) map[string]string {
+	clone := make(map[string]string, len(hash))
+	for field, value := range hash {
+		clone[field] = value
+	}
+	return clone
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % shardCount)
+}
+
+func (s *MemoryStore) shard(key string) *shard {
+	return s.shards[shardIndex(key)]
+}
+
+func (s *MemoryStore) now() int64 {
+	return s.clock.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// touch records a write to key, and gives it a new version. It's called with
+// the key's shard locked, after the write has been applied.
+func (s *MemoryStore) touch(key string) {
+	root := s.root()
+	atomic.AddInt64(&root.dirty, 1)
+	sh := s.shard(key)
+	if sh.exists(key) {
+		sh.versions[key] = atomic.AddUint64(&root.lastVersion, 1)
+	} else {
+		delete(sh.versions, key)
+	}
+	if sh.list(key).length() > 0 {
+		root.waiters.signal(key)
+	}
+}
+
+func (s *MemoryStore) lock(key string) *shard {
+	sh := s.shard(key)
+	sh.Lock()
+	s.expireIfNeeded(sh, key, s.now())
+	return sh
+}
+
+func (s *MemoryStore) lockKeys(keys []string) (unlock func()) {
+	seen := map[int]bool{}
+	indexes := []int{}
+	for _, key := range keys {
+		i := shardIndex(key)
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.shards[i].Lock()
+	}
+	now := s.now()
+	for _, key := range keys {
+		s.expireIfNeeded(s.shard(key), key, now)
+	}
+	return func() {
+		for _, i := range indexes {
+			s.shards[i].Unlock()
+		}
+	}
+}
+
+func (s *MemoryStore) Delete(keys ...string) (int64, error) {
+	defer s.lockKeys(keys)()
+	var deleted int64
+	for _, key := range keys {
+		sh := s.shard(key)
+		if sh.exists(key) {
+			sh.remove(key)
+			s.touch(key)
+			s.notify(GenericEvents, "del", key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) Exists(keys ...string) (int64, error) {
+	defer s.lockKeys(keys)()
+	var found int64
+	for _, key := range keys {
+		if s.shard(key).exists(key) {
+			found++
+		}
+	}
+	return found, nil
+}
+
+func (s *MemoryStore) Rename(key, newKey string) error {
+	defer s.lockKeys([]string{key, newKey})()
+	sh := s.shard(key)
+	if !sh.exists(key) {
+		return ErrNoSuchKey
+	}
+	if key != newKey {
+		sh.transfer(key, s.shard(newKey), newKey, false)
+		s.touch(key)
+		s.touch(newKey)
+		s.notify(GenericEvents, "rename_from", key)
+		s.notify(GenericEvents, "rename_to", newKey)
+	}
+	return nil
+}
+
+func (s *MemoryStore) RenameIfNotExists(key, newKey string) (bool, error) {
+	defer s.lockKeys([]string{key, newKey})()
+	sh := s.shard(key)
+	if !sh.exists(key) {
+		return false, ErrNoSuchKey
+	}
+	if s.shard(newKey).exists(newKey) {
+		return false, nil
+	}
+	sh.transfer(key, s.shard(newKey), newKey, false)
+	s.touch(key)
+	s.touch(newKey)
+	s.notify(GenericEvents, "rename_from", key)
+	s.notify(GenericEvents, "rename_to", newKey)
+	return true, nil
+}
+
+func (s *MemoryStore) Copy(source, destination string, replace bool) (bool, error) {
+	defer s.lockKeys([]string{source, destination})()
+	sh := s.shard(source)
+	if source == destination || !sh.exists(source) {
+		return false, nil
+	}
+	if !replace && s.shard(destination).exists(destination) {
+		return false, nil
+	}
+	sh.transfer(source, s.shard(destination), destination, true)
+	s.touch(destination)
+	s.notify(GenericEvents, "copy_to", destination)
+	return true, nil
+}
+
+func (s *MemoryStore) Type(key string) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	return sh.keyType(key), nil
+}
+
+func (s *MemoryStore) RandomKey() (string, error) {
+	offset := rand.Intn(shardCount)
+	for i := 0; i < shardCount; i++ {
+		sh := s.shards[(offset+i)%shardCount]
+		sh.Lock()
+		for sh.size() > 0 {
+			key := sh.keyAt(rand.Intn(sh.size()))
+			if !s.expireIfNeeded(sh, key, s.now()) {
+				sh.Unlock()
+				return key, nil
+			}
+		}
+		sh.Unlock()
+	}
+	return "", ErrNoSuchKey
+}
+
+func (s *MemoryStore) Expire(key string, seconds int64) (bool, error) {
+	at, err := expiryAt(seconds, 1000, s.now())
+	if err != nil {
+		return false, err
+	}
+	return s.PExpireAt(key, at)
+}
+
+func (s *MemoryStore) PExpire(key string, milliseconds int64) (bool, error) {
+	at, err := expiryAt(milliseconds, 1, s.now())
+	if err != nil {
+		return false, err
+	}
+	return s.PExpireAt(key, at)
+}
+
+func (s *MemoryStore) ExpireAt(key string, timestamp int64) (bool, error) {
+	at, err := expiryAt(timestamp, 1000, 0)
+	if err != nil {
+		return false, err
+	}
+	return s.PExpireAt(key, at)
+}
+
+func (s *MemoryStore) PExpireAt(key string, timestamp int64) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if !sh.exists(key) {
+		return false, nil
+	}
+	s.setExpiry(sh, key, timestamp)
+	s.touch(key)
+	return true, nil
+}
+
+// setExpiry sets the expiry of key, deleting it if the time has passed.
+func (s *MemoryStore) setExpiry(sh *shard, key string, at int64) {
+	if at <= s.now() {
+		sh.remove(key)
+		s.notify(GenericEvents, "del", key)
+		return
+	}
+	sh.expires[key] = at
+	s.notify(GenericEvents, "expire", key)
+	s.startExpiryCycle()
+}
+
+// startExpiryCycle starts the background expiry cycle, if it isn't running
+// already.
+func (s *MemoryStore) startExpiryCycle() {
+	root := s.root()
+	root.expiryStart.Do(func() { go root.runExpiryCycle() })
+}
+
+func (s *MemoryStore) TTL(key string) (int64, error) {
+	ttl, err := s.PTTL(key)
+	if ttl < 0 || err != nil {
+		return ttl, err
+	}
+	return (ttl + 500) / 1000, nil
+}
+
+func (s *MemoryStore) PTTL(key string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if !sh.exists(key) {
+		return -2, nil
+	}
+	at, ok := sh.expires[key]
+	if !ok {
+		return -1, nil
+	}
+	return at - s.now(), nil
+}
+
+func (s *MemoryStore) Persist(key string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if _, ok := sh.expires[key]; !ok {
+		return false, nil
+	}
+	delete(sh.expires, key)
+	s.touch(key)
+	s.notify(GenericEvents, "persist", key)
+	return true, nil
+}
+
+func (s *MemoryStore) runExpiryCycle() {
+	ticker := time.NewTicker(expiryCycleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.expireCycle()
+		}
+	}
+}
+
+func (s *MemoryStore) expireCycle() {
+	for _, sh := range s.shards {
+		sh.Lock()
+		for s.expireSample(sh, s.now()) {
+		}
+		sh.Unlock()
+	}
+}
+
+// Close stops the background expiry cycle and save rules, and saves a final
+// snapshot if there are save rules. The store remains usable, with keys
+// expiring lazily as they are accessed.
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.closeSnapshots()
+}
+
+// Broker returns the store's pub/sub broker.
+func (s *MemoryStore) Broker() *Broker {
+	return s.broker
+}
+
+// Scripts returns the store's script cache.
+func (s *MemoryStore) Scripts() *Scripts {
+	return &Scripts{s, s.scripts}
+}
+
+func (s *MemoryStore) Append(key, value string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return 0, err
+	}
+	sh.strings[key] = sh.strings[key] + value
+	s.touch(key)
+	s.notify(StringEvents, "append", key)
+	return int64(len(sh.strings[key])), nil
+}
+
+func (s *MemoryStore) Get(key string) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return "", err
+	}
+	return sh.strings[key], nil
+}
+
+func (s *MemoryStore) GetRange(key string, start, stop int64) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return "", err
+	}
+	start, stop = renormalize(int64(len(sh.strings[key])), start, stop)
+	if start > stop {
+		return "", nil
+	}
+	return sh.strings[key][start:stop], nil
+}
+
+func (s *MemoryStore) SetRange(key string, offset int64, value string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return 0, err
+	}
+	valueLength := int64(len(value))
+	if offset < 0 || offset+valueLength > maxStringLength {
+		return 0, ErrOutOfRange
+	}
+	if _, exists := sh.strings[key]; !exists && value == "" {
+		return 0, nil
+	}
+	originalLength := int64(len(sh.strings[key]))
+	if originalLength < offset+valueLength {
+		sh.strings[key] = sh.strings[key] + strings.Repeat(" ", int(offset+valueLength-originalLength))
+	}
+	sh.strings[key] = sh.strings[key][:offset] + value + sh.strings[key][offset+valueLength:]
+	s.touch(key)
+	s.notify(StringEvents, "setrange", key)
+	return int64(len(sh.strings[key])), nil
+}
+
+func (s *MemoryStore) GetSet(key, value string) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return "", err
+	}
+	v := sh.strings[key]
+	sh.setString(key, value)
+	s.touch(key)
+	s.notify(StringEvents, "set", key)
+	return v, nil
+}
+
+func renormalize(length, start, stop int64) (int64, int64) {
+	start = normalize(length, start)
+	stop = normalize(length, stop)
+
+	start = max(start, 0)
+	stop = max(stop, -1)
+
+	stop = stop + 1 // Make the stop index inclusive
+
+	start = min(start, length)
+	stop = min(stop, length)
+	return start, stop
+}
+
+func (s *MemoryStore) Set(key string, value string) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	sh.setString(key, value)
+	s.touch(key)
+	s.notify(StringEvents, "set", key)
+	return nil
+}
+
+func (s *MemoryStore) SetWithOptions(key string, value string, options SetOptions) (bool, error) {
+	expiresAt, err := options.expiresAt(s.now())
+	if err != nil {
+		return false, err
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	exists := sh.exists(key)
+	if (options.IfExists && !exists) || (options.IfNotExists && exists) {
+		return false, nil
+	}
+	previous, hadExpiry := sh.expires[key]
+	sh.setString(key, value)
+	if options.KeepTTL && hadExpiry {
+		sh.expires[key] = previous
+	}
+	s.notify(StringEvents, "set", key)
+	if expiresAt != 0 {
+		s.setExpiry(sh, key, expiresAt)
+	}
+	s.touch(key)
+	return true, nil
+}
+
+func (s *MemoryStore) SetIfNotExists(key string, value string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	alreadyExists := sh.exists(key)
+	if !alreadyExists {
+		sh.setString(key, value)
+		s.touch(key)
+		s.notify(StringEvents, "set", key)
+	}
+	return !alreadyExists, nil
+}
+
+func (s *MemoryStore) SetIfExists(key string, value string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	alreadyExists := sh.exists(key)
+	if alreadyExists {
+		sh.setString(key, value)
+		s.touch(key)
+		s.notify(StringEvents, "set", key)
+	}
+	return alreadyExists, nil
+}
+
+func (s *MemoryStore) MultiGet(keys []string) (map[string]string, error) {
+	defer s.lockKeys(keys)()
+	m := map[string]string{}
+	for _, k := range keys {
+		if v, exists := s.shard(k).strings[k]; exists {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+func (s *MemoryStore) MultiSet(data map[string]string) error {
+	defer s.lockKeys(mapKeys(data))()
+	for k, v := range data {
+		s.shard(k).setString(k, v)
+		s.touch(k)
+		s.notify(StringEvents, "set", k)
+	}
+	return nil
+}
+
+func (s *MemoryStore) MultiSetIfNotExists(data map[string]string) (bool, error) {
+	defer s.lockKeys(mapKeys(data))()
+	for k := range data {
+		if s.shard(k).exists(k) {
+			return false, nil
+		}
+	}
+	for k, v := range data {
+		s.shard(k).setString(k, v)
+		s.touch(k)
+		s.notify(StringEvents, "set", k)
+	}
+	return true, nil
+}
+
+func mapKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s *MemoryStore) Increment(key string) (int64, error) {
+	return s.incrementBy(key, 1, "incrby")
+}
+
+func (s *MemoryStore) Decrement(key string) (int64, error) {
+	return s.incrementBy(key, -1, "decrby")
+}
+
+func (s *MemoryStore) IncrementBy(key string, delta int64) (int64, error) {
+	return s.incrementBy(key, delta, "incrby")
+}
+
+func (s *MemoryStore) DecrementBy(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return s.incrementBy(key, -delta, "decrby")
+}
+
+// IncrementByFloat adds delta to the number stored at key, treating a
+// missing key as 0, and returns the result as it's stored, formatted the way
+// Redis formats INCRBYFLOAT results. The key's TTL is kept.
+func (s *MemoryStore) IncrementByFloat(key string, delta float64) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return "", err
+	}
+	value, exists := sh.strings[key]
+	if !exists {
+		value = "0"
+	}
+	result, err := addLongDouble(value, delta, ErrNotFloat)
+	if err != nil {
+		return "", err
+	}
+	sh.strings[key] = result
+	s.touch(key)
+	s.notify(StringEvents, "incrbyfloat", key)
+	return result, nil
+}
+
+func (s *MemoryStore) Length(key string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return 0, err
+	}
+	return int64(len(sh.strings[key])), nil
+}
+
+func (sh *shard) ensureSet(key string) {
+	if _, ok := sh.sets[key]; !ok {
+		sh.sets[key] = make(map[string]bool)
+	}
+}
+
+func (s *MemoryStore) SetAdd(key string, values ...string) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sh.ensureSet(key)
+	added := false
+	for _, value := range values {
+		if !sh.sets[key][value] {
+			sh.sets[key][value] = true
+			added = true
+		}
+	}
+	if added {
+		s.touch(key)
+		s.notify(SetEvents, "sadd", key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetRemove(key string, values ...string) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return err
+	}
+	removed := false
+	for _, value := range values {
+		if sh.sets[key][value] {
+			delete(sh.sets[key], value)
+			removed = true
+		}
+	}
+	if removed {
+		s.touch(key)
+		s.notify(SetEvents, "srem", key)
+		s.removeIfEmpty(sh, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetIsMember(key string, value string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return false, err
+	}
+	_, exists := sh.sets[key][value]
+	return exists, nil
+}
+
+func (s *MemoryStore) SetCardinality(key string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return 0, err
+	}
+	return int64(len(sh.sets[key])), nil
+}
+
+func (s *MemoryStore) SetMembers(key string) ([]string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for val := range sh.sets[key] {
+		values = append(values, val)
+	}
+	return values, nil
+}
+
+// setsAt returns the sets at keys, nil for those that don't exist, or
+// ErrWrongType if any of them holds something else. It's called with the
+// keys locked.
+func (s *MemoryStore) setsAt(keys []string) ([]map[string]bool, error) {
+	sets := make([]map[string]bool, len(keys))
+	for i, key := range keys {
+		sh := s.shard(key)
+		if err := sh.expectType(key, typeSet); err != nil {
+			return nil, err
+		}
+		sets[i] = sh.sets[key]
+	}
+	return sets, nil
+}
+
+// intersectSets, unionSets and differenceSets each return a new set, so that
+// the result can be stored without sharing a map with its sources.
+func intersectSets(sets []map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	if len(sets) == 0 {
+		return result
+	}
+	smallest := sets[0]
+	for _, set := range sets[1:] {
+		if len(set) < len(smallest) {
+			smallest = set
+		}
+	}
+	for member := range smallest {
+		if inAll(member, sets) {
+			result[member] = true
+		}
+	}
+	return result
+}
+
+func inAll(member string, sets []map[string]bool) bool {
+	for _, set := range sets {
+		if !set[member] {
+			return false
+		}
+	}
+	return true
+}
+
+func unionSets(sets []map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	for _, set := range sets {
+		for member := range set {
+			result[member] = true
+		}
+	}
+	return result
+}
+
+func differenceSets(sets []map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	if len(sets) == 0 {
+		return result
+	}
+	for member := range sets[0] {
+		result[member] = true
+	}
+	for _, set := range sets[1:] {
+		for member := range set {
+			delete(result, member)
+		}
+	}
+	return result
+}
+
+func setMembers(set map[string]bool) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	return members
+}
+
+func (s *MemoryStore) SetIntersect(keys ...string) ([]string, error) {
+	return s.combineSets(keys, intersectSets)
+}
+
+func (s *MemoryStore) SetUnion(keys ...string) ([]string, error) {
+	return s.combineSets(keys, unionSets)
+}
+
+func (s *MemoryStore) SetDifference(keys ...string) ([]string, error) {
+	return s.combineSets(keys, differenceSets)
+}
+
+func (s *MemoryStore) combineSets(keys []string, combine func([]map[string]bool) map[string]bool) ([]string, error) {
+	defer s.lockKeys(keys)()
+	sets, err := s.setsAt(keys)
+	if err != nil {
+		return nil, err
+	}
+	return setMembers(combine(sets)), nil
+}
+
+func (s *MemoryStore) SetIntersectStore(destination string, keys ...string) (int64, error) {
+	return s.combineSetsStore(destination, keys, intersectSets, "sinterstore")
+}
+
+func (s *MemoryStore) SetUnionStore(destination string, keys ...string) (int64, error) {
+	return s.combineSetsStore(destination, keys, unionSets, "sunionstore")
+}
+
+func (s *MemoryStore) SetDifferenceStore(destination string, keys ...string) (int64, error) {
+	return s.combineSetsStore(destination, keys, differenceSets, "sdiffstore")
+}
+
+// combineSetsStore replaces destination with the combination of the sets
+// at keys, deleting it if that's empty. destination may be one of keys.
+func (s *MemoryStore) combineSetsStore(destination string, keys []string, combine func([]map[string]bool) map[string]bool, event string) (int64, error) {
+	defer s.lockKeys(append([]string{destination}, keys...))()
+	sets, err := s.setsAt(keys)
+	if err != nil {
+		return 0, err
+	}
+	result := combine(sets)
+	sh := s.shard(destination)
+	existed := sh.exists(destination)
+	sh.remove(destination)
+	if len(result) > 0 {
+		sh.sets[destination] = result
+	}
+	s.touch(destination)
+	if len(result) > 0 {
+		s.notify(SetEvents, event, destination)
+	} else if existed {
+		s.notify(GenericEvents, "del", destination)
+	}
+	return int64(len(result)), nil
+}
+
+// SetIntersectCardinality counts the intersection of the sets at keys
+// without building it, and stops counting at limit unless limit is 0.
+func (s *MemoryStore) SetIntersectCardinality(limit int64, keys ...string) (int64, error) {
+	if limit < 0 {
+		return 0, ErrNegativeLimit
+	}
+	defer s.lockKeys(keys)()
+	sets, err := s.setsAt(keys)
+	if err != nil || len(sets) == 0 {
+		return 0, err
+	}
+	smallest := sets[0]
+	for _, set := range sets[1:] {
+		if len(set) < len(smallest) {
+			smallest = set
+		}
+	}
+	var count int64
+	for member := range smallest {
+		if inAll(member, sets) {
+			if count++; count == limit {
+				break
+			}
+		}
+	}
+	return count, nil
 }
 
-func (s *MemoryStore) Append(key, value string) int64 {
-	s.strings[key] = s.strings[key] + value
-	return int64(len(s.strings[key]))
+func (s *MemoryStore) SetMultiIsMember(key string, values ...string) ([]bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(values))
+	for i, value := range values {
+		found[i] = sh.sets[key][value]
+	}
+	return found, nil
 }
 
-func (s *MemoryStore) Get(key string) string {
-	return s.strings[key]
+// SetMove moves value from the set at source to the one at destination, and
+// reports whether source had it. Both keys must hold sets or not exist.
+func (s *MemoryStore) SetMove(source, destination, value string) (bool, error) {
+	defer s.lockKeys([]string{source, destination})()
+	from, to := s.shard(source), s.shard(destination)
+	if err := from.expectType(source, typeSet); err != nil {
+		return false, err
+	}
+	if err := to.expectType(destination, typeSet); err != nil {
+		return false, err
+	}
+	if !from.sets[source][value] {
+		return false, nil
+	}
+	if source == destination {
+		return true, nil
+	}
+	delete(from.sets[source], value)
+	s.touch(source)
+	s.notify(SetEvents, "srem", source)
+	s.removeIfEmpty(from, source)
+	if !to.sets[destination][value] {
+		to.ensureSet(destination)
+		to.sets[destination][value] = true
+		s.touch(destination)
+		s.notify(SetEvents, "sadd", destination)
+	}
+	return true, nil
 }
 
-func (s *MemoryStore) GetRange(key string, start, stop int64) string {
-	start, stop = renormalize(int64(len(s.strings[key])), start, stop)
-	return s.strings[key][start:stop]
+// randomMembers returns count distinct members of set chosen at random, or
+// all of them if it has no more than that.
+func randomMembers(set map[string]bool, count int64) []string {
+	members := setMembers(set)
+	if count >= int64(len(members)) {
+		return members
+	}
+	for i := int64(0); i < count; i++ {
+		j := i + rand.Int63n(int64(len(members))-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:count]
 }
 
-func (s *MemoryStore) SetRange(key string, offset int64, value string) int64 {
-	valueLength := int64(len(value))
-	originalLength := int64(len(s.strings[key]))
-	if originalLength < offset+valueLength {
-		s.strings[key] = s.strings[key] + strings.Repeat(" ", int(offset+valueLength-originalLength))
+// SetPop removes and returns up to count random members of the set at key.
+func (s *MemoryStore) SetPop(key string, count int64) ([]string, error) {
+	if count < 0 {
+		return nil, ErrOutOfRange
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return nil, err
+	}
+	popped := randomMembers(sh.sets[key], count)
+	if len(popped) == 0 {
+		return popped, nil
+	}
+	for _, member := range popped {
+		delete(sh.sets[key], member)
 	}
-	s.strings[key] = s.strings[key][:offset] + value + s.strings[key][offset+valueLength:]
-	return s.Length(key)
+	s.touch(key)
+	s.notify(SetEvents, "spop", key)
+	s.removeIfEmpty(sh, key)
+	return popped, nil
 }
 
-func (s *MemoryStore) GetSet(key, value string) string {
-	v := s.Get(key)
-	s.Set(key, value)
-	return v
+// SetRandomMember returns random members of the set at key without removing
+// them, as SRANDMEMBER does: up to count distinct members if count is
+// positive, and exactly -count members that may repeat if it's negative.
+// It returns ErrCountOutOfRange if -count is more than maxRandomCount.
+func (s *MemoryStore) SetRandomMember(key string, count int64) ([]string, error) {
+	if count < -maxRandomCount {
+		return nil, ErrCountOutOfRange
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return nil, err
+	}
+	if count >= 0 {
+		return randomMembers(sh.sets[key], count), nil
+	}
+	members := setMembers(sh.sets[key])
+	chosen := []string{}
+	if len(members) == 0 {
+		return chosen, nil
+	}
+	for i := int64(0); i < -count; i++ {
+		chosen = append(chosen, members[rand.Intn(len(members))])
+	}
+	return chosen, nil
 }
 
-func renormalize(length, start, stop int64) (int64, int64) {
-	start = normalize(length, start)
-	stop = normalize(length, stop)
-
-	start = max(start, 0)
-	stop = max(stop, -1)
+func (sh *shard) ensureHash(key string) {
+	if _, ok := sh.hashes[key]; !ok {
+		sh.hashes[key] = make(map[string]string)
+	}
+}
 
-	stop = stop + 1 // Make the stop index inclusive
+func (s *MemoryStore) HashGet(key, field string) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return "", err
+	}
+	return sh.hashes[key][field], nil
+}
 
-	start = min(start, length)
-	stop = min(stop, length)
-	return start, stop
+func (s *MemoryStore) HashSet(key, field, value string) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return err
+	}
+	sh.ensureHash(key)
+	sh.hashes[key][field] = value
+	sh.persistField(key, field)
+	s.touch(key)
+	s.notify(HashEvents, "hset", key)
+	return nil
 }
 
-func (s *MemoryStore) Set(key string, value string) {
-	s.strings[key] = value
+func (s *MemoryStore) HashSetIfExists(key, field string, value string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return false, err
+	}
+	_, alreadyExists := sh.hashes[key][field]
+	if alreadyExists {
+		sh.hashes[key][field] = value
+		sh.persistField(key, field)
+		s.touch(key)
+		s.notify(HashEvents, "hset", key)
+	}
+	return alreadyExists, nil
 }
 
-func (s *MemoryStore) SetIfNotExists(key string, value string) bool {
-	alreadyExists := s.Exists(key)
+func (s *MemoryStore) HashSetIfNotExists(key, field string, value string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return false, err
+	}
+	_, alreadyExists := sh.hashes[key][field]
 	if !alreadyExists {
-		s.Set(key, value)
+		sh.ensureHash(key)
+		sh.hashes[key][field] = value
+		s.touch(key)
+		s.notify(HashEvents, "hset", key)
 	}
-	return !alreadyExists
+	return !alreadyExists, nil
 }
 
-func (s *MemoryStore) SetIfExists(key string, value string) bool {
-	alreadyExists := s.Exists(key)
-	if alreadyExists {
-		s.Set(key, value)
+func (s *MemoryStore) HashExists(key, field string) (bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return false, err
 	}
-	return alreadyExists
+	_, exists := sh.hashes[key][field]
+	return exists, nil
 }
 
-func (s *MemoryStore) MultiGet(keys []string) map[string]string {
-	m := map[string]string{}
-	for _, k := range keys {
-		if s.Exists(k) {
-			m[k] = s.strings[k]
-		}
+func (s *MemoryStore) HashMultiGet(key string, fields ...string) ([]string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
 	}
-	return m
+	values := []string{}
+	for _, field := range fields {
+		values = append(values, sh.hashes[key][field])
+	}
+	return values, nil
 }
 
-func (s *MemoryStore) MultiSet(data map[string]string) {
-	for k, v := range data {
-		s.strings[k] = v
+func (s *MemoryStore) HashMultiSet(key string, data map[string]string) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return err
 	}
+	if len(data) == 0 {
+		return nil
+	}
+	sh.ensureHash(key)
+	for field, value := range data {
+		sh.hashes[key][field] = value
+		sh.persistField(key, field)
+	}
+	s.touch(key)
+	s.notify(HashEvents, "hset", key)
+	return nil
 }
 
-func (s *MemoryStore) MultiSetIfNotExists(data map[string]string) bool {
-	for k, _ := range data {
-		if s.Exists(k) {
-			return false
-		}
+func (s *MemoryStore) HashLength(key string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return 0, err
 	}
-	s.MultiSet(data)
-	return true
+	return int64(len(sh.hashes[key])), nil
 }
 
-func (s *MemoryStore) Increment(key string) int64 {
-	return s.transformNumber(key, func(n int64) int64 { return n + 1 })
+func (s *MemoryStore) HashKeys(key string) ([]string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key, _ := range sh.hashes[key] {
+		keys = append(keys, key)
+	}
+	return keys, nil
 }
 
-func (s *MemoryStore) Decrement(key string) int64 {
-	return s.transformNumber(key, func(n int64) int64 { return n - 1 })
+func (s *MemoryStore) HashValues(key string) ([]string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for _, value := range sh.hashes[key] {
+		values = append(values, value)
+	}
+	return values, nil
 }
 
-func (s *MemoryStore) IncrementBy(key string, delta int64) int64 {
-	return s.transformNumber(key, func(n int64) int64 { return n + delta })
+// HashDelete removes fields from the hash at key, returning how many of
+// them it had.
+func (s *MemoryStore) HashDelete(key string, fields ...string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, field := range fields {
+		if _, ok := sh.hashes[key][field]; ok {
+			sh.deleteField(key, field)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.touch(key)
+		s.notify(HashEvents, "hdel", key)
+		s.removeIfEmpty(sh, key)
+	}
+	return deleted, nil
 }
 
-func (s *MemoryStore) DecrementBy(key string, delta int64) int64 {
-	return s.transformNumber(key, func(n int64) int64 { return n - delta })
+// HashGetAll returns every field of the hash at key with its value.
+func (s *MemoryStore) HashGetAll(key string) (map[string]string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	return cloneHash(sh.hashes[key]), nil
 }
 
-func (s *MemoryStore) Exists(key string) bool {
-	_, exists := s.strings[key]
-	return exists
+// HashStringLength returns the length of the value of field, or 0 if
+// there's no such field.
+func (s *MemoryStore) HashStringLength(key, field string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return 0, err
+	}
+	return int64(len(sh.hashes[key][field])), nil
 }
 
-func (s *MemoryStore) Length(key string) int64 {
-	return int64(len(s.Get(key)))
+// HashIncrementBy adds delta to the integer value of field, treating a
+// missing field as 0, and returns the result.
+func (s *MemoryStore) HashIncrementBy(key, field string, delta int64) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return 0, err
+	}
+	var n int64
+	if value, exists := sh.hashes[key][field]; exists {
+		var err error
+		if n, err = parseInteger(value); err != nil {
+			return 0, ErrHashNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	sh.ensureHash(key)
+	sh.hashes[key][field] = strconv.FormatInt(n, 10)
+	s.touch(key)
+	s.notify(HashEvents, "hincrby", key)
+	return n, nil
 }
 
-func (s *MemoryStore) ensureSet(key string) {
-	if _, ok := s.sets[key]; !ok {
-		s.sets[key] = make(map[string]bool)
+// HashIncrementByFloat adds delta to the numeric value of field, treating a
+// missing field as 0, and returns the result as it's stored, formatted the
+// way Redis formats HINCRBYFLOAT results.
+func (s *MemoryStore) HashIncrementByFloat(key, field string, delta float64) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return "", err
+	}
+	value, exists := sh.hashes[key][field]
+	if !exists {
+		value = "0"
+	}
+	result, err := addLongDouble(value, delta, ErrHashNotFloat)
+	if err != nil {
+		return "", err
 	}
+	sh.ensureHash(key)
+	sh.hashes[key][field] = result
+	s.touch(key)
+	s.notify(HashEvents, "hincrbyfloat", key)
+	return result, nil
 }
 
-func (s *MemoryStore) SetAdd(key string, values ...string) {
-	s.ensureSet(key)
-	for _, value := range values {
-		s.sets[key][value] = true
+// HashRandomField returns random fields of the hash at key, as HRANDFIELD
+// does: up to count distinct fields if count is positive, and exactly
+// -count fields that may repeat if it's negative. It returns
+// ErrCountOutOfRange if -count is more than maxRandomCount.
+func (s *MemoryStore) HashRandomField(key string, count int64) ([]string, error) {
+	fields, err := s.HashRandomFieldWithValues(key, count)
+	if err != nil {
+		return nil, err
 	}
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Field
+	}
+	return names, nil
 }
 
-func (s *MemoryStore) SetRemove(key string, values ...string) {
-	s.ensureSet(key)
-	for _, value := range values {
-		delete(s.sets[key], value)
+// HashRandomFieldWithValues is HashRandomField with each field's value.
+func (s *MemoryStore) HashRandomFieldWithValues(key string, count int64) ([]HashField, error) {
+	if count < -maxRandomCount {
+		return nil, ErrCountOutOfRange
 	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return nil, err
+	}
+	hash := sh.hashes[key]
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	chosen := []HashField{}
+	if count >= 0 {
+		for i := int64(0); i < count && i < int64(len(fields)); i++ {
+			j := i + rand.Int63n(int64(len(fields))-i)
+			fields[i], fields[j] = fields[j], fields[i]
+			chosen = append(chosen, HashField{fields[i], hash[fields[i]]})
+		}
+		return chosen, nil
+	}
+	if len(fields) == 0 {
+		return chosen, nil
+	}
+	for i := int64(0); i < -count; i++ {
+		field := fields[rand.Intn(len(fields))]
+		chosen = append(chosen, HashField{field, hash[field]})
+	}
+	return chosen, nil
 }
 
-func (s *MemoryStore) SetIsMember(key string, value string) bool {
-	_, exists := s.sets[key][value]
-	return exists
-}
+// longDoublePrecision is the number of mantissa bits in the x87 long double
+// Redis does float increments in.
+const longDoublePrecision = 64
 
-func (s *MemoryStore) SetCardinality(key string) int64 {
-	s.ensureSet(key)
-	return int64(len(s.sets[key]))
+// addLongDouble adds delta to the number in value the way Redis' float
+// increments do: in long double precision, formatted with 17 decimal
+// places and without trailing zeros, so that 0.1 plus 0.2 is "0.3". delta is
+// taken as the shortest decimal that rounds to it, which is what a caller
+// would have written. notFloat is returned if value isn't a number.
+func addLongDouble(value string, delta float64, notFloat error) (string, error) {
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return "", ErrNaNOrInfinity
+	}
+	n, ok := parseLongDouble(value)
+	if !ok {
+		return "", notFloat
+	}
+	d, _ := parseLongDouble(strconv.FormatFloat(delta, 'g', -1, 64))
+	n.Add(n, d)
+	// A long double's exponent tops out at 16383.
+	if n.MantExp(nil) > 16384 {
+		return "", ErrIncrementNaNOrInfinity
+	}
+	result := n.Text('f', 17)
+	result = strings.TrimSuffix(strings.TrimRight(result, "0"), ".")
+	if result == "-0" {
+		result = "0"
+	}
+	return result, nil
 }
 
-func (s *MemoryStore) SetMembers(key string) []string {
-	s.ensureSet(key)
-	values := []string{}
-	for val := range s.sets[key] {
-		values = append(values, val)
+func parseLongDouble(value string) (*big.Float, bool) {
+	n, _, err := new(big.Float).SetPrec(longDoublePrecision).Parse(value, 10)
+	if err != nil || n.IsInf() || strings.ContainsAny(value, "_ \t") {
+		return nil, false
 	}
-	return values
+	return n, true
 }
 
-func (s *MemoryStore) ensureHash(key string) {
-	if _, ok := s.hashes[key]; !ok {
-		s.hashes[key] = make(map[string]string)
+func parseInteger(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != value {
+		return 0, ErrNotInteger
 	}
+	return n, nil
 }
 
-func (s *MemoryStore) HashGet(key, field string) string {
-	s.ensureHash(key)
-	return s.hashes[key][field]
+func (s *MemoryStore) incrementBy(key string, delta int64, event string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeString); err != nil {
+		return 0, err
+	}
+	var n int64
+	if value, exists := sh.strings[key]; exists {
+		var err error
+		if n, err = parseInteger(value); err != nil {
+			return 0, err
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	sh.strings[key] = strconv.FormatInt(n, 10)
+	s.touch(key)
+	s.notify(StringEvents, event, key)
+	return n, nil
 }
 
-func (s *MemoryStore) HashSet(key, field, value string) {
-	s.ensureHash(key)
-	s.hashes[key][field] = value
+func (s *MemoryStore) ListLeftPush(key string, values ...string) (int64, error) {
+	return s.listPush(key, ListLeft, false, values)
 }
 
-func (s *MemoryStore) HashSetIfExists(key, field string, value string) bool {
-	s.ensureHash(key)
-	alreadyExists := s.HashExists(key, field)
-	if alreadyExists {
-		s.HashSet(key, field, value)
-	}
-	return alreadyExists
+func (s *MemoryStore) ListRightPush(key string, values ...string) (int64, error) {
+	return s.listPush(key, ListRight, false, values)
 }
 
-func (s *MemoryStore) HashSetIfNotExists(key, field string, value string) bool {
-	s.ensureHash(key)
-	alreadyExists := s.HashExists(key, field)
-	if !alreadyExists {
-		s.HashSet(key, field, value)
-	}
-	return !alreadyExists
+// ListLeftPushIfExists pushes values onto the head of the list at key only
+// if there is one, as LPUSHX does, returning its length or 0 if there isn't.
+func (s *MemoryStore) ListLeftPushIfExists(key string, values ...string) (int64, error) {
+	return s.listPush(key, ListLeft, true, values)
 }
 
-func (s *MemoryStore) HashExists(key, field string) bool {
-	s.ensureHash(key)
-	_, exists := s.hashes[key][field]
-	return exists
+// ListRightPushIfExists is ListLeftPushIfExists at the tail of the list.
+func (s *MemoryStore) ListRightPushIfExists(key string, values ...string) (int64, error) {
+	return s.listPush(key, ListRight, true, values)
 }
 
-func (s *MemoryStore) HashMultiGet(key string, fields ...string) []string {
-	values := []string{}
-	for _, field := range fields {
-		values = append(values, s.HashGet(key, field))
+func (s *MemoryStore) listPush(key string, side ListSide, ifExists bool, values []string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return 0, err
+	}
+	list := sh.list(key)
+	if ifExists && list.length() == 0 {
+		return 0, nil
 	}
-	return values
+	for _, value := range values {
+		list.push(side, value)
+	}
+	sh.storeList(key, list)
+	s.touch(key)
+	if len(values) > 0 {
+		s.notify(ListEvents, side.event("push"), key)
+	}
+	return list.length(), nil
 }
 
-func (s *MemoryStore) HashMultiSet(key string, data map[string]string) {
-	for field, value := range data {
-		s.HashSet(key, field, value)
+func (s *MemoryStore) ListLength(key string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return 0, err
 	}
+	return sh.list(key).length(), nil
 }
 
-func (s *MemoryStore) HashLength(key string) int64 {
-	return int64(len(s.hashes[key]))
+func (s *MemoryStore) ListLeftPop(key string) (string, error) {
+	return s.listPopEnd(key, ListLeft)
 }
 
-func (s *MemoryStore) HashKeys(key string) []string {
-	keys := []string{}
-	for key, _ := range s.hashes[key] {
-		keys = append(keys, key)
-	}
-	return keys
+func (s *MemoryStore) ListRightPop(key string) (string, error) {
+	return s.listPopEnd(key, ListRight)
 }
 
-func (s *MemoryStore) HashValues(key string) []string {
-	values := []string{}
-	for _, value := range s.hashes[key] {
-		values = append(values, value)
+func (s *MemoryStore) listPopEnd(key string, side ListSide) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return "", err
 	}
-	return values
+	if sh.list(key).length() == 0 {
+		return "", ErrNoSuchKey
+	}
+	return s.listPop(sh, key, side), nil
 }
 
-func (s *MemoryStore) transformNumber(key string, transform func(int64) int64) int64 {
-	n, err := strconv.ParseInt(s.strings[key], 10, 64)
-	if err != nil {
-		n = 0
-	}
-	n = transform(n)
-	s.strings[key] = strconv.FormatInt(n, 10)
-	return n
+// ListLeftPopCount pops up to count items from the head of the list at key,
+// in the order they're popped, or returns ErrNoSuchKey if it's empty.
+func (s *MemoryStore) ListLeftPopCount(key string, count int64) ([]string, error) {
+	return s.listPopCount(key, count, ListLeft)
 }
 
-func (s *MemoryStore) ListLeftPush(key string, values ...string) int64 {
-	for _, value := range values {
-		s.lists[key] = append([]string{value}, s.lists[key]...)
+// ListRightPopCount is ListLeftPopCount from the tail of the list.
+func (s *MemoryStore) ListRightPopCount(key string, count int64) ([]string, error) {
+	return s.listPopCount(key, count, ListRight)
+}
+
+func (s *MemoryStore) listPopCount(key string, count int64, side ListSide) ([]string, error) {
+	if count < 0 {
+		return nil, ErrOutOfRange
 	}
-	return s.ListLength(key)
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return nil, err
+	}
+	if sh.list(key).length() == 0 {
+		return nil, ErrNoSuchKey
+	}
+	return s.listPopN(sh, key, side, count), nil
 }
 
-func (s *MemoryStore) ListRightPush(key string, values ...string) int64 {
-	for _, value := range values {
-		s.lists[key] = append(s.lists[key], value)
+// ListMultiPop pops up to count items from the first of keys that holds a
+// non-empty list, as LMPOP does, returning that key and the items, or
+// ErrNoSuchKey if none do.
+func (s *MemoryStore) ListMultiPop(side ListSide, count int64, keys ...string) (string, []string, error) {
+	if count <= 0 {
+		return "", nil, ErrOutOfRange
+	}
+	key, values, popped, err := s.listPopFirst(keys, side, count)
+	if err == nil && !popped {
+		err = ErrNoSuchKey
 	}
-	return s.ListLength(key)
+	return key, values, err
 }
 
-func (s *MemoryStore) ListLength(key string) int64 {
-	return int64(len(s.lists[key]))
+// listPop removes and returns an item from the non-empty list at key. It's
+// called with the key's shard locked.
+func (s *MemoryStore) listPop(sh *shard, key string, side ListSide) string {
+	return s.listPopN(sh, key, side, 1)[0]
 }
 
-func (s *MemoryStore) ListLeftPop(key string) string {
-	popped := s.lists[key][0]
-	s.lists[key] = s.lists[key][1:]
+// listPopN removes and returns up to count items from the list at key, in
+// the order they're popped. It's called with the key's shard locked.
+func (s *MemoryStore) listPopN(sh *shard, key string, side ListSide, count int64) []string {
+	list := sh.list(key)
+	popped := make([]string, min(count, list.length()))
+	for i := range popped {
+		popped[i] = list.pop(side)
+	}
+	if len(popped) > 0 {
+		s.touch(key)
+		s.notify(ListEvents, side.event("pop"), key)
+		s.removeIfEmpty(sh, key)
+	}
 	return popped
 }
 
-func (s *MemoryStore) ListRightPop(key string) string {
-	lastIndex := s.ListLength(key) - 1
-	popped := s.lists[key][lastIndex]
-	s.lists[key] = s.lists[key][0:lastIndex]
-	return popped
+// ListMove pops an item from one end of the list at source and pushes it
+// onto one end of the list at destination, returning the item, or
+// ErrNoSuchKey if source is empty. source and destination may be the same
+// list, which rotates it.
+func (s *MemoryStore) ListMove(source, destination string, from, to ListSide) (string, error) {
+	defer s.lockKeys([]string{source, destination})()
+	sh, dest := s.shard(source), s.shard(destination)
+	if err := sh.expectType(source, typeList); err != nil {
+		return "", err
+	}
+	if err := dest.expectType(destination, typeList); err != nil {
+		return "", err
+	}
+	list := sh.list(source)
+	if list.length() == 0 {
+		return "", ErrNoSuchKey
+	}
+	value := list.pop(from)
+	target := dest.list(destination)
+	target.push(to, value)
+	dest.storeList(destination, target)
+	s.touch(source)
+	s.touch(destination)
+	s.notify(ListEvents, from.event("pop"), source)
+	s.notify(ListEvents, to.event("push"), destination)
+	s.removeIfEmpty(sh, source)
+	return value, nil
 }
 
 func min(x, y int64) int64 {
@@ -306,39 +1712,476 @@ func outOfBounds(length, index int64) bool {
 	return index > length-1 || index < 0
 }
 
-func (s *MemoryStore) ListRange(key string, start, stop int64) []string {
-	start, stop = renormalize(s.ListLength(key), start, stop)
-	return s.lists[key][start:stop]
+func (sh *shard) listRange(key string, start, stop int64) []string {
+	list := sh.list(key)
+	start, stop = renormalize(list.length(), start, stop)
+	if start > stop {
+		return []string{}
+	}
+	return list.slice(start, stop)
+}
+
+func (s *MemoryStore) ListRange(key string, start, stop int64) ([]string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return nil, err
+	}
+	return sh.listRange(key, start, stop), nil
 }
 
-func (s *MemoryStore) ListSet(key string, index int64, value string) bool {
-	length := s.ListLength(key)
+func (s *MemoryStore) ListSet(key string, index int64, value string) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return err
+	}
+	list := sh.list(key)
+	length := list.length()
+	if length == 0 {
+		return ErrNoSuchKey
+	}
 	index = normalize(length, index)
 	if outOfBounds(length, index) {
-		return false
+		return ErrOutOfRange
 	}
-	s.lists[key][index] = value
-	return true
+	list.set(index, value)
+	s.touch(key)
+	s.notify(ListEvents, "lset", key)
+	return nil
 }
 
-func (s *MemoryStore) ListIndex(key string, index int64) string {
-	length := s.ListLength(key)
+func (s *MemoryStore) ListIndex(key string, index int64) (string, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return "", err
+	}
+	list := sh.list(key)
+	length := list.length()
 	index = normalize(length, index)
 	if outOfBounds(length, index) {
-		return ""
+		return "", nil
+	}
+	return list.at(index), nil
+}
+
+func (s *MemoryStore) ListTrim(key string, start, stop int64) error {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return err
+	}
+	list, ok := sh.lists[key]
+	if !ok {
+		return nil
+	}
+	start, stop = renormalize(list.length(), start, stop)
+	stop = max(start, stop)
+	for n := list.length() - stop; n > 0; n-- {
+		list.popBack()
+	}
+	for ; start > 0; start-- {
+		list.popFront()
+	}
+	s.touch(key)
+	s.notify(ListEvents, "ltrim", key)
+	s.removeIfEmpty(sh, key)
+	return nil
+}
+
+// ListInsertBefore inserts value into the list at key just before the first
+// item equal to pivot, as LINSERT does, returning the list's new length. It
+// returns 0 if there's no list at key and -1 if pivot isn't in it.
+func (s *MemoryStore) ListInsertBefore(key, pivot, value string) (int64, error) {
+	return s.listInsert(key, pivot, value, false)
+}
+
+// ListInsertAfter is ListInsertBefore, inserting just after pivot.
+func (s *MemoryStore) ListInsertAfter(key, pivot, value string) (int64, error) {
+	return s.listInsert(key, pivot, value, true)
+}
+
+func (s *MemoryStore) listInsert(key, pivot, value string, after bool) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return 0, err
+	}
+	list := sh.list(key)
+	if list.length() == 0 {
+		return 0, nil
+	}
+	for i := int64(0); i < list.length(); i++ {
+		if list.at(i) != pivot {
+			continue
+		}
+		if after {
+			i++
+		}
+		list.insert(i, value)
+		s.touch(key)
+		s.notify(ListEvents, "linsert", key)
+		return list.length(), nil
+	}
+	return -1, nil
+}
+
+// ListRemove removes items equal to value from the list at key, as LREM
+// does: the first count of them from the head if count is positive, the
+// last -count of them from the tail if it's negative, and all of them if
+// it's 0. It returns how many it removed.
+func (s *MemoryStore) ListRemove(key string, count int64, value string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return 0, err
+	}
+	list := sh.list(key).items()
+	// The limit is unsigned so that -math.MinInt64 doesn't overflow.
+	limit := uint64(count)
+	if count < 0 {
+		limit = -limit
+	}
+	removing := make([]bool, len(list))
+	var removed uint64
+	for n := range list {
+		i := n
+		if count < 0 {
+			i = len(list) - 1 - n
+		}
+		if list[i] == value && (limit == 0 || removed < limit) {
+			removing[i] = true
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	kept := make([]string, 0, len(list)-int(removed))
+	for i, item := range list {
+		if !removing[i] {
+			kept = append(kept, item)
+		}
+	}
+	sh.lists[key] = newDeque(kept...)
+	s.touch(key)
+	s.notify(ListEvents, "lrem", key)
+	s.removeIfEmpty(sh, key)
+	return int64(removed), nil
+}
+
+// ListPosition returns the indexes of items equal to value in the list at
+// key, as LPOS does, in the order they're found.
+func (s *MemoryStore) ListPosition(key, value string, options ListPositionOptions) ([]int64, error) {
+	switch {
+	case options.Rank == math.MinInt64:
+		return nil, ErrOutOfRange
+	case options.Count < 0:
+		return nil, ErrNegativeCount
+	case options.MaxLen < 0:
+		return nil, ErrNegativeMaxLen
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeList); err != nil {
+		return nil, err
+	}
+	list := sh.list(key)
+	length := list.length()
+	scan := length
+	if options.MaxLen > 0 {
+		scan = min(scan, options.MaxLen)
+	}
+	skip := max(options.Rank, 1) - 1
+	if options.Rank < 0 {
+		skip = -options.Rank - 1
+	}
+	positions := []int64{}
+	for n := int64(0); n < scan && (options.Count == 0 || int64(len(positions)) < options.Count); n++ {
+		i := n
+		if options.Rank < 0 {
+			i = length - 1 - n
+		}
+		if list.at(i) != value {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		positions = append(positions, i)
+	}
+	return positions, nil
+}
+
+// removeIfEmpty deletes key if it's a collection with nothing left in it,
+// as Redis does.
+func (s *MemoryStore) removeIfEmpty(sh *shard, key string) {
+	empty := false
+	switch sh.keyType(key) {
+	case typeSet:
+		empty = len(sh.sets[key]) == 0
+	case typeHash:
+		empty = len(sh.hashes[key]) == 0
+	case typeList:
+		empty = sh.lists[key].length() == 0
+	case typeZSet:
+		empty = sh.sortedSets[key].length() == 0
+	}
+	if empty {
+		sh.remove(key)
+		s.notify(GenericEvents, "del", key)
+	}
+}
+
+func (sh *shard) list(key string) *deque {
+	if list, ok := sh.lists[key]; ok {
+		return list
+	}
+	return newDeque()
+}
+
+func (sh *shard) storeList(key string, list *deque) {
+	if list.length() == 0 {
+		delete(sh.lists, key)
+		return
+	}
+	sh.lists[key] = list
+}
+
+func (sh *shard) sortedSet(key string) *sortedSet {
+	if z, ok := sh.sortedSets[key]; ok {
+		return z
+	}
+	return newSortedSet()
+}
+
+func (sh *shard) storeSortedSet(key string, z *sortedSet) {
+	if z.length() == 0 {
+		delete(sh.sortedSets, key)
+		return
+	}
+	sh.sortedSets[key] = z
+}
+
+func (o SortedSetAddOptions) validate() error {
+	if (o.IfNotExists && (o.IfExists || o.GreaterThan || o.LessThan)) || (o.GreaterThan && o.LessThan) {
+		return ErrSyntax
+	}
+	return nil
+}
+
+func (s *MemoryStore) SortedSetAdd(key string, options SortedSetAddOptions, members ...ScoredMember) (int64, error) {
+	if err := options.validate(); err != nil {
+		return 0, err
+	}
+	for _, m := range members {
+		if math.IsNaN(m.Score) {
+			return 0, ErrNotFloat
+		}
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, err
+	}
+	z := sh.sortedSet(key)
+	var count int64
+	updated := false
+	for _, m := range members {
+		added, changed, _ := z.add(m.Member, m.Score, options)
+		if added || (changed && options.Changed) {
+			count++
+		}
+		updated = updated || added || changed
+	}
+	sh.storeSortedSet(key, z)
+	if updated {
+		s.touch(key)
+		s.notify(SortedSetEvents, "zadd", key)
+	}
+	return count, nil
+}
+
+func (s *MemoryStore) SortedSetAddIncrement(key string, options SortedSetAddOptions, member string, delta float64) (float64, bool, error) {
+	if err := options.validate(); err != nil {
+		return 0, false, err
+	}
+	if math.IsNaN(delta) {
+		return 0, false, ErrNotFloat
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, false, err
+	}
+	z := sh.sortedSet(key)
+	score := z.scores[member] + delta
+	if math.IsNaN(score) {
+		return 0, false, ErrScoreNaN
+	}
+	if _, _, applied := z.add(member, score, options); !applied {
+		return 0, false, nil
+	}
+	sh.storeSortedSet(key, z)
+	s.touch(key)
+	s.notify(SortedSetEvents, "zincr", key)
+	return score, true, nil
+}
+
+func (s *MemoryStore) SortedSetIncrementBy(key, member string, delta float64) (float64, error) {
+	score, _, err := s.SortedSetAddIncrement(key, SortedSetAddOptions{}, member, delta)
+	return score, err
+}
+
+func (s *MemoryStore) SortedSetRemove(key string, members ...string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, err
+	}
+	z := sh.sortedSet(key)
+	var removed int64
+	for _, member := range members {
+		if z.remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.touch(key)
+		s.notify(SortedSetEvents, "zrem", key)
+		s.removeIfEmpty(sh, key)
+	}
+	return removed, nil
+}
+
+func (s *MemoryStore) SortedSetScore(key, member string) (float64, bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, false, err
+	}
+	score, ok := sh.sortedSet(key).scores[member]
+	return score, ok, nil
+}
+
+func (s *MemoryStore) SortedSetCardinality(key string) (int64, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, err
 	}
-	return s.lists[key][index]
+	return sh.sortedSet(key).length(), nil
 }
 
-func (s *MemoryStore) ListTrim(key string, start, stop int64) {
-	s.lists[key] = s.ListRange(key, start, stop)
+func (s *MemoryStore) SortedSetCount(key, min, max string) (int64, error) {
+	low, high, err := parseBounds(min, max, false)
+	if err != nil {
+		return 0, err
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, err
+	}
+	return sh.sortedSet(key).count(low, high), nil
+}
+
+func (s *MemoryStore) SortedSetRank(key, member string) (int64, bool, error) {
+	return s.sortedSetRank(key, member, false)
+}
+
+func (s *MemoryStore) SortedSetReverseRank(key, member string) (int64, bool, error) {
+	return s.sortedSetRank(key, member, true)
+}
+
+func (s *MemoryStore) sortedSetRank(key, member string, reverse bool) (int64, bool, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return 0, false, err
+	}
+	rank, ok := sh.sortedSet(key).rank(member, reverse)
+	return rank, ok, nil
+}
+
+func (s *MemoryStore) SortedSetRange(key string, query SortedSetRange) ([]ScoredMember, error) {
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return nil, err
+	}
+	return query.collect(sh.sortedSet(key))
+}
+
+func (s *MemoryStore) SortedSetRangeStore(destination, key string, query SortedSetRange) (int64, error) {
+	defer s.lockKeys([]string{destination, key})()
+	source := s.shard(key)
+	if err := source.expectType(key, typeZSet); err != nil {
+		return 0, err
+	}
+	members, err := query.collect(source.sortedSet(key))
+	if err != nil {
+		return 0, err
+	}
+	z := newSortedSet()
+	for _, m := range members {
+		z.set(m.Member, m.Score)
+	}
+	sh := s.shard(destination)
+	existed := sh.exists(destination)
+	sh.remove(destination)
+	sh.storeSortedSet(destination, z)
+	s.touch(destination)
+	if z.length() > 0 {
+		s.notify(SortedSetEvents, "zrangestore", destination)
+	} else if existed {
+		s.notify(GenericEvents, "del", destination)
+	}
+	return z.length(), nil
+}
+
+func (s *MemoryStore) SortedSetPopMin(key string, count int64) ([]ScoredMember, error) {
+	return s.sortedSetPop(key, count, false)
+}
+
+func (s *MemoryStore) SortedSetPopMax(key string, count int64) ([]ScoredMember, error) {
+	return s.sortedSetPop(key, count, true)
+}
+
+func (s *MemoryStore) sortedSetPop(key string, count int64, fromMax bool) ([]ScoredMember, error) {
+	if count < 0 {
+		return nil, ErrOutOfRange
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeZSet); err != nil {
+		return nil, err
+	}
+	z := sh.sortedSet(key)
+	popped := z.pop(count, fromMax)
+	if len(popped) > 0 {
+		s.touch(key)
+		event := "zpopmin"
+		if fromMax {
+			event = "zpopmax"
+		}
+		s.notify(SortedSetEvents, event, key)
+		s.removeIfEmpty(sh, key)
+	}
+	return popped, nil
 }
 
 func NewMemoryStore() Store {
-	return &MemoryStore{
-		strings: make(map[string]string),
-		sets:    make(map[string]map[string]bool),
-		hashes:  make(map[string]map[string]string),
-		lists:   make(map[string][]string),
+	return NewMemoryStoreWithClock(systemClock{})
+}
+
+func NewMemoryStoreWithClock(clock Clock) *MemoryStore {
+	s := &MemoryStore{lastVersion: 1, clock: clock, closed: make(chan struct{}), broker: NewBroker()}
+	s.scripts = NewScripts(s).scriptCache
+	for i := range s.shards {
+		s.shards[i] = newShard()
 	}
+	return s
 }
@@ -1,6 +1,15 @@
 package restis
 
-import "testing"
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestMemoryStore(t *testing.T) {
 	storeGenerator := func() Store {
@@ -9,3 +18,302 @@ func TestMemoryStore(t *testing.T) {
 	RunAllTestsOnStore(t, storeGenerator)
 	RunAllRedisDocChecksOnStore(t, storeGenerator)
 }
+
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	store := NewMemoryStore()
+	keys := []string{"k1", "k2", "k3"}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := keys[(worker+i)%len(keys)]
+				value := strconv.Itoa(i)
+
+				store.Exists(keys...)
+				store.Type(key)
+				store.RandomKey()
+				store.Copy(key, "c"+key, true)
+				store.Rename("c"+key, "r"+key)
+				store.RenameIfNotExists("r"+key, "c"+key)
+				store.Delete("c"+key, "r"+key)
+				store.Expire(key, 100)
+				store.PExpire(key, 100000)
+				store.ExpireAt(key, 32503680000)
+				store.TTL(key)
+				store.PTTL(key)
+				store.Persist(key)
+				store.SetWithOptions(key, value, SetOptions{ExpireMilliseconds: 1})
+
+				store.Append(key, value)
+				store.Get(key)
+				store.GetRange(key, 0, -1)
+				store.GetSet(key, value)
+				store.Set(key, value)
+				store.SetIfExists(key, value)
+				store.SetIfNotExists(key, value)
+				store.MultiGet(keys)
+				store.MultiSet(map[string]string{"k1": value, "k2": value})
+				store.MultiSetIfNotExists(map[string]string{"k2": value, "k3": value})
+				store.Increment("n" + key)
+				store.Decrement("n" + key)
+				store.IncrementBy("n"+key, 2)
+				store.DecrementBy("n"+key, 2)
+				store.SetRange(key, 1, value)
+				store.Length(key)
+
+				store.SetAdd("s"+key, value, "common")
+				store.SetRemove("s"+key, value)
+				store.SetIsMember("s"+key, "common")
+				store.SetMembers("s" + key)
+				store.SetCardinality("s" + key)
+
+				store.HashSet("h"+key, value, value)
+				store.HashGet("h"+key, value)
+				store.HashLength("h" + key)
+				store.HashMultiGet("h"+key, "0", value)
+				store.HashMultiSet("h"+key, map[string]string{"a": value, "b": value})
+				store.HashExists("h"+key, "a")
+				store.HashKeys("h" + key)
+				store.HashValues("h" + key)
+				store.HashSetIfExists("h"+key, "a", value)
+				store.HashSetIfNotExists("h"+key, value, value)
+
+				store.ListRightPush("l"+key, value, value)
+				store.ListLeftPush("l"+key, value)
+				store.ListLength("l" + key)
+				store.ListRange("l"+key, 0, -1)
+				store.ListSet("l"+key, 0, value)
+				store.ListIndex("l"+key, -1)
+				store.ListLeftPop("l" + key)
+				store.ListRightPop("l" + key)
+				store.ListTrim("l"+key, 0, 20)
+
+				store.SortedSetAdd("z"+key, SortedSetAddOptions{}, ScoredMember{value, float64(i)}, ScoredMember{"common", 0})
+				store.SortedSetAddIncrement("z"+key, SortedSetAddOptions{IfExists: true}, value, 1)
+				store.SortedSetIncrementBy("zcounter", "counter", 1)
+				store.SortedSetRemove("z"+key, value)
+				store.SortedSetScore("z"+key, "common")
+				store.SortedSetCardinality("z" + key)
+				store.SortedSetCount("z"+key, "-inf", "+inf")
+				store.SortedSetRank("z"+key, "common")
+				store.SortedSetReverseRank("z"+key, "common")
+				store.SortedSetRange("z"+key, SortedSetRange{Start: "0", Stop: "-1"})
+				store.SortedSetRangeStore("rz"+key, "z"+key, SortedSetRange{Start: "0", Stop: "10", ByScore: true})
+				store.SortedSetPopMin("rz"+key, 1)
+				store.SortedSetPopMax("rz"+key, 1)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	ok := noError(t)
+	assert.Equal(t, 0, ok(store.IncrementBy("nk1", 0)))
+	assert.Equal(t, 21, ok(store.ListLength("lk1")))
+	assert.Equal(t, true, ok(store.SetIsMember("sk1", "common")))
+	score, found, err := store.SortedSetScore("zcounter", "counter")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 1600.0, score)
+}
+
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestMemoryStoreLazyExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStoreWithClock(clock)
+	defer store.Close()
+	ok := noError(t)
+
+	assert.NoError(t, store.Set("k1", "v1"))
+	assert.Equal(t, true, ok(store.Expire("k1", 10)))
+	assert.NoError(t, store.SetAdd("s1", "m1"))
+	assert.Equal(t, true, ok(store.PExpire("s1", 1500)))
+	assert.Equal(t, true, ok(store.SetWithOptions("k2", "v2", SetOptions{ExpireAt: 1005})))
+
+	clock.Advance(1499 * time.Millisecond)
+	assert.Equal(t, 1, ok(store.PTTL("s1")))
+	assert.Equal(t, 9, ok(store.TTL("k1")))
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, false, ok(store.SetIsMember("s1", "m1")))
+	assert.Equal(t, -2, ok(store.TTL("s1")))
+
+	clock.Advance(3500 * time.Millisecond)
+	assert.Equal(t, "", ok(store.Get("k2")))
+	assert.Equal(t, 1, ok(store.Exists("k1", "k2")))
+	assert.Equal(t, "k1", ok(store.RandomKey()))
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, ErrNoSuchKey, failure(store.RandomKey()))
+	assert.Equal(t, true, ok(store.SetIfNotExists("k1", "v1.1")))
+	assert.Equal(t, -1, ok(store.TTL("k1")))
+}
+
+func TestMemoryStoreActiveExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStoreWithClock(clock)
+	defer store.Close()
+	ok := noError(t)
+
+	for i := 0; i < 200; i++ {
+		key := "k" + strconv.Itoa(i)
+		assert.NoError(t, store.Set(key, "v"))
+		assert.Equal(t, true, ok(store.Expire(key, int64(1+i%2))))
+	}
+	assert.NoError(t, store.Set("forever", "v"))
+
+	clock.Advance(time.Second)
+	store.expireCycle()
+	remaining := 0
+	for _, sh := range store.shards {
+		sh.Lock()
+		remaining += sh.size()
+		sh.Unlock()
+	}
+	assert.Equal(t, 101, remaining)
+
+	clock.Advance(time.Second)
+	store.expireCycle()
+	remaining = 0
+	for _, sh := range store.shards {
+		sh.Lock()
+		remaining += sh.size()
+		assert.Empty(t, sh.expires)
+		sh.Unlock()
+	}
+	assert.Equal(t, 1, remaining)
+	assert.Equal(t, "forever", ok(store.RandomKey()))
+}
+
+func TestMemoryStoreScanDuringWrites(t *testing.T) {
+	store := NewMemoryStore()
+	ok := noError(t)
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, store.Set("stable"+strconv.Itoa(i), "v"))
+		assert.NoError(t, store.Set("removed"+strconv.Itoa(i), "v"))
+	}
+
+	seen := map[string]int{}
+	var cursor uint64
+	for round := 0; ; round++ {
+		next, page, err := store.Scan(cursor, ScanOptions{Count: 20})
+		assert.NoError(t, err)
+		for _, key := range page {
+			seen[key]++
+		}
+		assert.Equal(t, 1, ok(store.Delete("removed"+strconv.Itoa(round))))
+		assert.NoError(t, store.Set("added"+strconv.Itoa(round), "v"))
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 500; i++ {
+		assert.Equal(t, 1, seen["stable"+strconv.Itoa(i)])
+	}
+	for key, times := range seen {
+		assert.Equal(t, 1, times, key)
+	}
+}
+
+func TestScanPageKeepsTiesTogether(t *testing.T) {
+	positions := map[string]uint64{"a": 5, "b": 1, "c": 3, "d": 3, "e": 9, "f": 7}
+	position := func(element string) uint64 { return positions[element] }
+	elements := []string{"a", "b", "c", "d", "e", "f"}
+
+	page, next := scanPage(elements, position, 0, 2)
+	assert.Equal(t, "b", page[0])
+	assert.ElementsMatch(t, []string{"b", "c", "d"}, page)
+	assert.Equal(t, uint64(5), next)
+
+	page, next = scanPage(elements, position, next, 2)
+	assert.Equal(t, []string{"a", "f"}, page)
+	assert.Equal(t, uint64(9), next)
+
+	page, next = scanPage(elements, position, next, 2)
+	assert.Equal(t, []string{"e"}, page)
+	assert.Equal(t, uint64(0), next)
+}
+
+// waitUntil polls condition for up to a second, for things that happen on
+// other goroutines.
+func waitUntil(t *testing.T, message string, condition func() bool) {
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+	}
+}
+
+func TestMemoryStoreBlockingPopOrder(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	ok := noError(t)
+	results := make([]chan string, 3)
+	for i := range results {
+		results[i] = make(chan string, 1)
+		go func(result chan string) {
+			_, value, err := store.ListBlockingLeftPop(context.Background(), 5*time.Second, "other", "queue")
+			assert.NoError(t, err)
+			result <- value
+		}(results[i])
+		// Each caller has to be queued before the next starts.
+		waitUntil(t, "caller never started waiting", func() bool {
+			return atomic.LoadInt64(&store.waiters.waiting) == int64(i+1)
+		})
+	}
+	ok(store.ListRightPush("queue", "a", "b", "c", "d"))
+	for i, expected := range []string{"a", "b", "c"} {
+		assert.Equal(t, expected, <-results[i])
+	}
+	assert.Equal(t, []string{"d"}, ok(store.ListRange("queue", 0, -1)))
+	assert.Equal(t, 0, atomic.LoadInt64(&store.waiters.waiting))
+}
+
+func TestMemoryStoreBlockingPopDoesNotJumpQueue(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	ok := noError(t)
+	queued := make(chan string, 1)
+	go func() {
+		_, value, err := store.ListBlockingLeftPop(context.Background(), 5*time.Second, "queue")
+		assert.NoError(t, err)
+		queued <- value
+	}()
+	waitUntil(t, "caller never started waiting", func() bool {
+		return atomic.LoadInt64(&store.waiters.waiting) == 1
+	})
+
+	ok(store.ListRightPush("queue", "a"))
+	_, _, err := store.ListBlockingLeftPop(context.Background(), 50*time.Millisecond, "queue")
+	assert.Equal(t, ErrNoSuchKey, err)
+	assert.Equal(t, "a", <-queued)
+	assert.Equal(t, 0, atomic.LoadInt64(&store.waiters.waiting))
+}
+
+func TestMemoryStoreBlockingInTransaction(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	err := store.Transaction(func(tx Store) error {
+		_, _, err := tx.ListBlockingLeftPop(context.Background(), 0, "queue")
+		assert.Equal(t, ErrNoSuchKey, err)
+		_, err = tx.ListRightPush("queue", "a")
+		assert.NoError(t, err)
+		_, value, err := tx.ListBlockingLeftPop(context.Background(), 0, "queue")
+		assert.Equal(t, "a", value)
+		return err
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,227 @@
+package restis
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrInvalidKeyspaceEvents  = errors.New("ERR Invalid event class character. Use 'g$lshzxKEA'.")
+	ErrKeyspaceEventsDisabled = errors.New("ERR keyspace events are not available on this store")
+)
+
+// KeyspaceEvents selects classes of keyspace events, like the flags of
+// Redis' notify-keyspace-events setting.
+type KeyspaceEvents int32
+
+const (
+	KeyspaceChannels KeyspaceEvents = 1 << iota // K: publish the event to __keyspace@0__:<key>
+	KeyeventChannels                            // E: publish the key to __keyevent@0__:<event>
+	GenericEvents                               // g: del, expire, persist, rename_from, rename_to and copy_to
+	StringEvents                                // $
+	ListEvents                                  // l
+	SetEvents                                   // s
+	HashEvents                                  // h
+	SortedSetEvents                             // z
+	ExpiredEvents                               // x: keys removed because their expiry passed
+
+	AllEvents = GenericEvents | StringEvents | ListEvents | SetEvents | HashEvents | SortedSetEvents | ExpiredEvents // A
+)
+
+var keyspaceEventFlags = []struct {
+	flag   byte
+	events KeyspaceEvents
+}{
+	{'g', GenericEvents},
+	{'$', StringEvents},
+	{'l', ListEvents},
+	{'s', SetEvents},
+	{'h', HashEvents},
+	{'z', SortedSetEvents},
+	{'x', ExpiredEvents},
+}
+
+// ParseKeyspaceEvents parses Redis notify-keyspace-events flags like "KEA"
+// or "Kx".
+func ParseKeyspaceEvents(flags string) (KeyspaceEvents, error) {
+	var events KeyspaceEvents
+	for i := 0; i < len(flags); i++ {
+		switch flags[i] {
+		case 'A':
+			events |= AllEvents
+		case 'K':
+			events |= KeyspaceChannels
+		case 'E':
+			events |= KeyeventChannels
+		default:
+			found := false
+			for _, f := range keyspaceEventFlags {
+				if f.flag == flags[i] {
+					events |= f.events
+					found = true
+				}
+			}
+			if !found {
+				return 0, ErrInvalidKeyspaceEvents
+			}
+		}
+	}
+	return events, nil
+}
+
+// String formats events as notify-keyspace-events flags.
+func (e KeyspaceEvents) String() string {
+	var flags []byte
+	if e&AllEvents == AllEvents {
+		flags = append(flags, 'A')
+	} else {
+		for _, f := range keyspaceEventFlags {
+			if e&f.events != 0 {
+				flags = append(flags, f.flag)
+			}
+		}
+	}
+	if e&KeyspaceChannels != 0 {
+		flags = append(flags, 'K')
+	}
+	if e&KeyeventChannels != 0 {
+		flags = append(flags, 'E')
+	}
+	return string(flags)
+}
+
+// keyspaceEventsStore is implemented by stores that report changes to their
+// keys, and backs CONFIG GET and SET of notify-keyspace-events.
+type keyspaceEventsStore interface {
+	KeyspaceEvents() KeyspaceEvents
+	SetKeyspaceEvents(events KeyspaceEvents)
+}
+
+// A KeyspaceEvent reports a change to a key, named as Redis names it: set,
+// append, sadd, hset, lpush, del, expired and so on.
+type KeyspaceEvent struct {
+	Event string
+	Key   string
+}
+
+// A KeyspaceWatcher receives the keyspace events of the classes it asked
+// for. Its Events channel is closed once it's closed, or when it falls too
+// far behind.
+type KeyspaceWatcher struct {
+	hub    *keyspaceHub
+	events KeyspaceEvents
+	ch     chan KeyspaceEvent
+}
+
+// Events returns the channel events are delivered on.
+func (w *KeyspaceWatcher) Events() <-chan KeyspaceEvent {
+	return w.ch
+}
+
+// Close stops the watcher and closes its Events channel.
+func (w *KeyspaceWatcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.unwatch(w)
+}
+
+// keyspaceHub fans keyspace events out to watchers and pub/sub channels.
+// listening is the union of every class anyone wants, so that stores can
+// skip building events nobody will see.
+type keyspaceHub struct {
+	listening int32
+
+	mu       sync.Mutex
+	channels KeyspaceEvents
+	watchers map[*KeyspaceWatcher]bool
+}
+
+func (h *keyspaceHub) wants(class KeyspaceEvents) bool {
+	return KeyspaceEvents(atomic.LoadInt32(&h.listening))&class != 0
+}
+
+// update recomputes listening. It's called with h.mu held.
+func (h *keyspaceHub) update() {
+	var listening KeyspaceEvents
+	if h.channels&(KeyspaceChannels|KeyeventChannels) != 0 {
+		listening = h.channels &^ (KeyspaceChannels | KeyeventChannels)
+	}
+	for w := range h.watchers {
+		listening |= w.events
+	}
+	atomic.StoreInt32(&h.listening, int32(listening))
+}
+
+func (h *keyspaceHub) unwatch(w *KeyspaceWatcher) {
+	if h.watchers[w] {
+		delete(h.watchers, w)
+		close(w.ch)
+		h.update()
+	}
+}
+
+// KeyspaceEvents returns the classes of events published to the keyspace
+// and keyevent channels.
+func (s *MemoryStore) KeyspaceEvents() KeyspaceEvents {
+	s.keyspace.mu.Lock()
+	defer s.keyspace.mu.Unlock()
+	return s.keyspace.channels
+}
+
+// SetKeyspaceEvents chooses which classes of events are published to pub/sub
+// channels. As in Redis, nothing is published unless KeyspaceChannels or
+// KeyeventChannels is set along with at least one class. Watchers are
+// unaffected.
+func (s *MemoryStore) SetKeyspaceEvents(events KeyspaceEvents) {
+	s.keyspace.mu.Lock()
+	defer s.keyspace.mu.Unlock()
+	s.keyspace.channels = events
+	s.keyspace.update()
+}
+
+// WatchKeyspace returns a watcher for the given classes of events, whatever
+// is published to pub/sub. Events are delivered in the order each key
+// changed.
+func (s *MemoryStore) WatchKeyspace(events KeyspaceEvents) *KeyspaceWatcher {
+	w := &KeyspaceWatcher{hub: &s.keyspace, events: events &^ (KeyspaceChannels | KeyeventChannels), ch: make(chan KeyspaceEvent, subscriptionBuffer)}
+	s.keyspace.mu.Lock()
+	defer s.keyspace.mu.Unlock()
+	if s.keyspace.watchers == nil {
+		s.keyspace.watchers = make(map[*KeyspaceWatcher]bool)
+	}
+	s.keyspace.watchers[w] = true
+	s.keyspace.update()
+	return w
+}
+
+// notify reports an event of class on key. It's called with the key's shard
+// locked, after the change has been applied.
+func (s *MemoryStore) notify(class KeyspaceEvents, event, key string) {
+	s = s.root()
+	h := &s.keyspace
+	if !h.wants(class) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		if w.events&class == 0 {
+			continue
+		}
+		select {
+		case w.ch <- KeyspaceEvent{Event: event, Key: key}:
+		default:
+			h.unwatch(w)
+		}
+	}
+	if h.channels&class == 0 {
+		return
+	}
+	if h.channels&KeyspaceChannels != 0 {
+		s.broker.Publish("__keyspace@0__:"+key, event)
+	}
+	if h.channels&KeyeventChannels != 0 {
+		s.broker.Publish("__keyevent@0__:"+event, key)
+	}
+}
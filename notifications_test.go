@@ -0,0 +1,166 @@
+package restis
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// drain returns the events a watcher has been sent so far.
+func drain(w *KeyspaceWatcher) []KeyspaceEvent {
+	events := []KeyspaceEvent{}
+	for {
+		select {
+		case event, open := <-w.Events():
+			if !open {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	for flags, expected := range map[string]string{
+		"":        "",
+		"KEA":     "AKE",
+		"Ex":      "xE",
+		"Kg$":     "g$K",
+		"Ag$lshz": "A",
+		"lshzx$g": "A",
+	} {
+		events, err := ParseKeyspaceEvents(flags)
+		assert.NoError(t, err, flags)
+		assert.Equal(t, expected, events.String(), flags)
+	}
+	_, err := ParseKeyspaceEvents("KEm")
+	assert.Equal(t, ErrInvalidKeyspaceEvents, err)
+}
+
+func TestKeyspaceWatcher(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStoreWithClock(clock)
+	w := store.WatchKeyspace(AllEvents)
+	defer w.Close()
+	strings := store.WatchKeyspace(StringEvents | KeyspaceChannels)
+	defer strings.Close()
+
+	assert.NoError(t, store.Set("s", "v"))
+	ok(store.Append("s", "alue"))
+	ok(store.Increment("n"))
+	ok(store.DecrementBy("n", 2))
+	ok(store.SetWithOptions("s", "v", SetOptions{ExpireSeconds: 10}))
+	ok(store.Persist("s"))
+	assert.NoError(t, store.SetAdd("set", "a"))
+	assert.NoError(t, store.SetAdd("set", "a"))
+	assert.NoError(t, store.SetRemove("set", "b"))
+	assert.NoError(t, store.SetRemove("set", "a"))
+	assert.NoError(t, store.HashSet("hash", "f", "v"))
+	ok(store.ListLeftPush("list", "a"))
+	ok(store.ListRightPush("list", "b"))
+	ok(store.ListLeftPop("list"))
+	ok(store.ListRightPop("list"))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"a", 1}))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"a", 1}))
+	ok(store.SortedSetIncrementBy("zset", "a", 1))
+	ok(store.SortedSetRangeStore("copy", "zset", everything()))
+	ok(store.SortedSetPopMax("zset", 1))
+	assert.NoError(t, store.Rename("hash", "renamed"))
+	ok(store.Copy("renamed", "copied", false))
+	ok(store.Delete("renamed", "missing"))
+	ok(store.Expire("copied", -1))
+	ok(store.Expire("copy", 1))
+	assert.Equal(t, []KeyspaceEvent{
+		{"set", "s"},
+		{"append", "s"},
+		{"incrby", "n"},
+		{"decrby", "n"},
+		{"set", "s"},
+		{"expire", "s"},
+		{"persist", "s"},
+		{"sadd", "set"},
+		{"srem", "set"},
+		{"del", "set"},
+		{"hset", "hash"},
+		{"lpush", "list"},
+		{"rpush", "list"},
+		{"lpop", "list"},
+		{"rpop", "list"},
+		{"del", "list"},
+		{"zadd", "zset"},
+		{"zincr", "zset"},
+		{"zrangestore", "copy"},
+		{"zpopmax", "zset"},
+		{"del", "zset"},
+		{"rename_from", "hash"},
+		{"rename_to", "renamed"},
+		{"copy_to", "copied"},
+		{"del", "renamed"},
+		{"del", "copied"},
+		{"expire", "copy"},
+	}, drain(w))
+	assert.Equal(t, 5, len(drain(strings)))
+
+	clock.Advance(2 * time.Second)
+	ok(store.Exists("copy"))
+	assert.Equal(t, []KeyspaceEvent{{"expired", "copy"}}, drain(w))
+	ok(store.SetWithOptions("volatile", "v", SetOptions{ExpireSeconds: 1}))
+	clock.Advance(2 * time.Second)
+	store.expireCycle()
+	assert.Equal(t, []KeyspaceEvent{{"set", "volatile"}, {"expire", "volatile"}, {"expired", "volatile"}}, drain(w))
+
+	w.Close()
+	_, open := <-w.Events()
+	assert.False(t, open)
+}
+
+func TestKeyspaceWatcherFallsBehind(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	w := store.WatchKeyspace(StringEvents)
+	for i := 0; i <= subscriptionBuffer; i++ {
+		assert.NoError(t, store.Set("k", "v"))
+	}
+	assert.Equal(t, subscriptionBuffer, len(drain(w)))
+	_, open := <-w.Events()
+	assert.False(t, open)
+	assert.False(t, store.keyspace.wants(StringEvents))
+}
+
+func TestKeyspaceChannels(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	sub := store.Broker().NewSubscription()
+	defer sub.Close()
+	sub.PSubscribe("__key*__:*")
+
+	assert.NoError(t, store.Set("k", "v"))
+	store.SetKeyspaceEvents(AllEvents)
+	assert.NoError(t, store.Set("k", "v"))
+	store.SetKeyspaceEvents(KeyspaceChannels | HashEvents)
+	assert.NoError(t, store.Set("k", "v"))
+	assert.Equal(t, 0, len(sub.Messages()))
+
+	assert.NoError(t, store.HashSet("h", "f", "v"))
+	assert.Equal(t, Message{Pattern: "__key*__:*", Channel: "__keyspace@0__:h", Payload: "hset"}, <-sub.Messages())
+	store.SetKeyspaceEvents(KeyeventChannels | GenericEvents)
+	noError(t)(store.Delete("h"))
+	assert.Equal(t, Message{Pattern: "__key*__:*", Channel: "__keyevent@0__:del", Payload: "h"}, <-sub.Messages())
+	assert.Equal(t, KeyeventChannels|GenericEvents, store.KeyspaceEvents())
+}
+
+func TestDiskStoreKeyspaceEvents(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := openDisk(t, DiskOptions{Path: filepath.Join(t.TempDir(), "store"), Clock: clock})
+	w := store.WatchKeyspace(AllEvents)
+	defer w.Close()
+	assert.NoError(t, store.Set("s", "v"))
+	noError(t)(store.Expire("s", 1))
+	noError(t)(store.ListRightPush("list", "a"))
+	clock.Advance(2 * time.Second)
+	store.expireCycle()
+	assert.Equal(t, []KeyspaceEvent{{"set", "s"}, {"expire", "s"}, {"rpush", "list"}, {"expired", "s"}}, drain(w))
+}
@@ -0,0 +1,271 @@
+package restis
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrPubSubDisabled = errors.New("ERR pub/sub is not available on this store")
+
+// subscriptionBuffer is how many messages a subscriber can fall behind by
+// before it's dropped, so that a slow reader never stalls publishers.
+const subscriptionBuffer = 1024
+
+// pubSubStore is implemented by stores with a message broker, and backs the
+// pub/sub commands and the /channels routes. The RESP server and the HTTP
+// handler for a store share its broker.
+type pubSubStore interface {
+	Broker() *Broker
+}
+
+// A Message is a payload published to a channel. Pattern is the pattern
+// that matched for pattern subscriptions, and empty otherwise.
+type Message struct {
+	Pattern string
+	Channel string
+	Payload string
+}
+
+// A Broker delivers published messages to the subscribers of a channel and
+// of every glob pattern that matches it.
+type Broker struct {
+	mu       sync.Mutex
+	channels map[string]map[*Subscription]bool
+	patterns map[string]map[*Subscription]bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		channels: make(map[string]map[*Subscription]bool),
+		patterns: make(map[string]map[*Subscription]bool),
+	}
+}
+
+// A Subscription receives messages for the channels and patterns it's
+// subscribed to. It starts with none; its Messages channel is closed once
+// the subscription is closed, or when it falls too far behind.
+type Subscription struct {
+	broker   *Broker
+	messages chan Message
+	channels map[string]bool
+	patterns map[string]bool
+	closed   bool
+}
+
+func (b *Broker) NewSubscription() *Subscription {
+	return &Subscription{
+		broker:   b,
+		messages: make(chan Message, subscriptionBuffer),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+// Publish sends message to channel and returns how many subscribers
+// received it, counting a subscriber once for each of its subscriptions that
+// matched.
+func (b *Broker) Publish(channel, message string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var receivers int64
+	for sub := range b.channels[channel] {
+		if b.deliver(sub, Message{Channel: channel, Payload: message}) {
+			receivers++
+		}
+	}
+	for pattern, subs := range b.patterns {
+		if !matchGlob(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			if b.deliver(sub, Message{Pattern: pattern, Channel: channel, Payload: message}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+func (b *Broker) deliver(sub *Subscription, message Message) bool {
+	if sub.closed {
+		return false
+	}
+	select {
+	case sub.messages <- message:
+		return true
+	default:
+		b.close(sub)
+		return false
+	}
+}
+
+// Channels returns the channels with at least one subscriber, sorted, or
+// only those matching pattern if it isn't empty.
+func (b *Broker) Channels(pattern string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	channels := []string{}
+	for channel := range b.channels {
+		if pattern == "" || matchGlob(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// NumSub returns the number of subscribers to each channel, not counting
+// pattern subscriptions.
+func (b *Broker) NumSub(channels ...string) []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := make([]int64, len(channels))
+	for i, channel := range channels {
+		counts[i] = int64(len(b.channels[channel]))
+	}
+	return counts
+}
+
+// NumPat returns the number of patterns with at least one subscriber.
+func (b *Broker) NumPat() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.patterns))
+}
+
+func (b *Broker) close(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	for channel := range sub.channels {
+		unsubscribe(b.channels, channel, sub)
+	}
+	for pattern := range sub.patterns {
+		unsubscribe(b.patterns, pattern, sub)
+	}
+	sub.channels = make(map[string]bool)
+	sub.patterns = make(map[string]bool)
+	sub.closed = true
+	close(sub.messages)
+}
+
+func subscribe(index map[string]map[*Subscription]bool, name string, sub *Subscription) {
+	subs, ok := index[name]
+	if !ok {
+		subs = make(map[*Subscription]bool)
+		index[name] = subs
+	}
+	subs[sub] = true
+}
+
+func unsubscribe(index map[string]map[*Subscription]bool, name string, sub *Subscription) {
+	delete(index[name], sub)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+}
+
+// Messages returns the channel messages are delivered on.
+func (s *Subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Subscribe adds channels to the subscription. It does nothing once the
+// subscription is closed.
+func (s *Subscription) Subscribe(channels ...string) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, channel := range channels {
+		s.channels[channel] = true
+		subscribe(s.broker.channels, channel, s)
+	}
+}
+
+// PSubscribe adds glob patterns to the subscription.
+func (s *Subscription) PSubscribe(patterns ...string) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, pattern := range patterns {
+		s.patterns[pattern] = true
+		subscribe(s.broker.patterns, pattern, s)
+	}
+}
+
+// Unsubscribe removes channels from the subscription, or every channel if
+// none are given. The subscription stays open and can subscribe again.
+func (s *Subscription) Unsubscribe(channels ...string) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if len(channels) == 0 {
+		channels = names(s.channels)
+	}
+	for _, channel := range channels {
+		if s.channels[channel] {
+			delete(s.channels, channel)
+			unsubscribe(s.broker.channels, channel, s)
+		}
+	}
+}
+
+// PUnsubscribe removes patterns from the subscription, or every pattern if
+// none are given.
+func (s *Subscription) PUnsubscribe(patterns ...string) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if len(patterns) == 0 {
+		patterns = names(s.patterns)
+	}
+	for _, pattern := range patterns {
+		if s.patterns[pattern] {
+			delete(s.patterns, pattern)
+			unsubscribe(s.broker.patterns, pattern, s)
+		}
+	}
+}
+
+// Channels returns the subscribed channels, sorted.
+func (s *Subscription) Channels() []string {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	channels := names(s.channels)
+	sort.Strings(channels)
+	return channels
+}
+
+// Patterns returns the subscribed patterns, sorted.
+func (s *Subscription) Patterns() []string {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	patterns := names(s.patterns)
+	sort.Strings(patterns)
+	return patterns
+}
+
+// Count returns the number of channels and patterns subscribed to.
+func (s *Subscription) Count() int64 {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return int64(len(s.channels) + len(s.patterns))
+}
+
+// Close ends the subscription and closes its Messages channel.
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.close(s)
+}
+
+func names(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,94 @@
+package restis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"news.*", "news.tech", true},
+		{"news.*", "news", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"h[ab", "ha", true},
+	} {
+		assert.Equal(t, c.match, matchGlob(c.pattern, c.s), c.pattern+" "+c.s)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	sub := b.NewSubscription()
+	sub.Subscribe("news", "sports")
+	sub.PSubscribe("news.*", "*")
+	assert.Equal(t, 4, sub.Count())
+	assert.Equal(t, []string{"news", "sports"}, sub.Channels())
+	assert.Equal(t, []string{"*", "news.*"}, sub.Patterns())
+
+	assert.Equal(t, 2, b.Publish("news", "hello"))
+	assert.Equal(t, 2, b.Publish("news.tech", "restis"))
+	received := []Message{<-sub.Messages(), <-sub.Messages(), <-sub.Messages(), <-sub.Messages()}
+	assert.Contains(t, received, Message{Channel: "news", Payload: "hello"})
+	assert.Contains(t, received, Message{Pattern: "*", Channel: "news", Payload: "hello"})
+	assert.Contains(t, received, Message{Pattern: "news.*", Channel: "news.tech", Payload: "restis"})
+	assert.Contains(t, received, Message{Pattern: "*", Channel: "news.tech", Payload: "restis"})
+
+	other := b.NewSubscription()
+	other.Subscribe("news")
+	assert.Equal(t, []string{"news", "sports"}, b.Channels(""))
+	assert.Equal(t, []string{"sports"}, b.Channels("s*"))
+	assert.Equal(t, []int64{2, 1, 0}, b.NumSub("news", "sports", "weather"))
+	assert.Equal(t, 2, b.NumPat())
+
+	sub.Unsubscribe("news")
+	sub.PUnsubscribe()
+	assert.Equal(t, 1, sub.Count())
+	assert.Equal(t, []int64{1, 1}, b.NumSub("news", "sports"))
+	assert.Equal(t, 0, b.NumPat())
+	sub.Unsubscribe()
+	assert.Equal(t, []string{"news"}, b.Channels(""))
+
+	other.Close()
+	_, open := <-other.Messages()
+	assert.False(t, open)
+	other.Subscribe("news")
+	assert.Equal(t, 0, other.Count())
+	assert.Equal(t, 0, b.Publish("news", "hello"))
+}
+
+func TestBrokerDropsSlowSubscribers(t *testing.T) {
+	b := NewBroker()
+	slow := b.NewSubscription()
+	slow.Subscribe("firehose")
+	for i := 0; i < subscriptionBuffer; i++ {
+		assert.Equal(t, 1, b.Publish("firehose", "message"))
+	}
+	assert.Equal(t, 0, b.Publish("firehose", "one too many"))
+	assert.Equal(t, []string{}, b.Channels(""))
+	for i := 0; i < subscriptionBuffer; i++ {
+		<-slow.Messages()
+	}
+	_, open := <-slow.Messages()
+	assert.False(t, open)
+}
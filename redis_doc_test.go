@@ -7,6 +7,18 @@ import (
 )
 
 func RunAllRedisDocChecksOnStore(t *testing.T, storeGen storeGenerator) {
+	COPY(t, storeGen())
+	DEL(t, storeGen())
+	EXISTS(t, storeGen())
+	EXPIRE(t, storeGen())
+	EXPIREAT(t, storeGen())
+	PERSIST(t, storeGen())
+	PEXPIRE(t, storeGen())
+	PTTL(t, storeGen())
+	RENAME(t, storeGen())
+	RENAMENX(t, storeGen())
+	TTL(t, storeGen())
+	TYPE(t, storeGen())
 	APPEND(t, storeGen())
 	DECR(t, storeGen())
 	DECRBY(t, storeGen())
@@ -15,6 +27,7 @@ func RunAllRedisDocChecksOnStore(t *testing.T, storeGen storeGenerator) {
 	GETSET(t, storeGen())
 	INCR(t, storeGen())
 	INCRBY(t, storeGen())
+	INCRBYFLOAT(t, storeGen())
 	MGET(t, storeGen())
 	MSET(t, storeGen())
 	MSETNX(t, storeGen())
@@ -22,103 +35,676 @@ func RunAllRedisDocChecksOnStore(t *testing.T, storeGen storeGenerator) {
 	SETNX(t, storeGen())
 	SETRANGE(t, storeGen())
 	STRLEN(t, storeGen())
+	SDIFF(t, storeGen())
+	SDIFFSTORE(t, storeGen())
+	SINTER(t, storeGen())
+	SINTERCARD(t, storeGen())
+	SINTERSTORE(t, storeGen())
+	SMISMEMBER(t, storeGen())
+	SMOVE(t, storeGen())
+	SPOP(t, storeGen())
+	SRANDMEMBER(t, storeGen())
+	SUNION(t, storeGen())
+	SUNIONSTORE(t, storeGen())
+	HDEL(t, storeGen())
+	HEXPIRE(t, storeGen())
+	HGETALL(t, storeGen())
+	HGETEX(t, storeGen())
+	HINCRBY(t, storeGen())
+	HINCRBYFLOAT(t, storeGen())
+	HPERSIST(t, storeGen())
+	HRANDFIELD(t, storeGen())
+	HSETEX(t, storeGen())
+	HSTRLEN(t, storeGen())
+	HTTL(t, storeGen())
+	LINSERT(t, storeGen())
+	LMOVE(t, storeGen())
+	LMPOP(t, storeGen())
+	LPOP(t, storeGen())
+	LPOS(t, storeGen())
+	LPUSHX(t, storeGen())
+	LREM(t, storeGen())
+	RPOP(t, storeGen())
+	RPOPLPUSH(t, storeGen())
+	RPUSHX(t, storeGen())
+	ZADD(t, storeGen())
+	ZCARD(t, storeGen())
+	ZCOUNT(t, storeGen())
+	ZINCRBY(t, storeGen())
+	ZPOPMAX(t, storeGen())
+	ZPOPMIN(t, storeGen())
+	ZRANGE(t, storeGen())
+	ZRANGEBYLEX(t, storeGen())
+	ZRANGESTORE(t, storeGen())
+	ZRANK(t, storeGen())
+	ZREM(t, storeGen())
+	ZREVRANGEBYSCORE(t, storeGen())
+	ZREVRANK(t, storeGen())
+	ZSCORE(t, storeGen())
+}
+
+func COPY(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("dolly", "sheep"))
+	assert.Equal(t, true, ok(store.Copy("dolly", "clone", false)))
+	assert.Equal(t, "sheep", ok(store.Get("clone")))
+}
+
+func DEL(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("key1", "Hello"))
+	assert.NoError(t, store.Set("key2", "World"))
+	assert.Equal(t, 2, ok(store.Delete("key1", "key2", "key3")))
+}
+
+func EXISTS(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("key1", "Hello"))
+	assert.Equal(t, 1, ok(store.Exists("key1")))
+	assert.Equal(t, 0, ok(store.Exists("nosuchkey")))
+	assert.NoError(t, store.Set("key2", "World"))
+	assert.Equal(t, 2, ok(store.Exists("key1", "key2", "nosuchkey")))
+}
+
+func EXPIRE(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, true, ok(store.Expire("mykey", 10)))
+	assert.Equal(t, 10, ok(store.TTL("mykey")))
+	assert.NoError(t, store.Set("mykey", "Hello World"))
+	assert.Equal(t, -1, ok(store.TTL("mykey")))
+}
+
+func EXPIREAT(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, 1, ok(store.Exists("mykey")))
+	assert.Equal(t, true, ok(store.ExpireAt("mykey", 1293840000)))
+	assert.Equal(t, 0, ok(store.Exists("mykey")))
+}
+
+func PERSIST(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, true, ok(store.Expire("mykey", 10)))
+	assert.Equal(t, 10, ok(store.TTL("mykey")))
+	assert.Equal(t, true, ok(store.Persist("mykey")))
+	assert.Equal(t, -1, ok(store.TTL("mykey")))
+}
+
+func PEXPIRE(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, true, ok(store.PExpire("mykey", 1500)))
+	assert.InDelta(t, 1, ok(store.TTL("mykey")), 1)
+	assert.InDelta(t, 1499, ok(store.PTTL("mykey")), 100)
+}
 
+func PTTL(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, true, ok(store.Expire("mykey", 1)))
+	assert.InDelta(t, 999, ok(store.PTTL("mykey")), 100)
 }
 
-func APPEND(t *testing.T, store StringStore) {
-	assert.False(t, store.Exists("mykey"))
-	assert.Equal(t, 5, store.Append("mykey", "Hello"))
-	assert.Equal(t, 11, store.Append("mykey", " World"))
-	assert.Equal(t, "Hello World", store.Get("mykey"))
+func RENAME(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.NoError(t, store.Rename("mykey", "myotherkey"))
+	assert.Equal(t, "Hello", ok(store.Get("myotherkey")))
+}
+
+func RENAMENX(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.NoError(t, store.Set("myotherkey", "World"))
+	assert.Equal(t, false, ok(store.RenameIfNotExists("mykey", "myotherkey")))
+	assert.Equal(t, "World", ok(store.Get("myotherkey")))
+}
+
+func TTL(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, true, ok(store.Expire("mykey", 10)))
+	assert.Equal(t, 10, ok(store.TTL("mykey")))
+}
+
+func TYPE(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("key1", "value"))
+	ok(store.ListLeftPush("key2", "value"))
+	assert.NoError(t, store.SetAdd("key3", "value"))
+	assert.Equal(t, "string", ok(store.Type("key1")))
+	assert.Equal(t, "list", ok(store.Type("key2")))
+	assert.Equal(t, "set", ok(store.Type("key3")))
+}
+
+func APPEND(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.Equal(t, 0, ok(store.Exists("mykey")))
+	assert.Equal(t, 5, ok(store.Append("mykey", "Hello")))
+	assert.Equal(t, 11, ok(store.Append("mykey", " World")))
+	assert.Equal(t, "Hello World", ok(store.Get("mykey")))
 }
 
 func DECR(t *testing.T, store StringStore) {
-	store.Set("mykey", "10")
-	assert.Equal(t, 9, store.Decrement("mykey"))
-	store.Set("mykey", "234293482390480948029348230948")
-	assert.Equal(t, -1, store.Decrement("mykey")) // DEVIATION: Redis throws an error instead.
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "10"))
+	assert.Equal(t, 9, ok(store.Decrement("mykey")))
+	assert.NoError(t, store.Set("mykey", "234293482390480948029348230948"))
+	assert.Equal(t, ErrNotInteger, failure(store.Decrement("mykey")))
 }
 
 func DECRBY(t *testing.T, store StringStore) {
-	store.Set("mykey", "10")
-	assert.Equal(t, 7, store.DecrementBy("mykey", 3))
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "10"))
+	assert.Equal(t, 7, ok(store.DecrementBy("mykey", 3)))
 }
 
 func GET(t *testing.T, store StringStore) {
-	assert.Equal(t, "", store.Get("nonexisting"))
-	store.Set("mykey", "Hello")
-	assert.Equal(t, "Hello", store.Get("mykey"))
+	ok := noError(t)
+	assert.Equal(t, "", ok(store.Get("nonexisting")))
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, "Hello", ok(store.Get("mykey")))
 }
 
 func GETRANGE(t *testing.T, store StringStore) {
-	store.Set("mykey", "This is a string")
-	assert.Equal(t, "This", store.GetRange("mykey", 0, 3))
-	assert.Equal(t, "ing", store.GetRange("mykey", -3, -1))
-	assert.Equal(t, "This is a string", store.GetRange("mykey", 0, -1))
-	assert.Equal(t, "string", store.GetRange("mykey", 10, 100))
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "This is a string"))
+	assert.Equal(t, "This", ok(store.GetRange("mykey", 0, 3)))
+	assert.Equal(t, "ing", ok(store.GetRange("mykey", -3, -1)))
+	assert.Equal(t, "This is a string", ok(store.GetRange("mykey", 0, -1)))
+	assert.Equal(t, "string", ok(store.GetRange("mykey", 10, 100)))
 }
 
 func GETSET(t *testing.T, store StringStore) {
-	assert.Equal(t, 1, store.Increment("mycounter"))
-	assert.Equal(t, "1", store.GetSet("mycounter", "0"))
-	assert.Equal(t, "0", store.Get("mycounter"))
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.Increment("mycounter")))
+	assert.Equal(t, "1", ok(store.GetSet("mycounter", "0")))
+	assert.Equal(t, "0", ok(store.Get("mycounter")))
 
-	store.Set("mykey", "Hello")
-	assert.Equal(t, "Hello", store.GetSet("mykey", "World"))
-	assert.Equal(t, "World", store.Get("mykey"))
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, "Hello", ok(store.GetSet("mykey", "World")))
+	assert.Equal(t, "World", ok(store.Get("mykey")))
 }
 
 func INCR(t *testing.T, store StringStore) {
-	store.Set("mykey", "10")
-	assert.Equal(t, 11, store.Increment("mykey"))
-	assert.Equal(t, "11", store.Get("mykey"))
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "10"))
+	assert.Equal(t, 11, ok(store.Increment("mykey")))
+	assert.Equal(t, "11", ok(store.Get("mykey")))
 }
 
 func INCRBY(t *testing.T, store StringStore) {
-	store.Set("mykey", "10")
-	assert.Equal(t, 15, store.IncrementBy("mykey", 5))
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "10"))
+	assert.Equal(t, 15, ok(store.IncrementBy("mykey", 5)))
+}
+
+func INCRBYFLOAT(t *testing.T, store StringStore) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "10.50"))
+	assert.Equal(t, "10.6", ok(store.IncrementByFloat("mykey", 0.1)))
+	assert.Equal(t, "5.6", ok(store.IncrementByFloat("mykey", -5)))
+	assert.NoError(t, store.Set("mykey", "5.0e3"))
+	assert.Equal(t, "5200", ok(store.IncrementByFloat("mykey", 2.0e2)))
 }
 
 func MGET(t *testing.T, store StringStore) {
-	store.Set("key1", "Hello")
-	store.Set("key2", "World")
-	assert.Equal(t, map[string]string{"key1": "Hello", "key2": "World"}, store.MultiGet([]string{"key1", "key2", "nonexisting"}))
+	ok := noError(t)
+	assert.NoError(t, store.Set("key1", "Hello"))
+	assert.NoError(t, store.Set("key2", "World"))
+	assert.Equal(t, map[string]string{"key1": "Hello", "key2": "World"}, ok(store.MultiGet([]string{"key1", "key2", "nonexisting"})))
 }
 
 func MSET(t *testing.T, store StringStore) {
-	store.MultiSet(map[string]string{"key1": "Hello", "key2": "World"})
-	assert.Equal(t, "Hello", store.Get("key1"))
-	assert.Equal(t, "World", store.Get("key2"))
+	ok := noError(t)
+	assert.NoError(t, store.MultiSet(map[string]string{"key1": "Hello", "key2": "World"}))
+	assert.Equal(t, "Hello", ok(store.Get("key1")))
+	assert.Equal(t, "World", ok(store.Get("key2")))
 }
 
 func MSETNX(t *testing.T, store StringStore) {
-	assert.True(t, store.MultiSetIfNotExists(map[string]string{"key1": "Hello", "key2": "there"}))
-	assert.False(t, store.MultiSetIfNotExists(map[string]string{"key2": "there", "key3": "world"}))
-	assert.Equal(t, map[string]string{"key1": "Hello", "key2": "there"}, store.MultiGet([]string{"key1", "key2", "key3"}))
+	ok := noError(t)
+	assert.Equal(t, true, ok(store.MultiSetIfNotExists(map[string]string{"key1": "Hello", "key2": "there"})))
+	assert.Equal(t, false, ok(store.MultiSetIfNotExists(map[string]string{"key2": "there", "key3": "world"})))
+	assert.Equal(t, map[string]string{"key1": "Hello", "key2": "there"}, ok(store.MultiGet([]string{"key1", "key2", "key3"})))
 }
 
-func SET(t *testing.T, store StringStore) {
-	store.Set("mykey", "Hello")
-	assert.Equal(t, "Hello", store.Get("mykey"))
+func SET(t *testing.T, store Store) {
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello"))
+	assert.Equal(t, "Hello", ok(store.Get("mykey")))
+	assert.Equal(t, true, ok(store.SetWithOptions("anotherkey", "will expire in a minute", SetOptions{ExpireSeconds: 60})))
+	assert.Equal(t, 60, ok(store.TTL("anotherkey")))
 }
 
 func SETNX(t *testing.T, store StringStore) {
-	assert.True(t, store.SetIfNotExists("mykey", "Hello"))
-	assert.False(t, store.SetIfNotExists("mykey", "World"))
-	assert.Equal(t, "Hello", store.Get("mykey"))
+	ok := noError(t)
+	assert.Equal(t, true, ok(store.SetIfNotExists("mykey", "Hello")))
+	assert.Equal(t, false, ok(store.SetIfNotExists("mykey", "World")))
+	assert.Equal(t, "Hello", ok(store.Get("mykey")))
 }
 
 func SETRANGE(t *testing.T, store StringStore) {
-	store.Set("key1", "Hello World")
-	assert.Equal(t, 11, store.SetRange("key1", 6, "Redis"))
-	assert.Equal(t, "Hello Redis", store.Get("key1"))
+	ok := noError(t)
+	assert.NoError(t, store.Set("key1", "Hello World"))
+	assert.Equal(t, 11, ok(store.SetRange("key1", 6, "Redis")))
+	assert.Equal(t, "Hello Redis", ok(store.Get("key1")))
 
-	assert.Equal(t, 11, store.SetRange("key2", 6, "Redis"))
-	assert.Equal(t, "      Redis", store.Get("key2"))
+	assert.Equal(t, 11, ok(store.SetRange("key2", 6, "Redis")))
+	assert.Equal(t, "      Redis", ok(store.Get("key2")))
 }
 
 func STRLEN(t *testing.T, store StringStore) {
-	store.Set("mykey", "Hello world")
-	assert.Equal(t, 11, store.Length("mykey"))
-	assert.Equal(t, 0, store.Length("nonexisting"))
+	ok := noError(t)
+	assert.NoError(t, store.Set("mykey", "Hello world"))
+	assert.Equal(t, 11, ok(store.Length("mykey")))
+	assert.Equal(t, 0, ok(store.Length("nonexisting")))
+}
+
+func addKeyOneAndTwo(t *testing.T, store SetStore) {
+	assert.NoError(t, store.SetAdd("key1", "a", "b", "c"))
+	assert.NoError(t, store.SetAdd("key2", "c", "d", "e"))
+}
+
+func SDIFF(t *testing.T, store SetStore) {
+	ok := noError(t)
+	addKeyOneAndTwo(t, store)
+	assert.ElementsMatch(t, []string{"a", "b"}, ok(store.SetDifference("key1", "key2")))
+}
+
+func SDIFFSTORE(t *testing.T, store SetStore) {
+	ok := noError(t)
+	addKeyOneAndTwo(t, store)
+	assert.Equal(t, 2, ok(store.SetDifferenceStore("key", "key1", "key2")))
+	assert.ElementsMatch(t, []string{"a", "b"}, ok(store.SetMembers("key")))
+}
+
+func SINTER(t *testing.T, store SetStore) {
+	ok := noError(t)
+	addKeyOneAndTwo(t, store)
+	assert.ElementsMatch(t, []string{"c"}, ok(store.SetIntersect("key1", "key2")))
+}
+
+func SINTERCARD(t *testing.T, store SetStore) {
+	ok := noError(t)
+	assert.NoError(t, store.SetAdd("key1", "a", "b", "c", "d"))
+	assert.NoError(t, store.SetAdd("key2", "c", "d", "e"))
+	assert.Equal(t, 2, ok(store.SetIntersectCardinality(0, "key1", "key2")))
+	assert.Equal(t, 1, ok(store.SetIntersectCardinality(1, "key1", "key2")))
+}
+
+func SINTERSTORE(t *testing.T, store SetStore) {
+	ok := noError(t)
+	addKeyOneAndTwo(t, store)
+	assert.Equal(t, 1, ok(store.SetIntersectStore("key", "key1", "key2")))
+	assert.ElementsMatch(t, []string{"c"}, ok(store.SetMembers("key")))
+}
+
+func SMISMEMBER(t *testing.T, store SetStore) {
+	ok := noError(t)
+	assert.NoError(t, store.SetAdd("myset", "one"))
+	assert.Equal(t, []bool{true, false}, ok(store.SetMultiIsMember("myset", "one", "notamember")))
+}
+
+func SMOVE(t *testing.T, store SetStore) {
+	ok := noError(t)
+	assert.NoError(t, store.SetAdd("myset", "one", "two"))
+	assert.NoError(t, store.SetAdd("myotherset", "three"))
+	assert.Equal(t, true, ok(store.SetMove("myset", "myotherset", "two")))
+	assert.ElementsMatch(t, []string{"one"}, ok(store.SetMembers("myset")))
+	assert.ElementsMatch(t, []string{"three", "two"}, ok(store.SetMembers("myotherset")))
+}
+
+func SPOP(t *testing.T, store SetStore) {
+	ok := noError(t)
+	assert.NoError(t, store.SetAdd("myset", "one", "two", "three"))
+	assert.Len(t, ok(store.SetPop("myset", 1)), 1)
+	assert.Equal(t, 2, ok(store.SetCardinality("myset")))
+	assert.NoError(t, store.SetAdd("myset", "four", "five"))
+	assert.Len(t, ok(store.SetPop("myset", 3)), 3)
+	assert.Equal(t, 1, ok(store.SetCardinality("myset")))
+}
+
+func SRANDMEMBER(t *testing.T, store SetStore) {
+	ok := noError(t)
+	assert.NoError(t, store.SetAdd("myset", "one", "two", "three"))
+	assert.Subset(t, []string{"one", "two", "three"}, ok(store.SetRandomMember("myset", 1)))
+	assert.Len(t, ok(store.SetRandomMember("myset", 2)), 2)
+	assert.Len(t, ok(store.SetRandomMember("myset", -5)), 5)
+}
+
+func SUNION(t *testing.T, store SetStore) {
+	ok := noError(t)
+	addKeyOneAndTwo(t, store)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e"}, ok(store.SetUnion("key1", "key2")))
+}
+
+func SUNIONSTORE(t *testing.T, store SetStore) {
+	ok := noError(t)
+	addKeyOneAndTwo(t, store)
+	assert.Equal(t, 5, ok(store.SetUnionStore("key", "key1", "key2")))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e"}, ok(store.SetMembers("key")))
+}
+
+func HDEL(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashSet("myhash", "field1", "foo"))
+	assert.Equal(t, 1, ok(store.HashDelete("myhash", "field1")))
+	assert.Equal(t, 0, ok(store.HashDelete("myhash", "field2")))
+}
+
+func HEXPIRE(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.Equal(t, []int64{-2, -2}, ok(store.HashExpire("no-key", 20, HashExpireOptions{IfNotExists: true}, "field1", "field2")))
+	assert.NoError(t, store.HashMultiSet("mykey", map[string]string{"field1": "hello", "field2": "world"}))
+	assert.Equal(t, []int64{1, 1, -2}, ok(store.HashExpire("mykey", 10, HashExpireOptions{}, "field1", "field2", "field3")))
+	assert.Equal(t, map[string]string{"field1": "hello", "field2": "world"}, ok(store.HashGetAll("mykey")))
+}
+
+func HGETALL(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("myhash", map[string]string{"field1": "Hello", "field2": "World"}))
+	assert.Equal(t, map[string]string{"field1": "Hello", "field2": "World"}, ok(store.HashGetAll("myhash")))
+}
+
+func HGETEX(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("mykey", map[string]string{"field1": "Hello", "field2": "World"}))
+	assert.Equal(t, map[string]string{"field1": "Hello"}, ok(store.HashGetWithOptions("mykey", HashFieldOptions{ExpireSeconds: 120}, "field1")))
+	assert.Equal(t, []int64{120, -1}, ok(store.HashTTL("mykey", "field1", "field2")))
+	assert.Equal(t, map[string]string{"field1": "Hello"}, ok(store.HashGetWithOptions("mykey", HashFieldOptions{Persist: true}, "field1")))
+	assert.Equal(t, []int64{-1, -1}, ok(store.HashTTL("mykey", "field1", "field2")))
+}
+
+func HINCRBY(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashSet("myhash", "field", "5"))
+	assert.Equal(t, 6, ok(store.HashIncrementBy("myhash", "field", 1)))
+	assert.Equal(t, 5, ok(store.HashIncrementBy("myhash", "field", -1)))
+	assert.Equal(t, -5, ok(store.HashIncrementBy("myhash", "field", -10)))
+}
+
+func HINCRBYFLOAT(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashSet("mykey", "field", "10.50"))
+	assert.Equal(t, "10.6", ok(store.HashIncrementByFloat("mykey", "field", 0.1)))
+	assert.Equal(t, "5.6", ok(store.HashIncrementByFloat("mykey", "field", -5)))
+	assert.NoError(t, store.HashSet("mykey", "field", "5.0e3"))
+	assert.Equal(t, "5200", ok(store.HashIncrementByFloat("mykey", "field", 2.0e2)))
+}
+
+func HPERSIST(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("mykey", map[string]string{"field1": "hello", "field2": "world"}))
+	assert.Equal(t, []int64{1, 1}, ok(store.HashExpire("mykey", 300, HashExpireOptions{}, "field1", "field2")))
+	assert.Equal(t, []int64{300, 300}, ok(store.HashTTL("mykey", "field1", "field2")))
+	assert.Equal(t, []int64{1}, ok(store.HashPersist("mykey", "field2")))
+	assert.Equal(t, []int64{300, -1}, ok(store.HashTTL("mykey", "field1", "field2")))
+}
+
+func HRANDFIELD(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("coin", map[string]string{"heads": "obverse", "tails": "reverse", "edge": ""}))
+	assert.Subset(t, []string{"heads", "tails", "edge"}, ok(store.HashRandomField("coin", 1)))
+	fields := ok(store.HashRandomFieldWithValues("coin", -5)).([]HashField)
+	assert.Len(t, fields, 5)
+	for _, field := range fields {
+		assert.Equal(t, map[string]string{"heads": "obverse", "tails": "reverse", "edge": ""}[field.Field], field.Value)
+	}
+}
+
+func HSETEX(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.Equal(t, true, ok(store.HashSetWithOptions("mykey", map[string]string{"field1": "Hello", "field2": "World"}, HashFieldOptions{ExpireSeconds: 120})))
+	assert.Equal(t, []int64{120, 120}, ok(store.HashTTL("mykey", "field1", "field2")))
+	assert.Equal(t, true, ok(store.HashSetWithOptions("mykey", map[string]string{"field1": "hello", "field2": "world"}, HashFieldOptions{IfExists: true, KeepTTL: true})))
+	assert.Equal(t, []int64{120, 120}, ok(store.HashTTL("mykey", "field1", "field2")))
+	assert.Equal(t, map[string]string{"field1": "hello", "field2": "world"}, ok(store.HashGetAll("mykey")))
+}
+
+func HSTRLEN(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.NoError(t, store.HashMultiSet("myhash", map[string]string{"f1": "HelloWorld", "f2": "99", "f3": "-256"}))
+	assert.Equal(t, 10, ok(store.HashStringLength("myhash", "f1")))
+	assert.Equal(t, 2, ok(store.HashStringLength("myhash", "f2")))
+	assert.Equal(t, 4, ok(store.HashStringLength("myhash", "f3")))
+}
+
+func HTTL(t *testing.T, store HashStore) {
+	ok := noError(t)
+	assert.Equal(t, []int64{-2, -2, -2}, ok(store.HashTTL("no-key", "field1", "field2", "field3")))
+	assert.NoError(t, store.HashMultiSet("mykey", map[string]string{"field1": "hello", "field2": "world"}))
+	assert.Equal(t, []int64{1, -2}, ok(store.HashExpire("mykey", 300, HashExpireOptions{}, "field1", "field3")))
+	assert.Equal(t, []int64{300, -1, -2}, ok(store.HashTTL("mykey", "field1", "field2", "field3")))
+}
+
+func LINSERT(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 2, ok(store.ListRightPush("mylist", "Hello", "World")))
+	assert.Equal(t, 3, ok(store.ListInsertBefore("mylist", "World", "There")))
+	assert.Equal(t, []string{"Hello", "There", "World"}, ok(store.ListRange("mylist", 0, -1)))
+}
+
+func LMOVE(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 3, ok(store.ListRightPush("mylist", "one", "two", "three")))
+	assert.Equal(t, "one", ok(store.ListMove("mylist", "myotherlist", ListLeft, ListRight)))
+	assert.Equal(t, "three", ok(store.ListMove("mylist", "myotherlist", ListRight, ListLeft)))
+	assert.Equal(t, []string{"two"}, ok(store.ListRange("mylist", 0, -1)))
+	assert.Equal(t, []string{"three", "one"}, ok(store.ListRange("myotherlist", 0, -1)))
+}
+
+func LMPOP(t *testing.T, store ListStore) {
+	ok := noError(t)
+	_, _, err := store.ListMultiPop(ListLeft, 10, "non1", "non2")
+	assert.Equal(t, ErrNoSuchKey, err)
+	assert.Equal(t, 5, ok(store.ListLeftPush("mylist", "one", "two", "three", "four", "five")))
+	key, items, err := store.ListMultiPop(ListLeft, 1, "mylist")
+	assert.NoError(t, err)
+	assert.Equal(t, "mylist", key)
+	assert.Equal(t, []string{"five"}, items)
+	assert.Equal(t, []string{"four", "three", "two", "one"}, ok(store.ListRange("mylist", 0, -1)))
+	key, items, err = store.ListMultiPop(ListRight, 10, "mylist")
+	assert.NoError(t, err)
+	assert.Equal(t, "mylist", key)
+	assert.Equal(t, []string{"one", "two", "three", "four"}, items)
+	assert.Equal(t, 5, ok(store.ListLeftPush("mylist", "one", "two", "three", "four", "five")))
+	assert.Equal(t, 5, ok(store.ListLeftPush("mylist2", "a", "b", "c", "d", "e")))
+	key, items, err = store.ListMultiPop(ListRight, 3, "mylist", "mylist2")
+	assert.NoError(t, err)
+	assert.Equal(t, "mylist", key)
+	assert.Equal(t, []string{"one", "two", "three"}, items)
+	assert.Equal(t, []string{"five", "four"}, ok(store.ListRange("mylist", 0, -1)))
+	key, items, err = store.ListMultiPop(ListRight, 5, "mylist", "mylist2")
+	assert.NoError(t, err)
+	assert.Equal(t, "mylist", key)
+	assert.Equal(t, []string{"four", "five"}, items)
+	key, items, err = store.ListMultiPop(ListRight, 10, "mylist", "mylist2")
+	assert.NoError(t, err)
+	assert.Equal(t, "mylist2", key)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, items)
+}
+
+func LPOP(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 5, ok(store.ListRightPush("mylist", "one", "two", "three", "four", "five")))
+	assert.Equal(t, "one", ok(store.ListLeftPop("mylist")))
+	assert.Equal(t, []string{"two", "three"}, ok(store.ListLeftPopCount("mylist", 2)))
+	assert.Equal(t, []string{"four", "five"}, ok(store.ListRange("mylist", 0, -1)))
+}
+
+func LPOS(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 11, ok(store.ListRightPush("mylist", "a", "b", "c", "d", "1", "2", "3", "4", "3", "3", "3")))
+	assert.Equal(t, []int64{6}, ok(store.ListPosition("mylist", "3", ListPositionOptions{Count: 1})))
+	assert.Equal(t, []int64{8, 9, 10}, ok(store.ListPosition("mylist", "3", ListPositionOptions{Count: 0, Rank: 2})))
+}
+
+func LPUSHX(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.ListLeftPush("mylist", "World")))
+	assert.Equal(t, 2, ok(store.ListLeftPushIfExists("mylist", "Hello")))
+	assert.Equal(t, 0, ok(store.ListLeftPushIfExists("myotherlist", "Hello")))
+	assert.Equal(t, []string{"Hello", "World"}, ok(store.ListRange("mylist", 0, -1)))
+	assert.Equal(t, []string{}, ok(store.ListRange("myotherlist", 0, -1)))
+}
+
+func LREM(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 4, ok(store.ListRightPush("mylist", "hello", "hello", "foo", "hello")))
+	assert.Equal(t, 2, ok(store.ListRemove("mylist", -2, "hello")))
+	assert.Equal(t, []string{"hello", "foo"}, ok(store.ListRange("mylist", 0, -1)))
+}
+
+func RPOP(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 5, ok(store.ListRightPush("mylist", "one", "two", "three", "four", "five")))
+	assert.Equal(t, "five", ok(store.ListRightPop("mylist")))
+	assert.Equal(t, []string{"four", "three"}, ok(store.ListRightPopCount("mylist", 2)))
+	assert.Equal(t, []string{"one", "two"}, ok(store.ListRange("mylist", 0, -1)))
+}
+
+func RPOPLPUSH(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 3, ok(store.ListRightPush("mylist", "one", "two", "three")))
+	assert.Equal(t, "three", ok(store.ListMove("mylist", "myotherlist", ListRight, ListLeft)))
+	assert.Equal(t, []string{"one", "two"}, ok(store.ListRange("mylist", 0, -1)))
+	assert.Equal(t, []string{"three"}, ok(store.ListRange("myotherlist", 0, -1)))
+}
+
+func RPUSHX(t *testing.T, store ListStore) {
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.ListRightPush("mylist", "Hello")))
+	assert.Equal(t, 2, ok(store.ListRightPushIfExists("mylist", "World")))
+	assert.Equal(t, 0, ok(store.ListRightPushIfExists("myotherlist", "World")))
+	assert.Equal(t, []string{"Hello", "World"}, ok(store.ListRange("mylist", 0, -1)))
+	assert.Equal(t, []string{}, ok(store.ListRange("myotherlist", 0, -1)))
+}
+
+func addOneTwoThree(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	assert.Equal(t, 3, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"one", 1}, ScoredMember{"two", 2}, ScoredMember{"three", 3})))
+}
+
+func everything() SortedSetRange {
+	return SortedSetRange{Start: "0", Stop: "-1"}
+}
+
+func ZADD(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"one", 1})))
+	assert.Equal(t, 1, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"uno", 1})))
+	assert.Equal(t, 2, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"two", 2}, ScoredMember{"three", 3})))
+	assert.Equal(t, []ScoredMember{{"one", 1}, {"uno", 1}, {"two", 2}, {"three", 3}}, ok(store.SortedSetRange("myzset", everything())))
+}
+
+func ZCARD(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"one", 1})))
+	assert.Equal(t, 1, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"two", 2})))
+	assert.Equal(t, 2, ok(store.SortedSetCardinality("myzset")))
+}
+
+func ZCOUNT(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	addOneTwoThree(t, store)
+	assert.Equal(t, 3, ok(store.SortedSetCount("myzset", "-inf", "+inf")))
+	assert.Equal(t, 2, ok(store.SortedSetCount("myzset", "(1", "3")))
+}
+
+func ZINCRBY(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	assert.Equal(t, 2, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"one", 1}, ScoredMember{"two", 2})))
+	assert.Equal(t, 3.0, ok(store.SortedSetIncrementBy("myzset", "one", 2)))
+	assert.Equal(t, []ScoredMember{{"two", 2}, {"one", 3}}, ok(store.SortedSetRange("myzset", everything())))
+}
+
+func ZPOPMAX(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	addOneTwoThree(t, store)
+	assert.Equal(t, []ScoredMember{{"three", 3}}, ok(store.SortedSetPopMax("myzset", 1)))
+}
+
+func ZPOPMIN(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	addOneTwoThree(t, store)
+	assert.Equal(t, []ScoredMember{{"one", 1}}, ok(store.SortedSetPopMin("myzset", 1)))
+}
+
+func ZRANGE(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	addOneTwoThree(t, store)
+	assert.Equal(t, []ScoredMember{{"one", 1}, {"two", 2}, {"three", 3}}, ok(store.SortedSetRange("myzset", everything())))
+	assert.Equal(t, []ScoredMember{{"three", 3}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "2", Stop: "3"})))
+	assert.Equal(t, []ScoredMember{{"two", 2}, {"three", 3}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "-2", Stop: "-1"})))
+	assert.Equal(t, []ScoredMember{{"one", 1}, {"two", 2}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "0", Stop: "1"})))
+	assert.Equal(t, []ScoredMember{{"three", 3}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "(1", Stop: "+inf", ByScore: true, Limit: &RangeLimit{1, 1}})))
+}
+
+func ZRANGEBYLEX(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	members := []ScoredMember{}
+	for _, member := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		members = append(members, ScoredMember{member, 0})
+	}
+	assert.Equal(t, 7, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, members...)))
+	assert.Equal(t, members[:3], ok(store.SortedSetRange("myzset", SortedSetRange{Start: "-", Stop: "[c", ByLex: true})))
+	assert.Equal(t, members[:2], ok(store.SortedSetRange("myzset", SortedSetRange{Start: "-", Stop: "(c", ByLex: true})))
+	assert.Equal(t, members[1:6], ok(store.SortedSetRange("myzset", SortedSetRange{Start: "[aaa", Stop: "(g", ByLex: true})))
+}
+
+func ZRANGESTORE(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	assert.Equal(t, 4, ok(store.SortedSetAdd("srczset", SortedSetAddOptions{}, ScoredMember{"one", 1}, ScoredMember{"two", 2}, ScoredMember{"three", 3}, ScoredMember{"four", 4})))
+	assert.Equal(t, 2, ok(store.SortedSetRangeStore("dstzset", "srczset", SortedSetRange{Start: "2", Stop: "-1"})))
+	assert.Equal(t, []ScoredMember{{"three", 3}, {"four", 4}}, ok(store.SortedSetRange("dstzset", everything())))
+}
+
+func ZRANK(t *testing.T, store SortedSetStore) {
+	addOneTwoThree(t, store)
+	rank, found, err := store.SortedSetRank("myzset", "three")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 2, rank)
+	_, found, err = store.SortedSetRank("myzset", "four")
+	assert.NoError(t, err)
+	assert.Equal(t, false, found)
+}
+
+func ZREM(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	addOneTwoThree(t, store)
+	assert.Equal(t, 1, ok(store.SortedSetRemove("myzset", "two")))
+	assert.Equal(t, []ScoredMember{{"one", 1}, {"three", 3}}, ok(store.SortedSetRange("myzset", everything())))
+}
+
+func ZREVRANGEBYSCORE(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	addOneTwoThree(t, store)
+	assert.Equal(t, []ScoredMember{{"three", 3}, {"two", 2}, {"one", 1}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "+inf", Stop: "-inf", ByScore: true, Reverse: true})))
+	assert.Equal(t, []ScoredMember{{"two", 2}, {"one", 1}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "2", Stop: "1", ByScore: true, Reverse: true})))
+	assert.Equal(t, []ScoredMember{{"two", 2}}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "2", Stop: "(1", ByScore: true, Reverse: true})))
+	assert.Equal(t, []ScoredMember{}, ok(store.SortedSetRange("myzset", SortedSetRange{Start: "(2", Stop: "(1", ByScore: true, Reverse: true})))
+}
+
+func ZREVRANK(t *testing.T, store SortedSetStore) {
+	addOneTwoThree(t, store)
+	rank, found, err := store.SortedSetReverseRank("myzset", "one")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 2, rank)
+	_, found, err = store.SortedSetReverseRank("myzset", "four")
+	assert.NoError(t, err)
+	assert.Equal(t, false, found)
+}
+
+func ZSCORE(t *testing.T, store SortedSetStore) {
+	ok := noError(t)
+	assert.Equal(t, 1, ok(store.SortedSetAdd("myzset", SortedSetAddOptions{}, ScoredMember{"one", 1})))
+	score, found, err := store.SortedSetScore("myzset", "one")
+	assert.NoError(t, err)
+	assert.Equal(t, true, found)
+	assert.Equal(t, 1.0, score)
 }
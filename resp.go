@@ -0,0 +1,271 @@
+package restis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLength     = 512 << 20
+	maxMultiBulkCount = 1 << 20
+	maxInlineLength   = 64 << 10
+)
+
+// A respProtocolError means the client sent something that can't be parsed,
+// after which the connection can't be resynchronised and is closed.
+type respProtocolError string
+
+func (e respProtocolError) Error() string {
+	return "ERR Protocol error: " + string(e)
+}
+
+type respReader struct {
+	*bufio.Reader
+}
+
+// readCommand reads one command, either as a multi-bulk array of bulk
+// strings as sent by client libraries, or as an inline line of space
+// separated words as typed into telnet. Empty commands are skipped.
+func (r respReader) readCommand() ([]string, error) {
+	for {
+		prefix, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if prefix[0] == '*' {
+			args, err := r.readMultiBulk()
+			if err != nil || len(args) > 0 {
+				return args, err
+			}
+			continue
+		}
+		line, err := r.readLine(maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		if args := strings.Fields(line); len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+func (r respReader) readMultiBulk() ([]string, error) {
+	line, err := r.readLine(maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxMultiBulkCount {
+		return nil, respProtocolError("invalid multibulk length")
+	}
+	if count < 0 {
+		count = 0
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err := r.readLine(maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, respProtocolError(fmt.Sprintf("expected '$', got %q", line))
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, respProtocolError("invalid bulk length")
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, respProtocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(data[:length]))
+	}
+	return args, nil
+}
+
+func (r respReader) readLine(limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", respProtocolError("too big inline request")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	return string(line), nil
+}
+
+// A respWriter encodes replies for the protocol version the client chose
+// with HELLO. RESP3 types fall back to their RESP2 equivalents: maps become
+// flat arrays, doubles become bulk strings and nulls become null bulks.
+type respWriter struct {
+	*bufio.Writer
+	protocol int
+	// lastError is the last error replied with, which scripts raise.
+	lastError error
+}
+
+func (w *respWriter) writeSimple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) writeOK() {
+	w.writeSimple("OK")
+}
+
+func (w *respWriter) writeError(err error) {
+	w.lastError = err
+	message := err.Error()
+	if !startsWithErrorCode(message) {
+		message = "ERR " + message
+	}
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(message) + "\r\n")
+}
+
+// startsWithErrorCode reports whether a message already begins with an
+// upper case error code like ERR or WRONGTYPE.
+func startsWithErrorCode(message string) bool {
+	code := strings.SplitN(message, " ", 2)[0]
+	return code != "" && strings.ToUpper(code) == code && strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
+
+func (w *respWriter) writeInteger(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) writeBool(b bool) {
+	if b {
+		w.writeInteger(1)
+	} else {
+		w.writeInteger(0)
+	}
+}
+
+func (w *respWriter) writeBulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *respWriter) writeNull() {
+	if w.protocol == 3 {
+		w.WriteString("_\r\n")
+	} else {
+		w.WriteString("$-1\r\n")
+	}
+}
+
+func (w *respWriter) writeNullArray() {
+	if w.protocol == 3 {
+		w.WriteString("_\r\n")
+	} else {
+		w.WriteString("*-1\r\n")
+	}
+}
+
+func (w *respWriter) writeArrayHeader(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *respWriter) writeMapHeader(n int) {
+	if w.protocol == 3 {
+		w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		w.writeArrayHeader(n * 2)
+	}
+}
+
+func (w *respWriter) writeSetHeader(n int) {
+	if w.protocol == 3 {
+		w.WriteString("~" + strconv.Itoa(n) + "\r\n")
+	} else {
+		w.writeArrayHeader(n)
+	}
+}
+
+// writePushHeader starts an out of band push, which RESP2 sends as an
+// ordinary array.
+func (w *respWriter) writePushHeader(n int) {
+	if w.protocol == 3 {
+		w.WriteString(">" + strconv.Itoa(n) + "\r\n")
+	} else {
+		w.writeArrayHeader(n)
+	}
+}
+
+func (w *respWriter) writeMessage(m Message) {
+	if m.Pattern != "" {
+		w.writePushHeader(4)
+		w.writeBulk("pmessage")
+		w.writeBulk(m.Pattern)
+	} else {
+		w.writePushHeader(3)
+		w.writeBulk("message")
+	}
+	w.writeBulk(m.Channel)
+	w.writeBulk(m.Payload)
+}
+
+func (w *respWriter) writeDouble(f float64) {
+	if w.protocol == 3 {
+		w.WriteString("," + formatScore(f) + "\r\n")
+	} else {
+		w.writeBulk(formatScore(f))
+	}
+}
+
+func (w *respWriter) writeBulks(values []string) {
+	w.writeArrayHeader(len(values))
+	for _, value := range values {
+		w.writeBulk(value)
+	}
+}
+
+// writeScoredMembers writes members alone, or with their scores as a flat
+// array in RESP2 and as member and score pairs in RESP3.
+func (w *respWriter) writeScoredMembers(members []ScoredMember, withScores bool) {
+	if !withScores {
+		w.writeArrayHeader(len(members))
+		for _, m := range members {
+			w.writeBulk(m.Member)
+		}
+		return
+	}
+	if w.protocol == 3 {
+		w.writeArrayHeader(len(members))
+		for _, m := range members {
+			w.writeArrayHeader(2)
+			w.writeBulk(m.Member)
+			w.writeDouble(m.Score)
+		}
+		return
+	}
+	w.writeArrayHeader(len(members) * 2)
+	for _, m := range members {
+		w.writeBulk(m.Member)
+		w.writeDouble(m.Score)
+	}
+}
+
+// formatScore formats a float the way Redis replies with scores: the
+// shortest representation that round trips, and inf or -inf.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
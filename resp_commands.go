@@ -0,0 +1,1990 @@
+package restis
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A respCommand runs a command against the connection's store and writes
+// exactly one reply, or one per channel for the subscribe commands. Arity
+// counts the command name, as in Redis: a positive arity is exact and a
+// negative one is a minimum.
+type respCommand struct {
+	arity int
+	run   func(c *respConn, args []string)
+}
+
+var respCommands map[string]respCommand
+
+func init() {
+	respCommands = map[string]respCommand{
+		"auth":    {-2, respAuth},
+		"client":  {-2, respClient},
+		"command": {-1, respCommandInfo},
+		"config":  {-2, respConfig},
+		"echo":    {2, func(c *respConn, args []string) { c.writer.writeBulk(args[0]) }},
+		"hello":   {-1, respHello},
+		"ping":    {-1, respPing},
+		"quit":    {1, respQuit},
+		"select":  {2, respSelect},
+
+		"psubscribe":   {-2, respSubscribe((*Subscription).PSubscribe, "psubscribe")},
+		"publish":      {3, respPublish},
+		"pubsub":       {-2, respPubSub},
+		"punsubscribe": {-1, respUnsubscribe((*Subscription).PUnsubscribe, (*Subscription).Patterns, "punsubscribe")},
+		"subscribe":    {-2, respSubscribe((*Subscription).Subscribe, "subscribe")},
+		"unsubscribe":  {-1, respUnsubscribe((*Subscription).Unsubscribe, (*Subscription).Channels, "unsubscribe")},
+
+		"discard": {1, respDiscard},
+		"exec":    {1, respExec},
+		"multi":   {1, respMulti},
+		"unwatch": {1, respUnwatch},
+		"watch":   {-2, respWatch},
+
+		"eval":    {-3, respEval((*Scripts).Eval)},
+		"evalsha": {-3, respEval((*Scripts).EvalSHA)},
+		"script":  {-2, respScript},
+
+		"bgrewriteaof": {1, respBackgroundRewrite},
+		"bgsave":       {-1, respBackgroundSave},
+		"lastsave":     {1, respLastSave},
+		"save":         {1, respSave},
+
+		"copy":      {-3, respCopy},
+		"del":       {-2, respDelete},
+		"exists":    {-2, func(c *respConn, args []string) { c.replyInteger(c.store.Exists(args...)) }},
+		"expire":    {3, respExpire(KeyStore.Expire)},
+		"expireat":  {3, respExpire(KeyStore.ExpireAt)},
+		"keys":      {2, func(c *respConn, args []string) { c.replyBulks(c.store.Keys(args[0])) }},
+		"persist":   {2, func(c *respConn, args []string) { c.replyBool(c.store.Persist(args[0])) }},
+		"pexpire":   {3, respExpire(KeyStore.PExpire)},
+		"pexpireat": {3, respExpire(KeyStore.PExpireAt)},
+		"pttl":      {2, func(c *respConn, args []string) { c.replyInteger(c.store.PTTL(args[0])) }},
+		"randomkey": {1, respRandomKey},
+		"rename":    {3, func(c *respConn, args []string) { c.replyOK(c.store.Rename(args[0], args[1])) }},
+		"renamenx":  {3, func(c *respConn, args []string) { c.replyBool(c.store.RenameIfNotExists(args[0], args[1])) }},
+		"scan":      {-2, respScan},
+		"ttl":       {2, func(c *respConn, args []string) { c.replyInteger(c.store.TTL(args[0])) }},
+		"type":      {2, respType},
+		"unlink":    {-2, respDelete},
+
+		"append":      {3, func(c *respConn, args []string) { c.replyInteger(c.store.Append(args[0], args[1])) }},
+		"decr":        {2, func(c *respConn, args []string) { c.replyInteger(c.store.Decrement(args[0])) }},
+		"decrby":      {3, respIncrementBy(-1)},
+		"get":         {2, respGet},
+		"getrange":    {4, respGetRange},
+		"getset":      {3, respGetSet},
+		"incr":        {2, func(c *respConn, args []string) { c.replyInteger(c.store.Increment(args[0])) }},
+		"incrby":      {3, respIncrementBy(1)},
+		"incrbyfloat": {3, respIncrementByFloat},
+		"mget":        {-2, respMultiGet},
+		"mset":        {-3, respMultiSet},
+		"msetnx":      {-3, respMultiSetIfNotExists},
+		"psetex":      {4, respSetWithExpiry("psetex", 1)},
+		"set":         {-3, respSet},
+		"setex":       {4, respSetWithExpiry("setex", 1000)},
+		"setnx":       {3, func(c *respConn, args []string) { c.replyBool(c.store.SetIfNotExists(args[0], args[1])) }},
+		"setrange":    {4, respSetRange},
+		"strlen":      {2, func(c *respConn, args []string) { c.replyInteger(c.store.Length(args[0])) }},
+		"substr":      {4, respGetRange},
+
+		"sadd":        {-3, respSetAdd},
+		"scard":       {2, func(c *respConn, args []string) { c.replyInteger(c.store.SetCardinality(args[0])) }},
+		"sdiff":       {-2, func(c *respConn, args []string) { c.replySet(c.store.SetDifference(args...)) }},
+		"sdiffstore":  {-3, func(c *respConn, args []string) { c.replyInteger(c.store.SetDifferenceStore(args[0], args[1:]...)) }},
+		"sinter":      {-2, func(c *respConn, args []string) { c.replySet(c.store.SetIntersect(args...)) }},
+		"sintercard":  {-3, respSetIntersectCardinality},
+		"sinterstore": {-3, func(c *respConn, args []string) { c.replyInteger(c.store.SetIntersectStore(args[0], args[1:]...)) }},
+		"sismember":   {3, func(c *respConn, args []string) { c.replyBool(c.store.SetIsMember(args[0], args[1])) }},
+		"smembers":    {2, func(c *respConn, args []string) { c.replySet(c.store.SetMembers(args[0])) }},
+		"smismember":  {-3, respSetMultiIsMember},
+		"smove":       {4, func(c *respConn, args []string) { c.replyBool(c.store.SetMove(args[0], args[1], args[2])) }},
+		"spop":        {-2, respSetPop},
+		"srandmember": {-2, respSetRandomMember},
+		"srem":        {-3, respSetRemove},
+		"sscan":       {-3, respSetScan},
+		"sunion":      {-2, func(c *respConn, args []string) { c.replySet(c.store.SetUnion(args...)) }},
+		"sunionstore": {-3, func(c *respConn, args []string) { c.replyInteger(c.store.SetUnionStore(args[0], args[1:]...)) }},
+
+		"hdel":         {-3, func(c *respConn, args []string) { c.replyInteger(c.store.HashDelete(args[0], args[1:]...)) }},
+		"hexists":      {3, func(c *respConn, args []string) { c.replyBool(c.store.HashExists(args[0], args[1])) }},
+		"hexpire":      {-6, respHashExpire(HashStore.HashExpire)},
+		"hexpireat":    {-6, respHashExpire(HashStore.HashExpireAt)},
+		"hget":         {3, respHashGet},
+		"hgetall":      {2, respHashGetAll},
+		"hgetex":       {-5, respHashGetWithOptions},
+		"hincrby":      {4, respHashIncrementBy},
+		"hincrbyfloat": {4, respHashIncrementByFloat},
+		"hkeys":        {2, func(c *respConn, args []string) { c.replyBulks(c.store.HashKeys(args[0])) }},
+		"hlen":         {2, func(c *respConn, args []string) { c.replyInteger(c.store.HashLength(args[0])) }},
+		"hmget":        {-3, respHashMultiGet},
+		"hmset":        {-4, respHashMultiSet},
+		"hpersist":     {-5, respHashFields(HashStore.HashPersist)},
+		"hpexpire":     {-6, respHashExpire(HashStore.HashPExpire)},
+		"hpexpireat":   {-6, respHashExpire(HashStore.HashPExpireAt)},
+		"hpttl":        {-5, respHashFields(HashStore.HashPTTL)},
+		"hrandfield":   {-2, respHashRandomField},
+		"hscan":        {-3, respHashScan},
+		"hset":         {-4, respHashSet},
+		"hsetex":       {-6, respHashSetWithOptions},
+		"hsetnx":       {4, func(c *respConn, args []string) { c.replyBool(c.store.HashSetIfNotExists(args[0], args[1], args[2])) }},
+		"hstrlen":      {3, func(c *respConn, args []string) { c.replyInteger(c.store.HashStringLength(args[0], args[1])) }},
+		"httl":         {-5, respHashFields(HashStore.HashTTL)},
+		"hvals":        {2, func(c *respConn, args []string) { c.replyBulks(c.store.HashValues(args[0])) }},
+
+		"blmove":     {6, respListBlockingMove},
+		"blpop":      {-3, respListBlockingPop(ListStore.ListBlockingLeftPop)},
+		"brpop":      {-3, respListBlockingPop(ListStore.ListBlockingRightPop)},
+		"brpoplpush": {4, respListBlockingRotate},
+		"lindex":     {3, respListIndex},
+		"linsert":    {5, respListInsert},
+		"llen":       {2, func(c *respConn, args []string) { c.replyInteger(c.store.ListLength(args[0])) }},
+		"lmove":      {5, respListMove},
+		"lmpop":      {-4, respListMultiPop},
+		"lpop":       {-2, respListPop(ListStore.ListLeftPop, ListStore.ListLeftPopCount)},
+		"lpos":       {-3, respListPosition},
+		"lpush":      {-3, func(c *respConn, args []string) { c.replyInteger(c.store.ListLeftPush(args[0], args[1:]...)) }},
+		"lpushx":     {-3, func(c *respConn, args []string) { c.replyInteger(c.store.ListLeftPushIfExists(args[0], args[1:]...)) }},
+		"lrange":     {4, respListRange},
+		"lrem":       {4, respListRemove},
+		"lset":       {4, respListSet},
+		"ltrim":      {4, respListTrim},
+		"rpop":       {-2, respListPop(ListStore.ListRightPop, ListStore.ListRightPopCount)},
+		"rpoplpush": {3, func(c *respConn, args []string) {
+			c.replyMoved(c.store.ListMove(args[0], args[1], ListRight, ListLeft))
+		}},
+		"rpush":  {-3, func(c *respConn, args []string) { c.replyInteger(c.store.ListRightPush(args[0], args[1:]...)) }},
+		"rpushx": {-3, func(c *respConn, args []string) { c.replyInteger(c.store.ListRightPushIfExists(args[0], args[1:]...)) }},
+
+		"zadd":             {-4, respSortedSetAdd},
+		"zcard":            {2, func(c *respConn, args []string) { c.replyInteger(c.store.SortedSetCardinality(args[0])) }},
+		"zcount":           {4, func(c *respConn, args []string) { c.replyInteger(c.store.SortedSetCount(args[0], args[1], args[2])) }},
+		"zincrby":          {4, respSortedSetIncrementBy},
+		"zpopmax":          {-2, respSortedSetPop(SortedSetStore.SortedSetPopMax)},
+		"zpopmin":          {-2, respSortedSetPop(SortedSetStore.SortedSetPopMin)},
+		"zrange":           {-4, respSortedSetRange(SortedSetRange{})},
+		"zrangebylex":      {-4, respSortedSetRange(SortedSetRange{ByLex: true})},
+		"zrangebyscore":    {-4, respSortedSetRange(SortedSetRange{ByScore: true})},
+		"zrangestore":      {-5, respSortedSetRangeStore},
+		"zrank":            {3, respSortedSetRank(SortedSetStore.SortedSetRank)},
+		"zrem":             {-3, func(c *respConn, args []string) { c.replyInteger(c.store.SortedSetRemove(args[0], args[1:]...)) }},
+		"zrevrange":        {-4, respSortedSetRange(SortedSetRange{Reverse: true})},
+		"zrevrangebylex":   {-4, respSortedSetRange(SortedSetRange{ByLex: true, Reverse: true})},
+		"zrevrangebyscore": {-4, respSortedSetRange(SortedSetRange{ByScore: true, Reverse: true})},
+		"zrevrank":         {3, respSortedSetRank(SortedSetStore.SortedSetReverseRank)},
+		"zscore":           {3, respSortedSetScore},
+	}
+}
+
+func (c *respConn) replyOK(err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeOK()
+}
+
+func (c *respConn) replyInteger(n int64, err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeInteger(n)
+}
+
+func (c *respConn) replyBool(b bool, err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeBool(b)
+}
+
+func (c *respConn) replyBulk(s string, err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeBulk(s)
+}
+
+func (c *respConn) replySet(members []string, err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeSetHeader(len(members))
+	for _, member := range members {
+		c.writer.writeBulk(member)
+	}
+}
+
+// replySingle replies with the only one of values, or null if there isn't
+// one.
+func (c *respConn) replySingle(values []string, err error) {
+	switch {
+	case err != nil:
+		c.writer.writeError(err)
+	case len(values) == 0:
+		c.writer.writeNull()
+	default:
+		c.writer.writeBulk(values[0])
+	}
+}
+
+func (c *respConn) replyBulks(values []string, err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeBulks(values)
+}
+
+func parseIntegerArg(arg string) (int64, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+func respAuth(c *respConn, args []string) {
+	c.writer.writeError(errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+}
+
+func respClient(c *respConn, args []string) {
+	switch strings.ToLower(args[0]) {
+	case "id":
+		c.writer.writeInteger(c.id)
+	case "getname":
+		if c.name == "" {
+			c.writer.writeNull()
+		} else {
+			c.writer.writeBulk(c.name)
+		}
+	case "setname":
+		if len(args) != 2 {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		c.name = args[1]
+		c.writer.writeOK()
+	case "setinfo":
+		c.writer.writeOK()
+	default:
+		c.writer.writeError(errors.New("ERR unknown subcommand '" + args[0] + "'. Try CLIENT HELP."))
+	}
+}
+
+// respConfig gets and sets notify-keyspace-events, the only setting restis
+// has.
+func respConfig(c *respConn, args []string) {
+	store, ok := c.store.(keyspaceEventsStore)
+	switch strings.ToLower(args[0]) {
+	case "get":
+		if len(args) < 2 {
+			break
+		}
+		matched := false
+		for _, pattern := range args[1:] {
+			matched = matched || matchGlob(strings.ToLower(pattern), "notify-keyspace-events")
+		}
+		if !ok || !matched {
+			c.writer.writeMapHeader(0)
+			return
+		}
+		c.writer.writeMapHeader(1)
+		c.writer.writeBulk("notify-keyspace-events")
+		c.writer.writeBulk(store.KeyspaceEvents().String())
+		return
+	case "set":
+		if len(args) != 3 || !ok || strings.ToLower(args[1]) != "notify-keyspace-events" {
+			name := ""
+			if len(args) > 1 {
+				name = args[1]
+			}
+			c.writer.writeError(errors.New("ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'"))
+			return
+		}
+		events, err := ParseKeyspaceEvents(args[2])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		store.SetKeyspaceEvents(events)
+		c.writer.writeOK()
+		return
+	default:
+		c.writer.writeError(errors.New("ERR unknown subcommand '" + args[0] + "'. Try CONFIG HELP."))
+		return
+	}
+	c.writer.writeError(errors.New("ERR wrong number of arguments for 'config|" + strings.ToLower(args[0]) + "' command"))
+}
+
+// respCommandInfo answers COMMAND COUNT and otherwise replies with no command
+// documentation, which redis-cli and client libraries tolerate.
+func respCommandInfo(c *respConn, args []string) {
+	if len(args) > 0 && strings.ToLower(args[0]) == "count" {
+		c.writer.writeInteger(int64(len(respCommands)))
+		return
+	}
+	c.writer.writeArrayHeader(0)
+}
+
+// respHello switches the protocol version and describes the server. AUTH is
+// accepted and ignored, since restis has no users.
+func respHello(c *respConn, args []string) {
+	protocol := c.writer.protocol
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			c.writer.writeError(errors.New("ERR Protocol version is not an integer or out of range"))
+			return
+		}
+		if version != 2 && version != 3 {
+			c.writer.writeError(errors.New("NOPROTO unsupported protocol version"))
+			return
+		}
+		protocol = version
+		for i := 1; i < len(args); i++ {
+			switch option := strings.ToLower(args[i]); {
+			case option == "auth" && i+2 < len(args):
+				i += 2
+			case option == "setname" && i+1 < len(args):
+				c.name = args[i+1]
+				i++
+			default:
+				c.writer.writeError(ErrSyntax)
+				return
+			}
+		}
+	}
+	c.writer.protocol = protocol
+	c.writer.writeMapHeader(7)
+	c.writer.writeBulk("server")
+	c.writer.writeBulk("restis")
+	c.writer.writeBulk("version")
+	c.writer.writeBulk("7.2.0")
+	c.writer.writeBulk("proto")
+	c.writer.writeInteger(int64(protocol))
+	c.writer.writeBulk("id")
+	c.writer.writeInteger(c.id)
+	c.writer.writeBulk("mode")
+	c.writer.writeBulk("standalone")
+	c.writer.writeBulk("role")
+	c.writer.writeBulk("master")
+	c.writer.writeBulk("modules")
+	c.writer.writeArrayHeader(0)
+}
+
+func respPing(c *respConn, args []string) {
+	if c.subscribed() && c.writer.protocol == 2 && len(args) < 2 {
+		c.writer.writeBulks([]string{"pong", strings.Join(args, "")})
+		return
+	}
+	switch len(args) {
+	case 0:
+		c.writer.writeSimple("PONG")
+	case 1:
+		c.writer.writeBulk(args[0])
+	default:
+		c.writer.writeError(errors.New("ERR wrong number of arguments for 'ping' command"))
+	}
+}
+
+func respQuit(c *respConn, args []string) {
+	c.quit = true
+	c.writer.writeOK()
+}
+
+func respSelect(c *respConn, args []string) {
+	if args[0] != "0" {
+		c.writer.writeError(errors.New("ERR DB index is out of range"))
+		return
+	}
+	c.writer.writeOK()
+}
+
+func (c *respConn) snapshots() (snapshotStore, bool) {
+	store, ok := c.store.(snapshotStore)
+	if !ok {
+		c.writer.writeError(ErrSnapshotsDisabled)
+	}
+	return store, ok
+}
+
+func respSave(c *respConn, args []string) {
+	if store, ok := c.snapshots(); ok {
+		c.replyOK(store.Save())
+	}
+}
+
+// respBackgroundSave accepts and ignores SCHEDULE, since a save that can't
+// start right away fails rather than waiting.
+func respBackgroundSave(c *respConn, args []string) {
+	if len(args) > 1 || (len(args) == 1 && strings.ToLower(args[0]) != "schedule") {
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	store, ok := c.snapshots()
+	if !ok {
+		return
+	}
+	if err := store.BackgroundSave(); err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeSimple("Background saving started")
+}
+
+func respBackgroundRewrite(c *respConn, args []string) {
+	store, ok := c.store.(rewriteStore)
+	if !ok {
+		c.writer.writeError(ErrAppendOnlyDisabled)
+		return
+	}
+	if err := store.BackgroundRewrite(); err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeSimple("Background append only file rewriting started")
+}
+
+func respLastSave(c *respConn, args []string) {
+	if store, ok := c.snapshots(); ok {
+		c.writer.writeInteger(store.LastSave().Unix())
+	}
+}
+
+func (c *respConn) broker() (*Broker, bool) {
+	store, ok := c.store.(pubSubStore)
+	if !ok {
+		c.writer.writeError(ErrPubSubDisabled)
+		return nil, false
+	}
+	return store.Broker(), true
+}
+
+func respPublish(c *respConn, args []string) {
+	if broker, ok := c.broker(); ok {
+		c.writer.writeInteger(broker.Publish(args[0], args[1]))
+	}
+}
+
+// respSubscribe confirms each channel or pattern with the number the
+// connection is now subscribed to, starting a goroutine to write messages
+// the first time the connection subscribes.
+func respSubscribe(subscribe func(*Subscription, ...string), kind string) func(c *respConn, args []string) {
+	return func(c *respConn, args []string) {
+		if c.subscription == nil {
+			broker, ok := c.broker()
+			if !ok {
+				return
+			}
+			c.subscription = broker.NewSubscription()
+			go c.forward(c.subscription)
+		}
+		for _, name := range args {
+			subscribe(c.subscription, name)
+			c.writer.writePushHeader(3)
+			c.writer.writeBulk(kind)
+			c.writer.writeBulk(name)
+			c.writer.writeInteger(c.subscription.Count())
+		}
+	}
+}
+
+// respUnsubscribe confirms each channel or pattern, or every one the
+// connection was subscribed to if none are given.
+func respUnsubscribe(unsubscribe func(*Subscription, ...string), subscribed func(*Subscription) []string, kind string) func(c *respConn, args []string) {
+	return func(c *respConn, args []string) {
+		if len(args) == 0 && c.subscription != nil {
+			args = subscribed(c.subscription)
+		}
+		if len(args) == 0 {
+			c.writer.writePushHeader(3)
+			c.writer.writeBulk(kind)
+			c.writer.writeNull()
+			c.writer.writeInteger(0)
+			return
+		}
+		for _, name := range args {
+			var count int64
+			if c.subscription != nil {
+				unsubscribe(c.subscription, name)
+				count = c.subscription.Count()
+			}
+			c.writer.writePushHeader(3)
+			c.writer.writeBulk(kind)
+			c.writer.writeBulk(name)
+			c.writer.writeInteger(count)
+		}
+	}
+}
+
+func respPubSub(c *respConn, args []string) {
+	broker, ok := c.broker()
+	if !ok {
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "channels":
+		if len(args) > 2 {
+			break
+		}
+		pattern := ""
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		c.writer.writeBulks(broker.Channels(pattern))
+		return
+	case "numsub":
+		counts := broker.NumSub(args[1:]...)
+		c.writer.writeArrayHeader(len(counts) * 2)
+		for i, count := range counts {
+			c.writer.writeBulk(args[i+1])
+			c.writer.writeInteger(count)
+		}
+		return
+	case "numpat":
+		if len(args) > 1 {
+			break
+		}
+		c.writer.writeInteger(broker.NumPat())
+		return
+	default:
+		c.writer.writeError(errors.New("ERR unknown subcommand '" + args[0] + "'. Try PUBSUB HELP."))
+		return
+	}
+	c.writer.writeError(errors.New("ERR wrong number of arguments for 'pubsub|" + strings.ToLower(args[0]) + "' command"))
+}
+
+func (c *respConn) transactions() (transactionStore, bool) {
+	store, ok := c.store.(transactionStore)
+	if !ok {
+		c.writer.writeError(ErrTransactionsDisabled)
+	}
+	return store, ok
+}
+
+func respMulti(c *respConn, args []string) {
+	if c.multi {
+		c.writer.writeError(errors.New("ERR MULTI calls can not be nested"))
+		return
+	}
+	if _, ok := c.transactions(); ok {
+		c.multi = true
+		c.writer.writeOK()
+	}
+}
+
+// respExec runs the queued commands in a transaction and replies with an
+// array of their replies, or a null array if a watched key changed.
+func respExec(c *respConn, args []string) {
+	if !c.multi {
+		c.writer.writeError(errors.New("ERR EXEC without MULTI"))
+		return
+	}
+	queued, failed, watched := c.queued, c.multiFailed, c.watched
+	c.resetTransaction()
+	if failed {
+		c.writer.writeError(errors.New("EXECABORT Transaction discarded because of previous errors."))
+		return
+	}
+	store := c.store
+	ran := false
+	err := store.(transactionStore).WatchedTransaction(watched, func(tx Store) error {
+		ran = true
+		c.store = tx
+		defer func() { c.store = store }()
+		c.writer.writeArrayHeader(len(queued))
+		for _, args := range queued {
+			c.execute(args)
+		}
+		return nil
+	})
+	switch {
+	case err == ErrWatchedKeyChanged:
+		c.writer.writeNullArray()
+	case err != nil && !ran:
+		c.writer.writeError(err)
+	}
+}
+
+func respDiscard(c *respConn, args []string) {
+	if !c.multi {
+		c.writer.writeError(errors.New("ERR DISCARD without MULTI"))
+		return
+	}
+	c.resetTransaction()
+	c.writer.writeOK()
+}
+
+// respWatch records the versions of keys, keeping the first version of any
+// key that was already watched.
+func respWatch(c *respConn, args []string) {
+	if c.multi {
+		c.writer.writeError(errors.New("ERR WATCH inside MULTI is not allowed"))
+		return
+	}
+	store, ok := c.transactions()
+	if !ok {
+		return
+	}
+	versions, err := store.Watch(args...)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	if c.watched == nil {
+		c.watched = make(map[string]uint64)
+	}
+	for key, version := range versions {
+		if _, ok := c.watched[key]; !ok {
+			c.watched[key] = version
+		}
+	}
+	c.writer.writeOK()
+}
+
+func respUnwatch(c *respConn, args []string) {
+	c.watched = nil
+	c.writer.writeOK()
+}
+
+func (c *respConn) scripts() (*Scripts, bool) {
+	store, ok := c.store.(scriptStore)
+	if !ok {
+		c.writer.writeError(ErrScriptsDisabled)
+		return nil, false
+	}
+	return store.Scripts(), true
+}
+
+// respEval runs a script, given by its source or SHA1, with the number of
+// keys it takes followed by the keys and then its arguments.
+func respEval(eval func(*Scripts, string, []string, []string) (interface{}, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		numKeys, err := parseIntegerArg(args[1])
+		switch {
+		case err != nil:
+			c.writer.writeError(err)
+			return
+		case numKeys < 0:
+			c.writer.writeError(errors.New("ERR Number of keys can't be negative"))
+			return
+		case numKeys > int64(len(args)-2):
+			c.writer.writeError(errors.New("ERR Number of keys can't be greater than number of args"))
+			return
+		}
+		scripts, ok := c.scripts()
+		if !ok {
+			return
+		}
+		keys := args[2 : 2+numKeys]
+		result, err := eval(scripts, args[0], keys, args[2+numKeys:])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		c.writer.writeScriptResult(result)
+	}
+}
+
+func respScript(c *respConn, args []string) {
+	scripts, ok := c.scripts()
+	if !ok {
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "load":
+		if len(args) != 2 {
+			break
+		}
+		c.replyBulk(scripts.Load(args[1]))
+		return
+	case "exists":
+		if len(args) < 2 {
+			break
+		}
+		exists := scripts.Exists(args[1:]...)
+		c.writer.writeArrayHeader(len(exists))
+		for _, e := range exists {
+			c.writer.writeBool(e)
+		}
+		return
+	case "flush":
+		if len(args) > 2 {
+			break
+		}
+		if len(args) == 2 && strings.ToLower(args[1]) != "sync" && strings.ToLower(args[1]) != "async" {
+			c.writer.writeError(errors.New("ERR SCRIPT FLUSH only support SYNC|ASYNC option"))
+			return
+		}
+		scripts.Flush()
+		c.writer.writeOK()
+		return
+	case "kill":
+		if len(args) != 1 {
+			break
+		}
+		c.replyOK(scripts.Kill())
+		return
+	default:
+		c.writer.writeError(errors.New("ERR unknown subcommand '" + args[0] + "'. Try SCRIPT HELP."))
+		return
+	}
+	c.writer.writeError(errors.New("ERR wrong number of arguments for 'script|" + strings.ToLower(args[0]) + "' command"))
+}
+
+func respCopy(c *respConn, args []string) {
+	replace := false
+	for _, option := range args[2:] {
+		if strings.ToLower(option) != "replace" {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		replace = true
+	}
+	c.replyBool(c.store.Copy(args[0], args[1], replace))
+}
+
+func respDelete(c *respConn, args []string) {
+	c.replyInteger(c.store.Delete(args...))
+}
+
+func respExpire(expire func(KeyStore, string, int64) (bool, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		n, err := parseIntegerArg(args[1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		c.replyBool(expire(c.store, args[0], n))
+	}
+}
+
+func respRandomKey(c *respConn, args []string) {
+	key, err := c.store.RandomKey()
+	if err == ErrNoSuchKey {
+		c.writer.writeNull()
+		return
+	}
+	c.replyBulk(key, err)
+}
+
+// parseScanArgs parses the cursor and MATCH, COUNT and, if allowType is set,
+// TYPE options of the SCAN family.
+func parseScanArgs(args []string, allowType bool) (uint64, ScanOptions, error) {
+	var options ScanOptions
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, options, ErrInvalidCursor
+	}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return 0, options, ErrSyntax
+		}
+		switch value := args[i+1]; strings.ToLower(args[i]) {
+		case "match":
+			options.Match = value
+		case "count":
+			if options.Count, err = parseIntegerArg(value); err != nil {
+				return 0, options, err
+			}
+			if options.Count < 1 {
+				return 0, options, ErrSyntax
+			}
+		case "type":
+			if !allowType {
+				return 0, options, ErrSyntax
+			}
+			options.Type = strings.ToLower(value)
+		default:
+			return 0, options, ErrSyntax
+		}
+	}
+	return cursor, options, nil
+}
+
+// writeScanReply writes the cursor of the next page as a bulk string, and
+// the page as an array.
+func (w *respWriter) writeScanReply(next uint64, page []string) {
+	w.writeArrayHeader(2)
+	w.writeBulk(strconv.FormatUint(next, 10))
+	w.writeBulks(page)
+}
+
+func respScan(c *respConn, args []string) {
+	cursor, options, err := parseScanArgs(args, true)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	next, keys, err := c.store.Scan(cursor, options)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeScanReply(next, keys)
+}
+
+func respType(c *respConn, args []string) {
+	keyType, err := c.store.Type(args[0])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeSimple(keyType)
+}
+
+// respGet tells a missing key from an empty string, which Get can't, by
+// asking MultiGet when the value is empty.
+func respGet(c *respConn, args []string) {
+	value, err := c.store.Get(args[0])
+	if err != nil || value != "" {
+		c.replyBulk(value, err)
+		return
+	}
+	values, err := c.store.MultiGet(args[:1])
+	if _, ok := values[args[0]]; err == nil && !ok {
+		c.writer.writeNull()
+		return
+	}
+	c.replyBulk(value, err)
+}
+
+func respGetRange(c *respConn, args []string) {
+	start, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	stop, err := parseIntegerArg(args[2])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyBulk(c.store.GetRange(args[0], start, stop))
+}
+
+// respGetSet replies with a null rather than an empty string, since GetSet
+// returns the same for a missing key.
+func respGetSet(c *respConn, args []string) {
+	old, err := c.store.GetSet(args[0], args[1])
+	if err == nil && old == "" {
+		c.writer.writeNull()
+		return
+	}
+	c.replyBulk(old, err)
+}
+
+func respIncrementBy(sign int64) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		delta, err := parseIntegerArg(args[1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		if sign < 0 {
+			c.replyInteger(c.store.DecrementBy(args[0], delta))
+			return
+		}
+		c.replyInteger(c.store.IncrementBy(args[0], delta))
+	}
+}
+
+func respMultiGet(c *respConn, args []string) {
+	values, err := c.store.MultiGet(args)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeArrayHeader(len(args))
+	for _, key := range args {
+		if value, ok := values[key]; ok {
+			c.writer.writeBulk(value)
+		} else {
+			c.writer.writeNull()
+		}
+	}
+}
+
+func pairs(c *respConn, args []string, command string) (map[string]string, bool) {
+	if len(args)%2 != 0 {
+		c.writer.writeError(errors.New("ERR wrong number of arguments for '" + command + "' command"))
+		return nil, false
+	}
+	data := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		data[args[i]] = args[i+1]
+	}
+	return data, true
+}
+
+func respMultiSet(c *respConn, args []string) {
+	if data, ok := pairs(c, args, "mset"); ok {
+		c.replyOK(c.store.MultiSet(data))
+	}
+}
+
+func respMultiSetIfNotExists(c *respConn, args []string) {
+	if data, ok := pairs(c, args, "msetnx"); ok {
+		c.replyBool(c.store.MultiSetIfNotExists(data))
+	}
+}
+
+func respSet(c *respConn, args []string) {
+	options := SetOptions{}
+	expiries := 0
+	for i := 2; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch option {
+		case "nx":
+			options.IfNotExists = true
+			continue
+		case "xx":
+			options.IfExists = true
+			continue
+		case "keepttl":
+			options.KeepTTL = true
+			continue
+		case "ex", "px", "exat", "pxat":
+		default:
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		if i+1 == len(args) {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		i++
+		n, err := parseIntegerArg(args[i])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		if n <= 0 {
+			c.writer.writeError(errors.New("ERR invalid expire time in 'set' command"))
+			return
+		}
+		expiries++
+		switch option {
+		case "ex":
+			options.ExpireSeconds = n
+		case "px":
+			options.ExpireMilliseconds = n
+		case "exat":
+			options.ExpireAt = n
+		case "pxat":
+			options.ExpireAtMilliseconds = n
+		}
+	}
+	if expiries > 1 {
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	set, err := c.store.SetWithOptions(args[0], args[1], options)
+	if err == nil && !set {
+		c.writer.writeNull()
+		return
+	}
+	c.replyOK(err)
+}
+
+// respSetWithExpiry implements SETEX and PSETEX, whose TTL argument is in
+// seconds or milliseconds respectively.
+func respSetWithExpiry(command string, scale int64) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		n, err := parseIntegerArg(args[1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		if n <= 0 {
+			c.writer.writeError(errors.New("ERR invalid expire time in '" + command + "' command"))
+			return
+		}
+		_, err = c.store.SetWithOptions(args[0], args[2], SetOptions{ExpireMilliseconds: n * scale})
+		c.replyOK(err)
+	}
+}
+
+func respSetRange(c *respConn, args []string) {
+	offset, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyInteger(c.store.SetRange(args[0], offset, args[2]))
+}
+
+// SADD and SREM reply with how many members changed, which SetStore doesn't
+// report, so it's worked out from the cardinality before and after. Writes
+// racing with the command can skew the count, but never the set itself.
+func respSetAdd(c *respConn, args []string) {
+	c.replyInteger(cardinalityChange(c.store.SetCardinality, args[0], func() error {
+		return c.store.SetAdd(args[0], args[1:]...)
+	}))
+}
+
+func respSetRemove(c *respConn, args []string) {
+	removed, err := cardinalityChange(c.store.SetCardinality, args[0], func() error {
+		return c.store.SetRemove(args[0], args[1:]...)
+	})
+	c.replyInteger(-removed, err)
+}
+
+func cardinalityChange(cardinality func(string) (int64, error), key string, change func() error) (int64, error) {
+	before, err := cardinality(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := change(); err != nil {
+		return 0, err
+	}
+	after, err := cardinality(key)
+	return after - before, err
+}
+
+func respSetMultiIsMember(c *respConn, args []string) {
+	found, err := c.store.SetMultiIsMember(args[0], args[1:]...)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeArrayHeader(len(found))
+	for _, isMember := range found {
+		c.writer.writeBool(isMember)
+	}
+}
+
+// respSetPop replies with a single member, or null, without a count, and
+// with a set of members with one.
+func respSetPop(c *respConn, args []string) {
+	if len(args) > 2 {
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	if len(args) == 1 {
+		popped, err := c.store.SetPop(args[0], 1)
+		c.replySingle(popped, err)
+		return
+	}
+	count, err := parseIntegerArg(args[1])
+	if err != nil || count < 0 {
+		c.writer.writeError(errors.New("ERR value is out of range, must be positive"))
+		return
+	}
+	c.replySet(c.store.SetPop(args[0], count))
+}
+
+// respSetRandomMember replies like SPOP, except that the members come as an
+// array, since a negative count can repeat them.
+func respSetRandomMember(c *respConn, args []string) {
+	if len(args) > 2 {
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	if len(args) == 1 {
+		members, err := c.store.SetRandomMember(args[0], 1)
+		c.replySingle(members, err)
+		return
+	}
+	count, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyBulks(c.store.SetRandomMember(args[0], count))
+}
+
+// respSetIntersectCardinality parses SINTERCARD numkeys key [key ...]
+// [LIMIT limit].
+func respSetIntersectCardinality(c *respConn, args []string) {
+	numKeys, err := parseIntegerArg(args[0])
+	if err != nil || numKeys <= 0 {
+		c.writer.writeError(errors.New("ERR numkeys should be greater than 0"))
+		return
+	}
+	if numKeys > int64(len(args)-1) {
+		c.writer.writeError(errors.New("ERR Number of keys can't be greater than number of args"))
+		return
+	}
+	keys, rest := args[1:1+numKeys], args[1+numKeys:]
+	var limit int64
+	for len(rest) > 0 {
+		if len(rest) < 2 || strings.ToLower(rest[0]) != "limit" {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		if limit, err = parseIntegerArg(rest[1]); err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		rest = rest[2:]
+	}
+	c.replyInteger(c.store.SetIntersectCardinality(limit, keys...))
+}
+
+func respSetScan(c *respConn, args []string) {
+	cursor, options, err := parseScanArgs(args[1:], false)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	next, members, err := c.store.SetScan(args[0], cursor, options)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeScanReply(next, members)
+}
+
+// respHashGet tells a missing field from an empty value by asking
+// HashExists when the value is empty.
+func respHashGet(c *respConn, args []string) {
+	value, err := c.store.HashGet(args[0], args[1])
+	if err != nil || value != "" {
+		c.replyBulk(value, err)
+		return
+	}
+	exists, err := c.store.HashExists(args[0], args[1])
+	if err == nil && !exists {
+		c.writer.writeNull()
+		return
+	}
+	c.replyBulk(value, err)
+}
+
+func respHashMultiGet(c *respConn, args []string) {
+	values, err := c.store.HashMultiGet(args[0], args[1:]...)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeArrayHeader(len(values))
+	for i, value := range values {
+		if value == "" {
+			if exists, _ := c.store.HashExists(args[0], args[i+1]); !exists {
+				c.writer.writeNull()
+				continue
+			}
+		}
+		c.writer.writeBulk(value)
+	}
+}
+
+func respHashMultiSet(c *respConn, args []string) {
+	if data, ok := pairs(c, args[1:], "hmset"); ok {
+		c.replyOK(c.store.HashMultiSet(args[0], data))
+	}
+}
+
+// respHashSet replies with the number of new fields, worked out from the
+// hash length like SADD.
+func respHashSet(c *respConn, args []string) {
+	if data, ok := pairs(c, args[1:], "hset"); ok {
+		c.replyInteger(cardinalityChange(c.store.HashLength, args[0], func() error {
+			return c.store.HashMultiSet(args[0], data)
+		}))
+	}
+}
+
+// respHashGetAll replies with the fields in order, each followed by its
+// value, as a map in RESP3.
+func respHashGetAll(c *respConn, args []string) {
+	fields, err := c.store.HashGetAll(args[0])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	c.writer.writeMapHeader(len(names))
+	for _, field := range names {
+		c.writer.writeBulk(field)
+		c.writer.writeBulk(fields[field])
+	}
+}
+
+func respHashIncrementBy(c *respConn, args []string) {
+	delta, err := parseIntegerArg(args[2])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyInteger(c.store.HashIncrementBy(args[0], args[1], delta))
+}
+
+func respIncrementByFloat(c *respConn, args []string) {
+	delta, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		c.writer.writeError(ErrNotFloat)
+		return
+	}
+	c.replyBulk(c.store.IncrementByFloat(args[0], delta))
+}
+
+func respHashIncrementByFloat(c *respConn, args []string) {
+	delta, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		c.writer.writeError(ErrNotFloat)
+		return
+	}
+	c.replyBulk(c.store.HashIncrementByFloat(args[0], args[1], delta))
+}
+
+// respHashRandomField parses HRANDFIELD key [count [WITHVALUES]]. Without a
+// count it replies with a single field or null, and with WITHVALUES each
+// field is followed by its value, or paired with it in RESP3.
+func respHashRandomField(c *respConn, args []string) {
+	if len(args) == 1 {
+		fields, err := c.store.HashRandomField(args[0], 1)
+		c.replySingle(fields, err)
+		return
+	}
+	count, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	switch {
+	case len(args) == 2:
+		c.replyBulks(c.store.HashRandomField(args[0], count))
+		return
+	case len(args) > 3 || strings.ToLower(args[2]) != "withvalues":
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	fields, err := c.store.HashRandomFieldWithValues(args[0], count)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	if c.writer.protocol == 3 {
+		c.writer.writeArrayHeader(len(fields))
+		for _, field := range fields {
+			c.writer.writeBulks([]string{field.Field, field.Value})
+		}
+		return
+	}
+	c.writer.writeArrayHeader(2 * len(fields))
+	for _, field := range fields {
+		c.writer.writeBulk(field.Field)
+		c.writer.writeBulk(field.Value)
+	}
+}
+
+// parseFields parses the FIELDS numfields field... arguments that end the
+// hash field expiry commands, where each field is followed by width-1 more
+// arguments.
+func parseFields(c *respConn, args []string, width int) ([]string, bool) {
+	if len(args) < 2 || strings.ToLower(args[0]) != "fields" {
+		c.writer.writeError(errors.New("ERR Mandatory argument FIELDS is missing or not at the right position"))
+		return nil, false
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || n <= 0 {
+		c.writer.writeError(errors.New("ERR Parameter `numFields` should be greater than 0"))
+		return nil, false
+	}
+	if n != int64((len(args)-2)/width) || (len(args)-2)%width != 0 {
+		c.writer.writeError(errors.New("ERR The `numfields` parameter must match the number of arguments"))
+		return nil, false
+	}
+	return args[2:], true
+}
+
+func (c *respConn) replyIntegers(values []int64, err error) {
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeArrayHeader(len(values))
+	for _, n := range values {
+		c.writer.writeInteger(n)
+	}
+}
+
+// respHashExpire implements HEXPIRE and its variants, which take a time and
+// an optional NX, XX, GT or LT before the fields.
+func respHashExpire(expire func(HashStore, string, int64, HashExpireOptions, ...string) ([]int64, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		n, err := parseIntegerArg(args[1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		options := HashExpireOptions{}
+		rest := args[2:]
+		switch strings.ToLower(rest[0]) {
+		case "nx":
+			options.IfNotExists = true
+		case "xx":
+			options.IfExists = true
+		case "gt":
+			options.GreaterThan = true
+		case "lt":
+			options.LessThan = true
+		}
+		if options != (HashExpireOptions{}) {
+			rest = rest[1:]
+		}
+		fields, ok := parseFields(c, rest, 1)
+		if ok {
+			c.replyIntegers(expire(c.store, args[0], n, options, fields...))
+		}
+	}
+}
+
+// respHashFields implements HTTL, HPTTL and HPERSIST.
+func respHashFields(fn func(HashStore, string, ...string) ([]int64, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		if fields, ok := parseFields(c, args[1:], 1); ok {
+			c.replyIntegers(fn(c.store, args[0], fields...))
+		}
+	}
+}
+
+// parseHashFieldOptions parses the options of HGETEX or HSETEX that come
+// before FIELDS, and returns them with the arguments from FIELDS on.
+func parseHashFieldOptions(c *respConn, args []string, command string) (HashFieldOptions, []string, bool) {
+	options := HashFieldOptions{}
+	expiries := 0
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch {
+		case option == "fields":
+			if expiries > 1 {
+				c.writer.writeError(ErrSyntax)
+				return options, nil, false
+			}
+			return options, args[i:], true
+		case option == "persist" && command == "hgetex":
+			options.Persist = true
+			expiries++
+			continue
+		case option == "keepttl" && command == "hsetex":
+			options.KeepTTL = true
+			expiries++
+			continue
+		case option == "fnx" && command == "hsetex":
+			options.IfNotExists = true
+			continue
+		case option == "fxx" && command == "hsetex":
+			options.IfExists = true
+			continue
+		case option == "ex", option == "px", option == "exat", option == "pxat":
+		default:
+			c.writer.writeError(ErrSyntax)
+			return options, nil, false
+		}
+		if i+1 == len(args) {
+			c.writer.writeError(ErrSyntax)
+			return options, nil, false
+		}
+		i++
+		n, err := parseIntegerArg(args[i])
+		if err != nil {
+			c.writer.writeError(err)
+			return options, nil, false
+		}
+		if n <= 0 {
+			c.writer.writeError(errors.New("ERR invalid expire time in '" + command + "' command"))
+			return options, nil, false
+		}
+		expiries++
+		switch option {
+		case "ex":
+			options.ExpireSeconds = n
+		case "px":
+			options.ExpireMilliseconds = n
+		case "exat":
+			options.ExpireAt = n
+		case "pxat":
+			options.ExpireAtMilliseconds = n
+		}
+	}
+	c.writer.writeError(errors.New("ERR Mandatory argument FIELDS is missing or not at the right position"))
+	return options, nil, false
+}
+
+// respHashGetWithOptions replies with the value of each field, or null for
+// those that don't exist, like HMGET.
+func respHashGetWithOptions(c *respConn, args []string) {
+	options, rest, ok := parseHashFieldOptions(c, args[1:], "hgetex")
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(c, rest, 1)
+	if !ok {
+		return
+	}
+	values, err := c.store.HashGetWithOptions(args[0], options, fields...)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeArrayHeader(len(fields))
+	for _, field := range fields {
+		if value, ok := values[field]; ok {
+			c.writer.writeBulk(value)
+		} else {
+			c.writer.writeNull()
+		}
+	}
+}
+
+func respHashSetWithOptions(c *respConn, args []string) {
+	options, rest, ok := parseHashFieldOptions(c, args[1:], "hsetex")
+	if !ok {
+		return
+	}
+	fields, ok := parseFields(c, rest, 2)
+	if !ok {
+		return
+	}
+	data := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		data[fields[i]] = fields[i+1]
+	}
+	set, err := c.store.HashSetWithOptions(args[0], data, options)
+	if err == nil && !set {
+		c.writer.writeInteger(0)
+		return
+	}
+	c.replyInteger(1, err)
+}
+
+// respHashScan replies with the fields and their values in a flat array,
+// each field followed by its value.
+func respHashScan(c *respConn, args []string) {
+	cursor, options, err := parseScanArgs(args[1:], false)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	next, fields, err := c.store.HashScan(args[0], cursor, options)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	page := make([]string, 0, 2*len(fields))
+	for field, value := range fields {
+		page = append(page, field, value)
+	}
+	c.writer.writeScanReply(next, page)
+}
+
+func respListIndex(c *respConn, args []string) {
+	index, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	value, err := c.store.ListIndex(args[0], index)
+	if err != nil || value != "" {
+		c.replyBulk(value, err)
+		return
+	}
+	length, err := c.store.ListLength(args[0])
+	if err == nil && outOfBounds(length, normalize(length, index)) {
+		c.writer.writeNull()
+		return
+	}
+	c.replyBulk(value, err)
+}
+
+// respListPop pops one value, or with a count argument an array of up to
+// that many values.
+func respListPop(pop func(ListStore, string) (string, error), popCount func(ListStore, string, int64) ([]string, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		if len(args) > 2 {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		if len(args) == 1 {
+			value, err := pop(c.store, args[0])
+			if err == ErrNoSuchKey {
+				c.writer.writeNull()
+				return
+			}
+			c.replyBulk(value, err)
+			return
+		}
+		count, err := parseIntegerArg(args[1])
+		if err != nil || count < 0 {
+			c.writer.writeError(errors.New("ERR value is out of range, must be positive"))
+			return
+		}
+		values, err := popCount(c.store, args[0], count)
+		if err == ErrNoSuchKey {
+			c.writer.writeNullArray()
+			return
+		}
+		c.replyBulks(values, err)
+	}
+}
+
+// respListMultiPop parses LMPOP numkeys key [key ...] LEFT|RIGHT
+// [COUNT count], and replies with the key popped from and its items, or a
+// null array if every list was empty.
+func respListMultiPop(c *respConn, args []string) {
+	numKeys, err := parseIntegerArg(args[0])
+	if err != nil || numKeys <= 0 {
+		c.writer.writeError(errors.New("ERR numkeys should be greater than 0"))
+		return
+	}
+	if numKeys > int64(len(args)-2) {
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	keys, rest := args[1:1+numKeys], args[1+numKeys:]
+	side, err := parseSideArg(rest[0])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	count := int64(1)
+	switch {
+	case len(rest) == 3 && strings.ToLower(rest[1]) == "count":
+		if count, err = parseIntegerArg(rest[2]); err != nil || count <= 0 {
+			c.writer.writeError(errors.New("ERR count should be greater than 0"))
+			return
+		}
+	case len(rest) != 1:
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	key, values, err := c.store.ListMultiPop(side, count, keys...)
+	switch {
+	case err == ErrNoSuchKey:
+		c.writer.writeNullArray()
+	case err != nil:
+		c.writer.writeError(err)
+	default:
+		c.writer.writeArrayHeader(2)
+		c.writer.writeBulk(key)
+		c.writer.writeBulks(values)
+	}
+}
+
+func respListInsert(c *respConn, args []string) {
+	switch strings.ToLower(args[1]) {
+	case "before":
+		c.replyInteger(c.store.ListInsertBefore(args[0], args[2], args[3]))
+	case "after":
+		c.replyInteger(c.store.ListInsertAfter(args[0], args[2], args[3]))
+	default:
+		c.writer.writeError(ErrSyntax)
+	}
+}
+
+func respListRemove(c *respConn, args []string) {
+	count, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyInteger(c.store.ListRemove(args[0], count, args[2]))
+}
+
+// respListPosition parses LPOS key element [RANK rank] [COUNT num-matches]
+// [MAXLEN len]. Without COUNT it replies with the first index or null, and
+// with it an array of indexes.
+func respListPosition(c *respConn, args []string) {
+	options := ListPositionOptions{Count: 1}
+	withCount := false
+	for rest := args[2:]; len(rest) > 0; rest = rest[2:] {
+		if len(rest) < 2 {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		n, err := parseIntegerArg(rest[1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		switch strings.ToLower(rest[0]) {
+		case "rank":
+			if n == 0 {
+				c.writer.writeError(errors.New("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"))
+				return
+			}
+			if n == math.MinInt64 {
+				c.writer.writeError(errors.New("ERR value is out of range, value must between -9223372036854775807 and 9223372036854775807"))
+				return
+			}
+			options.Rank = n
+		case "count":
+			options.Count, withCount = n, true
+		case "maxlen":
+			options.MaxLen = n
+		default:
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+	}
+	positions, err := c.store.ListPosition(args[0], args[1], options)
+	switch {
+	case err != nil:
+		c.writer.writeError(err)
+	case withCount:
+		c.writer.writeArrayHeader(len(positions))
+		for _, position := range positions {
+			c.writer.writeInteger(position)
+		}
+	case len(positions) == 0:
+		c.writer.writeNull()
+	default:
+		c.writer.writeInteger(positions[0])
+	}
+}
+
+func respListRange(c *respConn, args []string) {
+	start, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	stop, err := parseIntegerArg(args[2])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyBulks(c.store.ListRange(args[0], start, stop))
+}
+
+func respListSet(c *respConn, args []string) {
+	index, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyOK(c.store.ListSet(args[0], index, args[2]))
+}
+
+func respListTrim(c *respConn, args []string) {
+	start, err := parseIntegerArg(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	stop, err := parseIntegerArg(args[2])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.replyOK(c.store.ListTrim(args[0], start, stop))
+}
+
+func parseSideArg(arg string) (ListSide, error) {
+	switch strings.ToLower(arg) {
+	case "left":
+		return ListLeft, nil
+	case "right":
+		return ListRight, nil
+	}
+	return 0, ErrSyntax
+}
+
+// parseTimeoutArg reads a blocking command's timeout, in seconds with an
+// optional fraction.
+func parseTimeoutArg(arg string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, errors.New("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, ErrNegativeTimeout
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// respListBlockingPop replies with the key and the item popped from it, or
+// a null array if the wait times out.
+func respListBlockingPop(pop func(ListStore, context.Context, time.Duration, ...string) (string, string, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		timeout, err := parseTimeoutArg(args[len(args)-1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		ctx, done := c.blockingContext()
+		key, value, err := pop(c.store, ctx, timeout, args[:len(args)-1]...)
+		done()
+		switch {
+		case err == ErrNoSuchKey:
+			c.writer.writeNullArray()
+		case err != nil:
+			c.writer.writeError(err)
+		default:
+			c.writer.writeBulks([]string{key, value})
+		}
+	}
+}
+
+func respListMove(c *respConn, args []string) {
+	from, to, err := parseMoveSides(args[2], args[3])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	value, err := c.store.ListMove(args[0], args[1], from, to)
+	c.replyMoved(value, err)
+}
+
+func respListBlockingMove(c *respConn, args []string) {
+	from, to, err := parseMoveSides(args[2], args[3])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	timeout, err := parseTimeoutArg(args[4])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	ctx, done := c.blockingContext()
+	value, err := c.store.ListBlockingMove(ctx, timeout, args[0], args[1], from, to)
+	done()
+	c.replyMoved(value, err)
+}
+
+// respListBlockingRotate is BRPOPLPUSH, which is BLMOVE from the right to
+// the left.
+func respListBlockingRotate(c *respConn, args []string) {
+	timeout, err := parseTimeoutArg(args[2])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	ctx, done := c.blockingContext()
+	value, err := c.store.ListBlockingMove(ctx, timeout, args[0], args[1], ListRight, ListLeft)
+	done()
+	c.replyMoved(value, err)
+}
+
+func parseMoveSides(from, to string) (ListSide, ListSide, error) {
+	fromSide, err := parseSideArg(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	toSide, err := parseSideArg(to)
+	return fromSide, toSide, err
+}
+
+// replyMoved replies with the item LMOVE or BLMOVE moved, or null if there
+// wasn't one.
+func (c *respConn) replyMoved(value string, err error) {
+	if err == ErrNoSuchKey {
+		c.writer.writeNull()
+		return
+	}
+	c.replyBulk(value, err)
+}
+
+func respSortedSetAdd(c *respConn, args []string) {
+	options := SortedSetAddOptions{}
+	increment := false
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			options.IfNotExists = true
+		case "xx":
+			options.IfExists = true
+		case "gt":
+			options.GreaterThan = true
+		case "lt":
+			options.LessThan = true
+		case "ch":
+			options.Changed = true
+		case "incr":
+			increment = true
+		default:
+			break flags
+		}
+	}
+	rest := args[i:]
+	if len(rest) == 0 || len(rest)%2 != 0 || (increment && len(rest) != 2) {
+		c.writer.writeError(ErrSyntax)
+		return
+	}
+	members := make([]ScoredMember, 0, len(rest)/2)
+	for j := 0; j < len(rest); j += 2 {
+		score, err := parseScore(rest[j])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		members = append(members, ScoredMember{Member: rest[j+1], Score: score})
+	}
+	if !increment {
+		c.replyInteger(c.store.SortedSetAdd(args[0], options, members...))
+		return
+	}
+	score, applied, err := c.store.SortedSetAddIncrement(args[0], options, members[0].Member, members[0].Score)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	if !applied {
+		c.writer.writeNull()
+		return
+	}
+	c.writer.writeDouble(score)
+}
+
+func respSortedSetIncrementBy(c *respConn, args []string) {
+	delta, err := parseScore(args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	score, err := c.store.SortedSetIncrementBy(args[0], args[2], delta)
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	c.writer.writeDouble(score)
+}
+
+// respSortedSetPop replies with a flat member and score pair, or with a
+// count argument, with every popped member and its score.
+func respSortedSetPop(pop func(SortedSetStore, string, int64) ([]ScoredMember, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		if len(args) > 2 {
+			c.writer.writeError(ErrSyntax)
+			return
+		}
+		count := int64(1)
+		if len(args) == 2 {
+			n, err := parseIntegerArg(args[1])
+			if err != nil || n < 0 {
+				c.writer.writeError(errors.New("ERR value is out of range, must be positive"))
+				return
+			}
+			count = n
+		}
+		members, err := pop(c.store, args[0], count)
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		if len(args) == 1 && c.writer.protocol == 3 {
+			c.writer.writeArrayHeader(len(members) * 2)
+			for _, m := range members {
+				c.writer.writeBulk(m.Member)
+				c.writer.writeDouble(m.Score)
+			}
+			return
+		}
+		c.writer.writeScoredMembers(members, true)
+	}
+}
+
+// parseRangeOptions reads the BYSCORE, BYLEX, REV, LIMIT and WITHSCORES
+// options that follow the bounds of ZRANGE and its older variants, on top of
+// the defaults the variant implies.
+func parseRangeOptions(query SortedSetRange, args []string, allowBy bool) (SortedSetRange, bool, error) {
+	withScores := false
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == "byscore" && allowBy:
+			query.ByScore = true
+		case option == "bylex" && allowBy:
+			query.ByLex = true
+		case option == "rev" && allowBy:
+			query.Reverse = true
+		case option == "withscores":
+			withScores = true
+		case option == "limit" && i+2 < len(args):
+			offset, err := parseIntegerArg(args[i+1])
+			if err != nil {
+				return query, false, err
+			}
+			count, err := parseIntegerArg(args[i+2])
+			if err != nil {
+				return query, false, err
+			}
+			query.Limit = &RangeLimit{Offset: offset, Count: count}
+			i += 2
+		default:
+			return query, false, ErrSyntax
+		}
+	}
+	if withScores && query.ByLex {
+		return query, false, ErrSyntax
+	}
+	return query, withScores, nil
+}
+
+func respSortedSetRange(defaults SortedSetRange) func(*respConn, []string) {
+	allowBy := defaults == SortedSetRange{}
+	return func(c *respConn, args []string) {
+		query, withScores, err := parseRangeOptions(defaults, args[3:], allowBy)
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		query.Start, query.Stop = args[1], args[2]
+		members, err := c.store.SortedSetRange(args[0], query)
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		c.writer.writeScoredMembers(members, withScores)
+	}
+}
+
+func respSortedSetRangeStore(c *respConn, args []string) {
+	query, withScores, err := parseRangeOptions(SortedSetRange{}, args[4:], true)
+	if err == nil && withScores {
+		err = ErrSyntax
+	}
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	query.Start, query.Stop = args[2], args[3]
+	c.replyInteger(c.store.SortedSetRangeStore(args[0], args[1], query))
+}
+
+func respSortedSetRank(rank func(SortedSetStore, string, string) (int64, bool, error)) func(*respConn, []string) {
+	return func(c *respConn, args []string) {
+		n, found, err := rank(c.store, args[0], args[1])
+		if err != nil {
+			c.writer.writeError(err)
+			return
+		}
+		if !found {
+			c.writer.writeNull()
+			return
+		}
+		c.writer.writeInteger(n)
+	}
+}
+
+func respSortedSetScore(c *respConn, args []string) {
+	score, found, err := c.store.SortedSetScore(args[0], args[1])
+	if err != nil {
+		c.writer.writeError(err)
+		return
+	}
+	if !found {
+		c.writer.writeNull()
+		return
+	}
+	c.writer.writeDouble(score)
+}
@@ -0,0 +1,298 @@
+package restis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by RESPServer.Serve once the server is closed.
+var ErrServerClosed = errors.New("restis: server closed")
+
+// A RESPServer serves a Store over the Redis serialization protocol, so that
+// redis-cli and Redis client libraries can talk to restis. Connections start
+// on RESP2 and can switch to RESP3 with HELLO.
+type RESPServer struct {
+	store Store
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	lastID    int64
+}
+
+func NewRESPServer(store Store) *RESPServer {
+	return &RESPServer{
+		store:     store,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+func (s *RESPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or the server is closed,
+// handling each connection on its own goroutine.
+func (s *RESPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		id, ok := s.track(conn)
+		if !ok {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn, id)
+	}
+}
+
+// Close stops all listeners and closes every open connection.
+func (s *RESPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *RESPServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *RESPServer) track(conn net.Conn) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, false
+	}
+	s.lastID++
+	s.conns[conn] = true
+	return s.lastID, true
+}
+
+func (s *RESPServer) forget(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+type respConn struct {
+	store  Store
+	conn   net.Conn
+	reader respReader
+	id     int64
+	name   string
+	quit   bool
+
+	// Between MULTI and EXEC commands are queued rather than run, and
+	// multiFailed records whether any of them were rejected.
+	multi       bool
+	multiFailed bool
+	queued      [][]string
+	watched     map[string]uint64
+
+	// mu guards the writer once the connection subscribes, because messages
+	// are then written from another goroutine.
+	mu           sync.Mutex
+	writer       *respWriter
+	subscription *Subscription
+}
+
+func (s *RESPServer) serveConn(conn net.Conn, id int64) {
+	defer s.forget(conn)
+	defer conn.Close()
+	c := &respConn{
+		store:  s.store,
+		conn:   conn,
+		reader: respReader{bufio.NewReader(conn)},
+		writer: &respWriter{Writer: bufio.NewWriter(conn), protocol: 2},
+		id:     id,
+	}
+	defer func() {
+		if c.subscription != nil {
+			c.subscription.Close()
+		}
+	}()
+	for !c.quit {
+		args, err := c.reader.readCommand()
+		c.mu.Lock()
+		if err != nil {
+			if protocolErr, ok := err.(respProtocolError); ok {
+				c.writer.writeError(protocolErr)
+				c.writer.Flush()
+			}
+			c.mu.Unlock()
+			return
+		}
+		c.execute(args)
+		// Pipelined commands are answered together once the input runs dry.
+		if c.reader.Buffered() == 0 || c.quit {
+			err = c.writer.Flush()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// blockingContext returns a context for a command that may block, which is
+// cancelled if the client disconnects while it waits, and a function to call
+// once the command is done. The client is watched by peeking at the
+// connection, which leaves anything it pipelines behind the command to be
+// read afterwards.
+func (c *respConn) blockingContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.conn == nil || c.reader.Buffered() > 0 {
+		return ctx, cancel
+	}
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		if _, err := c.reader.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				cancel()
+			}
+		}
+	}()
+	return ctx, func() {
+		// An expired deadline ends the peek, and is cleared before the
+		// connection is read again.
+		c.conn.SetReadDeadline(time.Now())
+		<-watching
+		c.conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+// forward writes published messages to the connection until the
+// subscription closes, and drops the connection if that's because it fell
+// behind.
+func (c *respConn) forward(sub *Subscription) {
+	for message := range sub.Messages() {
+		c.mu.Lock()
+		c.writer.writeMessage(message)
+		var err error
+		if len(sub.Messages()) == 0 {
+			err = c.writer.Flush()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	c.conn.Close()
+}
+
+// respSubscribedCommands are the only commands a RESP2 connection can run
+// while it's subscribed, since its replies are interleaved with messages.
+var respSubscribedCommands = map[string]bool{
+	"subscribe": true, "psubscribe": true, "unsubscribe": true, "punsubscribe": true, "ping": true, "quit": true,
+}
+
+func (c *respConn) execute(args []string) {
+	name := strings.ToLower(args[0])
+	command, ok := respCommands[name]
+	if !ok {
+		quoted := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			quoted = append(quoted, "'"+arg+"'")
+		}
+		c.multiFailed = c.multi
+		c.writer.writeError(fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", args[0], strings.Join(quoted, " ")))
+		return
+	}
+	if (command.arity > 0 && len(args) != command.arity) || len(args) < -command.arity {
+		c.multiFailed = c.multi
+		c.writer.writeError(fmt.Errorf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	if c.subscribed() && c.writer.protocol == 2 && !respSubscribedCommands[name] {
+		c.writer.writeError(fmt.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", name))
+		return
+	}
+	if c.multi && !respUnqueuedCommands[name] {
+		if respNoMultiCommands[name] {
+			c.multiFailed = true
+			c.writer.writeError(errors.New("ERR Command not allowed inside a transaction"))
+			return
+		}
+		c.queued = append(c.queued, args)
+		c.writer.writeSimple("QUEUED")
+		return
+	}
+	command.run(c, args[1:])
+}
+
+// respUnqueuedCommands run straight away between MULTI and EXEC, and
+// respNoMultiCommands are refused there: they either reply more than once or
+// need the whole store rather than the transaction's view of it.
+var (
+	respUnqueuedCommands = map[string]bool{
+		"discard": true, "exec": true, "multi": true, "quit": true, "watch": true,
+	}
+	respNoMultiCommands = map[string]bool{
+		"subscribe": true, "psubscribe": true, "unsubscribe": true, "punsubscribe": true,
+		"save": true, "bgsave": true, "bgrewriteaof": true, "lastsave": true, "config": true,
+	}
+)
+
+func (c *respConn) resetTransaction() {
+	c.multi, c.multiFailed, c.queued, c.watched = false, false, nil, nil
+}
+
+func (c *respConn) subscribed() bool {
+	return c.subscription != nil && c.subscription.Count() > 0
+}
@@ -0,0 +1,584 @@
+package restis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type respTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func startRESPServer(t *testing.T) (*RESPServer, func() respTestClient) {
+	return startRESPServerWithStore(t, NewMemoryStore())
+}
+
+func startRESPServerWithStore(t *testing.T, store Store) (*RESPServer, func() respTestClient) {
+	server := NewRESPServer(store)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	return server, func() respTestClient {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return respTestClient{t, conn, bufio.NewReader(conn)}
+	}
+}
+
+func encodeCommand(args ...string) string {
+	encoded := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		encoded += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return encoded
+}
+
+// check sends a command and compares the raw reply, written with "\n" in
+// place of each "\r\n" to keep the expectations readable.
+func (c respTestClient) check(expected string, args ...string) {
+	if _, err := io.WriteString(c.conn, encodeCommand(args...)); err != nil {
+		c.t.Fatal(err)
+	}
+	c.expect(expected, strings.Join(args, " "))
+}
+
+func (c respTestClient) expect(expected, message string) {
+	assert.Equal(c.t, expected, strings.Replace(c.readReply(), "\r\n", "\n", -1), message)
+}
+
+func (c respTestClient) readReply() string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	switch line[0] {
+	case '$':
+		if n < 0 {
+			return line
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			c.t.Fatal(err)
+		}
+		return line + string(data)
+	case '%':
+		n *= 2
+		fallthrough
+	case '*', '~', '>':
+		for i := 0; i < n; i++ {
+			line += c.readReply()
+		}
+	}
+	return line
+}
+
+func TestRESPStrings(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c := connect()
+	c.check("+PONG\n", "PING")
+	c.check("$5\nhello\n", "ping", "hello")
+	c.check("$-1\n", "GET", "k1")
+	c.check("+OK\n", "SET", "k1", "v1")
+	c.check("$2\nv1\n", "GET", "k1")
+	c.check("+OK\n", "SET", "empty", "")
+	c.check("$0\n\n", "GET", "empty")
+	c.check("$-1\n", "SET", "k1", "v2", "NX")
+	c.check("+OK\n", "SET", "k1", "v2", "xx", "EX", "100")
+	c.check(":100\n", "TTL", "k1")
+	c.check("-ERR invalid expire time in 'set' command\n", "SET", "k1", "v2", "EX", "0")
+	c.check("-ERR syntax error\n", "SET", "k1", "v2", "EX", "1", "PX", "1")
+	c.check("-ERR syntax error\n", "SET", "k1", "v2", "EX")
+	c.check("-ERR value is not an integer or out of range\n", "SET", "k1", "v2", "EX", "ten")
+	c.check("*3\n$2\nv2\n$-1\n$0\n\n", "MGET", "k1", "k2", "empty")
+	c.check("+OK\n", "MSET", "k2", "v2", "k3", "v3")
+	c.check("-ERR wrong number of arguments for 'mset' command\n", "MSET", "k2", "v2", "k3")
+	c.check(":0\n", "MSETNX", "k3", "v3", "k4", "v4")
+	c.check(":1\n", "SETNX", "k4", "v4")
+	c.check(":7\n", "APPEND", "k4", "-tail")
+	c.check("$4\ntail\n", "GETRANGE", "k4", "-4", "-1")
+	c.check(":7\n", "SETRANGE", "k4", "2", "-TAIL")
+	c.check(":7\n", "STRLEN", "k4")
+	c.check("$7\nv4-TAIL\n", "GETSET", "k4", "new")
+	c.check("$-1\n", "GETSET", "k5", "new")
+	c.check(":1\n", "INCR", "n")
+	c.check(":11\n", "INCRBY", "n", "10")
+	c.check(":10\n", "DECR", "n")
+	c.check(":6\n", "DECRBY", "n", "4")
+	c.check("$3\n6.5\n", "INCRBYFLOAT", "n", "0.5")
+	c.check("$2\n-1\n", "INCRBYFLOAT", "n", "-7.5")
+	c.check("-ERR value is not a valid float\n", "INCRBYFLOAT", "n", "x")
+	c.check("-ERR value is NaN or Infinity\n", "INCRBYFLOAT", "n", "-inf")
+	c.check("-ERR value is not a valid float\n", "INCRBYFLOAT", "k1", "1")
+	c.check(":0\n", "INCR", "n")
+	c.check("-ERR value is not an integer or out of range\n", "INCR", "k1")
+	c.check("+OK\n", "SETEX", "k6", "10", "v6")
+	c.check("+OK\n", "PSETEX", "k7", "1500", "v7")
+	c.check(":2\n", "TTL", "k7")
+	c.check("-ERR invalid expire time in 'setex' command\n", "SETEX", "k6", "-1", "v6")
+}
+
+func TestRESPKeys(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c := connect()
+	c.check("+OK\n", "SET", "k1", "v1")
+	c.check(":1\n", "SADD", "s1", "m1")
+	c.check(":2\n", "EXISTS", "k1", "s1", "k9")
+	c.check("+string\n", "TYPE", "k1")
+	c.check("+none\n", "TYPE", "k9")
+	c.check("-WRONGTYPE Operation against a key holding the wrong kind of value\n", "GET", "s1")
+	c.check("+OK\n", "RENAME", "k1", "k2")
+	c.check("-ERR no such key\n", "RENAME", "k1", "k3")
+	c.check(":0\n", "RENAMENX", "k2", "s1")
+	c.check(":1\n", "COPY", "k2", "k3")
+	c.check(":0\n", "COPY", "k2", "k3")
+	c.check(":1\n", "COPY", "k2", "k3", "REPLACE")
+	c.check("-ERR syntax error\n", "COPY", "k2", "k3", "DB", "1")
+	c.check(":1\n", "EXPIRE", "k2", "100")
+	c.check("-ERR invalid expire time\n", "EXPIREAT", "k2", "9223372036854775807")
+	c.check("-ERR invalid expire time\n", "SET", "k2", "v", "EX", "9223372036854775807")
+	c.check(":1\n", "PEXPIRE", "k3", "100000")
+	c.check(":100\n", "TTL", "k3")
+	c.check("*1\n$2\ns1\n", "KEYS", "s*")
+	c.check("*2\n$1\n0\n*1\n$2\ns1\n", "SCAN", "0", "MATCH", "s*", "COUNT", "100")
+	c.check("*2\n$1\n0\n*1\n$2\ns1\n", "SCAN", "0", "TYPE", "SET")
+	c.check("-ERR invalid cursor\n", "SCAN", "x")
+	c.check("-ERR syntax error\n", "SCAN", "0", "COUNT", "0")
+	c.check("-ERR syntax error\n", "SCAN", "0", "MATCH")
+	c.check(":1\n", "PERSIST", "k3")
+	c.check(":-1\n", "TTL", "k3")
+	c.check(":1\n", "EXPIREAT", "k3", "1")
+	c.check(":0\n", "PEXPIREAT", "k3", "1")
+	c.check(":2\n", "DEL", "k2", "s1", "k3")
+	c.check(":0\n", "UNLINK", "k2")
+	c.check("$-1\n", "RANDOMKEY")
+}
+
+func TestRESPCollections(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c := connect()
+	c.check(":2\n", "SADD", "s1", "a", "b", "a")
+	c.check(":1\n", "SADD", "s1", "b", "c")
+	c.check(":1\n", "SREM", "s1", "c", "d")
+	c.check(":2\n", "SCARD", "s1")
+	c.check(":1\n", "SISMEMBER", "s1", "a")
+	c.check(":0\n", "SISMEMBER", "s1", "c")
+	c.check(":1\n", "SREM", "s1", "b")
+	c.check("*1\n$1\na\n", "SMEMBERS", "s1")
+	c.check("*2\n$1\n0\n*1\n$1\na\n", "SSCAN", "s1", "0")
+	c.check("-ERR syntax error\n", "SSCAN", "s1", "0", "TYPE", "set")
+	c.check(":3\n", "SADD", "s2", "a", "b", "c")
+	c.check("*1\n$1\na\n", "SINTER", "s1", "s2")
+	c.check("*0\n", "SDIFF", "s1", "s2")
+	c.check(":3\n", "SUNIONSTORE", "s3", "s1", "s2")
+	c.check(":2\n", "SDIFFSTORE", "s3", "s2", "s1")
+	c.check(":1\n", "SINTERCARD", "2", "s1", "s2", "LIMIT", "1")
+	c.check("-ERR numkeys should be greater than 0\n", "SINTERCARD", "0", "s1")
+	c.check("-ERR Number of keys can't be greater than number of args\n", "SINTERCARD", "3", "s1", "s2")
+	c.check("-ERR LIMIT can't be negative\n", "SINTERCARD", "1", "s1", "LIMIT", "-1")
+	c.check("*2\n:1\n:0\n", "SMISMEMBER", "s1", "a", "b")
+	c.check(":1\n", "SMOVE", "s2", "s4", "a")
+	c.check(":0\n", "SMOVE", "s2", "s4", "a")
+	c.check("$1\na\n", "SRANDMEMBER", "s4")
+	c.check("*2\n$1\na\n$1\na\n", "SRANDMEMBER", "s4", "-2")
+	c.check("-ERR value is out of range\n", "SRANDMEMBER", "s4", "-9223372036854775808")
+	c.check("$1\na\n", "SPOP", "s4")
+	c.check("$-1\n", "SPOP", "s4")
+	c.check("*0\n", "SPOP", "s4", "2")
+	c.check("-ERR value is out of range, must be positive\n", "SPOP", "s2", "-1")
+
+	c.check(":2\n", "HSET", "h1", "f1", "v1", "f2", "v2")
+	c.check(":0\n", "HSET", "h1", "f1", "v1.1")
+	c.check("-ERR wrong number of arguments for 'hset' command\n", "HSET", "h1", "f1", "v1", "f2")
+	c.check("$4\nv1.1\n", "HGET", "h1", "f1")
+	c.check("$-1\n", "HGET", "h1", "f9")
+	c.check(":0\n", "HSETNX", "h1", "f1", "v")
+	c.check("+OK\n", "HMSET", "h1", "f3", "")
+	c.check("*3\n$2\nv2\n$-1\n$0\n\n", "HMGET", "h1", "f2", "f9", "f3")
+	c.check(":3\n", "HLEN", "h1")
+	c.check(":1\n", "HEXISTS", "h1", "f3")
+	c.check("*2\n$1\n0\n*2\n$2\nf2\n$2\nv2\n", "HSCAN", "h1", "0", "MATCH", "f2")
+	c.check("-WRONGTYPE Operation against a key holding the wrong kind of value\n", "HSCAN", "s1", "0")
+	c.check("*6\n$2\nf1\n$4\nv1.1\n$2\nf2\n$2\nv2\n$2\nf3\n$0\n\n", "HGETALL", "h1")
+	c.check(":4\n", "HSTRLEN", "h1", "f1")
+	c.check(":2\n", "HDEL", "h1", "f1", "f3", "f9")
+	c.check("*2\n$2\nf2\n$2\nv2\n", "HRANDFIELD", "h1", "1", "WITHVALUES")
+	c.check("$-1\n", "HRANDFIELD", "h9")
+	c.check("-ERR value is out of range\n", "HRANDFIELD", "h1", "-9223372036854775808", "WITHVALUES")
+	c.check("-ERR syntax error\n", "HRANDFIELD", "h1", "1", "WITHSCORES")
+	c.check(":-3\n", "HINCRBY", "h2", "n", "-3")
+	c.check("-ERR value is not an integer or out of range\n", "HINCRBY", "h2", "n", "x")
+	c.check("$4\n-2.5\n", "HINCRBYFLOAT", "h2", "n", "0.5")
+	c.check("-ERR hash value is not an integer\n", "HINCRBY", "h2", "n", "1")
+	c.check("-ERR value is not a valid float\n", "HINCRBYFLOAT", "h2", "n", "x")
+	c.check("-ERR value is NaN or Infinity\n", "HINCRBYFLOAT", "h2", "n", "inf")
+	c.check("*2\n:1\n:-2\n", "HEXPIRE", "h2", "100", "FIELDS", "2", "n", "f9")
+	c.check("*1\n:0\n", "HPEXPIRE", "h2", "1000", "GT", "FIELDS", "1", "n")
+	c.check("*2\n:100\n:-2\n", "HTTL", "h2", "FIELDS", "2", "n", "f9")
+	c.check("*1\n:1\n", "HPERSIST", "h2", "FIELDS", "1", "n")
+	c.check("*1\n:-1\n", "HPTTL", "h2", "FIELDS", "1", "n")
+	c.check("-ERR Mandatory argument FIELDS is missing or not at the right position\n", "HEXPIRE", "h2", "100", "XX", "n", "1", "2")
+	c.check("-ERR Parameter `numFields` should be greater than 0\n", "HTTL", "h2", "FIELDS", "0", "n")
+	c.check("-ERR The `numfields` parameter must match the number of arguments\n", "HTTL", "h2", "FIELDS", "2", "n")
+	c.check("-ERR invalid expire time\n", "HEXPIREAT", "h2", "281474976710656", "FIELDS", "1", "n")
+	c.check("*2\n$4\n-2.5\n$-1\n", "HGETEX", "h2", "EX", "100", "FIELDS", "2", "n", "f9")
+	c.check("*1\n:100\n", "HTTL", "h2", "FIELDS", "1", "n")
+	c.check("-ERR syntax error\n", "HGETEX", "h2", "KEEPTTL", "FIELDS", "1", "n")
+	c.check("-ERR invalid expire time in 'hgetex' command\n", "HGETEX", "h2", "EX", "0", "FIELDS", "1", "n")
+	c.check(":0\n", "HSETEX", "h2", "FNX", "FIELDS", "2", "n", "1", "m", "2")
+	c.check(":1\n", "HSETEX", "h2", "FXX", "KEEPTTL", "FIELDS", "1", "n", "1")
+	c.check("*1\n:100\n", "HTTL", "h2", "FIELDS", "1", "n")
+	c.check(":1\n", "HSETEX", "h2", "PX", "5000", "FIELDS", "2", "n", "1", "m", "2")
+	c.check("*2\n:5\n:5\n", "HTTL", "h2", "FIELDS", "2", "n", "m")
+	c.check("-ERR syntax error\n", "HSETEX", "h2", "EX", "1", "KEEPTTL", "FIELDS", "1", "n", "1")
+
+	c.check(":3\n", "RPUSH", "l1", "b", "c", "d")
+	c.check(":4\n", "LPUSH", "l1", "a")
+	c.check("*2\n$1\nb\n$1\nc\n", "LRANGE", "l1", "1", "2")
+	c.check("$1\nd\n", "LINDEX", "l1", "-1")
+	c.check("$-1\n", "LINDEX", "l1", "10")
+	c.check("+OK\n", "LSET", "l1", "0", "A")
+	c.check("-ERR index out of range\n", "LSET", "l1", "10", "A")
+	c.check("-ERR no such key\n", "LSET", "l9", "0", "A")
+	c.check("$1\nA\n", "LPOP", "l1")
+	c.check("*2\n$1\nd\n$1\nc\n", "RPOP", "l1", "2")
+	c.check("+OK\n", "LTRIM", "l1", "0", "0")
+	c.check(":1\n", "LLEN", "l1")
+	c.check("$1\nb\n", "LPOP", "l1")
+	c.check("$-1\n", "LPOP", "l1")
+	c.check("*-1\n", "RPOP", "l1", "3")
+	c.check(":0\n", "RPUSHX", "l2", "a")
+	c.check(":0\n", "LINSERT", "l2", "BEFORE", "a", "b")
+	c.check(":3\n", "RPUSH", "l2", "a", "b", "a")
+	c.check(":4\n", "LPUSHX", "l2", "z")
+	c.check(":5\n", "LINSERT", "l2", "AFTER", "b", "c")
+	c.check(":-1\n", "LINSERT", "l2", "BEFORE", "x", "c")
+	c.check("-ERR syntax error\n", "LINSERT", "l2", "AROUND", "b", "c")
+	c.check(":1\n", "LPOS", "l2", "a")
+	c.check(":4\n", "LPOS", "l2", "a", "RANK", "-1")
+	c.check("$-1\n", "LPOS", "l2", "x")
+	c.check("*2\n:1\n:4\n", "LPOS", "l2", "a", "COUNT", "0")
+	c.check("*0\n", "LPOS", "l2", "a", "COUNT", "0", "MAXLEN", "1")
+	c.check("-ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list\n", "LPOS", "l2", "a", "RANK", "0")
+	c.check("-ERR COUNT can't be negative\n", "LPOS", "l2", "a", "COUNT", "-1")
+	c.check("-ERR syntax error\n", "LPOS", "l2", "a", "RANK")
+	c.check(":1\n", "LREM", "l2", "-1", "a")
+	c.check("*4\n$1\nz\n$1\na\n$1\nb\n$1\nc\n", "LRANGE", "l2", "0", "-1")
+	c.check("*0\n", "LPOP", "l2", "0")
+	c.check("*2\n$2\nl2\n*2\n$1\nc\n$1\nb\n", "LMPOP", "2", "l9", "l2", "RIGHT", "COUNT", "2")
+	c.check("*-1\n", "LMPOP", "1", "l9", "LEFT")
+	c.check("-ERR count should be greater than 0\n", "LMPOP", "1", "l2", "LEFT", "COUNT", "0")
+	c.check("-ERR numkeys should be greater than 0\n", "LMPOP", "0", "l2", "LEFT")
+	c.check("$1\na\n", "RPOPLPUSH", "l2", "l3")
+	c.check("$1\nz\n", "BRPOPLPUSH", "l2", "l3", "0")
+	c.check("*2\n$1\nz\n$1\na\n", "LRANGE", "l3", "0", "-1")
+
+	c.check(":3\n", "ZADD", "z1", "1", "a", "2", "b", "3", "c")
+	c.check(":1\n", "ZADD", "z1", "XX", "CH", "GT", "0", "a", "2.5", "b")
+	c.check("$-1\n", "ZADD", "z1", "NX", "INCR", "1", "a")
+	c.check("$1\n2\n", "ZADD", "z1", "INCR", "1", "a")
+	c.check("-ERR syntax error\n", "ZADD", "z1", "INCR", "1", "a", "2", "b")
+	c.check("-ERR value is not a valid float\n", "ZADD", "z1", "one", "a")
+	c.check("$3\n2.5\n", "ZSCORE", "z1", "b")
+	c.check("$-1\n", "ZSCORE", "z1", "z")
+	c.check("$3\n4.5\n", "ZINCRBY", "z1", "2", "b")
+	c.check(":3\n", "ZCARD", "z1")
+	c.check(":2\n", "ZCOUNT", "z1", "(2", "+inf")
+	c.check(":1\n", "ZRANK", "z1", "c")
+	c.check(":0\n", "ZREVRANK", "z1", "b")
+	c.check("$-1\n", "ZRANK", "z1", "z")
+	c.check("*6\n$1\na\n$1\n2\n$1\nc\n$1\n3\n$1\nb\n$3\n4.5\n", "ZRANGE", "z1", "0", "-1", "WITHSCORES")
+	c.check("*2\n$1\nb\n$1\nc\n", "ZRANGE", "z1", "0", "1", "REV")
+	c.check("*1\n$1\nc\n", "ZRANGE", "z1", "(2", "+inf", "BYSCORE", "LIMIT", "0", "1")
+	c.check("*2\n$1\nb\n$1\nc\n", "ZREVRANGEBYSCORE", "z1", "+inf", "(2")
+	c.check("*2\n$1\nc\n$1\n3\n", "ZRANGEBYSCORE", "z1", "3", "4", "WITHSCORES")
+	c.check("*1\n$1\nb\n", "ZREVRANGE", "z1", "0", "0")
+	c.check("-ERR syntax error\n", "ZRANGEBYSCORE", "z1", "0", "1", "REV")
+	c.check("-ERR min or max is not a float\n", "ZRANGEBYSCORE", "z1", "a", "1")
+	c.check(":2\n", "ZRANGESTORE", "z2", "z1", "0", "1")
+	c.check("*2\n$1\nb\n$3\n4.5\n", "ZPOPMAX", "z1")
+	c.check("*4\n$1\na\n$1\n2\n$1\nc\n$1\n3\n", "ZPOPMIN", "z1", "5")
+	c.check(":1\n", "ZREM", "z2", "a", "z")
+	c.check(":2\n", "ZADD", "z3", "0", "a", "0", "b")
+	c.check("*1\n$1\nb\n", "ZRANGEBYLEX", "z3", "(a", "+")
+}
+
+func TestRESP3(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c := connect()
+	c.check("-NOPROTO unsupported protocol version\n", "HELLO", "4")
+	c.check("*14\n$6\nserver\n$6\nrestis\n$7\nversion\n$5\n7.2.0\n$5\nproto\n:2\n$2\nid\n:1\n$4\nmode\n$10\nstandalone\n$4\nrole\n$6\nmaster\n$7\nmodules\n*0\n", "HELLO")
+	c.check("%7\n$6\nserver\n$6\nrestis\n$7\nversion\n$5\n7.2.0\n$5\nproto\n:3\n$2\nid\n:1\n$4\nmode\n$10\nstandalone\n$4\nrole\n$6\nmaster\n$7\nmodules\n*0\n", "HELLO", "3", "AUTH", "default", "secret", "SETNAME", "tests")
+	c.check("$5\ntests\n", "CLIENT", "GETNAME")
+	c.check("_\n", "GET", "k1")
+	c.check(":1\n", "SADD", "s1", "a")
+	c.check("~1\n$1\na\n", "SMEMBERS", "s1")
+	c.check(":2\n", "ZADD", "z1", "1.5", "a", "+inf", "b")
+	c.check(",1.5\n", "ZSCORE", "z1", "a")
+	c.check("*2\n*2\n$1\na\n,1.5\n*2\n$1\nb\n,inf\n", "ZRANGE", "z1", "0", "-1", "WITHSCORES")
+	c.check("*2\n$1\na\n,1.5\n", "ZPOPMIN", "z1")
+	c.check("*1\n*2\n$1\nb\n,inf\n", "ZPOPMIN", "z1", "1")
+	c.check("_\n", "ZSCORE", "z1", "a")
+	c.check(":2\n", "HSET", "h1", "f1", "v1", "f2", "v2")
+	c.check("%2\n$2\nf1\n$2\nv1\n$2\nf2\n$2\nv2\n", "HGETALL", "h1")
+	c.check(":1\n", "HDEL", "h1", "f2")
+	c.check("*2\n*2\n$2\nf1\n$2\nv1\n*2\n$2\nf1\n$2\nv1\n", "HRANDFIELD", "h1", "-2", "WITHVALUES")
+}
+
+func TestRESPConnection(t *testing.T) {
+	server, connect := startRESPServer(t)
+	c := connect()
+	c.check("-ERR unknown command 'NOPE', with args beginning with: 'a' 'b'\n", "NOPE", "a", "b")
+	c.check("-ERR wrong number of arguments for 'get' command\n", "GET")
+	c.check("+OK\n", "SELECT", "0")
+	c.check("-ERR DB index is out of range\n", "SELECT", "1")
+	c.check("$2\nhi\n", "ECHO", "hi")
+	c.check("*0\n", "COMMAND", "DOCS")
+	c.check("-ERR snapshots are not configured\n", "SAVE")
+	c.check("-ERR syntax error\n", "BGSAVE", "NOW")
+
+	io.WriteString(c.conn, "PING\r\n\r\nSET k1 v1\r\n"+encodeCommand("GET", "k1")+"*0\r\n"+encodeCommand("DEL", "k1"))
+	c.expect("+PONG\n", "inline PING")
+	c.expect("+OK\n", "inline SET")
+	c.expect("$2\nv1\n", "pipelined GET")
+	c.expect(":1\n", "pipelined DEL")
+
+	c.check("+OK\n", "QUIT")
+	_, err := c.reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	c = connect()
+	io.WriteString(c.conn, "*1\r\n+PING\r\n")
+	c.expect("-ERR Protocol error: expected '$', got \"+PING\"\n", "protocol error")
+	_, err = c.reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	c = connect()
+	c.check("+PONG\n", "PING")
+	assert.NoError(t, server.Close())
+	_, err = c.reader.ReadByte()
+	assert.Error(t, err)
+	assert.Equal(t, ErrServerClosed, server.Serve(&net.TCPListener{}))
+}
+
+func TestRESPPubSub(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	subscriber, publisher := connect(), connect()
+
+	subscriber.check("*3\n$9\nsubscribe\n$4\nnews\n:1\n", "SUBSCRIBE", "news")
+	subscriber.check("*3\n$10\npsubscribe\n$6\nnews.*\n:2\n", "PSUBSCRIBE", "news.*")
+	subscriber.check("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\n", "GET", "k")
+	subscriber.check("*2\n$4\npong\n$0\n\n", "PING")
+
+	publisher.check(":1\n", "PUBLISH", "news", "hello")
+	subscriber.expect("*3\n$7\nmessage\n$4\nnews\n$5\nhello\n", "message")
+	publisher.check(":1\n", "PUBLISH", "news.tech", "restis")
+	subscriber.expect("*4\n$8\npmessage\n$6\nnews.*\n$9\nnews.tech\n$6\nrestis\n", "pmessage")
+	publisher.check(":0\n", "PUBLISH", "sports", "goal")
+
+	publisher.check("*1\n$4\nnews\n", "PUBSUB", "CHANNELS")
+	publisher.check("*0\n", "PUBSUB", "CHANNELS", "sp*")
+	publisher.check("*4\n$4\nnews\n:1\n$6\nsports\n:0\n", "PUBSUB", "NUMSUB", "news", "sports")
+	publisher.check(":1\n", "PUBSUB", "NUMPAT")
+	publisher.check("-ERR unknown subcommand 'nope'. Try PUBSUB HELP.\n", "PUBSUB", "nope")
+
+	subscriber.check("*3\n$11\nunsubscribe\n$4\nnews\n:1\n", "UNSUBSCRIBE")
+	subscriber.check("*3\n$12\npunsubscribe\n$6\nnews.*\n:0\n", "PUNSUBSCRIBE")
+	subscriber.check("*3\n$12\npunsubscribe\n$-1\n:0\n", "PUNSUBSCRIBE")
+	subscriber.check("$-1\n", "GET", "k")
+	publisher.check(":0\n", "PUBLISH", "news", "hello")
+
+	resp3 := connect()
+	io.WriteString(resp3.conn, encodeCommand("HELLO", "3"))
+	resp3.readReply()
+	resp3.check(">3\n$9\nsubscribe\n$4\nnews\n:1\n", "SUBSCRIBE", "news")
+	resp3.check("_\n", "GET", "k")
+	publisher.check(":1\n", "PUBLISH", "news", "pushed")
+	resp3.expect(">3\n$7\nmessage\n$4\nnews\n$6\npushed\n", "push")
+}
+
+func TestRESPPubSubDisabled(t *testing.T) {
+	server, connect := startRESPServerWithStore(t, struct{ Store }{NewMemoryStore()})
+	defer server.Close()
+	c := connect()
+	c.check("-ERR pub/sub is not available on this store\n", "SUBSCRIBE", "news")
+	c.check("-ERR pub/sub is not available on this store\n", "PUBLISH", "news", "hello")
+	c.check("+PONG\n", "PING")
+}
+
+func TestRESPKeyspaceEvents(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c, subscriber := connect(), connect()
+	c.check("*2\n$22\nnotify-keyspace-events\n$0\n\n", "CONFIG", "GET", "notify-*")
+	c.check("*0\n", "CONFIG", "GET", "maxmemory")
+	c.check("-ERR Invalid event class character. Use 'g$lshzxKEA'.\n", "CONFIG", "SET", "notify-keyspace-events", "KEm")
+	c.check("-ERR Unknown option or number of arguments for CONFIG SET - 'maxmemory'\n", "CONFIG", "SET", "maxmemory", "1")
+	c.check("-ERR unknown subcommand 'REWRITE'. Try CONFIG HELP.\n", "CONFIG", "REWRITE")
+	c.check("+OK\n", "CONFIG", "SET", "notify-keyspace-events", "KEA")
+	c.check("*2\n$22\nnotify-keyspace-events\n$3\nAKE\n", "CONFIG", "GET", "notify-keyspace-events")
+
+	subscriber.check("*3\n$10\npsubscribe\n$16\n__keyspace@0__:*\n:1\n", "PSUBSCRIBE", "__keyspace@0__:*")
+	c.check("+OK\n", "SET", "k", "v")
+	subscriber.expect("*4\n$8\npmessage\n$16\n__keyspace@0__:*\n$16\n__keyspace@0__:k\n$3\nset\n", "set")
+	c.check(":1\n", "DEL", "k")
+	subscriber.expect("*4\n$8\npmessage\n$16\n__keyspace@0__:*\n$16\n__keyspace@0__:k\n$3\ndel\n", "del")
+}
+
+func TestRESPTransactions(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c, other := connect(), connect()
+	c.check("-ERR EXEC without MULTI\n", "EXEC")
+	c.check("-ERR DISCARD without MULTI\n", "DISCARD")
+
+	c.check("+OK\n", "MULTI")
+	c.check("-ERR MULTI calls can not be nested\n", "MULTI")
+	c.check("+QUEUED\n", "SET", "k", "v")
+	c.check("+QUEUED\n", "INCR", "k")
+	c.check("+QUEUED\n", "GET", "k")
+	other.check("$-1\n", "GET", "k")
+	c.check("*3\n+OK\n-ERR value is not an integer or out of range\n$1\nv\n", "EXEC")
+
+	c.check("+OK\n", "MULTI")
+	c.check("+QUEUED\n", "DEL", "k")
+	c.check("+OK\n", "DISCARD")
+	c.check("$1\nv\n", "GET", "k")
+
+	// Commands rejected while queuing abort the whole transaction.
+	c.check("+OK\n", "MULTI")
+	c.check("+QUEUED\n", "DEL", "k")
+	c.check("-ERR wrong number of arguments for 'get' command\n", "GET")
+	c.check("-ERR Command not allowed inside a transaction\n", "SUBSCRIBE", "news")
+	c.check("-EXECABORT Transaction discarded because of previous errors.\n", "EXEC")
+	c.check("$1\nv\n", "GET", "k")
+
+	c.check("+OK\n", "WATCH", "k", "missing")
+	c.check("+OK\n", "MULTI")
+	c.check("-ERR WATCH inside MULTI is not allowed\n", "WATCH", "other")
+	c.check("+QUEUED\n", "SET", "k", "w")
+	c.check("*1\n+OK\n", "EXEC")
+
+	c.check("+OK\n", "WATCH", "k")
+	other.check("+OK\n", "SET", "k", "x")
+	c.check("+OK\n", "MULTI")
+	c.check("+QUEUED\n", "SET", "k", "w")
+	c.check("*-1\n", "EXEC")
+	c.check("$1\nx\n", "GET", "k")
+
+	// EXEC and UNWATCH both forget watched keys.
+	c.check("+OK\n", "WATCH", "k")
+	other.check("+OK\n", "SET", "k", "y")
+	c.check("+OK\n", "UNWATCH")
+	c.check("+OK\n", "MULTI")
+	c.check("+QUEUED\n", "SET", "k", "w")
+	c.check("*1\n+OK\n", "EXEC")
+	c.check("$1\nw\n", "GET", "k")
+}
+
+func TestRESPScripts(t *testing.T) {
+	server, connect := startRESPServer(t)
+	defer server.Close()
+	c := connect()
+	c.check("*3\n:1\n$2\nk1\n$1\na\n", "EVAL", "return {#KEYS, KEYS[1], ARGV[1]}", "1", "k1", "a")
+	c.check("+OK\n", "EVAL", "return redis.call('SET', KEYS[1], ARGV[1])", "1", "k", "v")
+	c.check("$1\nv\n", "EVAL", "return redis.call('GET', KEYS[1])", "1", "k")
+	c.check("$-1\n", "EVAL", "return redis.call('GET', 'missing')", "0")
+	c.check("-WRONGTYPE Operation against a key holding the wrong kind of value\n", "EVAL", "return redis.call('LPUSH', 'k', 'x')", "0")
+	c.check("-ERR user_script:1: Script attempted to access nonexistent global variable 'x'\n", "EVAL", "return x", "0")
+	c.check("-ERR Error compiling script (new function): user_script:1: unexpected symbol near '+'\n", "EVAL", "return +", "0")
+	c.check("-ERR Number of keys can't be greater than number of args\n", "EVAL", "return 1", "2", "k")
+	c.check("-ERR Number of keys can't be negative\n", "EVAL", "return 1", "-1")
+	c.check("-ERR value is not an integer or out of range\n", "EVAL", "return 1", "one")
+
+	c.check("$40\ne0e1f9fabfc9d4800c877a703b823ac0578ff8db\n", "SCRIPT", "LOAD", "return 1")
+	c.check(":1\n", "EVALSHA", "e0e1f9fabfc9d4800c877a703b823ac0578ff8db", "0")
+	c.check("*2\n:1\n:0\n", "SCRIPT", "EXISTS", "e0e1f9fabfc9d4800c877a703b823ac0578ff8db", "missing")
+	c.check("+OK\n", "SCRIPT", "FLUSH")
+	c.check("-NOSCRIPT No matching script. Please use EVAL.\n", "EVALSHA", "e0e1f9fabfc9d4800c877a703b823ac0578ff8db", "0")
+	c.check("-NOTBUSY No scripts in execution right now.\n", "SCRIPT", "KILL")
+	c.check("-ERR unknown subcommand 'HELP'. Try SCRIPT HELP.\n", "SCRIPT", "HELP")
+	c.check("-ERR wrong number of arguments for 'script|load' command\n", "SCRIPT", "LOAD")
+
+	// Scripts can run in transactions.
+	c.check("+OK\n", "MULTI")
+	c.check("+QUEUED\n", "EVAL", "return redis.call('INCR', KEYS[1])", "1", "n")
+	c.check("+QUEUED\n", "GET", "n")
+	c.check("*2\n:1\n$1\n1\n", "EXEC")
+}
+
+func TestRESPTransactionsDisabled(t *testing.T) {
+	server, connect := startRESPServerWithStore(t, struct{ Store }{NewMemoryStore()})
+	defer server.Close()
+	c := connect()
+	c.check("-ERR transactions are not available on this store\n", "MULTI")
+	c.check("-ERR transactions are not available on this store\n", "WATCH", "k")
+	c.check("-ERR EXEC without MULTI\n", "EXEC")
+	c.check("-ERR scripting is not available on this store\n", "EVAL", "return 1", "0")
+}
+
+func TestRESPBlockingLists(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	server, connect := startRESPServerWithStore(t, store)
+	defer server.Close()
+	c := connect()
+	c.check(":3\n", "RPUSH", "l1", "a", "b", "c")
+	c.check("*2\n$2\nl1\n$1\na\n", "BLPOP", "l0", "l1", "1")
+	c.check("*2\n$2\nl1\n$1\nc\n", "BRPOP", "l1", "0.5")
+	c.check("*-1\n", "BLPOP", "l0", "0.01")
+	c.check("-ERR timeout is negative\n", "BLPOP", "l0", "-1")
+	c.check("-ERR timeout is not a float or out of range\n", "BLPOP", "l0", "soon")
+	c.check("$1\nb\n", "LMOVE", "l1", "l2", "LEFT", "right")
+	c.check("$-1\n", "LMOVE", "l1", "l2", "LEFT", "RIGHT")
+	c.check("-ERR syntax error\n", "LMOVE", "l2", "l1", "UP", "RIGHT")
+	c.check("$1\nb\n", "BLMOVE", "l2", "l1", "RIGHT", "LEFT", "1")
+	c.check("$-1\n", "BLMOVE", "l2", "l1", "RIGHT", "LEFT", "0.01")
+
+	// A blocked client is served by a push from another.
+	if _, err := io.WriteString(c.conn, encodeCommand("BLPOP", "queue", "5")+encodeCommand("PING")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	other := connect()
+	other.check(":1\n", "RPUSH", "queue", "job")
+	c.expect("*2\n$5\nqueue\n$3\njob\n", "BLPOP queue 5")
+	c.expect("+PONG\n", "PING")
+
+	c.check("+OK\n", "MULTI")
+	c.check("+QUEUED\n", "BLPOP", "queue", "0")
+	c.check("*1\n*-1\n", "EXEC")
+
+	// A client that disconnects stops waiting.
+	if _, err := io.WriteString(other.conn, encodeCommand("BLPOP", "queue", "0")); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "client never started waiting", func() bool {
+		return atomic.LoadInt64(&store.waiters.waiting) == 1
+	})
+	other.conn.Close()
+	waitUntil(t, "disconnected client still waiting", func() bool {
+		return atomic.LoadInt64(&store.waiters.waiting) == 0
+	})
+	c.check(":1\n", "RPUSH", "queue", "kept")
+	c.check("*1\n$4\nkept\n", "LRANGE", "queue", "0", "-1")
+}
@@ -0,0 +1,231 @@
+package restis
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sort"
+)
+
+const defaultScanCount = 10
+
+// Scans visit elements in the order of their scan position, which depends
+// only on the element itself. Adding or removing other elements doesn't move
+// an element past the cursor, so every element present for the whole of a
+// scan is returned, and none is returned twice.
+func scanPosition(element string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	return h.Sum64()
+}
+
+// keyScanPosition puts the shard of a key in the top six bits of its
+// position, so that a scan of the keyspace walks one shard at a time.
+func keyScanPosition(key string) uint64 {
+	return uint64(shardIndex(key))<<58 | scanPosition(key)>>6
+}
+
+func shardScanStart(i int) uint64 {
+	return uint64(i) << 58
+}
+
+func (o ScanOptions) count() (int, error) {
+	switch {
+	case o.Count < 0:
+		return 0, ErrSyntax
+	case o.Count == 0:
+		return defaultScanCount, nil
+	}
+	return int(o.Count), nil
+}
+
+func (o ScanOptions) matches(element string) bool {
+	return o.Match == "" || matchGlob(o.Match, element)
+}
+
+// scanPage returns the first count elements at or after cursor in scan
+// order, along with any that share the last one's position so that the next
+// cursor doesn't split them, and the cursor that carries on after them. The
+// cursor is 0 once there's nothing left. Rather than sorting every element,
+// it keeps the count lowest positions in a heap, so a page costs time
+// proportional to the number of elements and the log of count.
+func scanPage(elements []string, position func(string) uint64, cursor uint64, count int) ([]string, uint64) {
+	lowest := &positionHeap{}
+	for _, element := range elements {
+		p := position(element)
+		switch {
+		case p < cursor:
+		case lowest.Len() < count:
+			heap.Push(lowest, p)
+		case p < (*lowest)[0]:
+			(*lowest)[0] = p
+			heap.Fix(lowest, 0)
+		}
+	}
+	last := ^uint64(0)
+	if lowest.Len() == count && count > 0 {
+		last = (*lowest)[0]
+	}
+	type positioned struct {
+		element  string
+		position uint64
+	}
+	page := []positioned{}
+	var next uint64
+	for _, element := range elements {
+		p := position(element)
+		switch {
+		case p < cursor:
+		case p <= last:
+			page = append(page, positioned{element, p})
+		case next == 0 || p < next:
+			next = p
+		}
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return page[i].position < page[j].position
+	})
+	ordered := make([]string, len(page))
+	for i, e := range page {
+		ordered[i] = e.element
+	}
+	return ordered, next
+}
+
+// positionHeap is a max-heap of scan positions.
+type positionHeap []uint64
+
+func (h positionHeap) Len() int            { return len(h) }
+func (h positionHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h positionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *positionHeap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *positionHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (sh *shard) keys() []string {
+	keys := make([]string, 0, sh.size())
+	for key := range sh.strings {
+		keys = append(keys, key)
+	}
+	for key := range sh.sets {
+		keys = append(keys, key)
+	}
+	for key := range sh.hashes {
+		keys = append(keys, key)
+	}
+	for key := range sh.lists {
+		keys = append(keys, key)
+	}
+	for key := range sh.sortedSets {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// liveKeys returns the keys of sh, expiring any whose time has passed. It's
+// called with sh locked.
+func (s *MemoryStore) liveKeys(sh *shard) []string {
+	now := s.now()
+	keys := []string{}
+	for _, key := range sh.keys() {
+		if !s.expireIfNeeded(sh, key, now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Keys returns every key matching pattern, locking one shard at a time.
+func (s *MemoryStore) Keys(pattern string) ([]string, error) {
+	matched := []string{}
+	for _, sh := range s.shards {
+		sh.Lock()
+		for _, key := range s.liveKeys(sh) {
+			if matchGlob(pattern, key) {
+				matched = append(matched, key)
+			}
+		}
+		sh.Unlock()
+	}
+	return matched, nil
+}
+
+// Scan returns a page of keys and the cursor for the next one, starting
+// from cursor 0 and ending when the returned cursor is 0 again. Each call
+// looks at keys in only as many shards as it needs to fill the page.
+func (s *MemoryStore) Scan(cursor uint64, options ScanOptions) (uint64, []string, error) {
+	count, err := options.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	keys := []string{}
+	for i := int(cursor >> 58); i < shardCount && count > 0; i++ {
+		sh := s.shards[i]
+		sh.Lock()
+		page, next := scanPage(s.liveKeys(sh), keyScanPosition, cursor, count)
+		for _, key := range page {
+			if options.matches(key) && (options.Type == "" || sh.keyType(key) == options.Type) {
+				keys = append(keys, key)
+			}
+		}
+		sh.Unlock()
+		if next != 0 {
+			return next, keys, nil
+		}
+		count -= len(page)
+		cursor = shardScanStart(i + 1)
+	}
+	// The start of the shard after the last wraps around to 0.
+	return cursor, keys, nil
+}
+
+func (s *MemoryStore) SetScan(key string, cursor uint64, options ScanOptions) (uint64, []string, error) {
+	count, err := options.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeSet); err != nil {
+		return 0, nil, err
+	}
+	members := make([]string, 0, len(sh.sets[key]))
+	for member := range sh.sets[key] {
+		members = append(members, member)
+	}
+	page, next := scanPage(members, scanPosition, cursor, count)
+	matched := []string{}
+	for _, member := range page {
+		if options.matches(member) {
+			matched = append(matched, member)
+		}
+	}
+	return next, matched, nil
+}
+
+func (s *MemoryStore) HashScan(key string, cursor uint64, options ScanOptions) (uint64, map[string]string, error) {
+	count, err := options.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	sh := s.lock(key)
+	defer sh.Unlock()
+	if err := sh.expectType(key, typeHash); err != nil {
+		return 0, nil, err
+	}
+	fields := make([]string, 0, len(sh.hashes[key]))
+	for field := range sh.hashes[key] {
+		fields = append(fields, field)
+	}
+	page, next := scanPage(fields, scanPosition, cursor, count)
+	matched := map[string]string{}
+	for _, field := range page {
+		if options.matches(field) {
+			matched[field] = sh.hashes[key][field]
+		}
+	}
+	return next, matched, nil
+}
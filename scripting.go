@@ -0,0 +1,513 @@
+package restis
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoScript         = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	ErrScriptsDisabled  = errors.New("ERR scripting is not available on this store")
+	ErrScriptTimeout    = errors.New("ERR Error running script, script exceeded its time limit")
+	ErrScriptKilled     = errors.New("ERR Error running script, script killed by user with SCRIPT KILL")
+	ErrNoScriptsRunning = errors.New("NOTBUSY No scripts in execution right now.")
+)
+
+// DefaultScriptTimeout is how long a script can run before it's stopped.
+const DefaultScriptTimeout = 5 * time.Second
+
+// A ScriptError is an error raised by a script, or one it failed to compile
+// with.
+type ScriptError struct {
+	Message string
+}
+
+func (e *ScriptError) Error() string {
+	return e.Message
+}
+
+// ScriptStatus is a status reply returned by a script, such as the OK of
+// redis.status_reply('OK').
+type ScriptStatus string
+
+// scriptStore is implemented by stores that can run scripts, and backs
+// EVAL, EVALSHA and SCRIPT and the /scripts routes.
+type scriptStore interface {
+	Scripts() *Scripts
+}
+
+// Scripts runs Lua scripts against a store, the way Redis' EVAL does. Each
+// script runs in a transaction, so nothing else happens while it does, and
+// calls back into the store with redis.call. Scripts are cached by the SHA1
+// of their source, and can be registered under a name.
+//
+// A script's results are converted as Redis converts them: numbers are
+// truncated to int64, strings stay strings, true becomes 1 and false nil,
+// tables become []interface{} up to their first nil, and {ok=...} and
+// {err=...} tables become a ScriptStatus or an error.
+type Scripts struct {
+	store Store
+	*scriptCache
+}
+
+type scriptCache struct {
+	mu         sync.Mutex
+	scripts    map[string]*luaFunctionProto
+	registered map[string]registeredScript
+	running    map[*luaState]*int32 // each running script's kill flag
+	timeout    time.Duration
+}
+
+type registeredScript struct {
+	source, sha string
+	proto       *luaFunctionProto
+}
+
+// NewScripts returns a script cache for store, which must support
+// transactions for scripts to run.
+func NewScripts(store Store) *Scripts {
+	return &Scripts{store, &scriptCache{
+		scripts:    make(map[string]*luaFunctionProto),
+		registered: make(map[string]registeredScript),
+		running:    make(map[*luaState]*int32),
+		timeout:    DefaultScriptTimeout,
+	}}
+}
+
+// on returns scripts that share the cache of sc but run against store.
+func (sc *Scripts) on(store Store) *Scripts {
+	return &Scripts{store, sc.scriptCache}
+}
+
+func scriptSHA(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+func compileScript(source string) (*luaFunctionProto, error) {
+	proto, err := parseLua(source)
+	if err != nil {
+		return nil, &ScriptError{"Error compiling script (new function): " + err.Error()}
+	}
+	return proto, nil
+}
+
+// Timeout returns how long scripts can run before they're stopped.
+func (sc *Scripts) Timeout() time.Duration {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.timeout
+}
+
+// SetTimeout sets how long scripts can run before they're stopped with
+// ErrScriptTimeout, or lets them run forever if timeout is 0.
+func (sc *Scripts) SetTimeout(timeout time.Duration) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.timeout = timeout
+}
+
+// Load compiles and caches a script without running it, and returns its SHA1.
+func (sc *Scripts) Load(source string) (string, error) {
+	_, sha, err := sc.load(source)
+	return sha, err
+}
+
+func (sc *Scripts) load(source string) (*luaFunctionProto, string, error) {
+	sha := scriptSHA(source)
+	sc.mu.Lock()
+	proto, ok := sc.scripts[sha]
+	sc.mu.Unlock()
+	if ok {
+		return proto, sha, nil
+	}
+	proto, err := compileScript(source)
+	if err != nil {
+		return nil, "", err
+	}
+	sc.mu.Lock()
+	sc.scripts[sha] = proto
+	sc.mu.Unlock()
+	return proto, sha, nil
+}
+
+// Exists reports whether each script is cached.
+func (sc *Scripts) Exists(shas ...string) []bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	exists := make([]bool, len(shas))
+	for i, sha := range shas {
+		_, exists[i] = sc.scripts[strings.ToLower(sha)]
+	}
+	return exists
+}
+
+// Flush empties the cache. Registered scripts stay registered.
+func (sc *Scripts) Flush() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.scripts = make(map[string]*luaFunctionProto)
+}
+
+// Kill stops every running script at its next check of its time limit,
+// making it fail with ErrScriptKilled. As with a timeout, whatever a script
+// wrote before it was stopped stays written.
+func (sc *Scripts) Kill() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.running) == 0 {
+		return ErrNoScriptsRunning
+	}
+	for _, killed := range sc.running {
+		atomic.StoreInt32(killed, 1)
+	}
+	return nil
+}
+
+// Register compiles a script and registers it under name, replacing any
+// script already registered there, and returns its SHA1.
+func (sc *Scripts) Register(name, source string) (string, error) {
+	proto, err := compileScript(source)
+	if err != nil {
+		return "", err
+	}
+	sha := scriptSHA(source)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.registered[name] = registeredScript{source, sha, proto}
+	return sha, nil
+}
+
+// Unregister removes the script registered under name, and reports whether
+// there was one.
+func (sc *Scripts) Unregister(name string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	_, ok := sc.registered[name]
+	delete(sc.registered, name)
+	return ok
+}
+
+// Registered returns the source and SHA1 of the script registered under
+// name.
+func (sc *Scripts) Registered(name string) (source, sha string, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	script, ok := sc.registered[name]
+	return script.source, script.sha, ok
+}
+
+// Names returns the names scripts are registered under, sorted.
+func (sc *Scripts) Names() []string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	names := make([]string, 0, len(sc.registered))
+	for name := range sc.registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Eval runs a script with the keys and arguments it sees as KEYS and ARGV,
+// caching it for EvalSHA.
+func (sc *Scripts) Eval(source string, keys, args []string) (interface{}, error) {
+	proto, _, err := sc.load(source)
+	if err != nil {
+		return nil, err
+	}
+	return sc.run(proto, keys, args)
+}
+
+// EvalSHA runs a cached script, or returns ErrNoScript.
+func (sc *Scripts) EvalSHA(sha string, keys, args []string) (interface{}, error) {
+	sc.mu.Lock()
+	proto, ok := sc.scripts[strings.ToLower(sha)]
+	sc.mu.Unlock()
+	if !ok {
+		return nil, ErrNoScript
+	}
+	return sc.run(proto, keys, args)
+}
+
+// Run runs the script registered under name, or returns ErrNoScript.
+func (sc *Scripts) Run(name string, keys, args []string) (interface{}, error) {
+	sc.mu.Lock()
+	script, ok := sc.registered[name]
+	sc.mu.Unlock()
+	if !ok {
+		return nil, ErrNoScript
+	}
+	return sc.run(script.proto, keys, args)
+}
+
+// luaGlobals are shared by every script, which can't change them.
+var luaGlobals = luaScriptingLibrary()
+
+func (sc *Scripts) run(proto *luaFunctionProto, keys, args []string) (interface{}, error) {
+	store, ok := sc.store.(transactionStore)
+	if !ok {
+		return nil, ErrScriptsDisabled
+	}
+	var result interface{}
+	err := store.Transaction(func(tx Store) error {
+		killed := new(int32)
+		L := &luaState{
+			globals: luaGlobals,
+			env:     map[string]interface{}{"KEYS": luaStrings(keys), "ARGV": luaStrings(args)},
+			store:   tx,
+			killed:  func() bool { return atomic.LoadInt32(killed) == 1 },
+		}
+		sc.mu.Lock()
+		if sc.timeout > 0 {
+			L.deadline = time.Now().Add(sc.timeout)
+		}
+		sc.running[L] = killed
+		sc.mu.Unlock()
+		defer func() {
+			sc.mu.Lock()
+			delete(sc.running, L)
+			sc.mu.Unlock()
+		}()
+
+		results, err := L.call(&luaClosure{proto: proto}, nil)
+		if luaErr, ok := err.(*luaError); ok {
+			if luaErr.cause != nil {
+				return luaErr.cause
+			}
+			return &ScriptError{luaErr.Error()}
+		}
+		if err != nil {
+			return err
+		}
+		result = luaResult(luaArg(results, 0))
+		if err, ok := result.(error); ok {
+			result = nil
+			return err
+		}
+		return nil
+	})
+	return result, err
+}
+
+func luaStrings(values []string) *luaTable {
+	t := newLuaTable()
+	for i, v := range values {
+		t.set(float64(i+1), v)
+	}
+	return t
+}
+
+// luaResult converts a value a script returned into a Go value.
+func luaResult(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		return v
+	case bool:
+		if v {
+			return int64(1)
+		}
+	case *luaTable:
+		if err, ok := v.get("err").(string); ok {
+			return &ScriptError{err}
+		}
+		if status, ok := v.get("ok").(string); ok {
+			return ScriptStatus(status)
+		}
+		results := make([]interface{}, 0, len(v.array))
+		for _, item := range v.array {
+			results = append(results, luaResult(item))
+		}
+		return results
+	}
+	return nil
+}
+
+// luaScriptingLibrary adds the redis library to the standard ones.
+func luaScriptingLibrary() *luaTable {
+	globals := luaLibrary()
+	globals.set("redis", luaLibraryTable(map[string]func(*luaState, []interface{}) ([]interface{}, error){
+		"call":         luaRedisCall(true),
+		"error_reply":  luaRedisReply("err", "error_reply"),
+		"pcall":        luaRedisCall(false),
+		"sha1hex":      luaRedisSHA1Hex,
+		"status_reply": luaRedisReply("ok", "status_reply"),
+	}))
+	return globals
+}
+
+// luaForbiddenCommands can't be called from scripts, because they'd block,
+// reply more than once or run scripts themselves.
+var luaForbiddenCommands = map[string]bool{
+	"eval": true, "evalsha": true, "script": true,
+	"multi": true, "exec": true, "discard": true, "watch": true, "unwatch": true,
+	"hello": true, "auth": true, "quit": true, "client": true,
+}
+
+// luaRedisCall runs a command against the script's transaction, as if it
+// came over RESP2, and converts its reply. redis.call raises error replies
+// and redis.pcall returns them as {err=...} tables.
+func luaRedisCall(raise bool) func(*luaState, []interface{}) ([]interface{}, error) {
+	return func(L *luaState, args []interface{}) ([]interface{}, error) {
+		if len(args) == 0 {
+			return nil, L.errorf("Please specify at least one argument for this redis lib call")
+		}
+		command := make([]string, len(args))
+		for i, arg := range args {
+			s, ok := luaToString(arg)
+			if !ok {
+				return nil, L.errorf("Lua redis lib command arguments must be strings or integers")
+			}
+			command[i] = s
+		}
+		name := strings.ToLower(command[0])
+		var reply interface{}
+		var cause error
+		switch _, ok := respCommands[name]; {
+		case !ok:
+			reply = errors.New("ERR Unknown Redis command called from script")
+		case luaForbiddenCommands[name] || respNoMultiCommands[name]:
+			reply = errors.New("ERR This Redis command is not allowed from script")
+		default:
+			var buf bytes.Buffer
+			c := &respConn{store: L.store, writer: &respWriter{Writer: bufio.NewWriter(&buf), protocol: 2}}
+			c.execute(command)
+			c.writer.Flush()
+			var err error
+			if reply, err = parseRESPReply(bufio.NewReader(&buf)); err != nil {
+				return nil, err
+			}
+			cause = c.writer.lastError
+		}
+		if err, ok := reply.(error); ok && raise {
+			return nil, &luaError{value: luaErrorTable(err.Error()), cause: cause}
+		}
+		return luaResults(luaReply(reply))
+	}
+}
+
+func luaErrorTable(message string) *luaTable {
+	t := newLuaTable()
+	t.set("err", message)
+	return t
+}
+
+// luaReply converts a reply into a Lua value.
+func luaReply(reply interface{}) interface{} {
+	switch r := reply.(type) {
+	case int64:
+		return float64(r)
+	case string:
+		return r
+	case ScriptStatus:
+		t := newLuaTable()
+		t.set("ok", string(r))
+		return t
+	case error:
+		return luaErrorTable(r.Error())
+	case []interface{}:
+		t := newLuaTable()
+		for i, item := range r {
+			t.set(float64(i+1), luaReply(item))
+		}
+		return t
+	}
+	return false
+}
+
+// parseRESPReply reads a RESP2 reply, as simple strings (ScriptStatus),
+// errors, int64s, strings, nil and []interface{}.
+func parseRESPReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, respProtocolError("ERR empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return ScriptStatus(line[1:]), nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = parseRESPReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, respProtocolError("ERR unexpected reply " + strconv.Quote(line))
+}
+
+func luaRedisReply(field, name string) func(*luaState, []interface{}) ([]interface{}, error) {
+	return func(L *luaState, args []interface{}) ([]interface{}, error) {
+		s, err := L.checkString(args, 0, name)
+		if err != nil {
+			return nil, err
+		}
+		t := newLuaTable()
+		t.set(field, s)
+		return luaResults(t)
+	}
+}
+
+func luaRedisSHA1Hex(L *luaState, args []interface{}) ([]interface{}, error) {
+	s, err := L.checkString(args, 0, "sha1hex")
+	if err != nil {
+		return nil, err
+	}
+	return luaResults(scriptSHA(s))
+}
+
+// writeScriptResult writes a script's result as a RESP reply.
+func (w *respWriter) writeScriptResult(result interface{}) {
+	switch r := result.(type) {
+	case int64:
+		w.writeInteger(r)
+	case string:
+		w.writeBulk(r)
+	case ScriptStatus:
+		w.writeSimple(string(r))
+	case error:
+		w.writeError(r)
+	case []interface{}:
+		w.writeArrayHeader(len(r))
+		for _, item := range r {
+			w.writeScriptResult(item)
+		}
+	default:
+		w.writeNull()
+	}
+}
@@ -0,0 +1,281 @@
+package restis
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type scriptingStore interface {
+	Store
+	scriptStore
+}
+
+func testScripts(t *testing.T, store scriptingStore) {
+	ok := noError(t)
+	scripts := store.Scripts()
+
+	assert.Equal(t, ScriptStatus("OK"), ok(scripts.Eval("return redis.call('SET', KEYS[1], ARGV[1])", []string{"k"}, []string{"v"})))
+	assert.Equal(t, "v", ok(store.Get("k")))
+	assert.Equal(t, int64(3), ok(scripts.Eval("return redis.call('RPUSH', KEYS[1], unpack(ARGV))", []string{"list"}, []string{"a", "b", "c"})))
+	assert.Equal(t, []interface{}{"a", "b", "c"}, ok(scripts.Eval("return redis.call('LRANGE', KEYS[1], 0, -1)", []string{"list"}, nil)))
+
+	// Scripts run atomically, so read-modify-write cycles don't lose updates.
+	increment := `
+		local n = tonumber(redis.call('GET', KEYS[1]) or '0')
+		redis.call('SET', KEYS[1], n + 1)
+		return n + 1`
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := scripts.Eval(increment, []string{"counter"}, nil)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "20", ok(store.Get("counter")))
+
+	// Scripts are cached by the SHA1 of their source.
+	sha := ok(scripts.Load(increment)).(string)
+	assert.Equal(t, scriptSHA(increment), sha)
+	assert.Equal(t, int64(21), ok(scripts.EvalSHA(strings.ToUpper(sha), []string{"counter"}, nil)))
+	assert.Equal(t, []bool{true, false}, scripts.Exists(sha, "ffffffffffffffffffffffffffffffffffffffff"))
+	scripts.Flush()
+	assert.Equal(t, []bool{false}, scripts.Exists(sha))
+	_, err := scripts.EvalSHA(sha, nil, nil)
+	assert.Equal(t, ErrNoScript, err)
+
+	// Errors from commands keep their identity unless the script catches
+	// them.
+	_, err = scripts.Eval("return redis.call('INCR', KEYS[1])", []string{"k"}, nil)
+	assert.Equal(t, ErrNotInteger, err)
+	assert.Equal(t, "ERR value is not an integer or out of range", ok(scripts.Eval(`
+		local reply = redis.pcall('INCR', KEYS[1])
+		return reply.err`, []string{"k"}, nil)))
+	_, err = scripts.Eval("return redis.call('LPUSH', KEYS[1], 'x')", []string{"k"}, nil)
+	assert.Equal(t, ErrWrongType, err)
+
+	// Registered scripts run by name.
+	_, err = scripts.Run("incr", []string{"counter"}, nil)
+	assert.Equal(t, ErrNoScript, err)
+	ok(scripts.Register("incr", increment))
+	assert.Equal(t, int64(22), ok(scripts.Run("incr", []string{"counter"}, nil)))
+	assert.Equal(t, []string{"incr"}, scripts.Names())
+	assert.True(t, scripts.Unregister("incr"))
+	assert.False(t, scripts.Unregister("incr"))
+}
+
+func TestScripts(t *testing.T) {
+	testScripts(t, NewMemoryStoreWithClock(systemClock{}))
+}
+
+func TestScriptLanguage(t *testing.T) {
+	ok := noError(t)
+	scripts := NewMemoryStoreWithClock(systemClock{}).Scripts()
+	eval := func(source string, args ...string) interface{} {
+		t.Helper()
+		result, err := scripts.Eval(source, nil, args)
+		assert.NoError(t, err, source)
+		return result
+	}
+
+	assert.Equal(t, int64(7), eval("return 1 + 2 * 3"))
+	assert.Equal(t, int64(512), eval("return 2 ^ 3 ^ 2"))
+	assert.Equal(t, int64(3), eval("return 3.9"))
+	assert.Equal(t, int64(-1), eval("return -7 % 3 - 3"))
+	assert.Equal(t, "abc1.5", eval("return 'a' .. \"b\" .. [[c]] .. 1.5"))
+	assert.Equal(t, int64(1), eval("return 10 == '10' or 1"))
+	assert.Equal(t, nil, eval("return false"))
+	assert.Equal(t, int64(1), eval("return true"))
+	assert.Equal(t, int64(15), eval("return '10' + 5"))
+	assert.Equal(t, int64(255), eval("return 0xff"))
+	assert.Equal(t, "tab\there\n", eval(`return "tab\there\n"`))
+	assert.Equal(t, "AB", eval(`return "\65\066"`))
+	assert.Equal(t, int64(6), eval("return #'abc' + #{1, 2, 3}"))
+
+	assert.Equal(t, int64(55), eval(`
+		local sum = 0
+		for i = 1, 10 do sum = sum + i end
+		return sum`))
+	assert.Equal(t, []interface{}{int64(10), int64(7), int64(4), int64(1)}, eval(`
+		local t = {}
+		for i = 10, 1, -3 do t[#t + 1] = i end
+		return t`))
+	assert.Equal(t, int64(9), eval(`
+		local n = 1
+		while true do
+			n = n * 2
+			if n > 5 then break end
+		end
+		repeat local m = n; n = m + 1 until m >= 7
+		return n`))
+	assert.Equal(t, "small", eval(`
+		local n = tonumber(ARGV[1])
+		if n > 10 then return 'big' elseif n > 1 then return 'small' else return 'tiny' end`, "5"))
+
+	// Functions are closures, and take and return any number of values.
+	assert.Equal(t, []interface{}{int64(1), int64(2), int64(3)}, eval(`
+		local function counter()
+			local n = 0
+			return function() n = n + 1; return n end
+		end
+		local next1 = counter()
+		return {next1(), next1(), next1()}`))
+	assert.Equal(t, []interface{}{int64(3), "b", "c"}, eval(`
+		local function rest(first, ...)
+			return select('#', ...), ...
+		end
+		return {rest('a', 'b', 'c', nil)}`))
+	assert.Equal(t, int64(120), eval(`
+		local function fact(n) if n <= 1 then return 1 end return n * fact(n - 1) end
+		return fact(5)`))
+	assert.Equal(t, "HELLO", eval(`
+		local greeter = {greeting = 'hello'}
+		function greeter:shout() return self.greeting:upper() end
+		return greeter:shout()`))
+
+	// Tables.
+	assert.Equal(t, "a=1,b=2,c=3", eval(`
+		local t = {c = 3, a = 1, ['b'] = 2}
+		local keys = {}
+		for k, v in pairs(t) do keys[#keys + 1] = k .. '=' .. v end
+		table.sort(keys)
+		return table.concat(keys, ',')`))
+	assert.Equal(t, []interface{}{"z", "y", "x"}, eval(`
+		local t = {'x', 'y', 'z'}
+		table.sort(t, function(a, b) return a > b end)
+		return t`))
+	assert.Equal(t, []interface{}{"a", "x", "b"}, eval(`
+		local t = {'a', 'b', 'c'}
+		table.insert(t, 2, 'x')
+		table.remove(t)
+		return t`))
+	assert.Equal(t, []interface{}{int64(1), int64(2)}, eval("return {1, 2, nil, 4}"))
+	assert.Equal(t, ScriptStatus("FINE"), eval("return redis.status_reply('FINE')"))
+	assert.Equal(t, []interface{}{int64(1), &ScriptError{"inner"}}, eval("return {1, redis.error_reply('inner')}"))
+
+	// The string library.
+	assert.Equal(t, "ell", eval("return string.sub('hello', 2, -2)"))
+	assert.Equal(t, "ababab", eval("return ('ab'):rep(3)"))
+	assert.Equal(t, "00042|3.50|hi|  x", eval("return string.format('%05d|%.2f|%s|%3s', 42, 3.5, 'hi', 'x')"))
+	assert.Equal(t, []interface{}{int64(2), int64(3)}, eval("return {string.find('a.b.c', '.b', 1, true)}"))
+	assert.Equal(t, []interface{}{int64(104), int64(105)}, eval("return {string.byte('hi', 1, -1)}"))
+	assert.Equal(t, "olleh", eval("return string.reverse(string.char(104, 101, 108, 108, 111))"))
+	assert.Equal(t, int64(5), eval("return math.max(1, 5, 3) + math.floor(-0.5) + math.abs(-1)"))
+	assert.Equal(t, "1e+15 0.1 nan", eval("return tostring(1e15) .. ' ' .. tostring(0.1) .. ' ' .. tostring(0/0)"))
+	assert.Equal(t, "356a192b7913b04c54574d18c28d46e6395428ab", eval("return redis.sha1hex('1')"))
+
+	// Errors are caught by pcall.
+	assert.Equal(t, []interface{}{nil, "user_script:1: boom"}, eval("return {pcall(error, 'boom')}"))
+	assert.Equal(t, []interface{}{nil, "custom"}, eval("local ok, err = pcall(error, {err = 'custom'}); return {ok, err.err}"))
+
+	for source, message := range map[string]string{
+		"return 1 +":                        "Error compiling script (new function): user_script:1: unexpected symbol near '<eof>'",
+		"if true then":                      "Error compiling script (new function): user_script:1: 'end' expected near '<eof>'",
+		"while true do\n\nx = 1":            "Error compiling script (new function): user_script:3: 'end' expected (to close 'while' at line 1) near '<eof>'",
+		"local s = 'open":                   "Error compiling script (new function): user_script:1: unfinished string near ''open'",
+		"local function f() return ... end": "Error compiling script (new function): user_script:1: cannot use '...' outside a vararg function near '...'",
+		"return undefined":                  "user_script:1: Script attempted to access nonexistent global variable 'undefined'",
+		"x = 1":                             "user_script:1: Script attempted to create global variable 'x'",
+		"string.len = nil":                  "user_script:1: Attempt to modify a readonly table",
+		"local t = nil\nreturn t.field":     "user_script:2: attempt to index local 't' (a nil value)",
+		"return 1 + {}":                     "user_script:1: attempt to perform arithmetic on a table value",
+		"return {} < {}":                    "user_script:1: attempt to compare two table values",
+		"redis.nothing()":                   "user_script:1: attempt to call field 'nothing' (a nil value)",
+		"error('failed')":                   "user_script:1: failed",
+		"error({err = 'MYERR custom'})":     "MYERR custom",
+		"return redis.error_reply('bad')":   "bad",
+		"local function f() return f() + 1 end return f()": "user_script:1: stack overflow",
+		"return string.rep('x', -1) .. string.len()":       "user_script:1: bad argument #1 to 'len' (string expected, got no value)",
+		"return redis.call('nosuchcommand')":               "ERR Unknown Redis command called from script",
+		"return redis.call('MULTI')":                       "ERR This Redis command is not allowed from script",
+		"return redis.call('GET')":                         "ERR wrong number of arguments for 'get' command",
+		"return redis.call('SET', 'k', {})":                "user_script:1: Lua redis lib command arguments must be strings or integers",
+	} {
+		_, err := scripts.Eval(source, nil, nil)
+		if assert.Error(t, err, source) {
+			assert.Equal(t, message, err.Error(), source)
+		}
+	}
+	assert.Equal(t, []bool{false}, scripts.Exists(scriptSHA("return 1 +")))
+	assert.Equal(t, int64(1), ok(scripts.Eval("return #KEYS", []string{"k"}, nil)))
+}
+
+func TestScriptTimeouts(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	scripts := store.Scripts()
+	assert.Equal(t, DefaultScriptTimeout, scripts.Timeout())
+	scripts.SetTimeout(20 * time.Millisecond)
+	assert.Equal(t, ErrNoScriptsRunning, scripts.Kill())
+
+	// A timeout can't be caught, and what the script wrote stays written.
+	start := time.Now()
+	_, err := scripts.Eval("redis.call('SET', 'k', 'v') pcall(function() while true do end end)", nil, nil)
+	assert.Equal(t, ErrScriptTimeout, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, noError(t)(store.Exists("k")))
+
+	scripts.SetTimeout(0)
+	done := make(chan error)
+	go func() {
+		_, err := scripts.Eval("local n = 0 while true do n = n + 1 end", nil, nil)
+		done <- err
+	}()
+	for scripts.Kill() == ErrNoScriptsRunning {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, ErrScriptKilled, <-done)
+}
+
+func TestScriptKeyspaceEvents(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	w := store.WatchKeyspace(AllEvents)
+	defer w.Close()
+	_, err := store.Scripts().Eval("redis.call('SET', KEYS[1], '1') redis.call('DEL', KEYS[1])", []string{"a"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []KeyspaceEvent{{"set", "a"}, {"del", "a"}}, drain(w))
+}
+
+func TestAppendOnlyScripts(t *testing.T) {
+	ok := noError(t)
+	path := filepath.Join(t.TempDir(), "restis.aof")
+	store := openAppendOnly(t, AppendOnlyOptions{Path: path, Fsync: FsyncAlways})
+	testScripts(t, store)
+
+	// What scripts write is logged as commands, in a transaction, rather
+	// than as the script itself.
+	ok(store.Scripts().Eval("redis.call('SET', KEYS[1], 'from script')", []string{"logged"}, nil))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$6\r\nlogged\r\n$11\r\nfrom script\r\n*1\r\n$4\r\nEXEC\r\n")
+	assert.NotContains(t, string(data), "redis.call")
+	assert.NoError(t, store.Close())
+
+	reopened := openAppendOnly(t, AppendOnlyOptions{Path: path})
+	assert.Equal(t, "from script", ok(reopened.Get("logged")))
+	assert.Equal(t, "22", ok(reopened.Get("counter")))
+}
+
+func TestDiskStoreScripts(t *testing.T) {
+	ok := noError(t)
+	path := filepath.Join(t.TempDir(), "store")
+	store := openDisk(t, DiskOptions{Path: path, Fsync: FsyncAlways})
+	testScripts(t, store)
+	assert.NoError(t, store.Close())
+
+	reopened := openDisk(t, DiskOptions{Path: path})
+	assert.Equal(t, "22", ok(reopened.Get("counter")))
+	assert.Equal(t, []string{"a", "b", "c"}, ok(reopened.ListRange("list", 0, -1)))
+}
+
+func TestScriptsDisabled(t *testing.T) {
+	_, err := NewScripts(struct{ Store }{NewMemoryStore()}).Eval("return 1", nil, nil)
+	assert.Equal(t, ErrScriptsDisabled, err)
+}
@@ -0,0 +1,524 @@
+package restis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSnapshotCorrupt   = errors.New("restis: snapshot is corrupt")
+	ErrSaveInProgress    = errors.New("ERR Background save already in progress")
+	ErrSnapshotsDisabled = errors.New("ERR snapshots are not configured")
+)
+
+// A snapshot file starts with a magic string and a big-endian version, holds
+// one record per key and ends with an end marker and the CRC-64 of
+// everything before the checksum. Each record is a type byte, the key, the
+// expiry in Unix milliseconds (0 for none) and the value. Strings are
+// prefixed with their length as a uvarint, and collections with their size.
+// Hashes with fields that expire, which version 2 added, have each field's
+// expiry after its value.
+const (
+	snapshotMagic   = "RESTIS"
+	snapshotVersion = 2
+)
+
+const (
+	recordString byte = iota + 1
+	recordSet
+	recordHash
+	recordList
+	recordSortedSet
+	recordVolatileHash
+	recordEnd byte = 0xff
+)
+
+const (
+	saveRuleInterval = 100 * time.Millisecond
+	saveRetryDelay   = 5 * time.Second
+)
+
+var snapshotTable = crc64.MakeTable(crc64.ECMA)
+
+// A SaveRule snapshots the store once at least Changes writes have happened
+// and Interval has passed since the last save, like Redis' "save 60 1000".
+type SaveRule struct {
+	Interval time.Duration
+	Changes  int64
+}
+
+type SnapshotOptions struct {
+	Path  string
+	Rules []SaveRule
+	Clock Clock // defaults to the system clock
+}
+
+// snapshotStore is implemented by stores that can persist themselves, and
+// backs the SAVE, BGSAVE and LASTSAVE commands and the /snapshots routes.
+type snapshotStore interface {
+	Save() error
+	BackgroundSave() error
+	LastSave() time.Time
+}
+
+type snapshotter struct {
+	path  string
+	rules []SaveRule
+
+	mu          sync.Mutex
+	saving      bool
+	done        *sync.Cond
+	lastSave    time.Time
+	lastAttempt time.Time
+	lastErr     error
+}
+
+// NewMemoryStoreWithSnapshots returns a MemoryStore loaded from the snapshot
+// at options.Path, or an empty one if the file doesn't exist yet. The store
+// saves back to the same path on Save, BackgroundSave, whenever one of the
+// rules fires and, if there are rules, on Close.
+func NewMemoryStoreWithSnapshots(options SnapshotOptions) (*MemoryStore, error) {
+	clock := options.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	s := NewMemoryStoreWithClock(clock)
+	snapshots := &snapshotter{path: options.Path, rules: options.Rules, lastSave: clock.Now()}
+	snapshots.done = sync.NewCond(&snapshots.mu)
+	s.snapshots = snapshots
+	data, err := ioutil.ReadFile(options.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := s.readSnapshot(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", options.Path, err)
+		}
+	}
+	if len(options.Rules) > 0 {
+		go s.runSaveRules()
+	}
+	return s, nil
+}
+
+// Save writes a snapshot and waits for it to reach the disk.
+func (s *MemoryStore) Save() error {
+	if s.snapshots == nil {
+		return ErrSnapshotsDisabled
+	}
+	if !s.snapshots.begin() {
+		return ErrSaveInProgress
+	}
+	return s.save()
+}
+
+// BackgroundSave takes a snapshot and writes it to disk on another
+// goroutine. Taking the snapshot still blocks writers briefly, since there is
+// no fork to lean on.
+func (s *MemoryStore) BackgroundSave() error {
+	if s.snapshots == nil {
+		return ErrSnapshotsDisabled
+	}
+	if !s.snapshots.begin() {
+		return ErrSaveInProgress
+	}
+	data, dirty := s.writeSnapshot()
+	go s.finishSave(data, dirty)
+	return nil
+}
+
+// LastSave returns when the last successful save finished, or when the
+// store was loaded if it hasn't saved since.
+func (s *MemoryStore) LastSave() time.Time {
+	if s.snapshots == nil {
+		return time.Time{}
+	}
+	s.snapshots.mu.Lock()
+	defer s.snapshots.mu.Unlock()
+	return s.snapshots.lastSave
+}
+
+func (s *MemoryStore) save() error {
+	data, dirty := s.writeSnapshot()
+	return s.finishSave(data, dirty)
+}
+
+func (s *MemoryStore) finishSave(data []byte, dirty int64) error {
+	err := writeFileAtomic(s.snapshots.path, data)
+	if err == nil {
+		atomic.AddInt64(&s.dirty, -dirty)
+	}
+	s.snapshots.end(s.clock.Now(), err)
+	return err
+}
+
+func (sn *snapshotter) begin() bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if sn.saving {
+		return false
+	}
+	sn.saving = true
+	return true
+}
+
+func (sn *snapshotter) end(now time.Time, err error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.saving = false
+	sn.lastAttempt = now
+	sn.lastErr = err
+	if err == nil {
+		sn.lastSave = now
+	}
+	sn.done.Broadcast()
+}
+
+// wait blocks until no save is in progress.
+func (sn *snapshotter) wait() {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	for sn.saving {
+		sn.done.Wait()
+	}
+}
+
+// due reports whether a rule has fired. After a failed save it holds off for
+// a while rather than retrying on every check.
+func (sn *snapshotter) due(now time.Time, dirty int64) bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if sn.saving || (sn.lastErr != nil && now.Sub(sn.lastAttempt) < saveRetryDelay) {
+		return false
+	}
+	for _, rule := range sn.rules {
+		if dirty >= rule.Changes && now.Sub(sn.lastSave) >= rule.Interval {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) runSaveRules() {
+	ticker := time.NewTicker(saveRuleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			if s.snapshots.due(s.clock.Now(), atomic.LoadInt64(&s.dirty)) {
+				s.BackgroundSave()
+			}
+		}
+	}
+}
+
+// closeSnapshots saves one last time if there are save rules and unsaved
+// writes, waiting out any background save that is still running.
+func (s *MemoryStore) closeSnapshots() error {
+	if s.snapshots == nil {
+		return nil
+	}
+	for len(s.snapshots.rules) > 0 && atomic.LoadInt64(&s.dirty) > 0 {
+		s.snapshots.wait()
+		if err := s.Save(); err != ErrSaveInProgress {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSnapshot encodes every key with all shards locked, so the snapshot
+// is a single point in time, and returns it with the number of writes it
+// covers.
+func (s *MemoryStore) writeSnapshot() ([]byte, int64) {
+	for _, sh := range s.shards {
+		sh.Lock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.Unlock()
+		}
+	}()
+	now := s.now()
+	e := &snapshotEncoder{}
+	e.WriteString(snapshotMagic)
+	binary.Write(e, binary.BigEndian, uint16(snapshotVersion))
+	for _, sh := range s.shards {
+		sh.encode(e, now)
+	}
+	e.WriteByte(recordEnd)
+	binary.Write(e, binary.BigEndian, crc64.Checksum(e.Bytes(), snapshotTable))
+	return e.Bytes(), atomic.LoadInt64(&s.dirty)
+}
+
+func (sh *shard) encode(e *snapshotEncoder, now int64) {
+	header := func(kind byte, key string) {
+		e.WriteByte(kind)
+		e.writeString(key)
+		e.writeUvarint(uint64(sh.expires[key]))
+	}
+	live := func(key string) bool {
+		return !sh.expired(key, now)
+	}
+	for key, value := range sh.strings {
+		if live(key) {
+			header(recordString, key)
+			e.writeString(value)
+		}
+	}
+	for key, set := range sh.sets {
+		if live(key) {
+			header(recordSet, key)
+			e.writeUvarint(uint64(len(set)))
+			for member := range set {
+				e.writeString(member)
+			}
+		}
+	}
+	for key, hash := range sh.hashes {
+		volatile, ok := sh.fieldExpires[key]
+		if !live(key) {
+			continue
+		}
+		if !ok {
+			header(recordHash, key)
+			e.writeUvarint(uint64(len(hash)))
+			for field, value := range hash {
+				e.writeString(field)
+				e.writeString(value)
+			}
+			continue
+		}
+		fields := make([]string, 0, len(hash))
+		for field := range hash {
+			if at, ok := volatile.expiry(field); !ok || at > now {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		header(recordVolatileHash, key)
+		e.writeUvarint(uint64(len(fields)))
+		for _, field := range fields {
+			at, _ := volatile.expiry(field)
+			e.writeString(field)
+			e.writeString(hash[field])
+			e.writeUvarint(uint64(at))
+		}
+	}
+	for key, list := range sh.lists {
+		if live(key) {
+			header(recordList, key)
+			e.writeUvarint(uint64(list.length()))
+			for _, item := range list.items() {
+				e.writeString(item)
+			}
+		}
+	}
+	for key, z := range sh.sortedSets {
+		if live(key) {
+			header(recordSortedSet, key)
+			e.writeUvarint(uint64(z.length()))
+			for member, score := range z.scores {
+				e.writeString(member)
+				binary.Write(e, binary.BigEndian, math.Float64bits(score))
+			}
+		}
+	}
+}
+
+// readSnapshot adds every key in the snapshot to the store, replacing keys
+// of the same name. Keys whose expiry has passed are skipped.
+func (s *MemoryStore) readSnapshot(data []byte) error {
+	header := len(snapshotMagic) + 2
+	if len(data) < header+1+8 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrSnapshotCorrupt
+	}
+	if version := binary.BigEndian.Uint16(data[len(snapshotMagic):]); version > snapshotVersion {
+		return fmt.Errorf("restis: snapshot version %d is newer than the supported version %d", version, snapshotVersion)
+	}
+	body := data[:len(data)-8]
+	if crc64.Checksum(body, snapshotTable) != binary.BigEndian.Uint64(data[len(body):]) {
+		return ErrSnapshotCorrupt
+	}
+	d := &snapshotDecoder{data: body[header:]}
+	for {
+		kind := d.byte()
+		if kind == recordEnd || d.err != nil {
+			break
+		}
+		key := d.string()
+		expiresAt := int64(d.uvarint())
+		sh := s.shard(key)
+		sh.Lock()
+		sh.remove(key)
+		switch kind {
+		case recordString:
+			sh.strings[key] = d.string()
+		case recordSet:
+			set := make(map[string]bool)
+			for n := d.length(); n > 0; n-- {
+				set[d.string()] = true
+			}
+			sh.sets[key] = set
+		case recordHash:
+			hash := make(map[string]string)
+			for n := d.length(); n > 0; n-- {
+				field := d.string()
+				hash[field] = d.string()
+			}
+			sh.hashes[key] = hash
+		case recordVolatileHash:
+			hash := make(map[string]string)
+			for n := d.length(); n > 0; n-- {
+				field := d.string()
+				hash[field] = d.string()
+				if at := int64(d.uvarint()); at != 0 {
+					sh.setFieldExpiry(key, field, at)
+				}
+			}
+			sh.hashes[key] = hash
+			if _, ok := sh.fieldExpires[key]; ok {
+				s.startExpiryCycle()
+			}
+		case recordList:
+			list := newDeque()
+			for n := d.length(); n > 0; n-- {
+				list.pushBack(d.string())
+			}
+			sh.lists[key] = list
+		case recordSortedSet:
+			z := newSortedSet()
+			for n := d.length(); n > 0; n-- {
+				member := d.string()
+				z.set(member, math.Float64frombits(d.uint64()))
+			}
+			sh.storeSortedSet(key, z)
+		default:
+			d.err = ErrSnapshotCorrupt
+		}
+		if expiresAt != 0 && d.err == nil {
+			s.setExpiry(sh, key, expiresAt)
+		}
+		sh.Unlock()
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = ErrSnapshotCorrupt
+	}
+	return d.err
+}
+
+type snapshotEncoder struct {
+	bytes.Buffer
+}
+
+func (e *snapshotEncoder) writeUvarint(n uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Write(buf[:binary.PutUvarint(buf[:], n)])
+}
+
+func (e *snapshotEncoder) writeString(s string) {
+	e.writeUvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+// A snapshotDecoder consumes data from the front and records the first
+// error, after which every read returns a zero value.
+type snapshotDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *snapshotDecoder) take(n uint64) []byte {
+	if d.err != nil || n > uint64(len(d.data)) {
+		d.err = ErrSnapshotCorrupt
+		return nil
+	}
+	taken := d.data[:n]
+	d.data = d.data[n:]
+	return taken
+}
+
+func (d *snapshotDecoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *snapshotDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		d.err = ErrSnapshotCorrupt
+		return 0
+	}
+	d.data = d.data[size:]
+	return n
+}
+
+// length reads a collection size, which can't be more than the bytes left.
+func (d *snapshotDecoder) length() uint64 {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = ErrSnapshotCorrupt
+		return 0
+	}
+	return n
+}
+
+func (d *snapshotDecoder) string() string {
+	return string(d.take(d.uvarint()))
+}
+
+func (d *snapshotDecoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it
+// and renames it into place, so readers see either the old file or the
+// complete new one.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
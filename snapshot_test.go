@@ -0,0 +1,163 @@
+package restis
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openSnapshot(t *testing.T, options SnapshotOptions) *MemoryStore {
+	store, err := NewMemoryStoreWithSnapshots(options)
+	return opened(t, store, err)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := SnapshotOptions{Path: filepath.Join(t.TempDir(), "dump.restis"), Clock: clock}
+	store := openSnapshot(t, options)
+	assert.Equal(t, time.Unix(1000, 0), store.LastSave())
+
+	assert.NoError(t, store.Set("s", "string"))
+	assert.NoError(t, store.Set("empty", ""))
+	assert.NoError(t, store.SetAdd("set", "a", "b", "c"))
+	assert.NoError(t, store.HashMultiSet("hash", map[string]string{"f1": "v1", "f2": ""}))
+	ok(store.ListRightPush("list", "x", "y", "x"))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"low", math.Inf(-1)}, ScoredMember{"mid", 1.5}, ScoredMember{"high", math.Inf(1)}))
+	ok(store.SetWithOptions("volatile", "v", SetOptions{ExpireSeconds: 100}))
+	ok(store.SetWithOptions("short", "v", SetOptions{ExpireSeconds: 1}))
+	assert.NoError(t, store.HashMultiSet("fields", map[string]string{"f1": "v1", "f2": "v2", "f3": "v3"}))
+	ok(store.HashExpire("fields", 100, HashExpireOptions{}, "f1"))
+	ok(store.HashExpire("fields", 1, HashExpireOptions{}, "f2"))
+	assert.NoError(t, store.Save())
+	assert.Equal(t, 0, store.dirty)
+	clock.Advance(2 * time.Second)
+	assert.NoError(t, store.Set("unsaved", "v"))
+
+	store = openSnapshot(t, options)
+	assert.Equal(t, 8, ok(store.Exists("s", "empty", "set", "hash", "fields", "list", "zset", "volatile", "short", "unsaved")))
+	assert.Equal(t, "string", ok(store.Get("s")))
+	assert.Equal(t, typeString, ok(store.Type("empty")))
+	members := ok(store.SetMembers("set")).([]string)
+	sort.Strings(members)
+	assert.Equal(t, []string{"a", "b", "c"}, members)
+	assert.Equal(t, []string{"v1", ""}, ok(store.HashMultiGet("hash", "f1", "f2")))
+	assert.Equal(t, []string{"x", "y", "x"}, ok(store.ListRange("list", 0, -1)))
+	assert.Equal(t, []ScoredMember{{"low", math.Inf(-1)}, {"mid", 1.5}, {"high", math.Inf(1)}}, ok(store.SortedSetRange("zset", everything())))
+	assert.Equal(t, 98000, ok(store.PTTL("volatile")))
+	assert.Equal(t, []int64{98000, -2, -1}, ok(store.HashPTTL("fields", "f1", "f2", "f3")))
+	assert.Equal(t, map[string]string{"f1": "v1", "f3": "v3"}, ok(store.HashGetAll("fields")))
+	assert.Equal(t, -1, ok(store.PTTL("s")))
+}
+
+func TestSnapshotMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.restis")
+	store := openSnapshot(t, SnapshotOptions{Path: path})
+	assert.Equal(t, 0, noError(t)(store.Exists("k")))
+	assert.NoError(t, store.Save())
+	_, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrSnapshotsDisabled, NewMemoryStoreWithClock(systemClock{}).Save())
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.restis")
+	store := openSnapshot(t, SnapshotOptions{Path: path})
+	assert.NoError(t, store.Set("k", "value"))
+	assert.NoError(t, store.Save())
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	for name, corrupt := range map[string][]byte{
+		"flipped byte": append(append(append([]byte{}, data[:12]...), data[12]^1), data[13:]...),
+		"truncated":    data[:len(data)-3],
+		"empty":        {},
+		"wrong magic":  append([]byte("REDIS0"), data[6:]...),
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, corrupt, 0644))
+		_, err := NewMemoryStoreWithSnapshots(SnapshotOptions{Path: path})
+		assert.True(t, errors.Is(err, ErrSnapshotCorrupt), name)
+	}
+
+	newer := append([]byte{}, data...)
+	newer[7] = snapshotVersion + 1
+	assert.NoError(t, ioutil.WriteFile(path, newer, 0644))
+	_, err = NewMemoryStoreWithSnapshots(SnapshotOptions{Path: path})
+	assert.EqualError(t, err, path+": restis: snapshot version 3 is newer than the supported version 2")
+}
+
+func TestSnapshotBackgroundSave(t *testing.T) {
+	options := SnapshotOptions{Path: filepath.Join(t.TempDir(), "dump.restis")}
+	store := openSnapshot(t, options)
+	assert.NoError(t, store.Set("k", "v"))
+	assert.NoError(t, store.BackgroundSave())
+	store.snapshots.wait()
+	assert.Equal(t, "v", noError(t)(openSnapshot(t, options).Get("k")))
+
+	store.snapshots.begin()
+	assert.Equal(t, ErrSaveInProgress, store.Save())
+	assert.Equal(t, ErrSaveInProgress, store.BackgroundSave())
+	store.snapshots.end(time.Now(), nil)
+}
+
+func TestSnapshotSaveRules(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	options := SnapshotOptions{Path: filepath.Join(t.TempDir(), "dump.restis"), Rules: []SaveRule{{Interval: time.Minute, Changes: 2}}, Clock: clock}
+	store := openSnapshot(t, options)
+	assert.NoError(t, store.Set("k1", "v"))
+	clock.Advance(time.Minute)
+	time.Sleep(3 * saveRuleInterval)
+	assert.Equal(t, time.Unix(1000, 0), store.LastSave())
+
+	assert.NoError(t, store.Set("k2", "v"))
+	deadline := time.Now().Add(5 * time.Second)
+	for store.LastSave() == time.Unix(1000, 0) && time.Now().Before(deadline) {
+		time.Sleep(saveRuleInterval)
+	}
+	assert.Equal(t, time.Unix(1060, 0), store.LastSave())
+
+	assert.NoError(t, store.Set("k3", "v"))
+	assert.NoError(t, store.Close())
+	assert.Equal(t, 3, noError(t)(openSnapshot(t, options).Exists("k1", "k2", "k3")))
+}
+
+func TestHandlerSnapshots(t *testing.T) {
+	c := httpChecker{t, NewHandler(NewMemoryStore())}
+	c.check("POST", "/snapshots", "", 501, `{"error":"ERR snapshots are not configured"}`)
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := openSnapshot(t, SnapshotOptions{Path: filepath.Join(t.TempDir(), "dump.restis"), Clock: clock})
+	c = httpChecker{t, NewHandler(store)}
+	c.check("GET", "/snapshots", "", 200, `{"last_save":1000}`)
+	clock.Advance(time.Second)
+	c.check("POST", "/snapshots", "", 204, "")
+	c.check("GET", "/snapshots", "", 200, `{"last_save":1001}`)
+	c.check("POST", "/snapshots?background=true", "", 202, "")
+	store.snapshots.wait()
+	store.snapshots.begin()
+	c.check("POST", "/snapshots", "", 409, `{"error":"ERR Background save already in progress"}`)
+	store.snapshots.end(clock.Now(), nil)
+	c.check("DELETE", "/snapshots", "", 405, `{"error":"method not allowed"}`)
+}
+
+func TestRESPSnapshots(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := openSnapshot(t, SnapshotOptions{Path: filepath.Join(t.TempDir(), "dump.restis"), Clock: clock})
+	server, connect := startRESPServerWithStore(t, store)
+	defer server.Close()
+	c := connect()
+	c.check(":1000\n", "LASTSAVE")
+	clock.Advance(time.Second)
+	c.check("+OK\n", "SAVE")
+	c.check(":1001\n", "LASTSAVE")
+	c.check("+Background saving started\n", "BGSAVE", "SCHEDULE")
+	store.snapshots.wait()
+}
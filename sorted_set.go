@@ -0,0 +1,481 @@
+package restis
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+// A sortedSet keeps a member-to-score map for lookups next to a skiplist
+// ordered by (score, member) for ranges and ranks, the same pairing Redis
+// uses for large sorted sets.
+type sortedSet struct {
+	scores map[string]float64
+	list   *skiplist
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{scores: make(map[string]float64), list: newSkiplist()}
+}
+
+func (z *sortedSet) length() int64 {
+	return z.list.length
+}
+
+func (z *sortedSet) set(member string, score float64) {
+	if current, ok := z.scores[member]; ok {
+		if current == score {
+			return
+		}
+		z.list.delete(current, member)
+	}
+	z.scores[member] = score
+	z.list.insert(score, member)
+}
+
+func (z *sortedSet) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	delete(z.scores, member)
+	z.list.delete(score, member)
+	return true
+}
+
+// add applies the ZADD conditions to a single member. It reports whether the
+// member was added, whether an existing score changed, and whether the
+// conditions allowed the write at all.
+func (z *sortedSet) add(member string, score float64, options SortedSetAddOptions) (added, changed, applied bool) {
+	current, exists := z.scores[member]
+	added, changed, applied = options.apply(current, exists, score)
+	if applied {
+		z.set(member, score)
+	}
+	return added, changed, applied
+}
+
+// apply reports what giving a member score does under o, given its current
+// score if it exists: whether it's added, whether its score changes and
+// whether the options let it be set at all.
+func (o SortedSetAddOptions) apply(current float64, exists bool, score float64) (added, changed, applied bool) {
+	if (exists && o.IfNotExists) || (!exists && o.IfExists) {
+		return false, false, false
+	}
+	if !exists {
+		return true, false, true
+	}
+	if (o.GreaterThan && score <= current) || (o.LessThan && score >= current) {
+		return false, false, false
+	}
+	return false, score != current, true
+}
+
+func (z *sortedSet) rank(member string, reverse bool) (int64, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.list.rank(score, member)
+	if reverse {
+		rank = z.length() - 1 - rank
+	}
+	return rank, true
+}
+
+func (z *sortedSet) count(min, max rangeBound) int64 {
+	first := z.list.first(min)
+	if first == nil || max.above(first) {
+		return 0
+	}
+	last := z.list.last(max)
+	return z.list.rank(last.score, last.member) - z.list.rank(first.score, first.member) + 1
+}
+
+func (z *sortedSet) pop(count int64, fromMax bool) []ScoredMember {
+	popped := []ScoredMember{}
+	for ; count > 0 && z.length() > 0; count-- {
+		node := z.list.head.levels[0].next
+		if fromMax {
+			node = z.list.tail
+		}
+		popped = append(popped, ScoredMember{Member: node.member, Score: node.score})
+		z.remove(node.member)
+	}
+	return popped
+}
+
+func (z *sortedSet) rangeByRank(start, stop int64, reverse bool) []ScoredMember {
+	length := z.length()
+	start, stop = renormalize(length, start, stop)
+	members := []ScoredMember{}
+	if start >= stop {
+		return members
+	}
+	if reverse {
+		for node := z.list.byRank(length - 1 - start); start < stop; start++ {
+			members = append(members, ScoredMember{Member: node.member, Score: node.score})
+			node = node.previous
+		}
+		return members
+	}
+	for node := z.list.byRank(start); start < stop; start++ {
+		members = append(members, ScoredMember{Member: node.member, Score: node.score})
+		node = node.levels[0].next
+	}
+	return members
+}
+
+func (z *sortedSet) rangeByBounds(min, max rangeBound, reverse bool, offset, count int64) []ScoredMember {
+	members := []ScoredMember{}
+	if offset < 0 {
+		return members
+	}
+	node := z.list.first(min)
+	if reverse {
+		node = z.list.last(max)
+	}
+	for ; node != nil && count != 0; offset-- {
+		if (reverse && min.below(node)) || (!reverse && max.above(node)) {
+			break
+		}
+		if offset <= 0 {
+			members = append(members, ScoredMember{Member: node.member, Score: node.score})
+			count--
+		}
+		if reverse {
+			node = node.previous
+		} else {
+			node = node.levels[0].next
+		}
+	}
+	return members
+}
+
+// collect returns the members of z selected by query.
+func (query SortedSetRange) collect(z *sortedSet) ([]ScoredMember, error) {
+	if (query.ByScore && query.ByLex) || (query.Limit != nil && !query.ByScore && !query.ByLex) {
+		return nil, ErrSyntax
+	}
+	if !query.ByScore && !query.ByLex {
+		start, err := strconv.ParseInt(query.Start, 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		stop, err := strconv.ParseInt(query.Stop, 10, 64)
+		if err != nil {
+			return nil, ErrNotInteger
+		}
+		return z.rangeByRank(start, stop, query.Reverse), nil
+	}
+	low, high := query.Start, query.Stop
+	if query.Reverse {
+		low, high = high, low
+	}
+	min, max, err := parseBounds(low, high, query.ByLex)
+	if err != nil {
+		return nil, err
+	}
+	offset, count := int64(0), int64(-1)
+	if query.Limit != nil {
+		offset, count = query.Limit.Offset, query.Limit.Count
+	}
+	return z.rangeByBounds(min, max, query.Reverse, offset, count), nil
+}
+
+func parseBounds(low, high string, lex bool) (rangeBound, rangeBound, error) {
+	if lex {
+		min, err := parseLexBound(low)
+		if err != nil {
+			return nil, nil, err
+		}
+		max, err := parseLexBound(high)
+		return min, max, err
+	}
+	min, err := parseScoreBound(low)
+	if err != nil {
+		return nil, nil, err
+	}
+	max, err := parseScoreBound(high)
+	return min, max, err
+}
+
+func (z *sortedSet) clone() *sortedSet {
+	clone := newSortedSet()
+	for node := z.list.head.levels[0].next; node != nil; node = node.levels[0].next {
+		clone.set(node.member, node.score)
+	}
+	return clone
+}
+
+type skiplistLevel struct {
+	next *skiplistNode
+	span int64
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	previous *skiplistNode
+	levels   []skiplistLevel
+}
+
+// A skiplist where every forward pointer also records how many nodes it
+// skips, so that ranks can be computed on the way down.
+type skiplist struct {
+	head   *skiplistNode
+	tail   *skiplistNode
+	length int64
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{head: &skiplistNode{levels: make([]skiplistLevel, skiplistMaxLevel)}, level: 1}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+func nodeBefore(node *skiplistNode, score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+func nodeAfter(node *skiplistNode, score float64, member string) bool {
+	return node.score > score || (node.score == score && node.member > member)
+}
+
+func (l *skiplist) insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int64
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		if i < l.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].next != nil && nodeBefore(x.levels[i].next, score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].next
+		}
+		update[i] = x
+	}
+	level := randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+			update[i].levels[i].span = l.length
+		}
+		l.level = level
+	}
+	x = &skiplistNode{member: member, score: score, levels: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.levels[i].next = update[i].levels[i].next
+		update[i].levels[i].next = x
+		x.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < l.level; i++ {
+		update[i].levels[i].span++
+	}
+	if update[0] != l.head {
+		x.previous = update[0]
+	}
+	if x.levels[0].next != nil {
+		x.levels[0].next.previous = x
+	} else {
+		l.tail = x
+	}
+	l.length++
+}
+
+func (l *skiplist) delete(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && nodeBefore(x.levels[i].next, score, member) {
+			x = x.levels[i].next
+		}
+		update[i] = x
+	}
+	x = x.levels[0].next
+	if x == nil || x.score != score || x.member != member {
+		return
+	}
+	for i := 0; i < l.level; i++ {
+		if update[i].levels[i].next == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].next = x.levels[i].next
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if x.levels[0].next != nil {
+		x.levels[0].next.previous = x.previous
+	} else {
+		l.tail = x.previous
+	}
+	for l.level > 1 && l.head.levels[l.level-1].next == nil {
+		l.level--
+	}
+	l.length--
+}
+
+// rank returns the 0-based position of the member, which must be present.
+func (l *skiplist) rank(score float64, member string) int64 {
+	var rank int64
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && !nodeAfter(x.levels[i].next, score, member) {
+			rank += x.levels[i].span
+			x = x.levels[i].next
+		}
+		if x != l.head && x.score == score && x.member == member {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// byRank returns the node at the 0-based position, or nil.
+func (l *skiplist) byRank(rank int64) *skiplistNode {
+	if rank < 0 || rank >= l.length {
+		return nil
+	}
+	var traversed int64
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && traversed+x.levels[i].span <= rank+1 {
+			traversed += x.levels[i].span
+			x = x.levels[i].next
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// first returns the lowest node that is not below the bound.
+func (l *skiplist) first(bound rangeBound) *skiplistNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && bound.below(x.levels[i].next) {
+			x = x.levels[i].next
+		}
+	}
+	return x.levels[0].next
+}
+
+// last returns the highest node that is not above the bound.
+func (l *skiplist) last(bound rangeBound) *skiplistNode {
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.levels[i].next != nil && !bound.above(x.levels[i].next) {
+			x = x.levels[i].next
+		}
+	}
+	if x == l.head {
+		return nil
+	}
+	return x
+}
+
+// A rangeBound is one end of a BYSCORE or BYLEX range. It reports whether a
+// node falls below it when used as a minimum, or above it as a maximum.
+type rangeBound interface {
+	below(node *skiplistNode) bool
+	above(node *skiplistNode) bool
+}
+
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func (b scoreBound) below(node *skiplistNode) bool {
+	return node.score < b.value || (b.exclusive && node.score == b.value)
+}
+
+func (b scoreBound) above(node *skiplistNode) bool {
+	return node.score > b.value || (b.exclusive && node.score == b.value)
+}
+
+// parseScoreBound reads bounds like "1.5", "(1.5", "-inf" and "+inf".
+func parseScoreBound(raw string) (scoreBound, error) {
+	bound := scoreBound{}
+	if strings.HasPrefix(raw, "(") {
+		bound.exclusive = true
+		raw = raw[1:]
+	}
+	value, err := parseScore(raw)
+	if err != nil {
+		return bound, ErrMinMaxNotFloat
+	}
+	bound.value = value
+	return bound, nil
+}
+
+type lexBound struct {
+	value     string
+	exclusive bool
+	infinite  int
+}
+
+func (b lexBound) below(node *skiplistNode) bool {
+	switch b.infinite {
+	case -1:
+		return false
+	case 1:
+		return true
+	}
+	return node.member < b.value || (b.exclusive && node.member == b.value)
+}
+
+func (b lexBound) above(node *skiplistNode) bool {
+	switch b.infinite {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	return node.member > b.value || (b.exclusive && node.member == b.value)
+}
+
+// parseLexBound reads bounds like "[a", "(a", "-" and "+".
+func parseLexBound(raw string) (lexBound, error) {
+	switch {
+	case raw == "-":
+		return lexBound{infinite: -1}, nil
+	case raw == "+":
+		return lexBound{infinite: 1}, nil
+	case strings.HasPrefix(raw, "["):
+		return lexBound{value: raw[1:]}, nil
+	case strings.HasPrefix(raw, "("):
+		return lexBound{value: raw[1:], exclusive: true}, nil
+	}
+	return lexBound{}, ErrLexRange
+}
+
+func parseScore(raw string) (float64, error) {
+	switch strings.ToLower(raw) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, ErrNotFloat
+	}
+	return value, nil
+}
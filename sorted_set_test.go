@@ -0,0 +1,62 @@
+package restis
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkiplistAgainstSortedSlice(t *testing.T) {
+	z := newSortedSet()
+	expected := map[string]float64{}
+	for i := 0; i < 2000; i++ {
+		member := strconv.Itoa(rand.Intn(300))
+		if rand.Intn(3) == 0 {
+			assert.Equal(t, z.remove(member), expected[member] != 0)
+			delete(expected, member)
+		} else {
+			score := float64(rand.Intn(50) + 1)
+			z.set(member, score)
+			expected[member] = score
+		}
+	}
+
+	ordered := []ScoredMember{}
+	for member, score := range expected {
+		ordered = append(ordered, ScoredMember{member, score})
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Score != ordered[j].Score {
+			return ordered[i].Score < ordered[j].Score
+		}
+		return ordered[i].Member < ordered[j].Member
+	})
+
+	assert.Equal(t, int64(len(ordered)), z.length())
+	assert.Equal(t, ordered, z.rangeByRank(0, -1, false))
+	for i, m := range ordered {
+		rank, ok := z.rank(m.Member, false)
+		assert.True(t, ok)
+		assert.Equal(t, int64(i), rank)
+		node := z.list.byRank(int64(i))
+		assert.Equal(t, m.Member, node.member)
+	}
+	reversed := z.rangeByRank(0, -1, true)
+	for i := range reversed {
+		assert.Equal(t, ordered[len(ordered)-1-i], reversed[i])
+	}
+
+	min, max := scoreBound{value: 10}, scoreBound{value: 20, exclusive: true}
+	var count int64
+	for _, m := range ordered {
+		if m.Score >= 10 && m.Score < 20 {
+			count++
+		}
+	}
+	assert.Equal(t, count, z.count(min, max))
+	assert.Equal(t, count, int64(len(z.rangeByBounds(min, max, false, 0, -1))))
+	assert.Equal(t, count, int64(len(z.rangeByBounds(min, max, true, 0, -1))))
+}
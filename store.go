@@ -1,61 +1,338 @@
 package restis
 
+import (
+	"context"
+	"math"
+	"time"
+)
+
+type KeyStore interface {
+	Delete(keys ...string) (int64, error)
+	Exists(keys ...string) (int64, error)
+	Rename(key, newKey string) error
+	RenameIfNotExists(key, newKey string) (bool, error)
+	Copy(source, destination string, replace bool) (bool, error)
+	Type(key string) (string, error)
+	RandomKey() (string, error)
+	Expire(key string, seconds int64) (bool, error)
+	PExpire(key string, milliseconds int64) (bool, error)
+	ExpireAt(key string, timestamp int64) (bool, error)
+	PExpireAt(key string, timestamp int64) (bool, error)
+	TTL(key string) (int64, error)
+	PTTL(key string) (int64, error)
+	Persist(key string) (bool, error)
+	Keys(pattern string) ([]string, error)
+	Scan(cursor uint64, options ScanOptions) (uint64, []string, error)
+}
+
+// ScanOptions mirrors the options of the Redis SCAN family. Count is how
+// many elements a call looks at, 10 if it's 0, and Match and Type filter
+// those it returns, so a call may return nothing and still not be the last.
+// Type only applies to Scan.
+type ScanOptions struct {
+	Match string // MATCH, a glob pattern
+	Count int64  // COUNT
+	Type  string // TYPE, like "string" or "zset"
+}
+
+// SetOptions mirrors the options of the Redis SET command. At most one of the
+// expiry fields may be set, and KeepTTL can't be combined with any of them.
+type SetOptions struct {
+	ExpireSeconds        int64 // EX
+	ExpireMilliseconds   int64 // PX
+	ExpireAt             int64 // EXAT, in Unix seconds
+	ExpireAtMilliseconds int64 // PXAT, in Unix milliseconds
+	KeepTTL              bool  // KEEPTTL
+	IfExists             bool  // XX
+	IfNotExists          bool  // NX
+}
+
+// expiryAt turns an expiry given in units of scale milliseconds after offset
+// into Unix milliseconds, or returns ErrInvalidExpireTime if that doesn't fit
+// in an int64. offset is never negative.
+func expiryAt(value, scale, offset int64) (int64, error) {
+	if value > math.MaxInt64/scale || value < math.MinInt64/scale || value*scale > math.MaxInt64-offset {
+		return 0, ErrInvalidExpireTime
+	}
+	return value*scale + offset, nil
+}
+
+func (o SetOptions) expiresAt(now int64) (int64, error) {
+	var expiresAt int64
+	given := 0
+	for _, option := range []struct {
+		value, scale, offset int64
+	}{
+		{o.ExpireSeconds, 1000, now},
+		{o.ExpireMilliseconds, 1, now},
+		{o.ExpireAt, 1000, 0},
+		{o.ExpireAtMilliseconds, 1, 0},
+	} {
+		if option.value < 0 {
+			return 0, ErrInvalidExpireTime
+		}
+		if option.value > 0 {
+			given++
+			at, err := expiryAt(option.value, option.scale, option.offset)
+			if err != nil {
+				return 0, err
+			}
+			expiresAt = at
+		}
+	}
+	if given > 1 || (given == 1 && o.KeepTTL) || (o.IfExists && o.IfNotExists) {
+		return 0, ErrSyntax
+	}
+	return expiresAt, nil
+}
+
 type StringStore interface {
-	Append(key, value string) int64
-	Get(key string) string
-	GetRange(key string, start, stop int64) string
-	GetSet(key, value string) string
-	Set(key string, value string)
-	SetIfExists(key string, value string) bool
-	SetIfNotExists(key string, value string) bool
-	MultiGet(keys []string) map[string]string
-	MultiSet(map[string]string)
-	MultiSetIfNotExists(map[string]string) bool
-	Increment(key string) int64
-	Decrement(key string) int64
-	IncrementBy(key string, delta int64) int64
-	DecrementBy(key string, delta int64) int64
-	SetRange(key string, offset int64, value string) int64
-	Exists(key string) bool
-	Length(key string) int64
+	Append(key, value string) (int64, error)
+	Get(key string) (string, error)
+	GetRange(key string, start, stop int64) (string, error)
+	GetSet(key, value string) (string, error)
+	Set(key string, value string) error
+	SetWithOptions(key string, value string, options SetOptions) (bool, error)
+	SetIfExists(key string, value string) (bool, error)
+	SetIfNotExists(key string, value string) (bool, error)
+	MultiGet(keys []string) (map[string]string, error)
+	MultiSet(map[string]string) error
+	MultiSetIfNotExists(map[string]string) (bool, error)
+	Increment(key string) (int64, error)
+	Decrement(key string) (int64, error)
+	IncrementBy(key string, delta int64) (int64, error)
+	DecrementBy(key string, delta int64) (int64, error)
+	IncrementByFloat(key string, delta float64) (string, error)
+	SetRange(key string, offset int64, value string) (int64, error)
+	Length(key string) (int64, error)
 }
 
 type SetStore interface {
-	SetAdd(key string, values ...string)
-	SetRemove(key string, values ...string)
-	SetIsMember(key string, value string) bool
-	SetMembers(key string) []string
-	SetCardinality(key string) int64
+	SetAdd(key string, values ...string) error
+	SetRemove(key string, values ...string) error
+	SetIsMember(key string, value string) (bool, error)
+	SetMembers(key string) ([]string, error)
+	SetCardinality(key string) (int64, error)
+	SetScan(key string, cursor uint64, options ScanOptions) (uint64, []string, error)
+	SetMultiIsMember(key string, values ...string) ([]bool, error)
+	SetMove(source, destination, value string) (bool, error)
+	SetPop(key string, count int64) ([]string, error)
+	SetRandomMember(key string, count int64) ([]string, error)
+	SetIntersect(keys ...string) ([]string, error)
+	SetUnion(keys ...string) ([]string, error)
+	SetDifference(keys ...string) ([]string, error)
+	SetIntersectStore(destination string, keys ...string) (int64, error)
+	SetUnionStore(destination string, keys ...string) (int64, error)
+	SetDifferenceStore(destination string, keys ...string) (int64, error)
+	SetIntersectCardinality(limit int64, keys ...string) (int64, error)
 }
 
 type HashStore interface {
-	HashGet(key, field string) string
-	HashSet(key, field, value string)
-	HashLength(key string) int64
-	HashMultiGet(key string, fields ...string) []string
-	HashMultiSet(key string, data map[string]string)
-	HashExists(key, field string) bool
-	HashKeys(key string) []string
-	HashValues(key string) []string
-	HashSetIfExists(key, field string, value string) bool
-	HashSetIfNotExists(key, field string, value string) bool
+	HashGet(key, field string) (string, error)
+	HashSet(key, field, value string) error
+	HashLength(key string) (int64, error)
+	HashMultiGet(key string, fields ...string) ([]string, error)
+	HashMultiSet(key string, data map[string]string) error
+	HashExists(key, field string) (bool, error)
+	HashKeys(key string) ([]string, error)
+	HashValues(key string) ([]string, error)
+	HashSetIfExists(key, field string, value string) (bool, error)
+	HashSetIfNotExists(key, field string, value string) (bool, error)
+	HashScan(key string, cursor uint64, options ScanOptions) (uint64, map[string]string, error)
+	HashDelete(key string, fields ...string) (int64, error)
+	HashGetAll(key string) (map[string]string, error)
+	HashStringLength(key, field string) (int64, error)
+	HashIncrementBy(key, field string, delta int64) (int64, error)
+	HashIncrementByFloat(key, field string, delta float64) (string, error)
+	HashRandomField(key string, count int64) ([]string, error)
+	HashRandomFieldWithValues(key string, count int64) ([]HashField, error)
+
+	// The field expiry operations return a result for each field, as the
+	// Redis HEXPIRE family does: -2 if there's no such field, and otherwise
+	// 0 if the condition in options wasn't met, 1 if the expiry was set and
+	// 2 if the field was deleted because the time had already passed.
+	HashExpire(key string, seconds int64, options HashExpireOptions, fields ...string) ([]int64, error)
+	HashPExpire(key string, milliseconds int64, options HashExpireOptions, fields ...string) ([]int64, error)
+	HashExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) ([]int64, error)
+	HashPExpireAt(key string, timestamp int64, options HashExpireOptions, fields ...string) ([]int64, error)
+	// HashTTL and HashPTTL return -2 for a missing field and -1 for one
+	// without an expiry, and HashPersist returns -2, -1 or 1 if it removed
+	// the expiry.
+	HashTTL(key string, fields ...string) ([]int64, error)
+	HashPTTL(key string, fields ...string) ([]int64, error)
+	HashPersist(key string, fields ...string) ([]int64, error)
+	// HashGetWithOptions returns the fields that exist, like HGETEX, and
+	// applies the expiry in options to them.
+	HashGetWithOptions(key string, options HashFieldOptions, fields ...string) (map[string]string, error)
+	// HashSetWithOptions sets every field or none of them, like HSETEX, and
+	// reports whether it did.
+	HashSetWithOptions(key string, data map[string]string, options HashFieldOptions) (bool, error)
+}
+
+type HashField struct {
+	Field string
+	Value string
+}
+
+// HashExpireOptions mirrors the conditions of the Redis HEXPIRE family, at
+// most one of which may be set. A field without an expiry counts as never
+// expiring, so GreaterThan never applies to it and LessThan always does.
+type HashExpireOptions struct {
+	IfNotExists bool // NX, only fields without an expiry
+	IfExists    bool // XX, only fields with one
+	GreaterThan bool // GT
+	LessThan    bool // LT
+}
+
+// HashFieldOptions mirrors the options of the Redis HGETEX and HSETEX
+// commands. At most one of the expiry fields may be set, and neither
+// KeepTTL nor Persist can be combined with any of them. Persist only applies
+// to HashGetWithOptions, and KeepTTL, IfExists and IfNotExists only to
+// HashSetWithOptions, which otherwise clears the expiry of the fields it
+// sets, as HashSet does.
+type HashFieldOptions struct {
+	ExpireSeconds        int64 // EX
+	ExpireMilliseconds   int64 // PX
+	ExpireAt             int64 // EXAT, in Unix seconds
+	ExpireAtMilliseconds int64 // PXAT, in Unix milliseconds
+	KeepTTL              bool  // KEEPTTL
+	Persist              bool  // PERSIST
+	IfExists             bool  // FXX, only if every field exists
+	IfNotExists          bool  // FNX, only if none of them do
+}
+
+func (o HashFieldOptions) expiresAt(now int64) (int64, error) {
+	if o.KeepTTL && o.Persist {
+		return 0, ErrSyntax
+	}
+	expiresAt, err := SetOptions{
+		ExpireSeconds:        o.ExpireSeconds,
+		ExpireMilliseconds:   o.ExpireMilliseconds,
+		ExpireAt:             o.ExpireAt,
+		ExpireAtMilliseconds: o.ExpireAtMilliseconds,
+		KeepTTL:              o.KeepTTL || o.Persist,
+		IfExists:             o.IfExists,
+		IfNotExists:          o.IfNotExists,
+	}.expiresAt(now)
+	if err == nil && (expiresAt < 0 || expiresAt > maxFieldExpireAt) {
+		return 0, ErrInvalidExpireTime
+	}
+	return expiresAt, err
 }
 
 type ListStore interface {
-	ListLeftPush(key string, values ...string) int64
-	ListRightPush(key string, values ...string) int64
-	ListLeftPop(key string) string
-	ListRightPop(key string) string
-	ListLength(key string) int64
-	ListRange(key string, start, stop int64) []string
-	ListSet(key string, index int64, value string) bool
-	ListIndex(key string, index int64) string
-	ListTrim(key string, start, stop int64)
+	ListLeftPush(key string, values ...string) (int64, error)
+	ListRightPush(key string, values ...string) (int64, error)
+	ListLeftPop(key string) (string, error)
+	ListRightPop(key string) (string, error)
+	ListLength(key string) (int64, error)
+	ListRange(key string, start, stop int64) ([]string, error)
+	ListSet(key string, index int64, value string) error
+	ListIndex(key string, index int64) (string, error)
+	ListTrim(key string, start, stop int64) error
+	ListInsertBefore(key, pivot, value string) (int64, error)
+	ListInsertAfter(key, pivot, value string) (int64, error)
+	ListRemove(key string, count int64, value string) (int64, error)
+	ListPosition(key, value string, options ListPositionOptions) ([]int64, error)
+	ListLeftPushIfExists(key string, values ...string) (int64, error)
+	ListRightPushIfExists(key string, values ...string) (int64, error)
+	ListLeftPopCount(key string, count int64) ([]string, error)
+	ListRightPopCount(key string, count int64) ([]string, error)
+	ListMultiPop(side ListSide, count int64, keys ...string) (string, []string, error)
+	ListMove(source, destination string, from, to ListSide) (string, error)
+	ListBlockingLeftPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error)
+	ListBlockingRightPop(ctx context.Context, timeout time.Duration, keys ...string) (string, string, error)
+	ListBlockingMove(ctx context.Context, timeout time.Duration, source, destination string, from, to ListSide) (string, error)
+}
+
+// ListPositionOptions mirrors the options of the Redis LPOS command. A
+// negative Rank searches from the tail, and skips -Rank-1 matches there.
+type ListPositionOptions struct {
+	Rank   int64 // RANK, 1 if it's 0
+	Count  int64 // COUNT, 0 for every match
+	MaxLen int64 // MAXLEN, 0 for the whole list
+}
+
+// ListSide picks an end of a list: ListLeft is its head and ListRight its
+// tail.
+type ListSide int
+
+const (
+	ListLeft ListSide = iota
+	ListRight
+)
+
+func (side ListSide) String() string {
+	if side == ListLeft {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// event names the keyspace event for a push or pop at this end.
+func (side ListSide) event(operation string) string {
+	if side == ListLeft {
+		return "l" + operation
+	}
+	return "r" + operation
+}
+
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// SortedSetAddOptions mirrors the flags of the Redis ZADD command. IfNotExists
+// can't be combined with IfExists, GreaterThan or LessThan, and GreaterThan
+// can't be combined with LessThan.
+type SortedSetAddOptions struct {
+	IfExists    bool // XX
+	IfNotExists bool // NX
+	GreaterThan bool // GT
+	LessThan    bool // LT
+	Changed     bool // CH
+}
+
+// SortedSetRange mirrors the arguments of the Redis ZRANGE command. Start and
+// Stop are ranks by default, score bounds like "(1.5" or "+inf" with ByScore,
+// and lex bounds like "[a" or "-" with ByLex. With Reverse the results are in
+// descending order and, for score and lex ranges, Start is the upper bound.
+// Limit may only be used with ByScore or ByLex.
+type SortedSetRange struct {
+	Start   string
+	Stop    string
+	ByScore bool
+	ByLex   bool
+	Reverse bool
+	Limit   *RangeLimit
+}
+
+type RangeLimit struct {
+	Offset int64
+	Count  int64 // negative for everything after Offset
+}
+
+type SortedSetStore interface {
+	SortedSetAdd(key string, options SortedSetAddOptions, members ...ScoredMember) (int64, error)
+	SortedSetAddIncrement(key string, options SortedSetAddOptions, member string, delta float64) (float64, bool, error)
+	SortedSetRemove(key string, members ...string) (int64, error)
+	SortedSetScore(key, member string) (float64, bool, error)
+	SortedSetIncrementBy(key, member string, delta float64) (float64, error)
+	SortedSetCardinality(key string) (int64, error)
+	SortedSetCount(key, min, max string) (int64, error)
+	SortedSetRank(key, member string) (int64, bool, error)
+	SortedSetReverseRank(key, member string) (int64, bool, error)
+	SortedSetRange(key string, query SortedSetRange) ([]ScoredMember, error)
+	SortedSetRangeStore(destination, key string, query SortedSetRange) (int64, error)
+	SortedSetPopMin(key string, count int64) ([]ScoredMember, error)
+	SortedSetPopMax(key string, count int64) ([]ScoredMember, error)
 }
 
 type Store interface {
+	KeyStore
 	StringStore
 	SetStore
 	HashStore
 	ListStore
+	SortedSetStore
 }
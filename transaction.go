@@ -0,0 +1,88 @@
+package restis
+
+import "errors"
+
+var (
+	ErrWatchedKeyChanged    = errors.New("restis: a watched key changed")
+	ErrTransactionsDisabled = errors.New("ERR transactions are not available on this store")
+)
+
+// transactionStore is implemented by stores that can run several operations
+// atomically, and backs MULTI, EXEC and WATCH and the /transactions route.
+type transactionStore interface {
+	Transaction(fn func(tx Store) error) error
+	Watch(keys ...string) (map[string]uint64, error)
+	WatchedTransaction(watched map[string]uint64, fn func(tx Store) error) error
+}
+
+// Transaction runs fn with every other operation on the store held off, so
+// that whatever fn does through tx happens atomically. fn must use only tx,
+// and only until it returns. Nothing is rolled back if fn fails: as with
+// Redis' EXEC, whatever fn did before failing stays done.
+func (s *MemoryStore) Transaction(fn func(tx Store) error) error {
+	return s.WatchedTransaction(nil, fn)
+}
+
+// Watch returns the version of each key, for WatchedTransaction. A key's
+// version changes whenever it's written, deleted or expires, and is 0 while
+// it doesn't exist.
+func (s *MemoryStore) Watch(keys ...string) (map[string]uint64, error) {
+	defer s.lockKeys(keys)()
+	versions := make(map[string]uint64, len(keys))
+	for _, key := range keys {
+		versions[key] = s.shard(key).version(key)
+	}
+	return versions, nil
+}
+
+// WatchedTransaction runs fn as Transaction does, unless a key in watched no
+// longer has the version Watch returned for it, in which case it returns
+// ErrWatchedKeyChanged without running fn.
+func (s *MemoryStore) WatchedTransaction(watched map[string]uint64, fn func(tx Store) error) error {
+	for _, sh := range s.shards {
+		sh.Lock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.Unlock()
+		}
+	}()
+	now := s.now()
+	for key, version := range watched {
+		sh := s.shard(key)
+		s.expireIfNeeded(sh, key, now)
+		if sh.version(key) != version {
+			return ErrWatchedKeyChanged
+		}
+	}
+	return fn(s.view())
+}
+
+// view returns a store over the same data as s whose shards have locks of
+// their own, so that a transaction can run against it while it holds every
+// one of s's shards. Writes made through the view are recorded and reported
+// by the store it came from.
+func (s *MemoryStore) view() *MemoryStore {
+	v := &MemoryStore{clock: s.clock, closed: s.closed, broker: s.broker, scripts: s.scripts, parent: s.root()}
+	for i, sh := range s.shards {
+		v.shards[i] = &shard{
+			strings:      sh.strings,
+			sets:         sh.sets,
+			hashes:       sh.hashes,
+			lists:        sh.lists,
+			sortedSets:   sh.sortedSets,
+			expires:      sh.expires,
+			fieldExpires: sh.fieldExpires,
+			versions:     sh.versions,
+		}
+	}
+	return v
+}
+
+// root returns the store a view came from, or s itself.
+func (s *MemoryStore) root() *MemoryStore {
+	if s.parent != nil {
+		return s.parent
+	}
+	return s
+}
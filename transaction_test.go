@@ -0,0 +1,205 @@
+package restis
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type transactionalStore interface {
+	Store
+	transactionStore
+}
+
+func testTransactions(t *testing.T, store transactionalStore) {
+	ok := noError(t)
+
+	// Reads inside a transaction see its own writes, and nothing else runs
+	// in between, so read-modify-write cycles don't lose updates.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.Transaction(func(tx Store) error {
+				value, err := tx.Get("counter")
+				if err == ErrNoSuchKey {
+					value, err = "0", nil
+				}
+				if err != nil {
+					return err
+				}
+				n, _ := strconv.Atoi(value)
+				return tx.Set("counter", strconv.Itoa(n+1))
+			}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "50", ok(store.Get("counter")))
+
+	// Nothing is rolled back when fn fails.
+	failed := errors.New("failed")
+	assert.Equal(t, failed, store.Transaction(func(tx Store) error {
+		assert.NoError(t, tx.Set("partial", "v"))
+		return failed
+	}))
+	assert.Equal(t, "v", ok(store.Get("partial")))
+
+	versions := ok(store.Watch("counter", "missing")).(map[string]uint64)
+	assert.Equal(t, uint64(0), versions["missing"])
+	assert.NotEqual(t, uint64(0), versions["counter"])
+	assert.Equal(t, versions, ok(store.Watch("counter", "missing")))
+
+	ran := false
+	assert.NoError(t, store.WatchedTransaction(versions, func(tx Store) error {
+		ran = true
+		return tx.Set("missing", "created")
+	}))
+	assert.True(t, ran)
+	assert.Equal(t, ErrWatchedKeyChanged, store.WatchedTransaction(versions, func(tx Store) error {
+		t.Error("ran a transaction after a watched key changed")
+		return nil
+	}))
+
+	// Writing the same value, and deleting and recreating a key, both
+	// change its version.
+	versions = ok(store.Watch("counter")).(map[string]uint64)
+	assert.NoError(t, store.Set("counter", "50"))
+	assert.NotEqual(t, versions, ok(store.Watch("counter")))
+	versions = ok(store.Watch("counter")).(map[string]uint64)
+	ok(store.Delete("counter"))
+	assert.NoError(t, store.Set("counter", "50"))
+	assert.Equal(t, ErrWatchedKeyChanged, store.WatchedTransaction(versions, func(tx Store) error { return nil }))
+
+	// Writes to other keys don't.
+	versions = ok(store.Watch("counter")).(map[string]uint64)
+	assert.NoError(t, store.Set("other", "v"))
+	assert.NoError(t, store.SetAdd("set", "a"))
+	assert.NoError(t, store.WatchedTransaction(versions, func(tx Store) error { return nil }))
+
+	// Nor do writes that change nothing.
+	versions = ok(store.Watch("set")).(map[string]uint64)
+	assert.NoError(t, store.SetAdd("set", "a"))
+	assert.NoError(t, store.SetRemove("set", "b"))
+	assert.NoError(t, store.WatchedTransaction(versions, func(tx Store) error { return nil }))
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"a", 1}))
+	versions = ok(store.Watch("zset")).(map[string]uint64)
+	ok(store.SortedSetAdd("zset", SortedSetAddOptions{}, ScoredMember{"a", 1}))
+	ok(store.SortedSetRemove("zset", "b"))
+	ok(store.SortedSetPopMin("zset", 0))
+	assert.NoError(t, store.WatchedTransaction(versions, func(tx Store) error { return nil }))
+}
+
+func TestTransactions(t *testing.T) {
+	testTransactions(t, NewMemoryStoreWithClock(systemClock{}))
+}
+
+func TestTransactionExpiry(t *testing.T) {
+	ok := noError(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStoreWithClock(clock)
+	ok(store.SetWithOptions("k", "v", SetOptions{ExpireSeconds: 10}))
+	versions := ok(store.Watch("k")).(map[string]uint64)
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, ErrWatchedKeyChanged, store.WatchedTransaction(versions, func(tx Store) error { return nil }))
+
+	// Expiries set inside a transaction run on the store's own cycle.
+	assert.NoError(t, store.Transaction(func(tx Store) error {
+		_, err := tx.SetWithOptions("k", "v", SetOptions{ExpireSeconds: 10})
+		return err
+	}))
+	assert.Equal(t, 10, ok(store.TTL("k")))
+}
+
+func TestTransactionKeyspaceEvents(t *testing.T) {
+	store := NewMemoryStoreWithClock(systemClock{})
+	w := store.WatchKeyspace(AllEvents)
+	defer w.Close()
+	assert.NoError(t, store.Transaction(func(tx Store) error {
+		if err := tx.Set("a", "1"); err != nil {
+			return err
+		}
+		_, err := tx.Delete("a")
+		return err
+	}))
+	assert.Equal(t, []KeyspaceEvent{{"set", "a"}, {"del", "a"}}, drain(w))
+}
+
+func TestAppendOnlyTransactions(t *testing.T) {
+	ok := noError(t)
+	path := filepath.Join(t.TempDir(), "restis.aof")
+	store := openAppendOnly(t, AppendOnlyOptions{Path: path, Fsync: FsyncAlways})
+	testTransactions(t, store)
+
+	assert.NoError(t, store.Transaction(func(tx Store) error {
+		if err := tx.Set("a", "1"); err != nil {
+			return err
+		}
+		_, err := tx.Get("a")
+		return err
+	}))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*1\r\n$4\r\nEXEC\r\n")
+
+	// A transaction with no writes isn't logged.
+	assert.NoError(t, store.Transaction(func(tx Store) error {
+		_, err := tx.Get("a")
+		return err
+	}))
+	size := len(data)
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, size, len(data))
+	assert.NoError(t, store.Close())
+
+	// A transaction the log ends part way through is dropped whole.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write(appendCommand(appendCommand(appendCommand(nil, "MULTI"), "SET", "a", "2"), "SET", "b", "2"))
+	f.Close()
+
+	reopened := openAppendOnly(t, AppendOnlyOptions{Path: path})
+	assert.Equal(t, "50", ok(reopened.Get("counter")))
+	assert.Equal(t, "1", ok(reopened.Get("a")))
+	assert.Equal(t, 0, ok(reopened.Exists("b")))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(size), info.Size())
+}
+
+func TestDiskStoreTransactions(t *testing.T) {
+	ok := noError(t)
+	path := filepath.Join(t.TempDir(), "store")
+	store := openDisk(t, DiskOptions{Path: path, Fsync: FsyncAlways})
+	testTransactions(t, store)
+
+	assert.NoError(t, store.Transaction(func(tx Store) error {
+		if err := tx.Set("a", "1"); err != nil {
+			return err
+		}
+		// Writes are readable before they're logged.
+		assert.Equal(t, "1", ok(tx.Get("a")))
+		_, err := tx.ListRightPush("list", "x", "y")
+		return err
+	}))
+	assert.NoError(t, store.Close())
+
+	reopened := openDisk(t, DiskOptions{Path: path})
+	assert.Equal(t, "50", ok(reopened.Get("counter")))
+	assert.Equal(t, "1", ok(reopened.Get("a")))
+	assert.Equal(t, []string{"x", "y"}, ok(reopened.ListRange("list", 0, -1)))
+
+	// Watched keys that expire count as changed.
+	ok(reopened.PExpire("a", 20))
+	versions := ok(reopened.Watch("a")).(map[string]uint64)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, ErrWatchedKeyChanged, reopened.WatchedTransaction(versions, func(tx Store) error { return nil }))
+}